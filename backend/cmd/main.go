@@ -5,6 +5,7 @@ import (
 	"Measurely/service"
 	"log"
 	"os"
+	_ "time/tzdata"
 
 	"github.com/joho/godotenv"
 	"github.com/measurely-dev/measurely-go"
@@ -24,6 +25,7 @@ func main() {
 	}
 
 	service := service.New()
+	service.StartJobs()
 
 	handler := handler.New(&service)
 
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"Measurely/types"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (db *DB) CreateAlertRule(rule types.AlertRule) (types.AlertRule, error) {
+	var created types.AlertRule
+	err := db.Conn.Get(&created, `
+		INSERT INTO alert_rules (project_id, metric_id, user_id, name, kind, aggregation, filter_id, condition, threshold,
+			window_minutes, cooldown_minutes, notify_email, webhook_url, webhook_secret, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		RETURNING *`,
+		rule.ProjectId, rule.MetricId, rule.UserId, rule.Name, rule.Kind, rule.Aggregation, rule.FilterId, rule.Condition,
+		rule.Threshold, rule.WindowMinutes, rule.CooldownMinutes, rule.NotifyEmail, rule.WebhookUrl, rule.WebhookSecret, rule.Enabled,
+	)
+	return created, err
+}
+
+func (db *DB) GetAlertRules(projectId uuid.UUID) ([]types.AlertRule, error) {
+	var rules []types.AlertRule
+	err := db.Conn.Select(&rules, "SELECT * FROM alert_rules WHERE project_id = $1 ORDER BY created", projectId)
+	return rules, err
+}
+
+func (db *DB) GetAlertRule(id uuid.UUID, projectId uuid.UUID) (types.AlertRule, error) {
+	var rule types.AlertRule
+	err := db.Conn.Get(&rule, "SELECT * FROM alert_rules WHERE id = $1 AND project_id = $2", id, projectId)
+	return rule, err
+}
+
+// UpdateAlertRule updates the settings of a rule. A rule that changed is evaluated again from the ok state.
+func (db *DB) UpdateAlertRule(rule types.AlertRule) error {
+	_, err := db.Conn.Exec(`
+		UPDATE alert_rules
+		SET name = $1, aggregation = $2, filter_id = $3, condition = $4, threshold = $5, window_minutes = $6,
+			cooldown_minutes = $7, notify_email = $8, webhook_url = $9, enabled = $10, state = $11, last_evaluated = NULL
+		WHERE id = $12 AND project_id = $13`,
+		rule.Name, rule.Aggregation, rule.FilterId, rule.Condition, rule.Threshold, rule.WindowMinutes,
+		rule.CooldownMinutes, rule.NotifyEmail, rule.WebhookUrl, rule.Enabled, types.ALERT_OK, rule.Id, rule.ProjectId,
+	)
+	return err
+}
+
+func (db *DB) DeleteAlertRule(id uuid.UUID, projectId uuid.UUID) error {
+	_, err := db.Conn.Exec("DELETE FROM alert_rules WHERE id = $1 AND project_id = $2", id, projectId)
+	return err
+}
+
+// GetDueAlertRules returns the enabled rules that have not been evaluated since before
+func (db *DB) GetDueAlertRules(before time.Time) ([]types.AlertRule, error) {
+	var rules []types.AlertRule
+	err := db.Conn.Select(&rules, `
+		SELECT * FROM alert_rules
+		WHERE enabled AND (last_evaluated IS NULL OR last_evaluated <= $1)
+		ORDER BY last_evaluated NULLS FIRST`, before)
+	return rules, err
+}
+
+// UpdateAlertRuleEvaluation records the outcome of an evaluation. The value is left empty when it
+// could not be computed.
+func (db *DB) UpdateAlertRuleEvaluation(id uuid.UUID, state string, value *float64, evaluated time.Time, triggered *time.Time) error {
+	_, err := db.Conn.Exec(`
+		UPDATE alert_rules SET state = $1, last_value = $2, last_evaluated = $3, last_triggered = $4
+		WHERE id = $5`,
+		state, value, evaluated, triggered, id,
+	)
+	return err
+}
+
+func (db *DB) CreateAlertEvent(event types.AlertEvent) (types.AlertEvent, error) {
+	var created types.AlertEvent
+	err := db.Conn.Get(&created, `
+		INSERT INTO alert_events (rule_id, project_id, state, value, reference, threshold)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING *`,
+		event.RuleId, event.ProjectId, event.State, event.Value, event.Reference, event.Threshold,
+	)
+	return created, err
+}
+
+func (db *DB) UpdateAlertEventWebhookStatus(id uuid.UUID, status int) error {
+	_, err := db.Conn.Exec("UPDATE alert_events SET webhook_status = $1 WHERE id = $2", status, id)
+	return err
+}
+
+// GetAlertEvents returns the latest alert events of a project, restricted to a rule when ruleId is set
+func (db *DB) GetAlertEvents(projectId uuid.UUID, ruleId uuid.UUID, limit int) ([]types.AlertEvent, error) {
+	args := []any{projectId, limit}
+	query := "SELECT * FROM alert_events WHERE project_id = $1"
+	if ruleId != uuid.Nil {
+		args = append(args, ruleId)
+		query += " AND rule_id = $3"
+	}
+	query += " ORDER BY created DESC LIMIT $2"
+
+	var events []types.AlertEvent
+	err := db.Conn.Select(&events, query, args...)
+	return events, err
+}
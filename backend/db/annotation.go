@@ -0,0 +1,123 @@
+package db
+
+import (
+	"Measurely/types"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type tmpAnnotation struct {
+	types.Annotation
+	Tags      []byte `db:"tags"`
+	MetricIds []byte `db:"metric_ids"`
+}
+
+func (tmp tmpAnnotation) decode() (types.Annotation, error) {
+	annotation := tmp.Annotation
+	if err := json.Unmarshal(tmp.Tags, &annotation.Tags); err != nil {
+		return types.Annotation{}, err
+	}
+	if err := json.Unmarshal(tmp.MetricIds, &annotation.MetricIds); err != nil {
+		return types.Annotation{}, err
+	}
+	return annotation, nil
+}
+
+func (db *DB) CreateAnnotation(annotation types.Annotation) (types.Annotation, error) {
+	tags, err := json.Marshal(annotation.Tags)
+	if err != nil {
+		return types.Annotation{}, err
+	}
+	metricIds, err := json.Marshal(annotation.MetricIds)
+	if err != nil {
+		return types.Annotation{}, err
+	}
+
+	var tmp tmpAnnotation
+	err = db.Conn.Get(&tmp, `
+		INSERT INTO annotations (project_id, user_id, source, title, description, tags, metric_ids, start_date, end_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING *`,
+		annotation.ProjectId, annotation.UserId, annotation.Source, annotation.Title, annotation.Description,
+		tags, metricIds, annotation.Start, annotation.End,
+	)
+	if err != nil {
+		return types.Annotation{}, err
+	}
+	return tmp.decode()
+}
+
+func (db *DB) GetAnnotation(id uuid.UUID, projectId uuid.UUID) (types.Annotation, error) {
+	var tmp tmpAnnotation
+	err := db.Conn.Get(&tmp, "SELECT * FROM annotations WHERE id = $1 AND project_id = $2", id, projectId)
+	if err != nil {
+		return types.Annotation{}, err
+	}
+	return tmp.decode()
+}
+
+// GetAnnotations returns the annotations of a project overlapping [start, end]. They are restricted
+// to the ones shown on a metric when metricId is set, and to the ones carrying a tag when tag is set.
+func (db *DB) GetAnnotations(projectId uuid.UUID, start time.Time, end time.Time, metricId uuid.UUID, tag string, limit int) ([]types.Annotation, error) {
+	args := []any{projectId, start, end, limit}
+	query := `
+		SELECT * FROM annotations
+		WHERE project_id = $1 AND start_date <= $3 AND COALESCE(end_date, start_date) >= $2`
+	if metricId != uuid.Nil {
+		args = append(args, metricId.String())
+		query += fmt.Sprintf(" AND (metric_ids = '[]' OR metric_ids @> jsonb_build_array($%d::text))", len(args))
+	}
+	if tag != "" {
+		args = append(args, tag)
+		query += fmt.Sprintf(" AND tags @> jsonb_build_array($%d::text)", len(args))
+	}
+	query += " ORDER BY start_date LIMIT $4"
+
+	var tmp []tmpAnnotation
+	if err := db.Conn.Select(&tmp, query, args...); err != nil {
+		return nil, err
+	}
+
+	annotations := make([]types.Annotation, len(tmp))
+	for i, row := range tmp {
+		var err error
+		if annotations[i], err = row.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return annotations, nil
+}
+
+func (db *DB) UpdateAnnotation(annotation types.Annotation) error {
+	tags, err := json.Marshal(annotation.Tags)
+	if err != nil {
+		return err
+	}
+	metricIds, err := json.Marshal(annotation.MetricIds)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Conn.Exec(`
+		UPDATE annotations
+		SET title = $1, description = $2, tags = $3, metric_ids = $4, start_date = $5, end_date = $6
+		WHERE id = $7 AND project_id = $8`,
+		annotation.Title, annotation.Description, tags, metricIds, annotation.Start, annotation.End,
+		annotation.Id, annotation.ProjectId,
+	)
+	return err
+}
+
+func (db *DB) GetAnnotationsCount(projectId uuid.UUID) (int, error) {
+	var count int
+	err := db.Conn.Get(&count, "SELECT COUNT(*) FROM annotations WHERE project_id = $1", projectId)
+	return count, err
+}
+
+func (db *DB) DeleteAnnotation(id uuid.UUID, projectId uuid.UUID) error {
+	_, err := db.Conn.Exec("DELETE FROM annotations WHERE id = $1 AND project_id = $2", id, projectId)
+	return err
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"Measurely/types"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// GetRollupBuckets returns the rollups of the given granularity of the metrics for a list of buckets,
+// aggregating every event of each bucket
+func (db *DB) GetRollupBuckets(metricIds []uuid.UUID, granularity string, buckets []time.Time) ([]types.BucketAggregate, error) {
+	dates := make([]string, len(buckets))
+	for i, bucket := range buckets {
+		dates[i] = bucket.UTC().Format("2006-01-02 15:04:05")
+	}
+
+	var aggregates []types.BucketAggregate
+	err := db.Conn.Select(&aggregates, `
+		SELECT metric_id, bucket, count, sum_pos, sum_neg, min_value, max_value
+		FROM metric_rollups
+		WHERE metric_id = ANY($1::uuid[]) AND granularity = $2 AND filter_id = $3 AND bucket = ANY($4::timestamp[])`,
+		pq.Array(metricIds), granularity, uuid.Nil, pq.Array(dates),
+	)
+	return aggregates, err
+}
+
+// GetActiveMetrics returns the metrics that received events since the given date, ordered by project
+func (db *DB) GetActiveMetrics(since time.Time) ([]types.Metric, error) {
+	var metrics []types.Metric
+	err := db.Conn.Select(&metrics, `
+		SELECT id, project_id, name, type, unit, created, last_event_timestamp
+		FROM metrics
+		WHERE last_event_timestamp >= $1 AND type <> $2
+		ORDER BY project_id`, since, types.FORMULA_METRIC)
+	return metrics, err
+}
+
+// CreateAnomaly records an anomaly, and reports false when the bucket was already recorded
+func (db *DB) CreateAnomaly(anomaly types.MetricAnomaly) (types.MetricAnomaly, bool, error) {
+	rows, err := db.Conn.Queryx(`
+		INSERT INTO metric_anomalies (project_id, metric_id, granularity, bucket, direction, value, expected, lower, upper, score)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (metric_id, granularity, bucket) DO NOTHING
+		RETURNING *`,
+		anomaly.ProjectId, anomaly.MetricId, anomaly.Granularity, anomaly.Bucket, anomaly.Direction,
+		anomaly.Value, anomaly.Expected, anomaly.Lower, anomaly.Upper, anomaly.Score,
+	)
+	if err != nil {
+		return types.MetricAnomaly{}, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return types.MetricAnomaly{}, false, rows.Err()
+	}
+
+	var created types.MetricAnomaly
+	if err := rows.StructScan(&created); err != nil {
+		return types.MetricAnomaly{}, false, err
+	}
+	return created, true, nil
+}
+
+// GetAnomalies returns the latest anomalies of a project, restricted to a metric when metricId is set
+func (db *DB) GetAnomalies(projectId uuid.UUID, metricId uuid.UUID, limit int) ([]types.MetricAnomaly, error) {
+	args := []any{projectId, limit}
+	query := "SELECT * FROM metric_anomalies WHERE project_id = $1"
+	if metricId != uuid.Nil {
+		args = append(args, metricId)
+		query += " AND metric_id = $3"
+	}
+	query += " ORDER BY bucket DESC LIMIT $2"
+
+	var anomalies []types.MetricAnomaly
+	err := db.Conn.Select(&anomalies, query, args...)
+	return anomalies, err
+}
+
+func (db *DB) CreateAnomalySubscription(subscription types.AnomalySubscription) (types.AnomalySubscription, error) {
+	var created types.AnomalySubscription
+	err := db.Conn.Get(&created, `
+		INSERT INTO anomaly_subscriptions (project_id, user_id, metric_id, notify_email, webhook_url, webhook_secret)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING *`,
+		subscription.ProjectId, subscription.UserId, subscription.MetricId, subscription.NotifyEmail,
+		subscription.WebhookUrl, subscription.WebhookSecret,
+	)
+	return created, err
+}
+
+// GetAnomalySubscriptions returns the subscriptions of a user to the anomalies of a project
+func (db *DB) GetAnomalySubscriptions(projectId uuid.UUID, userId uuid.UUID) ([]types.AnomalySubscription, error) {
+	var subscriptions []types.AnomalySubscription
+	err := db.Conn.Select(&subscriptions, `
+		SELECT * FROM anomaly_subscriptions
+		WHERE project_id = $1 AND user_id = $2
+		ORDER BY created`, projectId, userId)
+	return subscriptions, err
+}
+
+// GetMetricAnomalySubscriptions returns the subscriptions covering a metric, including the ones
+// covering every metric of its project
+func (db *DB) GetMetricAnomalySubscriptions(projectId uuid.UUID, metricId uuid.UUID) ([]types.AnomalySubscription, error) {
+	var subscriptions []types.AnomalySubscription
+	err := db.Conn.Select(&subscriptions, `
+		SELECT * FROM anomaly_subscriptions
+		WHERE project_id = $1 AND (metric_id IS NULL OR metric_id = $2)`, projectId, metricId)
+	return subscriptions, err
+}
+
+func (db *DB) DeleteAnomalySubscription(id uuid.UUID, projectId uuid.UUID, userId uuid.UUID) error {
+	_, err := db.Conn.Exec("DELETE FROM anomaly_subscriptions WHERE id = $1 AND project_id = $2 AND user_id = $3", id, projectId, userId)
+	return err
+}
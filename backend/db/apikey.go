@@ -0,0 +1,47 @@
+package db
+
+import (
+	"Measurely/types"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (db *DB) CreateApiKey(key types.ApiKey) (types.ApiKey, error) {
+	var created types.ApiKey
+	err := db.Conn.Get(&created, `
+		INSERT INTO api_keys (project_id, name, prefix, key_hash, scope)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING *`,
+		key.ProjectId, key.Name, key.Prefix, key.KeyHash, key.Scope,
+	)
+	return created, err
+}
+
+func (db *DB) GetApiKeys(projectId uuid.UUID) ([]types.ApiKey, error) {
+	var keys []types.ApiKey
+	err := db.Conn.Select(&keys, "SELECT * FROM api_keys WHERE project_id = $1 ORDER BY created DESC", projectId)
+	return keys, err
+}
+
+func (db *DB) GetApiKey(id uuid.UUID, projectId uuid.UUID) (types.ApiKey, error) {
+	var key types.ApiKey
+	err := db.Conn.Get(&key, "SELECT * FROM api_keys WHERE id = $1 AND project_id = $2", id, projectId)
+	return key, err
+}
+
+func (db *DB) GetApiKeyByHash(hash string) (types.ApiKey, error) {
+	var key types.ApiKey
+	err := db.Conn.Get(&key, "SELECT * FROM api_keys WHERE key_hash = $1", hash)
+	return key, err
+}
+
+func (db *DB) UpdateApiKeyLastUsed(id uuid.UUID, date time.Time) error {
+	_, err := db.Conn.Exec("UPDATE api_keys SET last_used = $1 WHERE id = $2", date, id)
+	return err
+}
+
+func (db *DB) DeleteApiKey(id uuid.UUID, projectId uuid.UUID) error {
+	_, err := db.Conn.Exec("DELETE FROM api_keys WHERE id = $1 AND project_id = $2", id, projectId)
+	return err
+}
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"Measurely/types"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+func (db *DB) GetTeamRelations(projectId uuid.UUID) ([]types.TeamRelation, error) {
+	var relations []types.TeamRelation
+	err := db.Conn.Select(&relations, "SELECT * FROM team_relation WHERE project_id = $1", projectId)
+	return relations, err
+}
+
+// GetProjectBlocks returns the dashboard layouts of every user of the project
+func (db *DB) GetProjectBlocks(projectId uuid.UUID) ([]types.Blocks, error) {
+	var tmp []tmpBlocks
+	err := db.Conn.Select(&tmp, "SELECT * FROM blocks WHERE project_id = $1", projectId)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]types.Blocks, len(tmp))
+	for i, row := range tmp {
+		blocks[i] = row.Blocks
+		if err := json.Unmarshal(row.Layout, &blocks[i].Layout); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(row.Labels, &blocks[i].Labels); err != nil {
+			return nil, err
+		}
+	}
+
+	return blocks, nil
+}
+
+// ProjectImport writes an imported project in a series of transactions. A failed import deletes the
+// project once part of it has been committed, so that it leaves nothing behind.
+type ProjectImport struct {
+	db        *DB
+	tx        *sqlx.Tx
+	projectId uuid.UUID
+	committed bool
+	metricIds []uuid.UUID
+}
+
+func (db *DB) BeginProjectImport() (*ProjectImport, error) {
+	tx, err := db.Conn.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	return &ProjectImport{db: db, tx: tx}, nil
+}
+
+// Checkpoint commits the records written so far and starts a new transaction
+func (pi *ProjectImport) Checkpoint() error {
+	if err := pi.tx.Commit(); err != nil {
+		return err
+	}
+	pi.committed = true
+
+	tx, err := pi.db.Conn.Beginx()
+	if err != nil {
+		return err
+	}
+	pi.tx = tx
+	return nil
+}
+
+func (pi *ProjectImport) CreateProject(project types.Project) (types.Project, error) {
+	units, err := json.Marshal(project.Units)
+	if err != nil {
+		return types.Project{}, err
+	}
+
+	var tmp tmpProject
+	err = pi.tx.Get(&tmp, `
+		INSERT INTO projects (user_id, api_key, name, units, current_plan, max_event_per_month, retention_days, timezone, week_start, fiscal_year_start_month)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING *`,
+		project.UserId, project.ApiKey, project.Name, units, project.CurrentPlan, project.MaxEventPerMonth,
+		project.RetentionDays, project.Timezone, project.WeekStart, project.FiscalYearStartMonth,
+	)
+	if err != nil {
+		return types.Project{}, err
+	}
+
+	created := tmp.Project
+	if err := json.Unmarshal(tmp.Units, &created.Units); err != nil {
+		return types.Project{}, err
+	}
+	pi.projectId = created.Id
+	return created, nil
+}
+
+// CreateMetric creates a metric along with its filters and its totals
+func (pi *ProjectImport) CreateMetric(metric types.Metric) (uuid.UUID, error) {
+	filters, err := json.Marshal(metric.Filters)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	var id uuid.UUID
+	err = pi.tx.Get(&id, `
+		INSERT INTO metrics (project_id, name, type, unit, name_pos, name_neg, filters, total, event_count, created, last_event_timestamp, formula)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id`,
+		metric.ProjectId, metric.Name, metric.Type, metric.Unit, metric.NamePos, metric.NameNeg, filters,
+		metric.Total, metric.EventCount, metric.Created, metric.LastEventTimestamp, metric.Formula,
+	)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	pi.metricIds = append(pi.metricIds, id)
+	return id, nil
+}
+
+func (pi *ProjectImport) CreateTeamRelation(relation types.TeamRelation) (uuid.UUID, error) {
+	var id uuid.UUID
+	err := pi.tx.Get(&id,
+		"INSERT INTO team_relation (user_id, project_id, role) VALUES ($1, $2, $3) RETURNING id",
+		relation.UserId, relation.ProjectId, relation.Role,
+	)
+	return id, err
+}
+
+func (pi *ProjectImport) CreateBlocks(blocks types.Blocks) error {
+	layout, err := json.Marshal(blocks.Layout)
+	if err != nil {
+		return err
+	}
+
+	labels, err := json.Marshal(blocks.Labels)
+	if err != nil {
+		return err
+	}
+
+	_, err = pi.tx.Exec(
+		"INSERT INTO blocks (team_relation_id, user_id, project_id, layout, labels) VALUES ($1, $2, $3, $4, $5)",
+		blocks.TeamRelationId, blocks.UserId, blocks.ProjectId, layout, labels,
+	)
+	return err
+}
+
+// CreateEvents inserts a batch of events with a single statement
+func (pi *ProjectImport) CreateEvents(events []types.MetricEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	values := make([]string, len(events))
+	args := make([]any, 0, len(events)*6)
+	for i, event := range events {
+		filters, err := json.Marshal(event.Filters)
+		if err != nil {
+			return err
+		}
+
+		n := i * 6
+		values[i] = fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, NULLIF($%d, ''))", n+1, n+2, n+3, n+4, n+5, n+6)
+		args = append(args, event.MetricId, event.ValuePos, event.ValueNeg, event.Date.UTC(), string(filters), event.EntityId)
+	}
+
+	_, err := pi.tx.Exec(
+		"INSERT INTO metric_events (metric_id, value_pos, value_neg, date, filters, entity_id) VALUES "+strings.Join(values, ", "),
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = pi.tx.Exec("UPDATE projects SET monthly_event_count = monthly_event_count + $1 WHERE id = $2", len(events), pi.projectId)
+	return err
+}
+
+// Commit builds the rollups of the imported events and commits the import
+func (pi *ProjectImport) Commit() error {
+	if len(pi.metricIds) > 0 {
+		if err := rebuildRollups(pi.tx, pi.metricIds); err != nil {
+			pi.Rollback()
+			return err
+		}
+	}
+	if err := pi.tx.Commit(); err != nil {
+		pi.Rollback()
+		return err
+	}
+	return nil
+}
+
+// Rollback discards the import, deleting the project when part of it was already committed
+func (pi *ProjectImport) Rollback() error {
+	pi.tx.Rollback()
+	if !pi.committed {
+		return nil
+	}
+
+	_, err := pi.db.Conn.Exec("DELETE FROM projects WHERE id = $1", pi.projectId)
+	return err
+}
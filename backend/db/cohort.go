@@ -0,0 +1,57 @@
+package db
+
+import (
+	"Measurely/types"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// GetCohorts groups the entities by the bucket of their first event of the start metric, for
+// the ones falling in [start, end), and counts the entities of each cohort with events of the return
+// metric in each bucket from their first event, until returnEnd. The filters restrict the events of each
+// metric when set.
+func (db *DB) GetCohorts(startMetricId uuid.UUID, startFilterId uuid.UUID, returnMetricId uuid.UUID, returnFilterId uuid.UUID, start time.Time, end time.Time, returnEnd time.Time, granularity string, calendar types.Calendar) ([]types.CohortAggregate, error) {
+	args := []any{startMetricId, start, end, returnMetricId, returnEnd}
+
+	startFilter, returnFilter := "", ""
+	if startFilterId != uuid.Nil {
+		args = append(args, startFilterId.String())
+		startFilter = fmt.Sprintf(" AND %s @> jsonb_build_array($%d::text)", eventFilterList, len(args))
+	}
+	if returnFilterId != uuid.Nil {
+		args = append(args, returnFilterId.String())
+		returnFilter = fmt.Sprintf(" AND %s @> jsonb_build_array($%d::text)", eventFilterList, len(args))
+	}
+
+	cohortBucket := bucketExpression(granularity, calendar, &args)
+	periodBucket := bucketExpression(granularity, calendar, &args)
+
+	query := fmt.Sprintf(`
+		WITH cohorts AS (
+			SELECT entity_id, date AS entered, %s AS cohort FROM (
+				SELECT entity_id, MIN(date) AS date FROM metric_events
+				WHERE metric_id = $1 AND entity_id IS NOT NULL%s
+				GROUP BY entity_id
+			) AS firsts
+			WHERE date >= $2 AND date < $3
+		), returns AS (
+			SELECT DISTINCT entity_id, %s AS period FROM (
+				SELECT c.entity_id, e.date FROM cohorts c
+				JOIN metric_events e ON e.entity_id = c.entity_id
+				WHERE e.metric_id = $4 AND e.date >= c.entered AND e.date < $5%s
+			) AS activity
+		)
+		SELECT cohort, NULL::timestamp AS period, COUNT(*) AS entities FROM cohorts GROUP BY cohort
+		UNION ALL
+		SELECT c.cohort, r.period, COUNT(*) AS entities FROM cohorts c
+		JOIN returns r ON r.entity_id = c.entity_id
+		GROUP BY c.cohort, r.period`,
+		cohortBucket, startFilter, periodBucket, returnFilter,
+	)
+
+	var aggregates []types.CohortAggregate
+	err := db.Conn.Select(&aggregates, query, args...)
+	return aggregates, err
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -13,6 +14,17 @@ import (
 	"github.com/jmoiron/sqlx"
 )
 
+// Advisory lock keys of the background jobs
+const (
+	LOCK_RETENTION int64 = iota + 1
+	LOCK_ALERTS
+	LOCK_ANOMALIES
+	LOCK_MONITORS
+	LOCK_DIGESTS
+	LOCK_GOALS
+	LOCK_ENTITY_INDEX
+)
+
 type DB struct {
 	Conn *sqlx.DB
 }
@@ -96,6 +108,29 @@ func migrate(db *sqlx.DB) error {
 	return nil
 }
 
+// WithAdvisoryLock runs fn while holding the advisory lock identified by key. When another session
+// holds the lock, fn is not run and false is returned, so that a job runs on a single replica at a time.
+func (d *DB) WithAdvisoryLock(key int64, fn func()) (bool, error) {
+	ctx := context.Background()
+	conn, err := d.Conn.Connx(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.GetContext(ctx, &locked, "SELECT pg_try_advisory_lock($1)", key); err != nil {
+		return false, err
+	}
+	if !locked {
+		return false, nil
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", key)
+
+	fn()
+	return true, nil
+}
+
 func (d *DB) Close() error {
 	return d.Conn.Close()
 }
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"Measurely/types"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// CreateDeadLetter stores a rejected event, collapsing identical rejections into a single entry
+func (db *DB) CreateDeadLetter(letter types.DeadLetter) error {
+	_, err := db.Conn.Exec(`
+		INSERT INTO dead_letter_events (project_id, metric_identifier, payload, payload_hash, reason, message)
+		VALUES ($1, $2, $3, md5($3), $4, $5)
+		ON CONFLICT (project_id, metric_identifier, reason, payload_hash)
+		DO UPDATE SET
+			occurrences = dead_letter_events.occurrences + 1,
+			message = EXCLUDED.message,
+			last_seen = timezone('UTC', CURRENT_TIMESTAMP)`,
+		letter.ProjectId, letter.MetricIdentifier, letter.Payload, letter.Reason, letter.Message,
+	)
+	return err
+}
+
+func (db *DB) GetDeadLetters(projectId uuid.UUID, reason string, limit int, offset int) ([]types.DeadLetter, error) {
+	var letters []types.DeadLetter
+	err := db.Conn.Select(&letters, `
+		SELECT * FROM dead_letter_events
+		WHERE project_id = $1 AND ($2 = '' OR reason = $2)
+		ORDER BY last_seen DESC
+		LIMIT $3 OFFSET $4`,
+		projectId, reason, limit, offset,
+	)
+	return letters, err
+}
+
+func (db *DB) GetDeadLettersByIds(projectId uuid.UUID, ids []uuid.UUID) ([]types.DeadLetter, error) {
+	var letters []types.DeadLetter
+	err := db.Conn.Select(&letters, `
+		SELECT * FROM dead_letter_events
+		WHERE project_id = $1 AND id = ANY($2)
+		ORDER BY created ASC`,
+		projectId, pq.Array(ids),
+	)
+	return letters, err
+}
+
+func (db *DB) GetDeadLetter(id, projectId uuid.UUID) (types.DeadLetter, error) {
+	var letter types.DeadLetter
+	err := db.Conn.Get(&letter, "SELECT * FROM dead_letter_events WHERE id = $1 AND project_id = $2", id, projectId)
+	return letter, err
+}
+
+// UpdateDeadLetterFailure records a failed replay attempt of a dead letter along with
+// the number of occurrences that are still left to replay
+func (db *DB) UpdateDeadLetterFailure(id uuid.UUID, reason string, message string, occurrences int) error {
+	_, err := db.Conn.Exec(`
+		UPDATE dead_letter_events
+		SET reason = $1, message = $2, occurrences = $3, last_seen = timezone('UTC', CURRENT_TIMESTAMP)
+		WHERE id = $4`,
+		reason, message, occurrences, id,
+	)
+	return err
+}
+
+// UpdateDeadLetterOccurrences sets the number of occurrences of a dead letter that are still left to replay
+func (db *DB) UpdateDeadLetterOccurrences(id uuid.UUID, occurrences int) error {
+	_, err := db.Conn.Exec("UPDATE dead_letter_events SET occurrences = $1 WHERE id = $2", occurrences, id)
+	return err
+}
+
+func (db *DB) DeleteDeadLetter(id uuid.UUID) error {
+	_, err := db.Conn.Exec("DELETE FROM dead_letter_events WHERE id = $1", id)
+	return err
+}
+
+// DeleteDeadLetters purges the dead letters of a project. An empty id list purges
+// every entry matching the reason, and an empty reason matches all reasons.
+func (db *DB) DeleteDeadLetters(projectId uuid.UUID, ids []uuid.UUID, reason string) (int64, error) {
+	result, err := db.Conn.Exec(`
+		DELETE FROM dead_letter_events
+		WHERE project_id = $1
+		AND (COALESCE(cardinality($2::uuid[]), 0) = 0 OR id = ANY($2::uuid[]))
+		AND ($3 = '' OR reason = $3)`,
+		projectId, pq.Array(ids), reason,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
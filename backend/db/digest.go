@@ -0,0 +1,81 @@
+package db
+
+import (
+	"Measurely/types"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type tmpDigestSubscription struct {
+	types.DigestSubscription
+	MetricIds []byte `db:"metric_ids"`
+}
+
+func (tmp tmpDigestSubscription) decode() (types.DigestSubscription, error) {
+	subscription := tmp.DigestSubscription
+	if err := json.Unmarshal(tmp.MetricIds, &subscription.MetricIds); err != nil {
+		return types.DigestSubscription{}, err
+	}
+	return subscription, nil
+}
+
+// UpsertDigestSubscription creates the digest of a user for a project, or replaces its settings
+func (db *DB) UpsertDigestSubscription(subscription types.DigestSubscription) (types.DigestSubscription, error) {
+	metricIds, err := json.Marshal(subscription.MetricIds)
+	if err != nil {
+		return types.DigestSubscription{}, err
+	}
+
+	var tmp tmpDigestSubscription
+	err = db.Conn.Get(&tmp, `
+		INSERT INTO digest_subscriptions (project_id, user_id, frequency, metric_ids, enabled, next_send)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (project_id, user_id) DO UPDATE
+		SET frequency = EXCLUDED.frequency, metric_ids = EXCLUDED.metric_ids, enabled = EXCLUDED.enabled, next_send = EXCLUDED.next_send
+		RETURNING *`,
+		subscription.ProjectId, subscription.UserId, subscription.Frequency, metricIds, subscription.Enabled, subscription.NextSend,
+	)
+	if err != nil {
+		return types.DigestSubscription{}, err
+	}
+	return tmp.decode()
+}
+
+func (db *DB) GetDigestSubscription(projectId uuid.UUID, userId uuid.UUID) (types.DigestSubscription, error) {
+	var tmp tmpDigestSubscription
+	err := db.Conn.Get(&tmp, "SELECT * FROM digest_subscriptions WHERE project_id = $1 AND user_id = $2", projectId, userId)
+	if err != nil {
+		return types.DigestSubscription{}, err
+	}
+	return tmp.decode()
+}
+
+func (db *DB) DeleteDigestSubscription(projectId uuid.UUID, userId uuid.UUID) error {
+	_, err := db.Conn.Exec("DELETE FROM digest_subscriptions WHERE project_id = $1 AND user_id = $2", projectId, userId)
+	return err
+}
+
+// GetDueDigestSubscriptions returns the enabled digests that are due at the given date
+func (db *DB) GetDueDigestSubscriptions(now time.Time) ([]types.DigestSubscription, error) {
+	var tmp []tmpDigestSubscription
+	err := db.Conn.Select(&tmp, "SELECT * FROM digest_subscriptions WHERE enabled AND next_send <= $1 ORDER BY next_send", now)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := make([]types.DigestSubscription, len(tmp))
+	for i, row := range tmp {
+		if subscriptions[i], err = row.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return subscriptions, nil
+}
+
+// UpdateDigestSchedule records when a digest was sent and schedules the next one
+func (db *DB) UpdateDigestSchedule(id uuid.UUID, lastSent *time.Time, nextSend time.Time) error {
+	_, err := db.Conn.Exec("UPDATE digest_subscriptions SET last_sent = COALESCE($1, last_sent), next_send = $2 WHERE id = $3", lastSent, nextSend, id)
+	return err
+}
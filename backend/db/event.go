@@ -13,12 +13,23 @@ import (
 
 // BatchManager handles batched metric event processing
 type BatchManager struct {
-	db            *DB
-	batchSize     int
-	flushInterval time.Duration
-	eventChan     chan MetricEventData
-	wg            sync.WaitGroup
-	shutdown      chan struct{}
+	db             *DB
+	batchSize      int
+	flushInterval  time.Duration
+	eventChan      chan MetricEventData
+	wg             sync.WaitGroup
+	shutdown       chan struct{}
+	listenersMu    sync.RWMutex
+	listeners      []func([]types.LiveEvent)
+	countListeners []func([]ProjectCount)
+}
+
+// ProjectCount is the monthly event count of a project before and after a batch, along with its limit
+type ProjectCount struct {
+	ProjectId uuid.UUID
+	Previous  int
+	Count     int
+	Limit     int
 }
 
 // MetricEventData represents a single metric event to be batched
@@ -28,6 +39,10 @@ type MetricEventData struct {
 	ToAdd      int32
 	ToRemove   int32
 	Filters    map[string]string
+	EntityId   string        // Entity behind the event, stored as null when empty
+	Date       time.Time     // Date of the event, the time of the batch when zero
+	ImportId   uuid.NullUUID // Import the event belongs to, imported events are not streamed live
+	SkipQuota  bool          // Leaves the event out of the monthly event count
 	ResponseCh chan BatchResult
 }
 
@@ -69,6 +84,46 @@ func (bm *BatchManager) start() {
 	}
 }
 
+// OnFlush registers a listener called with the events of every committed batch
+func (bm *BatchManager) OnFlush(listener func([]types.LiveEvent)) {
+	bm.listenersMu.Lock()
+	defer bm.listenersMu.Unlock()
+	bm.listeners = append(bm.listeners, listener)
+}
+
+// notifyListeners hands the committed events to the registered listeners
+func (bm *BatchManager) notifyListeners(events []types.LiveEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	bm.listenersMu.RLock()
+	defer bm.listenersMu.RUnlock()
+	for _, listener := range bm.listeners {
+		go listener(events)
+	}
+}
+
+// OnCount registers a listener called with the monthly event counts of the projects of every committed batch
+func (bm *BatchManager) OnCount(listener func([]ProjectCount)) {
+	bm.listenersMu.Lock()
+	defer bm.listenersMu.Unlock()
+	bm.countListeners = append(bm.countListeners, listener)
+}
+
+// notifyCountListeners hands the monthly event counts of a committed batch to the registered listeners
+func (bm *BatchManager) notifyCountListeners(counts []ProjectCount) {
+	if len(counts) == 0 {
+		return
+	}
+
+	bm.listenersMu.RLock()
+	defer bm.listenersMu.RUnlock()
+	for _, listener := range bm.countListeners {
+		go listener(counts)
+	}
+}
+
 // QueueEvent adds a metric event to the processing queue
 func (bm *BatchManager) QueueEvent(event MetricEventData) BatchResult {
 	resultCh := make(chan BatchResult, 1)
@@ -85,6 +140,33 @@ func (bm *BatchManager) QueueEvent(event MetricEventData) BatchResult {
 	return <-resultCh
 }
 
+// QueueEvents adds several metric events to the processing queue and waits for all of them, so
+// that they can be written in the same batches
+func (bm *BatchManager) QueueEvents(events []MetricEventData) []BatchResult {
+	results := make([]BatchResult, len(events))
+	channels := make([]chan BatchResult, len(events))
+
+	for i := range events {
+		channels[i] = make(chan BatchResult, 1)
+		events[i].ResponseCh = channels[i]
+
+		select {
+		case bm.eventChan <- events[i]:
+		case <-time.After(5 * time.Second):
+			results[i] = BatchResult{Error: fmt.Errorf("event queue is full"), MonthlyCount: 0}
+			channels[i] = nil
+		}
+	}
+
+	for i, ch := range channels {
+		if ch != nil {
+			results[i] = <-ch
+		}
+	}
+
+	return results
+}
+
 // processEvents handles batched event processing
 func (bm *BatchManager) processEvents() {
 	defer bm.wg.Done()
@@ -136,15 +218,17 @@ func (bm *BatchManager) processBatch(batch []MetricEventData) {
 	now := time.Now().UTC()
 	projectCounts := make(map[uuid.UUID]int)
 	results := make(map[int]BatchResult)
+	flushed := make(map[int]types.LiveEvent)
+	rollups := make(map[rollupKey]types.BucketAggregate)
 
 	// Prepare statement for updating metrics
 	updateMetricStmt, err := tx.Preparex(`
 		UPDATE metrics
 		SET total = total + ( CAST($1 AS BIGINT) - CAST($2 AS BIGINT) ),
 			event_count = event_count + 1,
-			last_event_timestamp = $3
+			last_event_timestamp = GREATEST(last_event_timestamp, $3)
 		WHERE id = $4
-		RETURNING type, filters`)
+		RETURNING name, type, filters`)
 	if err != nil {
 		tx.Rollback()
 		for _, event := range batch {
@@ -159,8 +243,8 @@ func (bm *BatchManager) processBatch(batch []MetricEventData) {
 
 	// Prepare statement for inserting events
 	insertEventStmt, err := tx.Preparex(`
-		INSERT INTO metric_events ( metric_id, value_pos, value_neg, date, filters)
-		VALUES ($1, $2, $3, $4, $5)`)
+		INSERT INTO metric_events ( metric_id, value_pos, value_neg, date, filters, import_id, entity_id)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))`)
 	if err != nil {
 		tx.Rollback()
 		for _, event := range batch {
@@ -175,13 +259,19 @@ func (bm *BatchManager) processBatch(batch []MetricEventData) {
 
 	// Process each event in the batch
 	for i, event := range batch {
+		var metricName string
 		var metricType int
 		var filtersData []byte
 
+		date := now
+		if !event.Date.IsZero() {
+			date = event.Date.UTC()
+		}
+
 		// Update the metric
 		err := updateMetricStmt.QueryRowx(
-			event.ToAdd, event.ToRemove, now, event.MetricID,
-		).Scan(&metricType, &filtersData)
+			event.ToAdd, event.ToRemove, date, event.MetricID,
+		).Scan(&metricName, &metricType, &filtersData)
 
 		if err != nil {
 			results[i] = BatchResult{
@@ -201,14 +291,7 @@ func (bm *BatchManager) processBatch(batch []MetricEventData) {
 			continue
 		}
 
-		var filter_list []uuid.UUID
-		for filter_id, filter_value := range metric_filters {
-			for category, name := range event.Filters {
-				if filter_value.Name == name && filter_value.Category == category {
-					filter_list = append(filter_list, filter_id)
-				}
-			}
-		}
+		filter_list := MatchFilters(metric_filters, event.Filters)
 
 		marshaled_filters, err := json.Marshal(filter_list)
 		if err != nil {
@@ -221,7 +304,7 @@ func (bm *BatchManager) processBatch(batch []MetricEventData) {
 
 		// Insert the event
 		_, err = insertEventStmt.Exec(
-			event.MetricID, event.ToAdd, event.ToRemove, now, marshaled_filters,
+			event.MetricID, event.ToAdd, event.ToRemove, date, marshaled_filters, event.ImportId, event.EntityId,
 		)
 
 		if err != nil {
@@ -233,18 +316,57 @@ func (bm *BatchManager) processBatch(batch []MetricEventData) {
 		}
 
 		// Track project counts
-		projectCounts[event.ProjectID]++
+		if event.SkipQuota {
+			results[i] = BatchResult{Error: nil, MonthlyCount: 0}
+		} else {
+			projectCounts[event.ProjectID]++
+		}
+		addToRollups(rollups, event.MetricID, filter_list, date, event.ToAdd, event.ToRemove)
+
+		if event.ImportId.Valid {
+			continue
+		}
+
+		matched_filters := make(map[uuid.UUID]types.Filter, len(filter_list))
+		for _, filter_id := range filter_list {
+			matched_filters[filter_id] = metric_filters[filter_id]
+		}
+
+		flushed[i] = types.LiveEvent{
+			ProjectId:  event.ProjectID,
+			MetricId:   event.MetricID,
+			MetricName: metricName,
+			MetricType: metricType,
+			Value:      float64(int64(event.ToAdd)-int64(event.ToRemove)) / 100,
+			ValuePos:   event.ToAdd,
+			ValueNeg:   event.ToRemove,
+			Date:       date,
+			Filters:    matched_filters,
+		}
+	}
+
+	// Update the rollups of the inserted events
+	if err := upsertRollups(tx, rollups); err != nil {
+		tx.Rollback()
+		for _, event := range batch {
+			event.ResponseCh <- BatchResult{
+				Error:        fmt.Errorf("failed to update rollups: %v", err),
+				MonthlyCount: 0,
+			}
+		}
+		return
 	}
 
 	// Bulk update project monthly counts
+	counts := make([]ProjectCount, 0, len(projectCounts))
 	for projectID, count := range projectCounts {
-		var monthlyCount int
+		var monthlyCount, limit int
 		err := tx.QueryRowx(`
 			UPDATE projects
 			SET monthly_event_count = monthly_event_count + $1
 			WHERE id = $2
-			RETURNING monthly_event_count`, count, projectID,
-		).Scan(&monthlyCount)
+			RETURNING monthly_event_count, max_event_per_month`, count, projectID,
+		).Scan(&monthlyCount, &limit)
 
 		if err != nil {
 			tx.Rollback()
@@ -258,10 +380,11 @@ func (bm *BatchManager) processBatch(batch []MetricEventData) {
 			}
 			return
 		}
+		counts = append(counts, ProjectCount{ProjectId: projectID, Previous: monthlyCount - count, Count: monthlyCount, Limit: limit})
 
 		// Set successful results for this project
 		for i, event := range batch {
-			if event.ProjectID == projectID && results[i].Error == nil {
+			if event.ProjectID == projectID && !event.SkipQuota && results[i].Error == nil {
 				results[i] = BatchResult{
 					Error:        nil,
 					MonthlyCount: monthlyCount,
@@ -278,6 +401,15 @@ func (bm *BatchManager) processBatch(batch []MetricEventData) {
 				MonthlyCount: 0,
 			}
 		}
+	} else {
+		committed := make([]types.LiveEvent, 0, len(flushed))
+		for i := range batch {
+			if event, exists := flushed[i]; exists && results[i].Error == nil {
+				committed = append(committed, event)
+			}
+		}
+		bm.notifyListeners(committed)
+		bm.notifyCountListeners(counts)
 	}
 
 	// Send results to waiting goroutines
@@ -293,6 +425,19 @@ func (bm *BatchManager) processBatch(batch []MetricEventData) {
 	}
 }
 
+// MatchFilters returns the ids of the metric filters matching the given category/name pairs
+func MatchFilters(metricFilters map[uuid.UUID]types.Filter, filters map[string]string) []uuid.UUID {
+	var filter_list []uuid.UUID
+	for filter_id, filter_value := range metricFilters {
+		for category, name := range filters {
+			if filter_value.Name == name && filter_value.Category == category {
+				filter_list = append(filter_list, filter_id)
+			}
+		}
+	}
+	return filter_list
+}
+
 // Shutdown gracefully stops the batch manager after processing any remaining events
 func (bm *BatchManager) Shutdown() {
 	close(bm.shutdown)
@@ -306,6 +451,7 @@ func (db *DB) UpdateMetricAndCreateEvent(
 	toAdd int32,
 	toRemove int32,
 	filters *map[string]string,
+	entityId string,
 	bm *BatchManager,
 ) (int, error) {
 	// Create a map if filters is nil
@@ -321,6 +467,7 @@ func (db *DB) UpdateMetricAndCreateEvent(
 		ToAdd:     toAdd,
 		ToRemove:  toRemove,
 		Filters:   actualFilters,
+		EntityId:  entityId,
 	})
 
 	return result.MonthlyCount, result.Error
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"Measurely/types"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+func (db *DB) CreateExport(export types.MetricExport) (types.MetricExport, error) {
+	var created types.MetricExport
+	err := db.Conn.Get(&created, `
+		INSERT INTO metric_exports (project_id, user_id, metric_id, format, start_date, end_date)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING *`,
+		export.ProjectId, export.UserId, export.MetricId, export.Format, export.StartDate, export.EndDate,
+	)
+	return created, err
+}
+
+func (db *DB) GetExports(projectId uuid.UUID, limit int) ([]types.MetricExport, error) {
+	var exports []types.MetricExport
+	err := db.Conn.Select(&exports, "SELECT * FROM metric_exports WHERE project_id = $1 ORDER BY created DESC LIMIT $2", projectId, limit)
+	return exports, err
+}
+
+func (db *DB) GetExport(id uuid.UUID, projectId uuid.UUID) (types.MetricExport, error) {
+	var export types.MetricExport
+	err := db.Conn.Get(&export, "SELECT * FROM metric_exports WHERE id = $1 AND project_id = $2", id, projectId)
+	return export, err
+}
+
+// ClaimExport marks the oldest pending export as running and returns it. Exports left running
+// since before staleBefore, by an instance that stopped, are claimed again.
+func (db *DB) ClaimExport(staleBefore time.Time) (types.MetricExport, error) {
+	var export types.MetricExport
+	err := db.Conn.Get(&export, `
+		UPDATE metric_exports SET status = $1, started = timezone('UTC', CURRENT_TIMESTAMP)
+		WHERE id = (
+			SELECT id FROM metric_exports
+			WHERE status = $2 OR (status = $1 AND started < $3)
+			ORDER BY created
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`, types.EXPORT_RUNNING, types.EXPORT_PENDING, staleBefore)
+	return export, err
+}
+
+// TouchExport refreshes the claim of a running export
+func (db *DB) TouchExport(id uuid.UUID) error {
+	_, err := db.Conn.Exec("UPDATE metric_exports SET started = timezone('UTC', CURRENT_TIMESTAMP) WHERE id = $1 AND status = $2", id, types.EXPORT_RUNNING)
+	return err
+}
+
+func (db *DB) CompleteExport(export types.MetricExport) error {
+	_, err := db.Conn.Exec(`
+		UPDATE metric_exports
+		SET status = $1, object_key = $2, row_count = $3, size = $4, error = $5, finished = timezone('UTC', CURRENT_TIMESTAMP)
+		WHERE id = $6`,
+		export.Status, export.ObjectKey, export.RowCount, export.Size, export.Error, export.Id,
+	)
+	return err
+}
+
+// GetExpiredExports returns the exports finished before the given date whose file is still stored
+func (db *DB) GetExpiredExports(before time.Time) ([]types.MetricExport, error) {
+	var exports []types.MetricExport
+	err := db.Conn.Select(&exports, `
+		SELECT * FROM metric_exports
+		WHERE status = $1 AND object_key <> '' AND finished < $2`, types.EXPORT_DONE, before)
+	return exports, err
+}
+
+func (db *DB) ClearExportObject(id uuid.UUID) error {
+	_, err := db.Conn.Exec("UPDATE metric_exports SET object_key = '' WHERE id = $1", id)
+	return err
+}
+
+// CountMetricEvents returns the number of events of the metrics recorded between start and end
+func (db *DB) CountMetricEvents(metricIds []uuid.UUID, start time.Time, end time.Time) (int64, error) {
+	var count int64
+	err := db.Conn.Get(&count, `
+		SELECT COUNT(*) FROM metric_events
+		WHERE metric_id = ANY($1::uuid[]) AND date BETWEEN $2 AND $3`, pq.Array(metricIds), start, end)
+	return count, err
+}
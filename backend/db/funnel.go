@@ -0,0 +1,182 @@
+package db
+
+import (
+	"Measurely/types"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type tmpFunnel struct {
+	types.Funnel
+	Steps []byte `db:"steps"`
+}
+
+func (tmp tmpFunnel) decode() (types.Funnel, error) {
+	funnel := tmp.Funnel
+	if err := json.Unmarshal(tmp.Steps, &funnel.Steps); err != nil {
+		return types.Funnel{}, err
+	}
+	return funnel, nil
+}
+
+func (db *DB) CreateFunnel(funnel types.Funnel) (types.Funnel, error) {
+	steps, err := json.Marshal(funnel.Steps)
+	if err != nil {
+		return types.Funnel{}, err
+	}
+
+	var tmp tmpFunnel
+	err = db.Conn.Get(&tmp, `
+		INSERT INTO funnels (project_id, user_id, name, steps, window_minutes)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING *`,
+		funnel.ProjectId, funnel.UserId, funnel.Name, steps, funnel.WindowMinutes,
+	)
+	if err != nil {
+		return types.Funnel{}, err
+	}
+	return tmp.decode()
+}
+
+func (db *DB) GetFunnels(projectId uuid.UUID) ([]types.Funnel, error) {
+	var tmp []tmpFunnel
+	if err := db.Conn.Select(&tmp, "SELECT * FROM funnels WHERE project_id = $1 ORDER BY created", projectId); err != nil {
+		return nil, err
+	}
+
+	funnels := make([]types.Funnel, len(tmp))
+	for i, row := range tmp {
+		var err error
+		if funnels[i], err = row.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return funnels, nil
+}
+
+func (db *DB) GetFunnel(id uuid.UUID, projectId uuid.UUID) (types.Funnel, error) {
+	var tmp tmpFunnel
+	err := db.Conn.Get(&tmp, "SELECT * FROM funnels WHERE id = $1 AND project_id = $2", id, projectId)
+	if err != nil {
+		return types.Funnel{}, err
+	}
+	return tmp.decode()
+}
+
+func (db *DB) UpdateFunnel(funnel types.Funnel) error {
+	steps, err := json.Marshal(funnel.Steps)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Conn.Exec(`
+		UPDATE funnels
+		SET name = $1, steps = $2, window_minutes = $3
+		WHERE id = $4 AND project_id = $5`,
+		funnel.Name, steps, funnel.WindowMinutes, funnel.Id, funnel.ProjectId,
+	)
+	return err
+}
+
+func (db *DB) DeleteFunnel(id uuid.UUID, projectId uuid.UUID) error {
+	_, err := db.Conn.Exec("DELETE FROM funnels WHERE id = $1 AND project_id = $2", id, projectId)
+	return err
+}
+
+// entityIndex follows the entities of a metric through its events
+const entityIndex = "idx_metricevents_metricid_entityid_date"
+
+// EnsureEntityIndex builds the index following the entities of the metrics when it is missing, and
+// reports whether it was built. The index is built concurrently so that the ingestion is not blocked.
+// A concurrent build that was interrupted leaves an invalid index behind, which is dropped first.
+func (db *DB) EnsureEntityIndex(ctx context.Context) (bool, error) {
+	var valid bool
+	err := db.Conn.GetContext(ctx, &valid, "SELECT indisvalid FROM pg_index WHERE indexrelid = to_regclass($1)", entityIndex)
+	if err == nil && valid {
+		return false, nil
+	} else if err == nil {
+		if _, err := db.Conn.ExecContext(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+entityIndex); err != nil {
+			return false, err
+		}
+	} else if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	_, err = db.Conn.ExecContext(ctx, "CREATE INDEX CONCURRENTLY IF NOT EXISTS "+entityIndex+" ON metric_events (metric_id, entity_id, date) WHERE entity_id IS NOT NULL")
+	return err == nil, err
+}
+
+// GetFunnelEntities follows the entities entering a funnel in [start, end) through its steps. An entity
+// enters the funnel with its first event of the first step, and reaches a step with its first event
+// of that step recorded after the previous one, within the window of the funnel. The entities are
+// grouped by the bucket of their entry.
+func (db *DB) GetFunnelEntities(funnel types.Funnel, start time.Time, end time.Time, granularity string, calendar types.Calendar) ([]types.FunnelAggregate, error) {
+	args := []any{start, end, funnel.WindowMinutes}
+
+	stepFilter := func(step types.FunnelStep) string {
+		if !step.FilterId.Valid {
+			return ""
+		}
+		args = append(args, step.FilterId.UUID.String())
+		return fmt.Sprintf(" AND %s @> jsonb_build_array($%d::text)", eventFilterList, len(args))
+	}
+
+	first := funnel.Steps[0]
+	args = append(args, first.MetricId)
+	ctes := []string{fmt.Sprintf(`step1 AS (
+			SELECT entity_id, MIN(date) AS entered, MIN(date) AS date FROM metric_events
+			WHERE metric_id = $%d AND entity_id IS NOT NULL AND date >= $1 AND date < $2%s
+			GROUP BY entity_id
+		)`, len(args), stepFilter(first))}
+	joins := []string{}
+	counts := []string{"COUNT(*)"}
+
+	for i, step := range funnel.Steps[1:] {
+		previous, current := fmt.Sprintf("step%d", i+1), fmt.Sprintf("step%d", i+2)
+		args = append(args, step.MetricId)
+		ctes = append(ctes, fmt.Sprintf(`%s AS (
+			SELECT p.entity_id, p.entered, MIN(e.date) AS date FROM %s p
+			JOIN metric_events e ON e.entity_id = p.entity_id
+			WHERE e.metric_id = $%d AND e.date > p.date AND e.date <= p.entered + make_interval(mins => $3::int)%s
+			GROUP BY p.entity_id, p.entered
+		)`, current, previous, len(args), stepFilter(step)))
+		joins = append(joins, fmt.Sprintf("LEFT JOIN %s ON %s.entity_id = step1.entity_id", current, current))
+		counts = append(counts, fmt.Sprintf("COUNT(%s)", current))
+	}
+
+	columns := []string{"step1.entered AS date"}
+	for i := 2; i <= len(funnel.Steps); i++ {
+		columns = append(columns, fmt.Sprintf("step%d.entity_id AS step%d", i, i))
+	}
+
+	bucket := bucketExpression(granularity, calendar, &args)
+	query := fmt.Sprintf(`
+		WITH %s
+		SELECT %s AS bucket, ARRAY[%s] AS counts
+		FROM (SELECT %s FROM step1 %s) AS entries
+		GROUP BY bucket
+		ORDER BY bucket ASC`,
+		strings.Join(ctes, ",\n\t\t"), bucket, strings.Join(counts, ", "), strings.Join(columns, ", "), strings.Join(joins, " "),
+	)
+
+	var rows []struct {
+		Bucket time.Time     `db:"bucket"`
+		Counts pq.Int64Array `db:"counts"`
+	}
+	if err := db.Conn.Select(&rows, query, args...); err != nil {
+		return nil, err
+	}
+
+	aggregates := make([]types.FunnelAggregate, len(rows))
+	for i, row := range rows {
+		aggregates[i] = types.FunnelAggregate{Bucket: row.Bucket, Counts: row.Counts}
+	}
+	return aggregates, nil
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"Measurely/types"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (db *DB) CreateMetricGoal(goal types.MetricGoal) (types.MetricGoal, error) {
+	var created types.MetricGoal
+	err := db.Conn.Get(&created, `
+		INSERT INTO metric_goals (project_id, metric_id, user_id, name, target, period, period_start, period_end, mode, granularity, aggregation, notify_email)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING *`,
+		goal.ProjectId, goal.MetricId, goal.UserId, goal.Name, goal.Target, goal.Period, goal.PeriodStart, goal.PeriodEnd,
+		goal.Mode, goal.Granularity, goal.Aggregation, goal.NotifyEmail,
+	)
+	return created, err
+}
+
+func (db *DB) GetMetricGoals(projectId uuid.UUID) ([]types.MetricGoal, error) {
+	var goals []types.MetricGoal
+	err := db.Conn.Select(&goals, "SELECT * FROM metric_goals WHERE project_id = $1 ORDER BY created", projectId)
+	return goals, err
+}
+
+func (db *DB) GetMetricGoal(id uuid.UUID, projectId uuid.UUID) (types.MetricGoal, error) {
+	var goal types.MetricGoal
+	err := db.Conn.Get(&goal, "SELECT * FROM metric_goals WHERE id = $1 AND project_id = $2", id, projectId)
+	return goal, err
+}
+
+// UpdateMetricGoal updates the settings of a goal. The state starts over, so that a goal changed
+// within a period is notified again.
+func (db *DB) UpdateMetricGoal(goal types.MetricGoal) error {
+	_, err := db.Conn.Exec(`
+		UPDATE metric_goals
+		SET name = $1, target = $2, period = $3, period_start = $4, period_end = $5, mode = $6, granularity = $7,
+			aggregation = $8, notify_email = $9, state = $10, state_period = NULL
+		WHERE id = $11 AND project_id = $12`,
+		goal.Name, goal.Target, goal.Period, goal.PeriodStart, goal.PeriodEnd, goal.Mode, goal.Granularity,
+		goal.Aggregation, goal.NotifyEmail, types.GOAL_ON_TRACK, goal.Id, goal.ProjectId,
+	)
+	return err
+}
+
+func (db *DB) DeleteMetricGoal(id uuid.UUID, projectId uuid.UUID) error {
+	_, err := db.Conn.Exec("DELETE FROM metric_goals WHERE id = $1 AND project_id = $2", id, projectId)
+	return err
+}
+
+// GetActiveMetricGoals returns the recurring goals and the custom goals that ended after the given
+// date, grouped by project
+func (db *DB) GetActiveMetricGoals(endedAfter time.Time) ([]types.MetricGoal, error) {
+	var goals []types.MetricGoal
+	err := db.Conn.Select(&goals, `
+		SELECT * FROM metric_goals
+		WHERE period <> $1 OR period_end > $2
+		ORDER BY project_id, created`, types.GOAL_CUSTOM, endedAfter)
+	return goals, err
+}
+
+func (db *DB) UpdateMetricGoalState(id uuid.UUID, state string, statePeriod time.Time) error {
+	_, err := db.Conn.Exec("UPDATE metric_goals SET state = $1, state_period = $2 WHERE id = $3", state, statePeriod, id)
+	return err
+}
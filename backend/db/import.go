@@ -0,0 +1,229 @@
+package db
+
+import (
+	"Measurely/types"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type tmpEventImport struct {
+	types.EventImport
+	Metrics []byte `db:"metrics"`
+	Errors  []byte `db:"errors"`
+}
+
+func (tmp tmpEventImport) decode() (types.EventImport, error) {
+	imp := tmp.EventImport
+	if err := json.Unmarshal(tmp.Metrics, &imp.Metrics); err != nil {
+		return types.EventImport{}, err
+	}
+	if err := json.Unmarshal(tmp.Errors, &imp.Errors); err != nil {
+		return types.EventImport{}, err
+	}
+	return imp, nil
+}
+
+func (db *DB) CreateEventImport(imp types.EventImport) (types.EventImport, error) {
+	metrics, err := json.Marshal(imp.Metrics)
+	if err != nil {
+		return types.EventImport{}, err
+	}
+
+	errors, err := json.Marshal(imp.Errors)
+	if err != nil {
+		return types.EventImport{}, err
+	}
+
+	var tmp tmpEventImport
+	err = db.Conn.Get(&tmp, `
+		INSERT INTO event_imports (project_id, user_id, file_name, object_key, total_rows, valid_rows, first_event, last_event, metrics, errors)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING *`,
+		imp.ProjectId, imp.UserId, imp.FileName, imp.ObjectKey, imp.TotalRows, imp.ValidRows,
+		imp.FirstEvent, imp.LastEvent, metrics, errors,
+	)
+	if err != nil {
+		return types.EventImport{}, err
+	}
+	return tmp.decode()
+}
+
+func (db *DB) GetEventImports(projectId uuid.UUID, limit int) ([]types.EventImport, error) {
+	var tmp []tmpEventImport
+	err := db.Conn.Select(&tmp, "SELECT * FROM event_imports WHERE project_id = $1 ORDER BY created DESC LIMIT $2", projectId, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	imports := make([]types.EventImport, len(tmp))
+	for i, row := range tmp {
+		if imports[i], err = row.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return imports, nil
+}
+
+func (db *DB) GetEventImport(id uuid.UUID, projectId uuid.UUID) (types.EventImport, error) {
+	var tmp tmpEventImport
+	err := db.Conn.Get(&tmp, "SELECT * FROM event_imports WHERE id = $1 AND project_id = $2", id, projectId)
+	if err != nil {
+		return types.EventImport{}, err
+	}
+	return tmp.decode()
+}
+
+// UpdateEventImportStatus moves an import from one state to another, and reports whether it was in the expected state
+func (db *DB) UpdateEventImportStatus(id uuid.UUID, from string, to string) (bool, error) {
+	result, err := db.Conn.Exec("UPDATE event_imports SET status = $1 WHERE id = $2 AND status = $3", to, id, from)
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+// ClaimEventImport marks the oldest pending import as running and returns it. Imports left running
+// since before staleBefore, by an instance that stopped, are claimed again.
+func (db *DB) ClaimEventImport(staleBefore time.Time) (types.EventImport, error) {
+	var tmp tmpEventImport
+	err := db.Conn.Get(&tmp, `
+		UPDATE event_imports SET status = $1, started = timezone('UTC', CURRENT_TIMESTAMP)
+		WHERE id = (
+			SELECT id FROM event_imports
+			WHERE status = $2 OR (status = $1 AND started < $3)
+			ORDER BY created
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`, types.IMPORT_RUNNING, types.IMPORT_PENDING, staleBefore)
+	if err != nil {
+		return types.EventImport{}, err
+	}
+	return tmp.decode()
+}
+
+// TouchEventImport refreshes the claim of a running import
+func (db *DB) TouchEventImport(id uuid.UUID) error {
+	_, err := db.Conn.Exec("UPDATE event_imports SET started = timezone('UTC', CURRENT_TIMESTAMP) WHERE id = $1 AND status = $2", id, types.IMPORT_RUNNING)
+	return err
+}
+
+// ExpireEventImports expires the previews left uncommitted since before the given date, and returns
+// them so that their files can be deleted
+func (db *DB) ExpireEventImports(before time.Time) ([]types.EventImport, error) {
+	var tmp []tmpEventImport
+	err := db.Conn.Select(&tmp, `
+		UPDATE event_imports SET status = $1
+		WHERE status = $2 AND created < $3
+		RETURNING *`, types.IMPORT_EXPIRED, types.IMPORT_PREVIEWED, before)
+	if err != nil {
+		return nil, err
+	}
+
+	imports := make([]types.EventImport, len(tmp))
+	for i, row := range tmp {
+		if imports[i], err = row.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return imports, nil
+}
+
+func (db *DB) CompleteEventImport(imp types.EventImport) error {
+	errors, err := json.Marshal(imp.Errors)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Conn.Exec(`
+		UPDATE event_imports
+		SET status = $1, imported_rows = $2, errors = $3, finished = timezone('UTC', CURRENT_TIMESTAMP)
+		WHERE id = $4`,
+		imp.Status, imp.ImportedRows, errors, imp.Id,
+	)
+	return err
+}
+
+// ClearImportEvents deletes the events written by an earlier run of an import, before it runs again
+func (db *DB) ClearImportEvents(id uuid.UUID) error {
+	tx, err := db.Conn.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteImportEvents(tx, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteImportEvents deletes the events of an import when it has finished, takes them out of the
+// totals of their metrics and rebuilds the rollups of those metrics. It reports whether the import could be undone.
+func (db *DB) DeleteImportEvents(id uuid.UUID, projectId uuid.UUID) (bool, error) {
+	tx, err := db.Conn.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE event_imports SET status = $1
+		WHERE id = $2 AND project_id = $3 AND status IN ($4, $5)`,
+		types.IMPORT_UNDONE, id, projectId, types.IMPORT_DONE, types.IMPORT_FAILED,
+	)
+	if err != nil {
+		return false, err
+	}
+	if count, err := result.RowsAffected(); err != nil || count == 0 {
+		return false, err
+	}
+
+	if err := deleteImportEvents(tx, id); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// deleteImportEvents deletes the events of an import, takes them out of the totals of their metrics
+// and rebuilds the rollups of those metrics
+func deleteImportEvents(tx *sqlx.Tx, id uuid.UUID) error {
+	var totals []struct {
+		MetricId uuid.UUID `db:"metric_id"`
+		Count    int64     `db:"count"`
+		Total    int64     `db:"total"`
+	}
+	err := tx.Select(&totals, `
+		WITH deleted AS (
+			DELETE FROM metric_events WHERE import_id = $1
+			RETURNING metric_id, value_pos, value_neg
+		)
+		SELECT metric_id, COUNT(*) AS count, SUM(value_pos::bigint - value_neg::bigint)::bigint AS total
+		FROM deleted
+		GROUP BY metric_id`, id)
+	if err != nil {
+		return err
+	}
+
+	metricIds := make([]uuid.UUID, len(totals))
+	for i, total := range totals {
+		metricIds[i] = total.MetricId
+		_, err := tx.Exec(
+			"UPDATE metrics SET total = total - $1, event_count = GREATEST(event_count - $2, 0) WHERE id = $3",
+			total.Total, total.Count, total.MetricId,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(metricIds) > 0 {
+		return rebuildRollups(tx, metricIds)
+	}
+	return nil
+}
@@ -4,7 +4,6 @@ import (
 	"Measurely/types"
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -18,8 +17,8 @@ type TmpMetric struct {
 func (db *DB) CreateMetric(metric types.Metric) (types.Metric, error) {
 	var new_metric types.Metric
 	query := `INSERT INTO metrics
-		(project_id, name, type, name_pos, name_neg,  unit, stripe_api_key)
-		VALUES (:project_id, :name, :type, :name_pos, :name_neg, :unit, :stripe_api_key) RETURNING *`
+		(project_id, name, type, name_pos, name_neg,  unit, stripe_api_key, formula)
+		VALUES (:project_id, :name, :type, :name_pos, :name_neg, :unit, :stripe_api_key, :formula) RETURNING *`
 
 	rows, err := db.Conn.NamedQuery(query, metric)
 	if err != nil {
@@ -71,6 +70,11 @@ func (db *DB) UpdateMetric(id, projectId uuid.UUID, name, namePos, nameNeg strin
 	return err
 }
 
+func (db *DB) UpdateMetricFormula(id, projectId uuid.UUID, formula string) error {
+	_, err := db.Conn.Exec("UPDATE metrics SET formula = $1 WHERE id = $2 AND project_id = $3 AND type = $4", formula, id, projectId, types.FORMULA_METRIC)
+	return err
+}
+
 func (db *DB) GetMetrics(projectId uuid.UUID) ([]types.Metric, error) {
 	rows, err := db.Conn.Queryx(`
 		SELECT * FROM metrics
@@ -174,92 +178,92 @@ func (db *DB) GetMetricCount(groupId uuid.UUID) (int, error) {
 	return count, err
 }
 
-func (db *DB) GetMetricEvents(metricId uuid.UUID, start time.Time, end time.Time, useNext bool) ([]types.MetricEvent, error) {
-	var query string
-	var rows *sql.Rows
-	var err error
-
-	if useNext {
-		query = `
-		SELECT * FROM metric_events
-		WHERE metric_id = $1 AND date > $2
-		ORDER BY date ASC LIMIT 1
-		`
-		rows, err = db.Conn.Query(query, metricId, end)
-	} else {
-		query = `
-		SELECT * FROM metric_events
-		WHERE metric_id = $1 AND date BETWEEN $2 AND $3
-		ORDER BY date ASC
-		`
-		rows, err = db.Conn.Query(query, metricId, start, end)
+// scanMetricEvent reads a row of the metric events table
+func scanMetricEvent(rows *sql.Rows) (types.MetricEvent, error) {
+	var event types.MetricEvent
+	var filter_list []byte
+	err := rows.Scan(&event.Id, &event.MetricId, &event.ValuePos, &event.ValueNeg, &event.Date, &filter_list, &event.EntityId)
+	if err != nil {
+		return types.MetricEvent{}, err
+	}
+
+	var filters []uuid.UUID
+	if err := json.Unmarshal(filter_list, &filters); err != nil {
+		return types.MetricEvent{}, err
 	}
 
+	event.Filters = filters
+	return event, nil
+}
+
+// StreamMetricEvents calls fn with each event of the metric recorded between start and end, in the
+// order of (date, id), without loading the range in memory. Returning an error from fn stops the stream.
+func (db *DB) StreamMetricEvents(metricId uuid.UUID, start time.Time, end time.Time, desc bool, fn func(types.MetricEvent) error) error {
+	order := "ASC"
+	if desc {
+		order = "DESC"
+	}
+
+	rows, err := db.Conn.Query(`
+		SELECT id, metric_id, value_pos, value_neg, date, filters, COALESCE(entity_id, '') FROM metric_events
+		WHERE metric_id = $1 AND date BETWEEN $2 AND $3
+		ORDER BY date `+order+`, id `+order, metricId, start, end)
 	if err != nil {
-		return []types.MetricEvent{}, err
+		return err
 	}
 	defer rows.Close()
 
-	var events []types.MetricEvent
 	for rows.Next() {
-		var event types.MetricEvent
-		var filter_list []byte
-		err := rows.Scan(&event.Id, &event.MetricId, &event.ValuePos, &event.ValueNeg, &event.Date, &filter_list)
+		event, err := scanMetricEvent(rows)
 		if err != nil {
-			return []types.MetricEvent{}, err
+			return err
 		}
-
-		var filters []uuid.UUID
-		err = json.Unmarshal(filter_list, &filters)
-		if err != nil {
-			return []types.MetricEvent{}, err
+		if err := fn(event); err != nil {
+			return err
 		}
-
-		event.Filters = filters
-		events = append(events, event)
 	}
 
-	return events, nil
+	return rows.Err()
 }
 
-func (db *DB) GetVariationEvents(metricId uuid.UUID, start time.Time, end time.Time) ([]types.MetricEvent, error) {
+// GetMetricEventsPage returns at most limit events of the metric recorded between start and end,
+// following the cursor in the order of (date, id). A nil cursor starts from the beginning of the range.
+func (db *DB) GetMetricEventsPage(metricId uuid.UUID, start time.Time, end time.Time, cursor *types.EventCursor, desc bool, limit int) ([]types.MetricEvent, error) {
+	order, comparison := "ASC", ">"
+	if desc {
+		order, comparison = "DESC", "<"
+	}
+
 	query := `
-		(SELECT * FROM metric_events
-		WHERE metric_id = $1 AND date >= $2 AND date <= $3
-		ORDER BY date ASC LIMIT 1)
-		UNION ALL
-		(SELECT * FROM metric_events
-		WHERE metric_id = $1 AND date <= $3 AND date >= $2
-		ORDER BY date DESC LIMIT 1)
-	`
-
-	rows, err := db.Conn.Query(query, metricId, start, end)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch variation events: %v", err)
+		SELECT id, metric_id, value_pos, value_neg, date, filters, COALESCE(entity_id, '') FROM metric_events
+		WHERE metric_id = $1 AND date BETWEEN $2 AND $3`
+	args := []any{metricId, start, end, limit}
+
+	if cursor != nil {
+		query += ` AND (date, id) ` + comparison + ` ($5, $6)`
+		args = append(args, cursor.Date, cursor.Id)
 	}
 
+	query += `
+		ORDER BY date ` + order + `, id ` + order + `
+		LIMIT $4`
+
+	rows, err := db.Conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
-	var events []types.MetricEvent
+	events := []types.MetricEvent{}
 	for rows.Next() {
-		var event types.MetricEvent
-		var filter_list []byte
-		err := rows.Scan(&event.Id, &event.MetricId, &event.ValuePos, &event.ValueNeg, &event.Date, &filter_list)
+		event, err := scanMetricEvent(rows)
 		if err != nil {
-			return []types.MetricEvent{}, err
-		}
-
-		var filters []uuid.UUID
-		err = json.Unmarshal(filter_list, &filters)
-		if err != nil {
-			return []types.MetricEvent{}, err
+			return nil, err
 		}
-
-		event.Filters = filters
 		events = append(events, event)
 	}
 
-	return events, nil
+	return events, rows.Err()
 }
 
 func (db *DB) UpdateMetricStripeAccount(id uuid.UUID, stripeId string) error {
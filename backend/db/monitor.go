@@ -0,0 +1,77 @@
+package db
+
+import (
+	"Measurely/types"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The monitors are read along with the last event of their metric
+const selectMetricMonitors = `
+	SELECT mm.*, m.last_event_timestamp
+	FROM metric_monitors mm
+	JOIN metrics m ON m.id = mm.metric_id`
+
+func (db *DB) CreateMetricMonitor(monitor types.MetricMonitor) (types.MetricMonitor, error) {
+	var created types.MetricMonitor
+	err := db.Conn.Get(&created, `
+		WITH mm AS (
+			INSERT INTO metric_monitors (project_id, metric_id, user_id, interval_minutes, notify_email, webhook_url, webhook_secret, enabled)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			RETURNING *
+		)
+		SELECT mm.*, m.last_event_timestamp FROM mm JOIN metrics m ON m.id = mm.metric_id`,
+		monitor.ProjectId, monitor.MetricId, monitor.UserId, monitor.IntervalMinutes, monitor.NotifyEmail,
+		monitor.WebhookUrl, monitor.WebhookSecret, monitor.Enabled,
+	)
+	return created, err
+}
+
+func (db *DB) GetMetricMonitors(projectId uuid.UUID) ([]types.MetricMonitor, error) {
+	var monitors []types.MetricMonitor
+	err := db.Conn.Select(&monitors, selectMetricMonitors+" WHERE mm.project_id = $1 ORDER BY mm.created", projectId)
+	return monitors, err
+}
+
+func (db *DB) GetMetricMonitor(id uuid.UUID, projectId uuid.UUID) (types.MetricMonitor, error) {
+	var monitor types.MetricMonitor
+	err := db.Conn.Get(&monitor, selectMetricMonitors+" WHERE mm.id = $1 AND mm.project_id = $2", id, projectId)
+	return monitor, err
+}
+
+// UpdateMetricMonitor updates the settings of a monitor. A monitor that changed starts over from the
+// ok state, and counts its interval from now when the metric has been silent for longer.
+func (db *DB) UpdateMetricMonitor(monitor types.MetricMonitor) error {
+	_, err := db.Conn.Exec(`
+		UPDATE metric_monitors
+		SET interval_minutes = $1, notify_email = $2, webhook_url = $3, enabled = $4, state = $5,
+			active_since = timezone ('UTC', CURRENT_TIMESTAMP), silent_since = NULL
+		WHERE id = $6 AND project_id = $7`,
+		monitor.IntervalMinutes, monitor.NotifyEmail, monitor.WebhookUrl, monitor.Enabled, types.MONITOR_OK,
+		monitor.Id, monitor.ProjectId,
+	)
+	return err
+}
+
+func (db *DB) DeleteMetricMonitor(id uuid.UUID, projectId uuid.UUID) error {
+	_, err := db.Conn.Exec("DELETE FROM metric_monitors WHERE id = $1 AND project_id = $2", id, projectId)
+	return err
+}
+
+// GetEnabledMetricMonitors returns every enabled monitor, ordered by project
+func (db *DB) GetEnabledMetricMonitors() ([]types.MetricMonitor, error) {
+	var monitors []types.MetricMonitor
+	err := db.Conn.Select(&monitors, selectMetricMonitors+" WHERE mm.enabled ORDER BY mm.project_id")
+	return monitors, err
+}
+
+// UpdateMetricMonitorState records the outcome of a check. The silent date is left empty while the metric receives events.
+func (db *DB) UpdateMetricMonitorState(id uuid.UUID, state string, silentSince *time.Time, checked time.Time) error {
+	_, err := db.Conn.Exec(`
+		UPDATE metric_monitors SET state = $1, silent_since = $2, last_checked = $3
+		WHERE id = $4`,
+		state, silentSince, checked, id,
+	)
+	return err
+}
@@ -80,6 +80,23 @@ func (db *DB) GetProjectByApi(key string) (types.Project, error) {
 	return project, err
 }
 
+func (db *DB) GetProjectById(id uuid.UUID) (types.Project, error) {
+	var tmp tmpProject
+	err := db.Conn.Get(&tmp, "SELECT * FROM projects WHERE id = $1", id)
+	if err != nil {
+		return types.Project{}, err
+	}
+
+	var units []types.Unit
+	if err := json.Unmarshal(tmp.Units, &units); err != nil {
+		return types.Project{}, err
+	}
+
+	project := tmp.Project
+	project.Units = units
+	return project, nil
+}
+
 func (db *DB) GetProjects(userId uuid.UUID) ([]types.Project, error) {
 	var projects []types.Project
 	var tmp []tmpProject
@@ -170,6 +187,14 @@ func (db *DB) UpdateProjectPlan(id uuid.UUID, plan, stripeSubscriptionId string,
 	return err
 }
 
+func (db *DB) UpdateProjectCalendar(id uuid.UUID, timezone string, weekStart int, fiscalYearStartMonth int) error {
+	_, err := db.Conn.Exec(
+		"UPDATE projects SET timezone = $1, week_start = $2, fiscal_year_start_month = $3 WHERE id = $4",
+		timezone, weekStart, fiscalYearStartMonth, id,
+	)
+	return err
+}
+
 func (db *DB) ResetProjectsMonthlyEventCount(user_id uuid.UUID) error {
 	_, err := db.Conn.Exec("UPDATE projects SET monthly_event_count = 0 WHERE user_id = $1", user_id)
 	return err
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"Measurely/types"
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Postgres limits NOTIFY payloads to 8000 bytes
+const maxNotifyPayload = 7900
+
+const (
+	liveEventsChannel = "measurely_live_events"
+	liveWatchChannel  = "measurely_live_watch"
+)
+
+// A project is watched for liveWatchTTL after a replica announced an open stream for it. The announces
+// of a project are sent at most once per liveWatchRepeat by each replica.
+const (
+	liveWatchTTL    = 45 * time.Second
+	liveWatchRepeat = 5 * time.Second
+)
+
+// NotifyPubSub shares flushed events between replicas through Postgres LISTEN/NOTIFY. Only the events
+// of the projects with an open stream on some replica are shared.
+type NotifyPubSub struct {
+	db        *DB
+	url       string
+	mu        sync.Mutex
+	handlers  []func([]types.LiveEvent)
+	watched   map[uuid.UUID]time.Time
+	announced map[uuid.UUID]time.Time
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// NewNotifyPubSub creates a pub/sub listening on a dedicated connection to the given database
+func NewNotifyPubSub(db *DB, url string) *NotifyPubSub {
+	ctx, cancel := context.WithCancel(context.Background())
+	ps := &NotifyPubSub{
+		db:        db,
+		url:       url,
+		watched:   make(map[uuid.UUID]time.Time),
+		announced: make(map[uuid.UUID]time.Time),
+		cancel:    cancel,
+	}
+
+	ps.wg.Add(1)
+	go ps.listen(ctx)
+	return ps
+}
+
+// Watch announces to every replica that the events of the project are streamed by this one. Open
+// streams must repeat the announce within liveWatchTTL.
+func (ps *NotifyPubSub) Watch(projectId uuid.UUID) error {
+	now := time.Now()
+	ps.mu.Lock()
+	if now.Sub(ps.announced[projectId]) < liveWatchRepeat {
+		ps.mu.Unlock()
+		return nil
+	}
+	ps.announced[projectId] = now
+	ps.watched[projectId] = now.Add(liveWatchTTL)
+	ps.mu.Unlock()
+
+	_, err := ps.db.Conn.Exec("SELECT pg_notify($1, $2)", liveWatchChannel, projectId.String())
+	return err
+}
+
+// isWatched reports whether a replica streams the events of the project
+func (ps *NotifyPubSub) isWatched(projectId uuid.UUID, now time.Time) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	until, exists := ps.watched[projectId]
+	if exists && now.After(until) {
+		delete(ps.watched, projectId)
+		delete(ps.announced, projectId)
+		return false
+	}
+	return exists
+}
+
+// Publish sends the events of the watched projects to every replica, splitting them to fit the NOTIFY
+// payload limit. Nothing is sent when no replica streams the projects of the events.
+func (ps *NotifyPubSub) Publish(events []types.LiveEvent) error {
+	var chunk []json.RawMessage
+	size := 2
+	now := time.Now()
+
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		payload, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		chunk = nil
+		size = 2
+		_, err = ps.db.Conn.Exec("SELECT pg_notify($1, $2)", liveEventsChannel, string(payload))
+		return err
+	}
+
+	for _, event := range events {
+		if !ps.isWatched(event.ProjectId, now) {
+			continue
+		}
+		bytes, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if len(bytes)+2 > maxNotifyPayload {
+			// Too large to be shared, only happens with an unreasonable amount of filters
+			continue
+		}
+		if size+len(bytes)+1 > maxNotifyPayload {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		chunk = append(chunk, bytes)
+		size += len(bytes) + 1
+	}
+
+	return flush()
+}
+
+// Subscribe registers a handler called with the events published by any replica
+func (ps *NotifyPubSub) Subscribe(handler func([]types.LiveEvent)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.handlers = append(ps.handlers, handler)
+}
+
+// Close stops listening for notifications
+func (ps *NotifyPubSub) Close() error {
+	ps.cancel()
+	ps.wg.Wait()
+	return nil
+}
+
+// listen keeps a LISTEN connection open, reconnecting when it drops
+func (ps *NotifyPubSub) listen(ctx context.Context) {
+	defer ps.wg.Done()
+
+	for ctx.Err() == nil {
+		if err := ps.receive(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Live events listener disconnected: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}
+}
+
+func (ps *NotifyPubSub) receive(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, ps.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+liveEventsChannel); err != nil {
+		return err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+liveWatchChannel); err != nil {
+		return err
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		if notification.Channel == liveWatchChannel {
+			if projectId, err := uuid.Parse(notification.Payload); err == nil {
+				ps.mu.Lock()
+				ps.watched[projectId] = time.Now().Add(liveWatchTTL)
+				ps.mu.Unlock()
+			}
+			continue
+		}
+
+		var events []types.LiveEvent
+		if err := json.Unmarshal([]byte(notification.Payload), &events); err != nil {
+			log.Printf("Invalid live events notification: %v", err)
+			continue
+		}
+
+		ps.mu.Lock()
+		handlers := ps.handlers
+		ps.mu.Unlock()
+		for _, handler := range handlers {
+			handler(events)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"Measurely/types"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// eventFilterList reads the filter ids of an event as a jsonb array. Events recorded without
+// filters store a null or empty list.
+const eventFilterList = `CASE WHEN filters LIKE '[%' THEN filters::jsonb ELSE '[]'::jsonb END`
+
+// bucketExpression returns the SQL expression of the start of the bucket containing the event date,
+// as a UTC timestamp. Buckets of a day or more follow the calendar of the project: they start at local
+// midnight, weeks start on the configured day and quarters and years follow the fiscal year.
+// The calendar settings are appended to args.
+func bucketExpression(granularity string, calendar types.Calendar, args *[]any) string {
+	if granularity == types.GRANULARITY_MINUTE {
+		return "date_trunc('minute', date)"
+	}
+
+	*args = append(*args, calendar.Timezone)
+	tz := fmt.Sprintf("$%d::text", len(*args))
+	local := fmt.Sprintf("((date AT TIME ZONE 'UTC') AT TIME ZONE %s)", tz)
+
+	var start string
+	switch granularity {
+	case types.GRANULARITY_HOUR:
+		// Some zones are offset by a fraction of an hour
+		return fmt.Sprintf("date_trunc('minute', date) - make_interval(mins => EXTRACT(MINUTE FROM %s)::int)", local)
+	case types.GRANULARITY_WEEK:
+		*args = append(*args, calendar.WeekStart)
+		start = fmt.Sprintf("date_trunc('day', %s) - make_interval(days => (EXTRACT(DOW FROM %s)::int - $%d::int + 7) %% 7)", local, local, len(*args))
+	case types.GRANULARITY_MONTH:
+		start = fmt.Sprintf("date_trunc('month', %s)", local)
+	case types.GRANULARITY_QUARTER, types.GRANULARITY_YEAR:
+		*args = append(*args, calendar.FiscalYearStartMonth-1)
+		shift := fmt.Sprintf("make_interval(months => $%d::int)", len(*args))
+		start = fmt.Sprintf("date_trunc('%s', %s - %s) + %s", granularity, local, shift, shift)
+	default:
+		start = fmt.Sprintf("date_trunc('day', %s)", local)
+	}
+
+	return fmt.Sprintf("((%s) AT TIME ZONE %s) AT TIME ZONE 'UTC'", start, tz)
+}
+
+// GetBucketAggregates computes the partial aggregates of the events of the given metrics recorded
+// in [start, end), grouped by metric and by bucket of the given granularity. When filterId is set,
+// only the events tagged with that filter are aggregated.
+func (db *DB) GetBucketAggregates(metricIds []uuid.UUID, start time.Time, end time.Time, granularity string, calendar types.Calendar, filterId uuid.UUID) ([]types.BucketAggregate, error) {
+	args := []any{pq.Array(metricIds), start, end}
+	bucket := bucketExpression(granularity, calendar, &args)
+
+	query := fmt.Sprintf(`
+		SELECT metric_id,
+			%s AS bucket,
+			COUNT(*) AS count,
+			COALESCE(SUM(value_pos), 0) AS sum_pos,
+			COALESCE(SUM(value_neg), 0) AS sum_neg,
+			MIN(value_pos::bigint - value_neg::bigint) AS min_value,
+			MAX(value_pos::bigint - value_neg::bigint) AS max_value
+		FROM metric_events
+		WHERE metric_id = ANY($1::uuid[]) AND date >= $2 AND date < $3`, bucket)
+
+	if filterId != uuid.Nil {
+		args = append(args, filterId.String())
+		query += fmt.Sprintf(` AND %s @> jsonb_build_array($%d::text)`, eventFilterList, len(args))
+	}
+
+	query += `
+		GROUP BY metric_id, bucket
+		ORDER BY bucket ASC`
+
+	var aggregates []types.BucketAggregate
+	err := db.Conn.Select(&aggregates, query, args...)
+	return aggregates, err
+}
+
+// GetGroupedBucketAggregates computes the partial aggregates of the events of a metric recorded in
+// [start, end), grouped by bucket and by the filter matched in each category. Each entry of
+// categories lists the filter ids of one category; events without a filter in a category get an
+// empty group key part.
+func (db *DB) GetGroupedBucketAggregates(metricId uuid.UUID, start time.Time, end time.Time, granularity string, calendar types.Calendar, filterId uuid.UUID, categories [][]string) ([]types.GroupedBucketAggregate, error) {
+	args := []any{metricId, start, end}
+	bucket := bucketExpression(granularity, calendar, &args)
+
+	groupKey := make([]string, len(categories))
+	for i, filterIds := range categories {
+		args = append(args, pq.Array(filterIds))
+		groupKey[i] = fmt.Sprintf(`COALESCE((
+			SELECT filter_id FROM jsonb_array_elements_text(%s) AS filter_id
+			WHERE filter_id = ANY($%d::text[]) LIMIT 1), '')`, eventFilterList, len(args))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT metric_id,
+			%s AS bucket,
+			%s AS group_key,
+			COUNT(*) AS count,
+			COALESCE(SUM(value_pos), 0) AS sum_pos,
+			COALESCE(SUM(value_neg), 0) AS sum_neg,
+			MIN(value_pos::bigint - value_neg::bigint) AS min_value,
+			MAX(value_pos::bigint - value_neg::bigint) AS max_value
+		FROM metric_events
+		WHERE metric_id = $1 AND date >= $2 AND date < $3`, bucket, strings.Join(groupKey, " || ',' || "))
+
+	if filterId != uuid.Nil {
+		args = append(args, filterId.String())
+		query += fmt.Sprintf(` AND %s @> jsonb_build_array($%d::text)`, eventFilterList, len(args))
+	}
+
+	query += `
+		GROUP BY metric_id, bucket, group_key
+		ORDER BY bucket ASC`
+
+	var aggregates []types.GroupedBucketAggregate
+	err := db.Conn.Select(&aggregates, query, args...)
+	return aggregates, err
+}
+
+// GetFilterAggregates computes the partial aggregates of the events of a metric recorded in
+// [start, end), for every event under the nil filter id and for each filter
+func (db *DB) GetFilterAggregates(metricId uuid.UUID, start time.Time, end time.Time) ([]types.FilterAggregate, error) {
+	var aggregates []types.FilterAggregate
+	err := db.Conn.Select(&aggregates, fmt.Sprintf(`
+		SELECT '00000000-0000-0000-0000-000000000000'::uuid AS filter_id,
+			COUNT(*) AS count,
+			COALESCE(SUM(value_pos), 0) AS sum_pos,
+			COALESCE(SUM(value_neg), 0) AS sum_neg,
+			COALESCE(MIN(value_pos::bigint - value_neg::bigint), 0) AS min_value,
+			COALESCE(MAX(value_pos::bigint - value_neg::bigint), 0) AS max_value
+		FROM metric_events
+		WHERE metric_id = $1 AND date >= $2 AND date < $3
+		UNION ALL
+		SELECT filter_id::uuid AS filter_id,
+			COUNT(*) AS count,
+			COALESCE(SUM(value_pos), 0) AS sum_pos,
+			COALESCE(SUM(value_neg), 0) AS sum_neg,
+			MIN(value_pos::bigint - value_neg::bigint) AS min_value,
+			MAX(value_pos::bigint - value_neg::bigint) AS max_value
+		FROM metric_events
+		CROSS JOIN LATERAL jsonb_array_elements_text(%s) AS filter_id
+		WHERE metric_id = $1 AND date >= $2 AND date < $3
+		GROUP BY filter_id`, eventFilterList),
+		metricId, start, end,
+	)
+	return aggregates, err
+}
+
+// GetImportedEventCounts returns the number of imported events of the metrics for each UTC day
+// between start and end. Imported events do not count against the monthly quota.
+func (db *DB) GetImportedEventCounts(metricIds []uuid.UUID, start time.Time, end time.Time) (map[time.Time]int64, error) {
+	var rows []struct {
+		Day   time.Time `db:"day"`
+		Count int64     `db:"count"`
+	}
+	err := db.Conn.Select(&rows, `
+		SELECT date_trunc('day', date) AS day, COUNT(*) AS count
+		FROM metric_events
+		WHERE import_id IS NOT NULL AND metric_id = ANY($1::uuid[]) AND date >= $2 AND date < $3
+		GROUP BY day`, pq.Array(metricIds), start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[time.Time]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Day.UTC()] = row.Count
+	}
+	return counts, nil
+}
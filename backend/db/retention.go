@@ -0,0 +1,79 @@
+package db
+
+import (
+	"Measurely/types"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (db *DB) GetRetentionProjects() ([]types.Project, error) {
+	var projects []types.Project
+	err := db.Conn.Select(&projects, `
+		SELECT id, current_plan, retention_days, grace_retention_days, grace_until
+		FROM projects`)
+	return projects, err
+}
+
+func (db *DB) UpdateProjectRetention(id uuid.UUID, retentionDays int) error {
+	_, err := db.Conn.Exec("UPDATE projects SET retention_days = $1 WHERE id = $2", retentionDays, id)
+	return err
+}
+
+func (db *DB) UpdateProjectRetentionGrace(id uuid.UUID, graceRetentionDays int, graceUntil time.Time) error {
+	_, err := db.Conn.Exec(
+		"UPDATE projects SET grace_retention_days = $1, grace_until = $2 WHERE id = $3",
+		graceRetentionDays, graceUntil, id,
+	)
+	return err
+}
+
+// DeleteExpiredEvents deletes at most limit events of the project recorded before the cutoff
+func (db *DB) DeleteExpiredEvents(projectId uuid.UUID, cutoff time.Time, limit int) (int64, error) {
+	result, err := db.Conn.Exec(`
+		DELETE FROM metric_events
+		WHERE id IN (
+			SELECT e.id FROM metric_events e
+			JOIN metrics m ON m.id = e.metric_id
+			WHERE m.project_id = $1 AND e.date < $2
+			LIMIT $3
+		)`, projectId, cutoff, limit)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteExpiredRollups deletes the rollups of the given granularity of the project older than the cutoff
+func (db *DB) DeleteExpiredRollups(projectId uuid.UUID, granularity string, cutoff time.Time) (int64, error) {
+	result, err := db.Conn.Exec(`
+		DELETE FROM metric_rollups
+		WHERE metric_id IN (SELECT id FROM metrics WHERE project_id = $1)
+			AND granularity = $2 AND bucket < $3`, projectId, granularity, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (db *DB) CreateRetentionRun(run types.RetentionRun) error {
+	_, err := db.Conn.NamedExec(`
+		INSERT INTO retention_runs (project_id, retention_days, cutoff, events_deleted, rollups_deleted, complete, error, started, finished)
+		VALUES (:project_id, :retention_days, :cutoff, :events_deleted, :rollups_deleted, :complete, :error, :started, :finished)`, run)
+	return err
+}
+
+func (db *DB) GetRetentionRuns(projectId uuid.UUID, limit int) ([]types.RetentionRun, error) {
+	var runs []types.RetentionRun
+	err := db.Conn.Select(&runs, `
+		SELECT * FROM retention_runs
+		WHERE project_id = $1
+		ORDER BY started DESC
+		LIMIT $2`, projectId, limit)
+	return runs, err
+}
+
+func (db *DB) DeleteRetentionRunsBefore(date time.Time) error {
+	_, err := db.Conn.Exec("DELETE FROM retention_runs WHERE started < $1", date)
+	return err
+}
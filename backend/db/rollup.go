@@ -0,0 +1,200 @@
+package db
+
+import (
+	"Measurely/types"
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// RollupGranularities lists the bucket sizes maintained in the rollup table
+var RollupGranularities = []string{types.GRANULARITY_HOUR, types.GRANULARITY_DAY}
+
+// rollupKey identifies a row of the rollup table. The nil filter id aggregates every event of the bucket.
+type rollupKey struct {
+	metricId    uuid.UUID
+	granularity string
+	bucket      time.Time
+	filterId    uuid.UUID
+}
+
+// rollupBucket returns the start of the rollup bucket containing date
+func rollupBucket(date time.Time, granularity string) time.Time {
+	date = date.UTC()
+	if granularity == types.GRANULARITY_HOUR {
+		return date.Truncate(time.Hour)
+	}
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// addToRollups accumulates an event into the rollups of its metric and of each of its filters
+func addToRollups(rollups map[rollupKey]types.BucketAggregate, metricId uuid.UUID, filterIds []uuid.UUID, date time.Time, valuePos int32, valueNeg int32) {
+	value := int64(valuePos) - int64(valueNeg)
+	event := types.BucketAggregate{
+		MetricId: metricId,
+		Count:    1,
+		SumPos:   int64(valuePos),
+		SumNeg:   int64(valueNeg),
+		MinValue: value,
+		MaxValue: value,
+	}
+
+	for _, granularity := range RollupGranularities {
+		bucket := rollupBucket(date, granularity)
+		for _, filterId := range append([]uuid.UUID{uuid.Nil}, filterIds...) {
+			key := rollupKey{metricId: metricId, granularity: granularity, bucket: bucket, filterId: filterId}
+			rollup, exists := rollups[key]
+			if !exists {
+				event.Bucket = bucket
+				rollups[key] = event
+				continue
+			}
+
+			rollup.Count += event.Count
+			rollup.SumPos += event.SumPos
+			rollup.SumNeg += event.SumNeg
+			rollup.MinValue = min(rollup.MinValue, event.MinValue)
+			rollup.MaxValue = max(rollup.MaxValue, event.MaxValue)
+			rollups[key] = rollup
+		}
+	}
+}
+
+// upsertRollups merges the accumulated rollups into the rollup table. Rows are written in a
+// stable order so that concurrent batches lock them in the same order.
+func upsertRollups(tx *sqlx.Tx, rollups map[rollupKey]types.BucketAggregate) error {
+	if len(rollups) == 0 {
+		return nil
+	}
+
+	keys := make([]rollupKey, 0, len(rollups))
+	for key := range rollups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.metricId != b.metricId {
+			return bytes.Compare(a.metricId[:], b.metricId[:]) < 0
+		}
+		if a.granularity != b.granularity {
+			return a.granularity < b.granularity
+		}
+		if a.filterId != b.filterId {
+			return bytes.Compare(a.filterId[:], b.filterId[:]) < 0
+		}
+		return a.bucket.Before(b.bucket)
+	})
+
+	stmt, err := tx.Preparex(`
+		INSERT INTO metric_rollups (metric_id, granularity, bucket, filter_id, count, sum_pos, sum_neg, min_value, max_value)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (metric_id, granularity, filter_id, bucket) DO UPDATE
+		SET count = metric_rollups.count + EXCLUDED.count,
+			sum_pos = metric_rollups.sum_pos + EXCLUDED.sum_pos,
+			sum_neg = metric_rollups.sum_neg + EXCLUDED.sum_neg,
+			min_value = LEAST(metric_rollups.min_value, EXCLUDED.min_value),
+			max_value = GREATEST(metric_rollups.max_value, EXCLUDED.max_value)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, key := range keys {
+		rollup := rollups[key]
+		_, err := stmt.Exec(
+			key.metricId, key.granularity, key.bucket, key.filterId,
+			rollup.Count, rollup.SumPos, rollup.SumNeg, rollup.MinValue, rollup.MaxValue,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetRollupAggregates returns the rollups of the given granularity for the buckets starting in [start, end).
+// When filterId is set, the rollups of that filter are returned instead of the rollups of every event.
+func (db *DB) GetRollupAggregates(metricIds []uuid.UUID, granularity string, start time.Time, end time.Time, filterId uuid.UUID) ([]types.BucketAggregate, error) {
+	var aggregates []types.BucketAggregate
+	err := db.Conn.Select(&aggregates, `
+		SELECT metric_id, bucket, count, sum_pos, sum_neg, min_value, max_value
+		FROM metric_rollups
+		WHERE metric_id = ANY($1::uuid[]) AND granularity = $2 AND filter_id = $3
+			AND bucket >= $4 AND bucket < $5
+		ORDER BY bucket ASC`,
+		pq.Array(metricIds), granularity, filterId, start, end,
+	)
+	return aggregates, err
+}
+
+// GetRollupFilterAggregates sums the rollups of the given granularity of a metric for the buckets
+// starting in [start, end), for every event under the nil filter id and for each filter
+func (db *DB) GetRollupFilterAggregates(metricId uuid.UUID, granularity string, start time.Time, end time.Time) ([]types.FilterAggregate, error) {
+	var aggregates []types.FilterAggregate
+	err := db.Conn.Select(&aggregates, `
+		SELECT filter_id,
+			SUM(count)::bigint AS count,
+			SUM(sum_pos)::bigint AS sum_pos,
+			SUM(sum_neg)::bigint AS sum_neg,
+			MIN(min_value) AS min_value,
+			MAX(max_value) AS max_value
+		FROM metric_rollups
+		WHERE metric_id = $1 AND granularity = $2 AND bucket >= $3 AND bucket < $4
+		GROUP BY filter_id`,
+		metricId, granularity, start, end,
+	)
+	return aggregates, err
+}
+
+// rebuildRollups recomputes the rollups of the metrics from their events
+func rebuildRollups(ex sqlx.Execer, metricIds []uuid.UUID) error {
+	if _, err := ex.Exec("DELETE FROM metric_rollups WHERE metric_id = ANY($1::uuid[])", pq.Array(metricIds)); err != nil {
+		return err
+	}
+
+	_, err := ex.Exec(`
+		INSERT INTO metric_rollups (metric_id, granularity, bucket, filter_id, count, sum_pos, sum_neg, min_value, max_value)
+		SELECT metric_id, granularity.name, date_trunc(granularity.name, date), $2::uuid,
+			COUNT(*), SUM(value_pos), SUM(value_neg),
+			MIN(value_pos::bigint - value_neg::bigint), MAX(value_pos::bigint - value_neg::bigint)
+		FROM metric_events
+		CROSS JOIN (VALUES ('hour'), ('day')) AS granularity (name)
+		WHERE metric_id = ANY($1::uuid[])
+		GROUP BY metric_id, granularity.name, date_trunc(granularity.name, date)`, pq.Array(metricIds), uuid.Nil)
+	if err != nil {
+		return err
+	}
+
+	_, err = ex.Exec(`
+		INSERT INTO metric_rollups (metric_id, granularity, bucket, filter_id, count, sum_pos, sum_neg, min_value, max_value)
+		SELECT metric_id, granularity.name, date_trunc(granularity.name, date), filter_id::uuid,
+			COUNT(*), SUM(value_pos), SUM(value_neg),
+			MIN(value_pos::bigint - value_neg::bigint), MAX(value_pos::bigint - value_neg::bigint)
+		FROM metric_events
+		CROSS JOIN LATERAL jsonb_array_elements_text(`+eventFilterList+`) AS filter_id
+		CROSS JOIN (VALUES ('hour'), ('day')) AS granularity (name)
+		WHERE metric_id = ANY($1::uuid[])
+		GROUP BY metric_id, granularity.name, date_trunc(granularity.name, date), filter_id`, pq.Array(metricIds))
+	return err
+}
+
+// RebuildRollups recomputes the rollups of the metrics from their events, after events were
+// written outside of the batch manager
+func (db *DB) RebuildRollups(metricIds []uuid.UUID) error {
+	tx, err := db.Conn.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if err := rebuildRollups(tx, metricIds); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
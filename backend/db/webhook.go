@@ -0,0 +1,228 @@
+package db
+
+import (
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type tmpWebhookEndpoint struct {
+	types.WebhookEndpoint
+	Events []byte `db:"events"`
+}
+
+func (tmp tmpWebhookEndpoint) decode() (types.WebhookEndpoint, error) {
+	endpoint := tmp.WebhookEndpoint
+	if err := json.Unmarshal(tmp.Events, &endpoint.Events); err != nil {
+		return types.WebhookEndpoint{}, err
+	}
+	return endpoint, nil
+}
+
+type tmpWebhookDelivery struct {
+	types.WebhookDelivery
+	Payload []byte `db:"payload"`
+}
+
+func decodeWebhookDeliveries(tmp []tmpWebhookDelivery) []types.WebhookDelivery {
+	deliveries := make([]types.WebhookDelivery, len(tmp))
+	for i, row := range tmp {
+		deliveries[i] = row.WebhookDelivery
+		deliveries[i].Payload = row.Payload
+	}
+	return deliveries
+}
+
+func (db *DB) CreateWebhookEndpoint(endpoint types.WebhookEndpoint) (types.WebhookEndpoint, error) {
+	events, err := json.Marshal(endpoint.Events)
+	if err != nil {
+		return types.WebhookEndpoint{}, err
+	}
+
+	var tmp tmpWebhookEndpoint
+	err = db.Conn.Get(&tmp, `
+		INSERT INTO webhook_endpoints (project_id, user_id, url, secret, events, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING *`,
+		endpoint.ProjectId, endpoint.UserId, endpoint.Url, endpoint.Secret, events, endpoint.Enabled,
+	)
+	if err != nil {
+		return types.WebhookEndpoint{}, err
+	}
+	return tmp.decode()
+}
+
+func (db *DB) GetWebhookEndpoints(projectId uuid.UUID) ([]types.WebhookEndpoint, error) {
+	var tmp []tmpWebhookEndpoint
+	err := db.Conn.Select(&tmp, "SELECT * FROM webhook_endpoints WHERE project_id = $1 ORDER BY created", projectId)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]types.WebhookEndpoint, len(tmp))
+	for i, row := range tmp {
+		if endpoints[i], err = row.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return endpoints, nil
+}
+
+func (db *DB) GetWebhookEndpoint(id uuid.UUID, projectId uuid.UUID) (types.WebhookEndpoint, error) {
+	var tmp tmpWebhookEndpoint
+	err := db.Conn.Get(&tmp, "SELECT * FROM webhook_endpoints WHERE id = $1 AND project_id = $2", id, projectId)
+	if err != nil {
+		return types.WebhookEndpoint{}, err
+	}
+	return tmp.decode()
+}
+
+func (db *DB) GetWebhookEndpointById(id uuid.UUID) (types.WebhookEndpoint, error) {
+	var tmp tmpWebhookEndpoint
+	err := db.Conn.Get(&tmp, "SELECT * FROM webhook_endpoints WHERE id = $1", id)
+	if err != nil {
+		return types.WebhookEndpoint{}, err
+	}
+	return tmp.decode()
+}
+
+func (db *DB) UpdateWebhookEndpoint(endpoint types.WebhookEndpoint) error {
+	events, err := json.Marshal(endpoint.Events)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Conn.Exec(`
+		UPDATE webhook_endpoints SET url = $1, events = $2, enabled = $3
+		WHERE id = $4 AND project_id = $5`,
+		endpoint.Url, events, endpoint.Enabled, endpoint.Id, endpoint.ProjectId,
+	)
+	return err
+}
+
+func (db *DB) DeleteWebhookEndpoint(id uuid.UUID, projectId uuid.UUID) error {
+	_, err := db.Conn.Exec("DELETE FROM webhook_endpoints WHERE id = $1 AND project_id = $2", id, projectId)
+	return err
+}
+
+// CreateWebhookDeliveries queues an event for every enabled endpoint of the project subscribed to it,
+// and returns the number of deliveries created
+func (db *DB) CreateWebhookDeliveries(projectId uuid.UUID, eventId uuid.UUID, event string, payload []byte) (int64, error) {
+	result, err := db.Conn.Exec(`
+		INSERT INTO webhook_deliveries (endpoint_id, project_id, event_id, event, payload, next_attempt)
+		SELECT id, project_id, $2, $3, $4, timezone('UTC', CURRENT_TIMESTAMP)
+		FROM webhook_endpoints
+		WHERE project_id = $1 AND enabled AND events @> jsonb_build_array($3::text)`,
+		projectId, eventId, event, payload,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// CreateSourceWebhookDelivery queues an event for the webhook of an alert rule, an anomaly subscription or a monitor
+func (db *DB) CreateSourceWebhookDelivery(projectId uuid.UUID, source string, sourceId uuid.UUID, eventId uuid.UUID, event string, payload []byte) error {
+	_, err := db.Conn.Exec(`
+		INSERT INTO webhook_deliveries (source, source_id, project_id, event_id, event, payload, next_attempt)
+		VALUES ($1, $2, $3, $4, $5, $6, timezone('UTC', CURRENT_TIMESTAMP))`,
+		source, sourceId, projectId, eventId, event, payload,
+	)
+	return err
+}
+
+// GetSourceWebhook returns the url and the secret of the webhook of an alert rule, an anomaly subscription or a monitor
+func (db *DB) GetSourceWebhook(source string, sourceId uuid.UUID) (string, string, error) {
+	var table string
+	switch source {
+	case types.DELIVERY_SOURCE_ALERT:
+		table = "alert_rules"
+	case types.DELIVERY_SOURCE_ANOMALY:
+		table = "anomaly_subscriptions"
+	case types.DELIVERY_SOURCE_MONITOR:
+		table = "metric_monitors"
+	default:
+		return "", "", sql.ErrNoRows
+	}
+
+	var webhook struct {
+		Url    string `db:"webhook_url"`
+		Secret string `db:"webhook_secret"`
+	}
+	err := db.Conn.Get(&webhook, "SELECT webhook_url, webhook_secret FROM "+table+" WHERE id = $1", sourceId)
+	return webhook.Url, webhook.Secret, err
+}
+
+// ClaimWebhookDeliveries returns up to limit pending deliveries that are due, counting a new attempt
+// for each. The next attempt of a claimed delivery is pushed to leaseUntil, so that a delivery left
+// behind by an instance that stopped is attempted again once the lease expires.
+func (db *DB) ClaimWebhookDeliveries(limit int, leaseUntil time.Time) ([]types.WebhookDelivery, error) {
+	var tmp []tmpWebhookDelivery
+	err := db.Conn.Select(&tmp, `
+		UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt = $1
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $2 AND next_attempt <= timezone('UTC', CURRENT_TIMESTAMP)
+			ORDER BY next_attempt
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING *`, leaseUntil, types.DELIVERY_PENDING, limit)
+	if err != nil {
+		return nil, err
+	}
+	return decodeWebhookDeliveries(tmp), nil
+}
+
+// UpdateWebhookDelivery records the outcome of an attempt. The next attempt is left empty once the
+// delivery succeeded or failed for good.
+func (db *DB) UpdateWebhookDelivery(delivery types.WebhookDelivery) error {
+	_, err := db.Conn.Exec(`
+		UPDATE webhook_deliveries
+		SET status = $1, response_status = $2, error = $3, next_attempt = $4, delivered = $5
+		WHERE id = $6`,
+		delivery.Status, delivery.ResponseStatus, delivery.Error, delivery.NextAttempt, delivery.Delivered, delivery.Id,
+	)
+	return err
+}
+
+// GetWebhookDeliveries returns the latest deliveries of a project, restricted to an endpoint when endpointId is set
+func (db *DB) GetWebhookDeliveries(projectId uuid.UUID, endpointId uuid.UUID, limit int) ([]types.WebhookDelivery, error) {
+	args := []any{projectId, limit}
+	query := "SELECT * FROM webhook_deliveries WHERE project_id = $1"
+	if endpointId != uuid.Nil {
+		args = append(args, endpointId)
+		query += " AND endpoint_id = $3"
+	}
+	query += " ORDER BY created DESC LIMIT $2"
+
+	var tmp []tmpWebhookDelivery
+	if err := db.Conn.Select(&tmp, query, args...); err != nil {
+		return nil, err
+	}
+	return decodeWebhookDeliveries(tmp), nil
+}
+
+// RedeliverWebhook queues a copy of a delivery, keeping the original in the log
+func (db *DB) RedeliverWebhook(id uuid.UUID, projectId uuid.UUID) (types.WebhookDelivery, error) {
+	var tmp tmpWebhookDelivery
+	err := db.Conn.Get(&tmp, `
+		INSERT INTO webhook_deliveries (endpoint_id, source, source_id, project_id, event_id, event, payload, next_attempt)
+		SELECT endpoint_id, source, source_id, project_id, event_id, event, payload, timezone('UTC', CURRENT_TIMESTAMP)
+		FROM webhook_deliveries
+		WHERE id = $1 AND project_id = $2
+		RETURNING *`, id, projectId)
+	if err != nil {
+		return types.WebhookDelivery{}, err
+	}
+	return decodeWebhookDeliveries([]tmpWebhookDelivery{tmp})[0], nil
+}
+
+// DeleteWebhookDeliveriesBefore deletes the deliveries created before the given date that are no longer pending
+func (db *DB) DeleteWebhookDeliveriesBefore(before time.Time) error {
+	_, err := db.Conn.Exec("DELETE FROM webhook_deliveries WHERE created < $1 AND status <> $2", before, types.DELIVERY_PENDING)
+	return err
+}
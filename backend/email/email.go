@@ -3,6 +3,7 @@ package email
 import (
 	"bytes"
 	"errors"
+	htmltemplate "html/template"
 	"os"
 	"text/template"
 
@@ -21,6 +22,30 @@ type MailFields struct {
 	ButtonTitle string
 }
 
+// DigestFields holds the content of a digest email. The values are formatted by the caller.
+type DigestFields struct {
+	To          string
+	Subject     string
+	ProjectName string
+	Period      string
+	Metrics     []DigestMetric
+	Link        string
+}
+
+type DigestMetric struct {
+	Name       string
+	Value      string
+	Previous   string
+	Change     string
+	Trend      string // up, down or flat
+	TopFilters []DigestFilter
+}
+
+type DigestFilter struct {
+	Label string
+	Value string
+}
+
 func NewEmail() (*Email, error) {
 	dialer := gomail.NewDialer("smtp.gmail.com", 587, "Info@measurely.dev", os.Getenv("APP_PWD"))
 
@@ -59,3 +84,25 @@ func (e *Email) SendEmail(fields MailFields) error {
 	}
 	return nil
 }
+
+// SendDigest renders a digest with the digest template. Names are escaped, as they are set by the users.
+func (e *Email) SendDigest(fields DigestFields) error {
+	t, err := htmltemplate.ParseFiles("digest.html")
+	if err != nil {
+		return err
+	}
+
+	buffer := new(bytes.Buffer)
+
+	if err := t.Execute(buffer, fields); err != nil {
+		return err
+	}
+
+	m := gomail.NewMessage()
+	m.SetHeader("From", "Info@measurely.dev")
+	m.SetHeader("To", fields.To)
+	m.SetHeader("Subject", fields.Subject)
+	m.SetBody("text/html", buffer.String())
+
+	return e.dialer.DialAndSend(m)
+}
@@ -39,6 +39,9 @@ func (h *Handler) Start(port string) {
 		Handler: h.router,
 	}
 
+	// Live event streams never go idle on their own
+	server.RegisterOnShutdown(h.service.CloseLiveStreams)
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
@@ -78,8 +81,17 @@ func (h *Handler) setup_api() {
 		AllowCredentials: false,
 	}).Handler
 
+	readCors := cors.New(cors.Options{
+		AllowedOrigins:   []string{"*"},
+		AllowedMethods:   []string{"OPTIONS", "GET"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowCredentials: false,
+		MaxAge:           3600,
+	}).Handler
+
 	privateRouter := chi.NewRouter()
 	publicRouter := chi.NewRouter()
+	readRouter := chi.NewRouter()
 	authRouter := chi.NewRouter()
 
 	//// ROUTES THAT ARE ONLY AVAILABLE TO THE APPLICATION DOMAIN, PRIVATE CORS
@@ -124,6 +136,14 @@ func (h *Handler) setup_api() {
 	authRouter.Post("/project_image/{project_id}", h.service.UploadProjectImage)
 	authRouter.Patch("/rand_apikey", h.service.RandomizeApiKey)
 	authRouter.Patch("/project-units", h.service.UpdateProjectUnits)
+	authRouter.Get("/project_archive/{project_id}", h.service.ExportProjectArchive)
+	authRouter.Post("/project_archive", h.service.ImportProjectArchive)
+	authRouter.Get("/retention/{project_id}", h.service.GetRetention)
+	authRouter.Patch("/retention", h.service.UpdateRetention)
+	authRouter.Patch("/project_calendar", h.service.UpdateProjectCalendar)
+	authRouter.Get("/read_keys/{project_id}", h.service.GetReadKeys)
+	authRouter.Post("/read_key", h.service.CreateReadKey)
+	authRouter.Delete("/read_key", h.service.DeleteReadKey)
 
 	authRouter.Get("/blocks/{project_id}", h.service.GetBlocks)
 	authRouter.Patch("/blocks/layout", h.service.UpdateBlocks)
@@ -135,7 +155,54 @@ func (h *Handler) setup_api() {
 
 	authRouter.Get("/metrics", h.service.GetMetrics)
 	authRouter.Get("/events", h.service.GetMetricEvents)
-	authRouter.Get("/daily_variation", h.service.GetDailyVariation)
+	authRouter.Get("/query", h.service.QueryMetricEvents)
+	authRouter.Get("/compare", h.service.CompareMetricPeriods)
+	authRouter.Get("/export", h.service.ExportMetricEvents)
+	authRouter.Get("/exports/{project_id}", h.service.GetExports)
+	authRouter.Get("/imports/{project_id}", h.service.GetEventImports)
+	authRouter.Post("/imports", h.service.CreateEventImport)
+	authRouter.Post("/imports/commit", h.service.CommitEventImport)
+	authRouter.Delete("/imports", h.service.UndoEventImport)
+	authRouter.Get("/alerts/{project_id}", h.service.GetAlertRules)
+	authRouter.Get("/alert_events/{project_id}", h.service.GetAlertEvents)
+	authRouter.Post("/alert", h.service.CreateAlertRule)
+	authRouter.Patch("/alert", h.service.UpdateAlertRule)
+	authRouter.Delete("/alert", h.service.DeleteAlertRule)
+	authRouter.Get("/anomalies/{project_id}", h.service.GetAnomalies)
+	authRouter.Get("/anomaly_subscriptions/{project_id}", h.service.GetAnomalySubscriptions)
+	authRouter.Post("/anomaly_subscription", h.service.CreateAnomalySubscription)
+	authRouter.Delete("/anomaly_subscription", h.service.DeleteAnomalySubscription)
+	authRouter.Get("/monitors/{project_id}", h.service.GetMetricMonitors)
+	authRouter.Post("/monitor", h.service.CreateMetricMonitor)
+	authRouter.Patch("/monitor", h.service.UpdateMetricMonitor)
+	authRouter.Delete("/monitor", h.service.DeleteMetricMonitor)
+	authRouter.Get("/digest/{project_id}", h.service.GetDigestSubscription)
+	authRouter.Post("/digest", h.service.UpdateDigestSubscription)
+	authRouter.Delete("/digest", h.service.DeleteDigestSubscription)
+	authRouter.Get("/goals/{project_id}", h.service.GetMetricGoals)
+	authRouter.Get("/goal_progress", h.service.GetGoalProgress)
+	authRouter.Post("/goal", h.service.CreateMetricGoal)
+	authRouter.Patch("/goal", h.service.UpdateMetricGoal)
+	authRouter.Delete("/goal", h.service.DeleteMetricGoal)
+	authRouter.Get("/annotations", h.service.GetAnnotations)
+	authRouter.Post("/annotation", h.service.CreateAnnotation)
+	authRouter.Patch("/annotation", h.service.UpdateAnnotation)
+	authRouter.Delete("/annotation", h.service.DeleteAnnotation)
+	authRouter.Get("/funnels/{project_id}", h.service.GetFunnels)
+	authRouter.Get("/funnel_query", h.service.QueryFunnel)
+	authRouter.Post("/funnel", h.service.CreateFunnel)
+	authRouter.Patch("/funnel", h.service.UpdateFunnel)
+	authRouter.Delete("/funnel", h.service.DeleteFunnel)
+	authRouter.Get("/cohorts", h.service.GetCohortRetention)
+	authRouter.Get("/webhook_endpoints/{project_id}", h.service.GetWebhookEndpoints)
+	authRouter.Post("/webhook_endpoint", h.service.CreateWebhookEndpoint)
+	authRouter.Patch("/webhook_endpoint", h.service.UpdateWebhookEndpoint)
+	authRouter.Delete("/webhook_endpoint", h.service.DeleteWebhookEndpoint)
+	authRouter.Get("/webhook_deliveries/{project_id}", h.service.GetWebhookDeliveries)
+	authRouter.Post("/webhook_delivery/redeliver", h.service.RedeliverWebhook)
+	authRouter.Get("/forecast", h.service.GetMetricForecast)
+	authRouter.Get("/forecast/quota", h.service.GetQuotaForecast)
+	authRouter.Get("/live/{project_id}", h.service.LiveEvents)
 	authRouter.Post("/metric", h.service.CreateMetric)
 	authRouter.Patch("/metric", h.service.UpdateMetric)
 	authRouter.Delete("/metric", h.service.DeleteMetric)
@@ -146,17 +213,35 @@ func (h *Handler) setup_api() {
 	authRouter.Post("/filter", h.service.CreateFilter)
 	authRouter.Patch("/metric-unit", h.service.UpdateMetricUnit)
 
+	authRouter.Get("/dead_letters/{project_id}", h.service.ListDeadLetters)
+	authRouter.Get("/dead_letters/{project_id}/{dead_letter_id}", h.service.GetDeadLetter)
+	authRouter.Post("/dead_letters/replay", h.service.ReplayDeadLetters)
+	authRouter.Delete("/dead_letters", h.service.PurgeDeadLetters)
+
 	authRouter.Get("/billing", h.service.ManageBilling)
 	authRouter.Post("/subscribe", h.service.Subscribe)
 	////
 
 	// PUBLIC API ENDPOINT
 	publicRouter.Use(publicCors)
+	publicRouter.Post("/v1/annotations/create", h.service.CreateAnnotationV1)
 	publicRouter.Post("/v1/{metric_identifier}", h.service.CreateMetricEventV1)
+	publicRouter.Post("/v1/{metric_identifier}/validate", h.service.ValidateMetricEventV1)
+
+	////
 
+	// PUBLIC READ API, AUTHENTICATED BY READ KEYS
+	readRouter.Use(readCors)
+	readRouter.Use(h.service.ReadApiKeyMiddleware)
+	readRouter.Get("/metrics", h.service.ReadMetricsV1)
+	readRouter.Get("/metrics/{metric}", h.service.ReadMetricV1)
+	readRouter.Get("/metrics/{metric}/total", h.service.ReadMetricTotalV1)
+	readRouter.Get("/metrics/{metric}/series", h.service.ReadMetricSeriesV1)
+	readRouter.Get("/annotations", h.service.ReadAnnotationsV1)
 	////
 
 	privateRouter.Mount("/", authRouter)
 	h.router.Mount("/", privateRouter)
+	h.router.Mount("/event/v1/read", readRouter)
 	h.router.Mount("/event", publicRouter)
 }
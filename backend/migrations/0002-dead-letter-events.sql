@@ -0,0 +1,17 @@
+-- Create Dead letter events table
+CREATE TABLE IF NOT EXISTS dead_letter_events (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    project_id UUID NOT NULL,
+    metric_identifier TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    payload_hash TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    message TEXT NOT NULL DEFAULT '',
+    occurrences INT NOT NULL DEFAULT 1,
+    created TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    last_seen TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    UNIQUE (project_id, metric_identifier, reason, payload_hash),
+    FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_deadletterevents_projectid_lastseen ON dead_letter_events (project_id, last_seen);
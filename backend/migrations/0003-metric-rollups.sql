@@ -0,0 +1,33 @@
+-- Create Metric rollups table
+-- Rows with the nil filter id aggregate every event of the bucket
+CREATE TABLE IF NOT EXISTS metric_rollups (
+    metric_id UUID NOT NULL,
+    granularity TEXT NOT NULL,
+    bucket TIMESTAMP NOT NULL,
+    filter_id UUID NOT NULL DEFAULT '00000000-0000-0000-0000-000000000000',
+    count BIGINT NOT NULL DEFAULT 0,
+    sum_pos BIGINT NOT NULL DEFAULT 0,
+    sum_neg BIGINT NOT NULL DEFAULT 0,
+    min_value BIGINT NOT NULL DEFAULT 0,
+    max_value BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (metric_id, granularity, filter_id, bucket),
+    FOREIGN KEY (metric_id) REFERENCES metrics (id) ON DELETE CASCADE
+);
+
+-- Backfill the rollups from the existing events
+INSERT INTO metric_rollups (metric_id, granularity, bucket, filter_id, count, sum_pos, sum_neg, min_value, max_value)
+SELECT metric_id, granularity.name, date_trunc(granularity.name, date), '00000000-0000-0000-0000-000000000000',
+    COUNT(*), SUM(value_pos), SUM(value_neg),
+    MIN(value_pos::bigint - value_neg::bigint), MAX(value_pos::bigint - value_neg::bigint)
+FROM metric_events
+CROSS JOIN (VALUES ('hour'), ('day')) AS granularity (name)
+GROUP BY metric_id, granularity.name, date_trunc(granularity.name, date);
+
+INSERT INTO metric_rollups (metric_id, granularity, bucket, filter_id, count, sum_pos, sum_neg, min_value, max_value)
+SELECT metric_id, granularity.name, date_trunc(granularity.name, date), filter_id::uuid,
+    COUNT(*), SUM(value_pos), SUM(value_neg),
+    MIN(value_pos::bigint - value_neg::bigint), MAX(value_pos::bigint - value_neg::bigint)
+FROM metric_events
+CROSS JOIN LATERAL jsonb_array_elements_text(CASE WHEN filters LIKE '[%' THEN filters::jsonb ELSE '[]'::jsonb END) AS filter_id
+CROSS JOIN (VALUES ('hour'), ('day')) AS granularity (name)
+GROUP BY metric_id, granularity.name, date_trunc(granularity.name, date), filter_id;
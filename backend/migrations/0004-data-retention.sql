@@ -0,0 +1,22 @@
+-- Retention policy of the projects
+-- A retention of 0 days follows the range of the current plan
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS retention_days INT NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS grace_retention_days INT NOT NULL DEFAULT 0;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS grace_until TIMESTAMP;
+
+-- Create Retention runs table
+CREATE TABLE IF NOT EXISTS retention_runs (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    project_id UUID NOT NULL,
+    retention_days INT NOT NULL,
+    cutoff TIMESTAMP NOT NULL,
+    events_deleted BIGINT NOT NULL DEFAULT 0,
+    rollups_deleted BIGINT NOT NULL DEFAULT 0,
+    complete BOOLEAN NOT NULL DEFAULT FALSE,
+    error TEXT NOT NULL DEFAULT '',
+    started TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    finished TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_retentionruns_projectid_started ON retention_runs (project_id, started);
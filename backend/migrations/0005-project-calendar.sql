@@ -0,0 +1,5 @@
+-- Calendar settings of the projects
+-- week_start follows the numbering of the days of the week, 0 being Sunday
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT 'UTC';
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS week_start INT NOT NULL DEFAULT 1;
+ALTER TABLE projects ADD COLUMN IF NOT EXISTS fiscal_year_start_month INT NOT NULL DEFAULT 1;
@@ -0,0 +1,2 @@
+-- Keyset pagination of the raw events
+CREATE INDEX IF NOT EXISTS idx_metricevents_metricid_date_id ON metric_events (metric_id, date, id);
@@ -0,0 +1,25 @@
+-- Create Metric exports table
+-- Exports without a metric cover every metric of the project
+CREATE TABLE IF NOT EXISTS metric_exports (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    project_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    metric_id UUID,
+    format TEXT NOT NULL,
+    start_date TIMESTAMP NOT NULL,
+    end_date TIMESTAMP NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    object_key TEXT NOT NULL DEFAULT '',
+    row_count BIGINT NOT NULL DEFAULT 0,
+    size BIGINT NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    created TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    started TIMESTAMP,
+    finished TIMESTAMP,
+    FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (metric_id) REFERENCES metrics (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_metricexports_projectid_created ON metric_exports (project_id, created);
+CREATE INDEX IF NOT EXISTS idx_metricexports_status ON metric_exports (status);
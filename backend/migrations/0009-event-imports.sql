@@ -0,0 +1,31 @@
+-- Create Event imports table
+CREATE TABLE IF NOT EXISTS event_imports (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    project_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    file_name TEXT NOT NULL DEFAULT '',
+    object_key TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'previewed',
+    total_rows BIGINT NOT NULL DEFAULT 0,
+    valid_rows BIGINT NOT NULL DEFAULT 0,
+    imported_rows BIGINT NOT NULL DEFAULT 0,
+    first_event TIMESTAMP,
+    last_event TIMESTAMP,
+    metrics JSONB NOT NULL DEFAULT '{}',
+    errors JSONB NOT NULL DEFAULT '[]',
+    created TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    started TIMESTAMP,
+    finished TIMESTAMP,
+    FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_eventimports_projectid_created ON event_imports (project_id, created);
+CREATE INDEX IF NOT EXISTS idx_eventimports_status ON event_imports (status);
+
+-- Imported events keep a reference to their import so that it can be undone
+ALTER TABLE metric_events ADD COLUMN IF NOT EXISTS import_id UUID;
+CREATE INDEX IF NOT EXISTS idx_metricevents_importid ON metric_events (import_id) WHERE import_id IS NOT NULL;
+
+-- Historical events, like the events of a single batch, can share a date
+ALTER TABLE metric_events DROP CONSTRAINT IF EXISTS metric_events_metric_id_date_key;
@@ -0,0 +1,2 @@
+-- Formula metrics are computed at query time from the other metrics of their project
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS formula TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,50 @@
+-- Create Alert rules table
+-- Thresholds are expressed in the unit of the metric, or in percent for the change rules
+CREATE TABLE IF NOT EXISTS alert_rules (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    project_id UUID NOT NULL,
+    metric_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    name TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    aggregation TEXT NOT NULL DEFAULT 'sum',
+    filter_id UUID,
+    condition TEXT NOT NULL,
+    threshold DOUBLE PRECISION NOT NULL,
+    window_minutes INT NOT NULL,
+    cooldown_minutes INT NOT NULL DEFAULT 60,
+    notify_email BOOLEAN NOT NULL DEFAULT TRUE,
+    webhook_url TEXT NOT NULL DEFAULT '',
+    webhook_secret TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    state TEXT NOT NULL DEFAULT 'ok',
+    last_value DOUBLE PRECISION,
+    last_evaluated TIMESTAMP,
+    last_triggered TIMESTAMP,
+    created TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+    FOREIGN KEY (metric_id) REFERENCES metrics (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_alertrules_projectid ON alert_rules (project_id);
+CREATE INDEX IF NOT EXISTS idx_alertrules_enabled ON alert_rules (enabled, last_evaluated);
+
+-- Create Alert events table
+-- Records each time a rule triggers or resolves
+CREATE TABLE IF NOT EXISTS alert_events (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    rule_id UUID NOT NULL,
+    project_id UUID NOT NULL,
+    state TEXT NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    reference DOUBLE PRECISION,
+    threshold DOUBLE PRECISION NOT NULL,
+    webhook_status INT NOT NULL DEFAULT 0,
+    created TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    FOREIGN KEY (rule_id) REFERENCES alert_rules (id) ON DELETE CASCADE,
+    FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_alertevents_projectid_created ON alert_events (project_id, created);
+CREATE INDEX IF NOT EXISTS idx_alertevents_ruleid_created ON alert_events (rule_id, created);
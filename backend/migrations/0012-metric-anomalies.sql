@@ -0,0 +1,39 @@
+-- Create Metric anomalies table
+-- Records the hourly buckets falling outside of the seasonal band of their metric
+CREATE TABLE IF NOT EXISTS metric_anomalies (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    project_id UUID NOT NULL,
+    metric_id UUID NOT NULL,
+    granularity TEXT NOT NULL,
+    bucket TIMESTAMP NOT NULL,
+    direction TEXT NOT NULL,
+    value DOUBLE PRECISION NOT NULL,
+    expected DOUBLE PRECISION NOT NULL,
+    lower DOUBLE PRECISION NOT NULL,
+    upper DOUBLE PRECISION NOT NULL,
+    score DOUBLE PRECISION NOT NULL,
+    created TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    UNIQUE (metric_id, granularity, bucket),
+    FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+    FOREIGN KEY (metric_id) REFERENCES metrics (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_metricanomalies_projectid_bucket ON metric_anomalies (project_id, bucket);
+
+-- Create Anomaly subscriptions table
+-- Subscriptions without a metric cover every metric of the project
+CREATE TABLE IF NOT EXISTS anomaly_subscriptions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    project_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    metric_id UUID,
+    notify_email BOOLEAN NOT NULL DEFAULT TRUE,
+    webhook_url TEXT NOT NULL DEFAULT '',
+    webhook_secret TEXT NOT NULL,
+    created TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+    FOREIGN KEY (metric_id) REFERENCES metrics (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_anomalysubscriptions_projectid ON anomaly_subscriptions (project_id);
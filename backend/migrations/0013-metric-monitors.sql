@@ -0,0 +1,24 @@
+-- Create Metric monitors table
+-- A monitor expects a metric to receive at least one event every interval, counted from
+-- its last event or from the moment the monitor was last enabled
+CREATE TABLE IF NOT EXISTS metric_monitors (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    project_id UUID NOT NULL,
+    metric_id UUID NOT NULL UNIQUE,
+    user_id UUID NOT NULL,
+    interval_minutes INT NOT NULL,
+    notify_email BOOLEAN NOT NULL DEFAULT TRUE,
+    webhook_url TEXT NOT NULL DEFAULT '',
+    webhook_secret TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    state TEXT NOT NULL DEFAULT 'ok',
+    active_since TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    silent_since TIMESTAMP,
+    last_checked TIMESTAMP,
+    created TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+    FOREIGN KEY (metric_id) REFERENCES metrics (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_metricmonitors_projectid ON metric_monitors (project_id);
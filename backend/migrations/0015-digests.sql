@@ -0,0 +1,19 @@
+-- Create Digest subscriptions table
+-- A user receives at most one digest per project, summarizing the previous week or month.
+-- An empty list of metrics includes every metric of the project.
+CREATE TABLE IF NOT EXISTS digest_subscriptions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    project_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    frequency TEXT NOT NULL,
+    metric_ids JSONB NOT NULL DEFAULT '[]',
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    next_send TIMESTAMP NOT NULL,
+    last_sent TIMESTAMP,
+    created TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    UNIQUE (project_id, user_id),
+    FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_digestsubscriptions_nextsend ON digest_subscriptions (next_send) WHERE enabled;
@@ -0,0 +1,27 @@
+-- Create Metric goals table
+-- A goal compares the value of a metric over a period with a target. Monthly and quarterly goals
+-- start over every period, custom goals cover the days between period_start and period_end.
+-- The state is the last one notified, for the period starting at state_period.
+CREATE TABLE IF NOT EXISTS metric_goals (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    project_id UUID NOT NULL,
+    metric_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    name TEXT NOT NULL,
+    target DOUBLE PRECISION NOT NULL,
+    period TEXT NOT NULL,
+    period_start TIMESTAMP,
+    period_end TIMESTAMP,
+    mode TEXT NOT NULL,
+    granularity TEXT NOT NULL DEFAULT '',
+    aggregation TEXT NOT NULL,
+    notify_email BOOLEAN NOT NULL DEFAULT TRUE,
+    state TEXT NOT NULL DEFAULT 'on_track',
+    state_period TIMESTAMP,
+    created TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+    FOREIGN KEY (metric_id) REFERENCES metrics (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_metricgoals_projectid ON metric_goals (project_id);
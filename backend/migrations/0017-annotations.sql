@@ -0,0 +1,20 @@
+-- Create Annotations table
+-- An annotation marks a moment, or a range when end_date is set, on the timeline of a project.
+-- An empty list of metrics shows the annotation on every metric.
+CREATE TABLE IF NOT EXISTS annotations (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    project_id UUID NOT NULL,
+    user_id UUID,
+    source TEXT NOT NULL,
+    title TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    tags JSONB NOT NULL DEFAULT '[]',
+    metric_ids JSONB NOT NULL DEFAULT '[]',
+    start_date TIMESTAMP NOT NULL,
+    end_date TIMESTAMP,
+    created TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_annotations_projectid_startdate ON annotations (project_id, start_date);
@@ -0,0 +1,2 @@
+-- Add the optional entity of the events, the user or the account performing the action
+ALTER TABLE metric_events ADD COLUMN IF NOT EXISTS entity_id TEXT;
@@ -0,0 +1,16 @@
+-- Create Funnels table
+-- The steps are an ordered list of metrics, each optionally restricted to a filter. The window bounds
+-- the time an entity has to go from the first step to the last one.
+CREATE TABLE IF NOT EXISTS funnels (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4 (),
+    project_id UUID NOT NULL,
+    user_id UUID NOT NULL,
+    name TEXT NOT NULL,
+    steps JSONB NOT NULL,
+    window_minutes INT NOT NULL,
+    created TIMESTAMP NOT NULL DEFAULT timezone ('UTC', CURRENT_TIMESTAMP),
+    FOREIGN KEY (project_id) REFERENCES projects (id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_funnels_projectid ON funnels (project_id);
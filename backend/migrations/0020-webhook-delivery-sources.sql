@@ -0,0 +1,5 @@
+-- Deliveries of the webhooks of alert rules, anomaly subscriptions and monitors
+-- The source identifies the owner of the webhook, whose url and secret are read at each attempt
+ALTER TABLE webhook_deliveries ALTER COLUMN endpoint_id DROP NOT NULL;
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT 'endpoint';
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS source_id UUID;
@@ -0,0 +1,682 @@
+package service
+
+import (
+	"Measurely/db"
+	"Measurely/email"
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Settings of the alert rules
+const (
+	alertInterval        = time.Minute
+	maxAlertRules        = 50
+	minAlertWindow       = 5
+	maxAlertWindow       = 7 * 24 * 60
+	maxAlertCooldown     = 7 * 24 * 60
+	defaultAlertWindow   = 60
+	defaultAlertCooldown = 60
+	alertEventsListed    = 50
+)
+
+// EvaluateAlerts checks the enabled alert rules against the stored events. Only one replica
+// evaluates the rules at a time, so that every transition is notified once.
+func (s *Service) EvaluateAlerts() {
+	locked, err := s.db.WithAdvisoryLock(db.LOCK_ALERTS, s.evaluateAlertRules)
+	if err != nil {
+		log.Println("Failed to acquire the alerts lock:", err)
+	} else if !locked {
+		log.Println("Alerts already evaluated on another instance, skipping")
+	}
+}
+
+func (s *Service) evaluateAlertRules() {
+	now := time.Now().UTC().Truncate(time.Minute)
+	rules, err := s.db.GetDueAlertRules(now.Add(-alertInterval))
+	if err != nil {
+		log.Println("Failed to fetch alert rules:", err)
+		return
+	}
+
+	for _, rule := range rules {
+		if s.scheduler.Stopping() {
+			return
+		}
+		s.evaluateAlertRule(rule, now)
+	}
+}
+
+// evaluateAlertRule computes the value of a rule and moves it between the ok and firing states.
+// A firing rule is notified once, and notified again when it resolves. A rule that triggered is
+// not triggered again before the end of its cooldown.
+func (s *Service) evaluateAlertRule(rule types.AlertRule, now time.Time) {
+	metric, err := s.db.GetMetricById(rule.MetricId)
+	if err != nil {
+		log.Println("Failed to fetch the metric of an alert:", err)
+		return
+	}
+
+	value, reference, ok, err := s.alertValue(rule, metric, now)
+	if err != nil {
+		log.Println("Failed to evaluate alert:", err)
+		return
+	}
+
+	state := rule.State
+	triggered := rule.LastTriggered
+	var lastValue *float64
+	if ok {
+		lastValue = &value
+		breaching := alertBreaches(rule, value, reference)
+		cooldown := time.Duration(rule.CooldownMinutes) * time.Minute
+
+		switch {
+		case breaching && rule.State == types.ALERT_OK:
+			if rule.LastTriggered == nil || !now.Before(rule.LastTriggered.Add(cooldown)) {
+				state = types.ALERT_FIRING
+				triggered = &now
+				s.notifyAlert(rule, metric, types.ALERT_TRIGGERED, value, reference, now)
+			}
+		case !breaching && rule.State == types.ALERT_FIRING:
+			state = types.ALERT_OK
+			s.notifyAlert(rule, metric, types.ALERT_RESOLVED, value, reference, now)
+		}
+	}
+
+	if err := s.db.UpdateAlertRuleEvaluation(rule.Id, state, lastValue, now, triggered); err != nil {
+		log.Println("Failed to update alert rule:", err)
+	}
+}
+
+// alertValue computes the value of the window of a rule, in the unit of the metric. Change rules
+// also return the value of the previous window, and cannot be evaluated when it is zero.
+func (s *Service) alertValue(rule types.AlertRule, metric types.Metric, now time.Time) (float64, *float64, bool, error) {
+	window := time.Duration(rule.WindowMinutes) * time.Minute
+	value, err := s.alertWindowValue(rule, metric, now.Add(-window), now)
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	if rule.Kind != types.ALERT_CHANGE {
+		return value, nil, true, nil
+	}
+
+	previous, err := s.alertWindowValue(rule, metric, now.Add(-2*window), now.Add(-window))
+	if err != nil {
+		return 0, nil, false, err
+	}
+	return value, &previous, previous != 0, nil
+}
+
+func (s *Service) alertWindowValue(rule types.AlertRule, metric types.Metric, start time.Time, end time.Time) (float64, error) {
+	aggregates, err := s.rangeAggregates(metric.Id, start, end)
+	if err != nil {
+		return 0, err
+	}
+
+	filterId := uuid.Nil
+	if rule.FilterId.Valid {
+		filterId = rule.FilterId.UUID
+	}
+
+	value := finalizeBucket(aggregates[filterId], start, metric.Type, rule.Aggregation).Value
+	if rule.Aggregation != types.AGGREGATION_COUNT {
+		value /= 100
+	}
+	return value, nil
+}
+
+// alertChange returns the change between the previous window and the current one, in percent
+func alertChange(value float64, reference float64) float64 {
+	return (value - reference) / math.Abs(reference) * 100
+}
+
+// alertBreaches reports whether the value of a rule meets its condition
+func alertBreaches(rule types.AlertRule, value float64, reference *float64) bool {
+	if rule.Kind == types.ALERT_CHANGE {
+		if reference == nil {
+			return false
+		}
+		change := alertChange(value, *reference)
+		if rule.Condition == types.ALERT_ABOVE {
+			return change >= rule.Threshold
+		}
+		return change <= -rule.Threshold
+	}
+
+	if rule.Condition == types.ALERT_ABOVE {
+		return value > rule.Threshold
+	}
+	return value < rule.Threshold
+}
+
+// describeAlert explains the state of a rule in plain words, for the notifications
+func describeAlert(rule types.AlertRule, metric types.Metric, value float64, reference *float64) string {
+	subject := fmt.Sprintf("the %s of %s over the last %s", rule.Aggregation, metric.Name, formatAlertWindow(rule.WindowMinutes))
+	if rule.FilterId.Valid {
+		if filter, exists := metric.Filters[rule.FilterId.UUID]; exists {
+			subject += fmt.Sprintf(" for %s %s", filter.Category, filter.Name)
+		}
+	}
+	current := strconv.FormatFloat(value, 'f', -1, 64)
+
+	if rule.Kind == types.ALERT_CHANGE && reference != nil {
+		direction := "increase"
+		if rule.Condition == types.ALERT_BELOW {
+			direction = "decrease"
+		}
+		return fmt.Sprintf("%s is %s, a change of %.1f%% from the previous period (%s). The rule watches for a %s of %s%%.",
+			capitalize(subject), current, alertChange(value, *reference), strconv.FormatFloat(*reference, 'f', -1, 64),
+			direction, strconv.FormatFloat(rule.Threshold, 'f', -1, 64))
+	}
+
+	return fmt.Sprintf("%s is %s. The rule watches for a value %s %s.",
+		capitalize(subject), current, rule.Condition, strconv.FormatFloat(rule.Threshold, 'f', -1, 64))
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+func formatAlertWindow(minutes int) string {
+	switch {
+	case minutes%(24*60) == 0:
+		if minutes == 24*60 {
+			return "day"
+		}
+		return fmt.Sprintf("%d days", minutes/(24*60))
+	case minutes%60 == 0:
+		if minutes == 60 {
+			return "hour"
+		}
+		return fmt.Sprintf("%d hours", minutes/60)
+	}
+	return fmt.Sprintf("%d minutes", minutes)
+}
+
+// alertPayload is the body of the alert webhooks
+type alertPayload struct {
+	Type      string    `json:"type"`
+	Date      time.Time `json:"date"`
+	ProjectId uuid.UUID `json:"project_id"`
+	Alert     struct {
+		Id            uuid.UUID `json:"id"`
+		Name          string    `json:"name"`
+		Kind          string    `json:"kind"`
+		Aggregation   string    `json:"aggregation"`
+		Condition     string    `json:"condition"`
+		Threshold     float64   `json:"threshold"`
+		WindowMinutes int       `json:"window_minutes"`
+	} `json:"alert"`
+	Metric struct {
+		Id   uuid.UUID `json:"id"`
+		Name string    `json:"name"`
+	} `json:"metric"`
+	Value     float64  `json:"value"`
+	Reference *float64 `json:"reference"`
+	Message   string   `json:"message"`
+}
+
+// notifyAlert records a transition of a rule and notifies it by email, through the webhook of the rule
+// and to the project webhooks. The rules of the users who left the project are removed.
+func (s *Service) notifyAlert(rule types.AlertRule, metric types.Metric, state string, value float64, reference *float64, now time.Time) {
+	if _, err := s.db.GetProject(rule.ProjectId, rule.UserId); err == sql.ErrNoRows {
+		if err := s.db.DeleteAlertRule(rule.Id, rule.ProjectId); err != nil {
+			log.Println("Failed to delete alert rule:", err)
+		}
+		return
+	} else if err != nil {
+		log.Println("Failed to fetch the project of an alert:", err)
+		return
+	}
+
+	event, err := s.db.CreateAlertEvent(types.AlertEvent{
+		RuleId:    rule.Id,
+		ProjectId: rule.ProjectId,
+		State:     state,
+		Value:     value,
+		Reference: reference,
+		Threshold: rule.Threshold,
+	})
+	if err != nil {
+		log.Println("Failed to record alert event:", err)
+	}
+
+	message := describeAlert(rule, metric, value, reference)
+
+	payload := alertPayload{
+		Type:      "alert." + state,
+		Date:      now,
+		ProjectId: rule.ProjectId,
+		Value:     value,
+		Reference: reference,
+		Message:   message,
+	}
+	payload.Alert.Id = rule.Id
+	payload.Alert.Name = rule.Name
+	payload.Alert.Kind = rule.Kind
+	payload.Alert.Aggregation = rule.Aggregation
+	payload.Alert.Condition = rule.Condition
+	payload.Alert.Threshold = rule.Threshold
+	payload.Alert.WindowMinutes = rule.WindowMinutes
+	payload.Metric.Id = metric.Id
+	payload.Metric.Name = metric.Name
+	s.emitProjectEvent(rule.ProjectId, payload.Type, payload)
+
+	if rule.WebhookUrl != "" {
+		// The delivery carries the id of the alert event, which records the outcome of the webhook
+		eventId := event.Id
+		if eventId == uuid.Nil {
+			eventId = uuid.New()
+		}
+		s.queueSourceWebhook(rule.ProjectId, types.DELIVERY_SOURCE_ALERT, rule.Id, eventId, payload.Type, payload)
+	}
+
+	if rule.NotifyEmail {
+		user, err := s.db.GetUserById(rule.UserId)
+		if err != nil {
+			log.Println("Failed to fetch the user of an alert:", err)
+			return
+		}
+
+		subject := "Alert triggered: " + rule.Name
+		if state == types.ALERT_RESOLVED {
+			subject = "Alert resolved: " + rule.Name
+		}
+
+		if err := s.email.SendEmail(email.MailFields{
+			To:          user.Email,
+			Subject:     subject,
+			Content:     message,
+			Link:        GetOrigin(),
+			ButtonTitle: "Open Measurely",
+		}); err != nil {
+			log.Println("Failed to send alert email:", err)
+		}
+	}
+}
+
+// alertRuleRequest holds the settings of a rule sent by the dashboard
+type alertRuleRequest struct {
+	ProjectId       uuid.UUID     `json:"project_id"`
+	AlertId         uuid.UUID     `json:"alert_id"`
+	MetricId        uuid.UUID     `json:"metric_id"`
+	Name            string        `json:"name"`
+	Kind            string        `json:"kind"`
+	Aggregation     string        `json:"aggregation"`
+	FilterId        uuid.NullUUID `json:"filter_id"`
+	Condition       string        `json:"condition"`
+	Threshold       float64       `json:"threshold"`
+	WindowMinutes   int           `json:"window_minutes"`
+	CooldownMinutes *int          `json:"cooldown_minutes"`
+	NotifyEmail     *bool         `json:"notify_email"`
+	WebhookUrl      string        `json:"webhook_url"`
+	Enabled         *bool         `json:"enabled"`
+}
+
+// apply validates the settings of the request and copies them to the rule. The returned error is
+// meant to be shown to the user.
+func (req alertRuleRequest) apply(rule *types.AlertRule, metric types.Metric) error {
+	rule.Name = strings.TrimSpace(req.Name)
+	if rule.Name == "" || len(rule.Name) > 100 {
+		return errors.New("The name of the alert must be between 1 and 100 characters")
+	}
+
+	if metric.Type == types.FORMULA_METRIC {
+		return errors.New("Alerts are not available for formula metrics")
+	}
+
+	switch rule.Kind {
+	case types.ALERT_THRESHOLD, types.ALERT_CHANGE:
+	default:
+		return errors.New("Invalid alert kind, it must be threshold or change")
+	}
+
+	rule.Aggregation = req.Aggregation
+	switch rule.Aggregation {
+	case "":
+		rule.Aggregation = defaultComparison(metric.Type)
+	case types.AGGREGATION_SUM, types.AGGREGATION_COUNT, types.AGGREGATION_AVG, types.AGGREGATION_MIN, types.AGGREGATION_MAX:
+	case types.AGGREGATION_NET:
+		if metric.Type != types.DUAL_METRIC {
+			return errors.New("The net aggregation is only available for dual metrics")
+		}
+	default:
+		return errors.New("Invalid aggregation")
+	}
+
+	rule.FilterId = req.FilterId
+	if rule.FilterId.Valid {
+		if _, exists := metric.Filters[rule.FilterId.UUID]; !exists {
+			return errors.New("The filter does not belong to the metric")
+		}
+	}
+
+	rule.Condition = req.Condition
+	if rule.Condition != types.ALERT_ABOVE && rule.Condition != types.ALERT_BELOW {
+		return errors.New("Invalid condition, it must be above or below")
+	}
+
+	rule.Threshold = req.Threshold
+	if math.IsNaN(rule.Threshold) || math.IsInf(rule.Threshold, 0) {
+		return errors.New("Invalid threshold")
+	}
+	if rule.Kind == types.ALERT_CHANGE && rule.Threshold <= 0 {
+		return errors.New("The threshold of a change alert is a percentage and must be positive")
+	}
+
+	rule.WindowMinutes = req.WindowMinutes
+	if rule.WindowMinutes == 0 {
+		rule.WindowMinutes = defaultAlertWindow
+	}
+	if rule.WindowMinutes < minAlertWindow || rule.WindowMinutes > maxAlertWindow {
+		return fmt.Errorf("The window must be between %d and %d minutes", minAlertWindow, maxAlertWindow)
+	}
+
+	if req.CooldownMinutes != nil {
+		rule.CooldownMinutes = *req.CooldownMinutes
+	}
+	if rule.CooldownMinutes < 0 || rule.CooldownMinutes > maxAlertCooldown {
+		return fmt.Errorf("The cooldown must be between 0 and %d minutes", maxAlertCooldown)
+	}
+
+	if req.NotifyEmail != nil {
+		rule.NotifyEmail = *req.NotifyEmail
+	}
+	if req.Enabled != nil {
+		rule.Enabled = *req.Enabled
+	}
+
+	rule.WebhookUrl = strings.TrimSpace(req.WebhookUrl)
+	if rule.WebhookUrl != "" {
+		if err := validateWebhookUrl(rule.WebhookUrl); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// alertProject loads the project of an alert request and checks that the user can manage its alerts
+func (s *Service) alertProject(w http.ResponseWriter, token types.Token, projectid uuid.UUID) (types.Project, bool) {
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return types.Project{}, false
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return types.Project{}, false
+	}
+
+	if project.UserRole != types.TEAM_OWNER && project.UserRole != types.TEAM_ADMIN {
+		http.Error(w, "You do not have the necessary role to perform this action", http.StatusUnauthorized)
+		return types.Project{}, false
+	}
+
+	return project, true
+}
+
+func (s *Service) GetAlertRules(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, projectid)
+	if !ok {
+		return
+	}
+
+	rules, err := s.db.GetAlertRules(project.Id)
+	if err != nil {
+		log.Println("Error fetching alert rules:", err)
+		http.Error(w, "Failed to retrieve alerts", http.StatusInternalServerError)
+		return
+	}
+	if rules == nil {
+		rules = []types.AlertRule{}
+	}
+
+	bytes, err := json.Marshal(rules)
+	if err != nil {
+		http.Error(w, "Failed to process alerts", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// CreateAlertRule creates an alert rule on a metric. The secret used to sign the webhooks of the
+// rule is generated along with it.
+func (s *Service) CreateAlertRule(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request alertRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	metric, err := s.db.GetMetricById(request.MetricId)
+	if err != nil || metric.ProjectId != project.Id {
+		http.Error(w, "Metric not found", http.StatusNotFound)
+		return
+	}
+
+	rules, err := s.db.GetAlertRules(project.Id)
+	if err != nil {
+		log.Println("Error fetching alert rules:", err)
+		http.Error(w, "Failed to retrieve alerts", http.StatusInternalServerError)
+		return
+	}
+	if len(rules) >= maxAlertRules {
+		http.Error(w, fmt.Sprintf("A project cannot have more than %d alerts", maxAlertRules), http.StatusForbidden)
+		return
+	}
+
+	rule := types.AlertRule{
+		ProjectId:       project.Id,
+		MetricId:        metric.Id,
+		UserId:          token.Id,
+		Kind:            request.Kind,
+		CooldownMinutes: defaultAlertCooldown,
+		NotifyEmail:     true,
+		Enabled:         true,
+	}
+	if err := request.apply(&rule, metric); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rule.WebhookSecret, err = generateWebhookSecret()
+	if err != nil {
+		log.Println("Error generating webhook secret:", err)
+		http.Error(w, "Failed to create alert", http.StatusInternalServerError)
+		return
+	}
+
+	rule, err = s.db.CreateAlertRule(rule)
+	if err != nil {
+		log.Println("Error creating alert rule:", err)
+		http.Error(w, "Failed to create alert", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(rule)
+	if err != nil {
+		http.Error(w, "Failed to process alert", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes)
+}
+
+// UpdateAlertRule updates the settings of a rule. The metric and the kind of a rule cannot change.
+func (s *Service) UpdateAlertRule(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request alertRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	rule, err := s.db.GetAlertRule(request.AlertId, project.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Alert not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching alert rule:", err)
+		http.Error(w, "Failed to retrieve alert", http.StatusInternalServerError)
+		return
+	}
+
+	metric, err := s.db.GetMetricById(rule.MetricId)
+	if err != nil {
+		http.Error(w, "Metric not found", http.StatusNotFound)
+		return
+	}
+
+	if err := request.apply(&rule, metric); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.db.UpdateAlertRule(rule); err != nil {
+		log.Println("Error updating alert rule:", err)
+		http.Error(w, "Failed to update alert", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) DeleteAlertRule(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId uuid.UUID `json:"project_id"`
+		AlertId   uuid.UUID `json:"alert_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeleteAlertRule(request.AlertId, project.Id); err != nil {
+		log.Println("Error deleting alert rule:", err)
+		http.Error(w, "Failed to delete alert", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetAlertEvents returns the history of the alerts of a project, or of a single alert with alert_id
+func (s *Service) GetAlertEvents(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	ruleid := uuid.Nil
+	if value := r.URL.Query().Get("alert_id"); value != "" {
+		ruleid, err = uuid.Parse(value)
+		if err != nil {
+			http.Error(w, "Invalid alert ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	events, err := s.db.GetAlertEvents(project.Id, ruleid, alertEventsListed)
+	if err != nil {
+		log.Println("Error fetching alert events:", err)
+		http.Error(w, "Failed to retrieve alert history", http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []types.AlertEvent{}
+	}
+
+	bytes, err := json.Marshal(events)
+	if err != nil {
+		http.Error(w, "Failed to process alert history", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
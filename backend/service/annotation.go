@@ -0,0 +1,467 @@
+package service
+
+import (
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Limits applied to the annotations. The public API accepts at most annotationRate annotations per
+// minute for each project.
+const (
+	maxAnnotationTitle       = 200
+	maxAnnotationDescription = 2000
+	maxAnnotationTags        = 10
+	maxAnnotationTag         = 50
+	maxAnnotationMetrics     = 20
+	maxAnnotationResults     = 1000
+	maxProjectAnnotations    = 10000
+	annotationRate           = 60
+)
+
+// annotationRequest holds an annotation sent by the dashboard or the public API. The dashboard
+// scopes annotations with metric ids, while the public API accepts the ids or the names of the metrics.
+type annotationRequest struct {
+	ProjectId    uuid.UUID   `json:"project_id"`
+	AnnotationId uuid.UUID   `json:"annotation_id"`
+	Title        string      `json:"title"`
+	Description  string      `json:"description"`
+	Tags         []string    `json:"tags"`
+	MetricIds    []uuid.UUID `json:"metric_ids"`
+	Metrics      []string    `json:"metrics"`
+	Start        *time.Time  `json:"start"`
+	End          *time.Time  `json:"end"`
+}
+
+// apply validates the request and copies it to the annotation. An annotation without a start date
+// is placed at the current time. The returned error is meant to be shown to the user.
+func (req annotationRequest) apply(annotation *types.Annotation, metrics []types.Metric) error {
+	annotation.Title = strings.TrimSpace(req.Title)
+	if annotation.Title == "" || len(annotation.Title) > maxAnnotationTitle {
+		return fmt.Errorf("The title must be between 1 and %d characters", maxAnnotationTitle)
+	}
+
+	annotation.Description = strings.TrimSpace(req.Description)
+	if len(annotation.Description) > maxAnnotationDescription {
+		return fmt.Errorf("The description must be at most %d characters", maxAnnotationDescription)
+	}
+
+	annotation.Tags = []string{}
+	for _, tag := range req.Tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || len(tag) > maxAnnotationTag {
+			return fmt.Errorf("Tags must be between 1 and %d characters", maxAnnotationTag)
+		}
+		if !slices.Contains(annotation.Tags, tag) {
+			annotation.Tags = append(annotation.Tags, tag)
+		}
+	}
+	if len(annotation.Tags) > maxAnnotationTags {
+		return fmt.Errorf("An annotation has at most %d tags", maxAnnotationTags)
+	}
+
+	annotation.MetricIds = []uuid.UUID{}
+	add := func(metric types.Metric) {
+		if !slices.Contains(annotation.MetricIds, metric.Id) {
+			annotation.MetricIds = append(annotation.MetricIds, metric.Id)
+		}
+	}
+	for _, metricid := range req.MetricIds {
+		index := slices.IndexFunc(metrics, func(metric types.Metric) bool { return metric.Id == metricid })
+		if index < 0 {
+			return errMetricAccess
+		}
+		add(metrics[index])
+	}
+	for _, identifier := range req.Metrics {
+		index := slices.IndexFunc(metrics, func(metric types.Metric) bool {
+			return metric.Id.String() == identifier || metric.Name == identifier
+		})
+		if index < 0 {
+			return fmt.Errorf("Metric '%s' not found", identifier)
+		}
+		add(metrics[index])
+	}
+	if len(annotation.MetricIds) > maxAnnotationMetrics {
+		return fmt.Errorf("An annotation applies to at most %d metrics", maxAnnotationMetrics)
+	}
+
+	annotation.Start = time.Now().UTC()
+	if req.Start != nil {
+		annotation.Start = req.Start.UTC()
+	}
+	annotation.End = nil
+	if req.End != nil {
+		end := req.End.UTC()
+		if end.Before(annotation.Start) {
+			return errors.New("The end date must be after the start date")
+		}
+		if end.After(annotation.Start) {
+			annotation.End = &end
+		}
+	}
+
+	return nil
+}
+
+// parseAnnotationQuery reads the range and the tag the annotations are listed for. The returned error
+// is meant to be shown to the user.
+func parseAnnotationQuery(query url.Values) (time.Time, time.Time, string, error) {
+	start, err := time.Parse(DateFormat, query.Get("start"))
+	if err != nil {
+		return time.Time{}, time.Time{}, "", errors.New("Invalid start date")
+	}
+
+	end, err := time.Parse(DateFormat, query.Get("end"))
+	if err != nil {
+		return time.Time{}, time.Time{}, "", errors.New("Invalid end date")
+	}
+
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, "", errors.New("The end date must be after the start date")
+	}
+
+	return start, end, strings.TrimSpace(query.Get("tag")), nil
+}
+
+// editorProject loads the project of a request and checks that the user can edit its annotations
+// and funnels. Guests can only read them.
+func (s *Service) editorProject(w http.ResponseWriter, token types.Token, projectid uuid.UUID) (types.Project, bool) {
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return types.Project{}, false
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return types.Project{}, false
+	}
+
+	if project.UserRole == types.TEAM_GUEST {
+		http.Error(w, "You do not have the necessary role to perform this action", http.StatusUnauthorized)
+		return types.Project{}, false
+	}
+
+	return project, true
+}
+
+// GetAnnotations lists the annotations of a project overlapping a date range, optionally restricted
+// to the ones shown on a metric and to a tag
+func (s *Service) GetAnnotations(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	projectid, err := uuid.Parse(query.Get("project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	metricid := uuid.Nil
+	if value := query.Get("metric_id"); value != "" {
+		metricid, err = uuid.Parse(value)
+		if err != nil {
+			http.Error(w, "Invalid metric ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	start, end, tag, err := parseAnnotationQuery(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	annotations, err := s.db.GetAnnotations(project.Id, start, end, metricid, tag, maxAnnotationResults)
+	if err != nil {
+		log.Println("Error fetching annotations:", err)
+		http.Error(w, "Failed to retrieve annotations", http.StatusInternalServerError)
+		return
+	}
+	if annotations == nil {
+		annotations = []types.Annotation{}
+	}
+
+	bytes, err := json.Marshal(annotations)
+	if err != nil {
+		http.Error(w, "Failed to process annotations", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+func (s *Service) CreateAnnotation(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request annotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.editorProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	s.createAnnotation(w, project, uuid.NullUUID{UUID: token.Id, Valid: true}, types.ANNOTATION_DASHBOARD, request)
+}
+
+// CreateAnnotationV1 creates an annotation from the public API, authenticated by the ingestion key
+// of the project, so that deploy markers can be posted from a CI pipeline
+func (s *Service) CreateAnnotationV1(w http.ResponseWriter, r *http.Request) {
+	apikey, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || apikey == "" {
+		http.Error(w, "Invalid or missing Authorization header", http.StatusUnauthorized)
+		return
+	}
+
+	var request annotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	projectCache, err := s.GetProjectCache(apikey)
+	if err != nil || projectCache.id == uuid.Nil {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+
+	if !s.annotationCap.allow(projectCache.id.String()) {
+		http.Error(w, "Too many annotations, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	project, err := s.db.GetProjectById(projectCache.id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	s.createAnnotation(w, project, uuid.NullUUID{}, types.ANNOTATION_API, request)
+}
+
+// createAnnotation validates and records an annotation, then writes it to the response
+func (s *Service) createAnnotation(w http.ResponseWriter, project types.Project, userid uuid.NullUUID, source string, request annotationRequest) {
+	count, err := s.db.GetAnnotationsCount(project.Id)
+	if err != nil {
+		log.Println("Error counting annotations:", err)
+		http.Error(w, "Failed to create annotation", http.StatusInternalServerError)
+		return
+	}
+	if count >= maxProjectAnnotations {
+		http.Error(w, fmt.Sprintf("A project cannot have more than %d annotations", maxProjectAnnotations), http.StatusForbidden)
+		return
+	}
+
+	metrics, err := s.db.GetMetrics(project.Id)
+	if err != nil {
+		log.Println("Error fetching metrics:", err)
+		http.Error(w, "Failed to retrieve metrics", http.StatusInternalServerError)
+		return
+	}
+
+	annotation := types.Annotation{
+		ProjectId: project.Id,
+		UserId:    userid,
+		Source:    source,
+	}
+	if err := request.apply(&annotation, metrics); err == errMetricAccess {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	annotation, err = s.db.CreateAnnotation(annotation)
+	if err != nil {
+		log.Println("Error creating annotation:", err)
+		http.Error(w, "Failed to create annotation", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(annotation)
+	if err != nil {
+		http.Error(w, "Failed to process annotation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes)
+}
+
+// UpdateAnnotation replaces the content of an annotation. The source of an annotation cannot change.
+func (s *Service) UpdateAnnotation(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request annotationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.editorProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	annotation, err := s.db.GetAnnotation(request.AnnotationId, project.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Annotation not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching annotation:", err)
+		http.Error(w, "Failed to retrieve annotation", http.StatusInternalServerError)
+		return
+	}
+
+	metrics, err := s.db.GetMetrics(project.Id)
+	if err != nil {
+		log.Println("Error fetching metrics:", err)
+		http.Error(w, "Failed to retrieve metrics", http.StatusInternalServerError)
+		return
+	}
+
+	// The date is kept when the request leaves it out
+	if request.Start == nil {
+		request.Start = &annotation.Start
+	}
+	if err := request.apply(&annotation, metrics); err == errMetricAccess {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.db.UpdateAnnotation(annotation); err != nil {
+		log.Println("Error updating annotation:", err)
+		http.Error(w, "Failed to update annotation", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) DeleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId    uuid.UUID `json:"project_id"`
+		AnnotationId uuid.UUID `json:"annotation_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.editorProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeleteAnnotation(request.AnnotationId, project.Id); err != nil {
+		log.Println("Error deleting annotation:", err)
+		http.Error(w, "Failed to delete annotation", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// ReadAnnotationsV1 lists the annotations of the project of the read key overlapping a date range,
+// optionally restricted to the ones shown on a metric, given by its ID or its name, and to a tag
+func (s *Service) ReadAnnotationsV1(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.readProject(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	start, end, tag, err := parseAnnotationQuery(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metricid := uuid.Nil
+	if identifier := query.Get("metric"); identifier != "" {
+		var metric types.Metric
+		if id, perr := uuid.Parse(identifier); perr == nil {
+			metric, err = s.db.GetMetricById(id)
+			if err == nil && metric.ProjectId != project.Id {
+				err = sql.ErrNoRows
+			}
+		} else {
+			metric, err = s.db.GetMetricByName(identifier, project.Id)
+		}
+		if err == sql.ErrNoRows {
+			http.Error(w, "Metric not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println("Error fetching metric:", err)
+			http.Error(w, "Failed to retrieve metric", http.StatusInternalServerError)
+			return
+		}
+		metricid = metric.Id
+	}
+
+	annotations, err := s.db.GetAnnotations(project.Id, start, end, metricid, tag, maxAnnotationResults)
+	if err != nil {
+		log.Println("Error fetching annotations:", err)
+		http.Error(w, "Failed to retrieve annotations", http.StatusInternalServerError)
+		return
+	}
+	if annotations == nil {
+		annotations = []types.Annotation{}
+	}
+
+	writeReadResponse(w, annotations, readCacheOpen)
+}
@@ -0,0 +1,595 @@
+package service
+
+import (
+	"Measurely/db"
+	"Measurely/email"
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Settings of the anomaly detection. The band of a bucket is learned from the same hour of the
+// previous weeks, or of the previous days when the metric is too recent.
+const (
+	anomalyInterval    = 15 * time.Minute
+	anomalyWeeks       = 8
+	anomalyDays        = 7
+	anomalyMinSamples  = 4
+	anomalySensitivity = 3.0
+	anomalyMinSpread   = 0.1
+	anomaliesListed    = 100
+)
+
+// seasonalReferences returns the dates the band of a bucket is learned from: the same time on the
+// same day of the previous weeks, and the same time of the previous days. Dates are computed in the
+// zone of the project, so that the hours keep lining up across daylight saving time.
+func seasonalReferences(date time.Time, loc *time.Location) ([]time.Time, []time.Time) {
+	local := date.In(loc)
+
+	weekly := make([]time.Time, anomalyWeeks)
+	for i := range weekly {
+		weekly[i] = local.AddDate(0, 0, -7*(i+1))
+	}
+
+	daily := make([]time.Time, anomalyDays)
+	for i := range daily {
+		daily[i] = local.AddDate(0, 0, -(i + 1))
+	}
+
+	return weekly, daily
+}
+
+// seasonalSamples returns the values the band of a bucket is learned from. The day of the week is
+// preferred, the hour of the day is used when there is not enough weekly history.
+func seasonalSamples(date time.Time, loc *time.Location, lookup func(date time.Time) (float64, bool)) []float64 {
+	weekly, daily := seasonalReferences(date, loc)
+
+	for _, references := range [][]time.Time{weekly, daily} {
+		var samples []float64
+		for _, reference := range references {
+			if value, ok := lookup(reference); ok {
+				samples = append(samples, value)
+			}
+		}
+		if len(samples) >= anomalyMinSamples {
+			return samples
+		}
+	}
+
+	return nil
+}
+
+// seasonalBand computes the band expected for a value from its samples, along with the score of the
+// value: its distance to the expected value in units of spread. The spread cannot be smaller than a
+// share of the expected value nor than one unit, so that flat histories do not flag every change.
+func seasonalBand(date time.Time, samples []float64, value float64, unit float64) (types.MetricBand, float64) {
+	mean := 0.0
+	for _, sample := range samples {
+		mean += sample
+	}
+	mean /= float64(len(samples))
+
+	variance := 0.0
+	for _, sample := range samples {
+		variance += (sample - mean) * (sample - mean)
+	}
+	spread := math.Sqrt(variance / float64(len(samples)))
+	spread = max(spread, anomalyMinSpread*math.Abs(mean), unit)
+
+	score := (value - mean) / spread
+	return types.MetricBand{
+		Date:     date,
+		Expected: mean,
+		Lower:    mean - anomalySensitivity*spread,
+		Upper:    mean + anomalySensitivity*spread,
+		Anomaly:  math.Abs(score) > anomalySensitivity,
+	}, score
+}
+
+// valueUnit returns one unit of the values of an aggregation, values being expressed in hundredths except for the counts
+func valueUnit(aggregation string) float64 {
+	if aggregation == types.AGGREGATION_COUNT {
+		return 1
+	}
+	return 100
+}
+
+// addSeasonalBands computes the band of every bucket of the series, from the history preceding the
+// range of the query. Buckets that are not over yet are never flagged.
+func (s *Service) addSeasonalBands(q metricQuery, metrics map[uuid.UUID]types.Metric, series []types.MetricSeries) error {
+	history := q
+	history.bands = false
+	history.start = q.start.In(q.calendar.loc).AddDate(0, 0, -7*anomalyWeeks)
+
+	past, err := s.runMetricQuery(history, metrics)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	unit := valueUnit(q.aggregation)
+	for i := range series {
+		metric := metrics[series[i].MetricId]
+		first := q.calendar.truncate(metric.Created, q.granularity)
+
+		values := make(map[time.Time]types.MetricBucket, len(past[i].Buckets))
+		for _, bucket := range past[i].Buckets {
+			values[bucket.Date.UTC()] = bucket
+		}
+
+		lookup := func(date time.Time) (float64, bool) {
+			if date.Before(first) {
+				return 0, false
+			}
+			bucket, exists := values[date.UTC()]
+			if !exists || (q.aggregation == types.AGGREGATION_AVG && bucket.Count == 0) {
+				return 0, false
+			}
+			return bucket.Value, true
+		}
+
+		series[i].Bands = make([]types.MetricBand, 0, len(series[i].Buckets))
+		for _, bucket := range series[i].Buckets {
+			samples := seasonalSamples(bucket.Date, q.calendar.loc, lookup)
+			if samples == nil {
+				continue
+			}
+
+			band, _ := seasonalBand(bucket.Date, samples, bucket.Value, unit)
+			if q.calendar.next(bucket.Date, q.granularity).After(now) {
+				band.Anomaly = false
+			}
+			series[i].Bands = append(series[i].Bands, band)
+		}
+	}
+
+	return nil
+}
+
+// DetectAnomalies flags the metrics whose last complete hour falls outside of its seasonal band.
+// Only one replica runs the detection at a time.
+func (s *Service) DetectAnomalies() {
+	locked, err := s.db.WithAdvisoryLock(db.LOCK_ANOMALIES, s.detectAnomalies)
+	if err != nil {
+		log.Println("Failed to acquire the anomalies lock:", err)
+	} else if !locked {
+		log.Println("Anomaly detection already running on another instance, skipping")
+	}
+}
+
+func (s *Service) detectAnomalies() {
+	bucket := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+	metrics, err := s.db.GetActiveMetrics(bucket.AddDate(0, 0, -7*anomalyWeeks))
+	if err != nil {
+		log.Println("Failed to fetch metrics for anomaly detection:", err)
+		return
+	}
+
+	// Metrics are ordered by project
+	for start := 0; start < len(metrics); {
+		end := start + 1
+		for end < len(metrics) && metrics[end].ProjectId == metrics[start].ProjectId {
+			end++
+		}
+
+		if s.scheduler.Stopping() {
+			return
+		}
+		if err := s.detectProjectAnomalies(metrics[start:end], bucket); err != nil {
+			log.Println("Failed to detect anomalies:", err)
+		}
+		start = end
+	}
+}
+
+// detectProjectAnomalies checks an hourly bucket of the metrics of a project against the hourly
+// rollups of the same hour in the previous weeks and days
+func (s *Service) detectProjectAnomalies(metrics []types.Metric, bucket time.Time) error {
+	project, err := s.db.GetProjectById(metrics[0].ProjectId)
+	if err != nil {
+		return err
+	}
+	cal := projectCalendar(project)
+
+	weekly, daily := seasonalReferences(bucket, cal.loc)
+	dates := append([]time.Time{bucket}, append(weekly, daily...)...)
+	for i, date := range dates {
+		dates[i] = date.UTC().Truncate(time.Hour)
+	}
+
+	metricIds := make([]uuid.UUID, len(metrics))
+	for i, metric := range metrics {
+		metricIds[i] = metric.Id
+	}
+
+	aggregates, err := s.db.GetRollupBuckets(metricIds, types.GRANULARITY_HOUR, dates)
+	if err != nil {
+		return err
+	}
+
+	perMetric := make(map[uuid.UUID]map[time.Time]types.BucketAggregate, len(metrics))
+	for _, aggregate := range aggregates {
+		if perMetric[aggregate.MetricId] == nil {
+			perMetric[aggregate.MetricId] = make(map[time.Time]types.BucketAggregate)
+		}
+		perMetric[aggregate.MetricId][aggregate.Bucket.UTC()] = aggregate
+	}
+
+	for _, metric := range metrics {
+		first := metric.Created.UTC().Truncate(time.Hour)
+		if bucket.Before(first) {
+			continue
+		}
+
+		aggregation := defaultComparison(metric.Type)
+		lookup := func(date time.Time) (float64, bool) {
+			date = date.UTC().Truncate(time.Hour)
+			if date.Before(first) {
+				return 0, false
+			}
+			aggregate := perMetric[metric.Id][date]
+			if aggregation == types.AGGREGATION_AVG && aggregate.Count == 0 {
+				return 0, false
+			}
+			return finalizeBucket(aggregate, date, metric.Type, aggregation).Value, true
+		}
+
+		value, ok := lookup(bucket)
+		if !ok {
+			continue
+		}
+		samples := seasonalSamples(bucket, cal.loc, lookup)
+		if samples == nil {
+			continue
+		}
+
+		band, score := seasonalBand(bucket, samples, value, valueUnit(aggregation))
+		if !band.Anomaly {
+			continue
+		}
+
+		direction := types.ANOMALY_SPIKE
+		if score < 0 {
+			direction = types.ANOMALY_DROP
+		}
+
+		anomaly, created, err := s.db.CreateAnomaly(types.MetricAnomaly{
+			ProjectId:   project.Id,
+			MetricId:    metric.Id,
+			Granularity: types.GRANULARITY_HOUR,
+			Bucket:      bucket,
+			Direction:   direction,
+			Value:       value,
+			Expected:    band.Expected,
+			Lower:       band.Lower,
+			Upper:       band.Upper,
+			Score:       score,
+		})
+		if err != nil {
+			log.Println("Failed to record anomaly:", err)
+			continue
+		}
+		if created {
+			s.notifyAnomaly(project, metric, anomaly, aggregation)
+		}
+	}
+
+	return nil
+}
+
+// anomalyPayload is the body of the anomaly webhooks. Values are expressed in the unit of the metric.
+type anomalyPayload struct {
+	Type      string    `json:"type"`
+	Date      time.Time `json:"date"`
+	ProjectId uuid.UUID `json:"project_id"`
+	Metric    struct {
+		Id   uuid.UUID `json:"id"`
+		Name string    `json:"name"`
+	} `json:"metric"`
+	Anomaly struct {
+		Id        uuid.UUID `json:"id"`
+		Bucket    time.Time `json:"bucket"`
+		Direction string    `json:"direction"`
+		Value     float64   `json:"value"`
+		Expected  float64   `json:"expected"`
+		Lower     float64   `json:"lower"`
+		Upper     float64   `json:"upper"`
+		Score     float64   `json:"score"`
+	} `json:"anomaly"`
+	Message string `json:"message"`
+}
+
+// notifyAnomaly sends an anomaly to the project webhooks and to the subscribers of its metric who are
+// still members of the project
+func (s *Service) notifyAnomaly(project types.Project, metric types.Metric, anomaly types.MetricAnomaly, aggregation string) {
+	unit := valueUnit(aggregation)
+	format := func(value float64) string {
+		return strconv.FormatFloat(math.Round(value/unit*100)/100, 'f', -1, 64)
+	}
+
+	local := anomaly.Bucket.In(projectCalendar(project).loc)
+	message := fmt.Sprintf("The %s of %s between %s and %s was %s, while %s was expected (between %s and %s).",
+		aggregation, metric.Name, local.Format("Jan 2, 15:04"), local.Add(time.Hour).Format("15:04 MST"),
+		format(anomaly.Value), format(anomaly.Expected), format(anomaly.Lower), format(anomaly.Upper))
+
+	payload := anomalyPayload{
+		Type:      "anomaly.detected",
+		Date:      anomaly.Created,
+		ProjectId: project.Id,
+		Message:   message,
+	}
+	payload.Metric.Id = metric.Id
+	payload.Metric.Name = metric.Name
+	payload.Anomaly.Id = anomaly.Id
+	payload.Anomaly.Bucket = anomaly.Bucket
+	payload.Anomaly.Direction = anomaly.Direction
+	payload.Anomaly.Value = anomaly.Value / unit
+	payload.Anomaly.Expected = anomaly.Expected / unit
+	payload.Anomaly.Lower = anomaly.Lower / unit
+	payload.Anomaly.Upper = anomaly.Upper / unit
+	payload.Anomaly.Score = anomaly.Score
+	s.emitProjectEvent(project.Id, payload.Type, payload)
+
+	subscriptions, err := s.db.GetMetricAnomalySubscriptions(project.Id, metric.Id)
+	if err != nil {
+		log.Println("Failed to fetch anomaly subscriptions:", err)
+		return
+	}
+	if len(subscriptions) == 0 {
+		return
+	}
+
+	subject := fmt.Sprintf("Unusual %s of %s in %s", anomaly.Direction, metric.Name, project.Name)
+	for _, subscription := range subscriptions {
+		// The subscriptions of the users who left the project are removed
+		if _, err := s.db.GetProject(project.Id, subscription.UserId); err == sql.ErrNoRows {
+			if err := s.db.DeleteAnomalySubscription(subscription.Id, project.Id, subscription.UserId); err != nil {
+				log.Println("Failed to delete anomaly subscription:", err)
+			}
+			continue
+		} else if err != nil {
+			log.Println("Failed to fetch the project of an anomaly subscription:", err)
+			continue
+		}
+
+		if subscription.WebhookUrl != "" {
+			s.queueSourceWebhook(project.Id, types.DELIVERY_SOURCE_ANOMALY, subscription.Id, uuid.New(), payload.Type, payload)
+		}
+
+		if subscription.NotifyEmail {
+			user, err := s.db.GetUserById(subscription.UserId)
+			if err != nil {
+				log.Println("Failed to fetch the user of an anomaly subscription:", err)
+				continue
+			}
+			if err := s.email.SendEmail(email.MailFields{
+				To:          user.Email,
+				Subject:     subject,
+				Content:     message,
+				Link:        GetOrigin(),
+				ButtonTitle: "Open Measurely",
+			}); err != nil {
+				log.Println("Failed to send anomaly email:", err)
+			}
+		}
+	}
+}
+
+// GetAnomalies lists the latest anomalies of a project, or of a single metric with metric_id
+func (s *Service) GetAnomalies(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	metricid := uuid.Nil
+	if value := r.URL.Query().Get("metric_id"); value != "" {
+		metricid, err = uuid.Parse(value)
+		if err != nil {
+			http.Error(w, "Invalid metric ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	anomalies, err := s.db.GetAnomalies(project.Id, metricid, anomaliesListed)
+	if err != nil {
+		log.Println("Error fetching anomalies:", err)
+		http.Error(w, "Failed to retrieve anomalies", http.StatusInternalServerError)
+		return
+	}
+	if anomalies == nil {
+		anomalies = []types.MetricAnomaly{}
+	}
+
+	bytes, err := json.Marshal(anomalies)
+	if err != nil {
+		http.Error(w, "Failed to process anomalies", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// GetAnomalySubscriptions lists the subscriptions of the user to the anomalies of a project
+func (s *Service) GetAnomalySubscriptions(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	subscriptions, err := s.db.GetAnomalySubscriptions(project.Id, token.Id)
+	if err != nil {
+		log.Println("Error fetching anomaly subscriptions:", err)
+		http.Error(w, "Failed to retrieve subscriptions", http.StatusInternalServerError)
+		return
+	}
+	if subscriptions == nil {
+		subscriptions = []types.AnomalySubscription{}
+	}
+
+	bytes, err := json.Marshal(subscriptions)
+	if err != nil {
+		http.Error(w, "Failed to process subscriptions", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// CreateAnomalySubscription subscribes the user to the anomalies of a metric, or of every metric of
+// the project when no metric is given. Anomalies are sent by email, and to a webhook for the owners and admins.
+func (s *Service) CreateAnomalySubscription(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId   uuid.UUID     `json:"project_id"`
+		MetricId    uuid.NullUUID `json:"metric_id"`
+		NotifyEmail bool          `json:"notify_email"`
+		WebhookUrl  string        `json:"webhook_url"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(request.ProjectId, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	if request.MetricId.Valid {
+		metric, err := s.db.GetMetricById(request.MetricId.UUID)
+		if err != nil || metric.ProjectId != project.Id {
+			http.Error(w, "Metric not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	if request.WebhookUrl != "" {
+		if project.UserRole != types.TEAM_OWNER && project.UserRole != types.TEAM_ADMIN {
+			http.Error(w, "You do not have the necessary role to perform this action", http.StatusUnauthorized)
+			return
+		}
+		if err := validateWebhookUrl(request.WebhookUrl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if !request.NotifyEmail {
+		http.Error(w, "A subscription needs an email notification or a webhook", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := generateWebhookSecret()
+	if err != nil {
+		log.Println("Error generating webhook secret:", err)
+		http.Error(w, "Failed to create subscription", http.StatusInternalServerError)
+		return
+	}
+
+	subscription, err := s.db.CreateAnomalySubscription(types.AnomalySubscription{
+		ProjectId:     project.Id,
+		UserId:        token.Id,
+		MetricId:      request.MetricId,
+		NotifyEmail:   request.NotifyEmail,
+		WebhookUrl:    request.WebhookUrl,
+		WebhookSecret: secret,
+	})
+	if err != nil {
+		log.Println("Error creating anomaly subscription:", err)
+		http.Error(w, "Failed to create subscription", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(subscription)
+	if err != nil {
+		http.Error(w, "Failed to process subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes)
+}
+
+func (s *Service) DeleteAnomalySubscription(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId      uuid.UUID `json:"project_id"`
+		SubscriptionId uuid.UUID `json:"subscription_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.db.DeleteAnomalySubscription(request.SubscriptionId, request.ProjectId, token.Id); err != nil {
+		log.Println("Error deleting anomaly subscription:", err)
+		http.Error(w, "Failed to delete subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+// historyLookup returns a lookup answering the dates of the history, which are compared as instants
+func historyLookup(history map[time.Time]float64) func(date time.Time) (float64, bool) {
+	return func(date time.Time) (float64, bool) {
+		for reference, value := range history {
+			if reference.Equal(date) {
+				return value, true
+			}
+		}
+		return 0, false
+	}
+}
+
+func TestSeasonalSamples(t *testing.T) {
+	date := time.Date(2025, 3, 20, 14, 0, 0, 0, time.UTC)
+
+	weekly := make(map[time.Time]float64)
+	for i := 1; i <= anomalyWeeks; i++ {
+		weekly[date.AddDate(0, 0, -7*i)] = float64(i)
+	}
+	if samples := seasonalSamples(date, time.UTC, historyLookup(weekly)); len(samples) != anomalyWeeks {
+		t.Errorf("got %d samples from a full weekly history, want %d", len(samples), anomalyWeeks)
+	}
+
+	// Too few weeks fall back on the previous days, which include the week before
+	daily := make(map[time.Time]float64)
+	for i := 1; i <= anomalyDays; i++ {
+		daily[date.AddDate(0, 0, -i)] = 10
+	}
+	daily[date.AddDate(0, 0, -14)] = 20
+	samples := seasonalSamples(date, time.UTC, historyLookup(daily))
+	if len(samples) != anomalyDays {
+		t.Fatalf("got %d samples from a daily history, want %d", len(samples), anomalyDays)
+	}
+	for _, sample := range samples {
+		if sample != 10 {
+			t.Errorf("the daily samples include %v, want only the previous days", sample)
+		}
+	}
+
+	sparse := map[time.Time]float64{date.AddDate(0, 0, -1): 1, date.AddDate(0, 0, -7): 2, date.AddDate(0, 0, -14): 3}
+	if samples := seasonalSamples(date, time.UTC, historyLookup(sparse)); samples != nil {
+		t.Errorf("got %v from a sparse history, want no samples", samples)
+	}
+}
+
+func TestSeasonalSamplesDaylightSaving(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The clocks moved forward on March 9, 2025, the references keep the local hour
+	date := time.Date(2025, 3, 12, 9, 0, 0, 0, loc)
+	history := make(map[time.Time]float64)
+	for i := 1; i <= anomalyWeeks; i++ {
+		history[time.Date(2025, 3, 12-7*i, 9, 0, 0, 0, loc)] = 1
+	}
+
+	if samples := seasonalSamples(date.UTC(), loc, historyLookup(history)); len(samples) != anomalyWeeks {
+		t.Errorf("got %d samples across a change of offset, want %d", len(samples), anomalyWeeks)
+	}
+}
+
+func TestSeasonalBand(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  []float64
+		value    float64
+		unit     float64
+		expected float64
+		lower    float64
+		upper    float64
+		score    float64
+		anomaly  bool
+	}{
+		{"spread", []float64{8, 12, 8, 12}, 20, 1, 10, 4, 16, 5, true},
+		{"within spread", []float64{8, 12, 8, 12}, 14, 1, 10, 4, 16, 2, false},
+		{"flat history", []float64{100, 100, 100, 100}, 120, 1, 100, 70, 130, 2, false},
+		{"flat history spike", []float64{100, 100, 100, 100}, 140, 1, 100, 70, 130, 4, true},
+		{"unit floor", []float64{0, 0, 0, 0}, 200, 100, 0, -300, 300, 2, false},
+		{"negative values", []float64{-100, -100, -100, -100}, -160, 1, -100, -130, -70, -6, true},
+	}
+
+	date := time.Date(2025, 3, 20, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		band, score := seasonalBand(date, test.samples, test.value, test.unit)
+		if band.Expected != test.expected || band.Lower != test.lower || band.Upper != test.upper {
+			t.Errorf("%s: band is %v [%v, %v], want %v [%v, %v]", test.name, band.Expected, band.Lower, band.Upper, test.expected, test.lower, test.upper)
+		}
+		if score != test.score || band.Anomaly != test.anomaly {
+			t.Errorf("%s: score is %v (anomaly %v), want %v (anomaly %v)", test.name, score, band.Anomaly, test.score, test.anomaly)
+		}
+		if !band.Date.Equal(date) {
+			t.Errorf("%s: band is dated %v, want %v", test.name, band.Date, date)
+		}
+	}
+}
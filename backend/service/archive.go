@@ -0,0 +1,689 @@
+package service
+
+import (
+	"Measurely/db"
+	"Measurely/types"
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Version of the project archives written by this instance. Archives of a later version are rejected.
+const archiveVersion = 1
+
+// Limits of the archive imports. The events are inserted per statement in batches of archiveEventBatch
+// and committed every archiveCommitEvents, so that a large import does not hold a single transaction.
+const (
+	archiveEventBatch    = 1000
+	archiveCommitEvents  = 100000
+	maxArchiveSize       = 256 << 20
+	maxArchiveExpandSize = 2 << 30
+)
+
+// Kinds of the records of a project archive. The header comes first, followed by the metrics,
+// the team members, the dashboard layouts and finally the events.
+const (
+	archiveHeader = "header"
+	archiveMetric = "metric"
+	archiveMember = "member"
+	archiveBlocks = "blocks"
+	archiveEvent  = "event"
+)
+
+// errInvalidArchive is returned when an archive cannot be imported because of its content
+var errInvalidArchive = errors.New("Invalid archive")
+
+// errArchiveTooLarge is returned when an archive decompresses past maxArchiveExpandSize
+var errArchiveTooLarge = errors.New("Archive too large")
+
+// errProjectExists is returned when the user already has a project with the name of the import
+var errProjectExists = errors.New("Project with this name already exists")
+
+// archiveRecord is a line of an archive, a gzipped stream of JSON records
+type archiveRecord struct {
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+type archiveProject struct {
+	Version              int          `json:"version"`
+	Exported             time.Time    `json:"exported"`
+	Id                   uuid.UUID    `json:"id"`
+	Name                 string       `json:"name"`
+	Units                []types.Unit `json:"units"`
+	RetentionDays        int          `json:"retention_days"`
+	Timezone             string       `json:"timezone"`
+	WeekStart            int          `json:"week_start"`
+	FiscalYearStartMonth int          `json:"fiscal_year_start_month"`
+}
+
+type archiveMetricData struct {
+	Id                 uuid.UUID                  `json:"id"`
+	Name               string                     `json:"name"`
+	Type               int                        `json:"type"`
+	Unit               string                     `json:"unit"`
+	NamePos            string                     `json:"name_pos"`
+	NameNeg            string                     `json:"name_neg"`
+	Filters            map[uuid.UUID]types.Filter `json:"filters"`
+	Total              int64                      `json:"total"`
+	EventCount         int64                      `json:"event_count"`
+	Created            time.Time                  `json:"created"`
+	LastEventTimestamp time.Time                  `json:"last_event_timestamp"`
+	Formula            string                     `json:"formula,omitempty"`
+}
+
+// Users are referenced by email, since their ids differ from one instance to another
+type archiveMemberData struct {
+	Email string `json:"email"`
+	Role  int    `json:"role"`
+}
+
+type archiveBlocksData struct {
+	Email  string        `json:"email"`
+	Owner  bool          `json:"owner"`
+	Layout []types.Block `json:"layout"`
+	Labels []types.Label `json:"labels"`
+}
+
+type archiveEventData struct {
+	MetricId uuid.UUID   `json:"metric_id"`
+	ValuePos int32       `json:"value_pos"`
+	ValueNeg int32       `json:"value_neg"`
+	Date     time.Time   `json:"date"`
+	Filters  []uuid.UUID `json:"filters"`
+	EntityId string      `json:"entity_id,omitempty"`
+}
+
+// limitedReader fails with errArchiveTooLarge past a number of bytes, bounding the decompressed size
+// of an archive
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, errArchiveTooLarge
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// archiveWriter writes the records of an archive
+type archiveWriter struct {
+	encoder *json.Encoder
+}
+
+func (aw archiveWriter) write(kind string, data any) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return aw.encoder.Encode(archiveRecord{Kind: kind, Data: raw})
+}
+
+// writeArchive writes the settings, metrics, members, dashboards and events of a project
+func (s *Service) writeArchive(w io.Writer, project types.Project) error {
+	aw := archiveWriter{encoder: json.NewEncoder(w)}
+
+	err := aw.write(archiveHeader, archiveProject{
+		Version:              archiveVersion,
+		Exported:             time.Now().UTC(),
+		Id:                   project.Id,
+		Name:                 project.Name,
+		Units:                project.Units,
+		RetentionDays:        project.RetentionDays,
+		Timezone:             project.Timezone,
+		WeekStart:            project.WeekStart,
+		FiscalYearStartMonth: project.FiscalYearStartMonth,
+	})
+	if err != nil {
+		return err
+	}
+
+	metrics, err := s.db.GetMetrics(project.Id)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	for _, metric := range metrics {
+		err := aw.write(archiveMetric, archiveMetricData{
+			Id:                 metric.Id,
+			Name:               metric.Name,
+			Type:               metric.Type,
+			Unit:               metric.Unit,
+			NamePos:            metric.NamePos,
+			NameNeg:            metric.NameNeg,
+			Filters:            metric.Filters,
+			Total:              metric.Total,
+			EventCount:         metric.EventCount,
+			Created:            metric.Created,
+			LastEventTimestamp: metric.LastEventTimestamp,
+			Formula:            metric.Formula,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Resolve the emails of the owner and the members
+	owner, err := s.db.GetUserById(project.UserId)
+	if err != nil {
+		return err
+	}
+	emails := map[uuid.UUID]string{owner.Id: owner.Email}
+
+	relations, err := s.db.GetTeamRelations(project.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, relation := range relations {
+		user, err := s.db.GetUserById(relation.UserId)
+		if err != nil {
+			return err
+		}
+		emails[user.Id] = user.Email
+
+		if err := aw.write(archiveMember, archiveMemberData{Email: user.Email, Role: relation.Role}); err != nil {
+			return err
+		}
+	}
+
+	blocks, err := s.db.GetProjectBlocks(project.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, userBlocks := range blocks {
+		email, exists := emails[userBlocks.UserId]
+		if !exists {
+			continue
+		}
+
+		err := aw.write(archiveBlocks, archiveBlocksData{
+			Email:  email,
+			Owner:  userBlocks.UserId == project.UserId,
+			Layout: userBlocks.Layout,
+			Labels: userBlocks.Labels,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, metric := range metrics {
+		err := s.db.StreamMetricEvents(metric.Id, time.Time{}, time.Now().UTC().Add(time.Hour), false, func(event types.MetricEvent) error {
+			return aw.write(archiveEvent, archiveEventData{
+				MetricId: event.MetricId,
+				ValuePos: event.ValuePos,
+				ValueNeg: event.ValueNeg,
+				Date:     event.Date,
+				Filters:  event.Filters,
+				EntityId: event.EntityId,
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remapBlocks points the blocks of a layout to the imported metrics, dropping the metrics that
+// are not part of the archive
+func remapBlocks(layout []types.Block, metricIds map[uuid.UUID]uuid.UUID) []types.Block {
+	for i := range layout {
+		ids := []uuid.UUID{}
+		for _, id := range layout[i].MetricIds {
+			if newId, exists := metricIds[id]; exists {
+				ids = append(ids, newId)
+			}
+		}
+		layout[i].MetricIds = ids
+		layout[i].Nested = remapBlocks(layout[i].Nested, metricIds)
+	}
+	return layout
+}
+
+// archiveImport tracks the ids remapped while importing an archive
+type archiveImport struct {
+	project   types.Project
+	owner     types.User
+	metricIds map[uuid.UUID]uuid.UUID
+	filterIds map[uuid.UUID]uuid.UUID
+	relations map[string]uuid.UUID
+	metrics   []types.Metric
+	events    []types.MetricEvent
+	Metrics   int      `json:"metrics"`
+	Members   int      `json:"members"`
+	Events    int64    `json:"events"`
+	Skipped   []string `json:"skipped_members"`
+}
+
+// importArchive creates a new project from an archive. Every id is regenerated, and members are
+// only added when a user with the same email exists on this instance.
+func (s *Service) importArchive(r io.Reader, owner types.User, name string, apiKey string) (types.Project, archiveImport, error) {
+	result := archiveImport{
+		owner:     owner,
+		metricIds: make(map[uuid.UUID]uuid.UUID),
+		filterIds: make(map[uuid.UUID]uuid.UUID),
+		relations: make(map[string]uuid.UUID),
+		Skipped:   []string{},
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(r))
+
+	var header archiveRecord
+	if err := decoder.Decode(&header); err != nil || header.Kind != archiveHeader {
+		return types.Project{}, result, fmt.Errorf("%w: the archive must start with a header", errInvalidArchive)
+	}
+
+	var settings archiveProject
+	if err := json.Unmarshal(header.Data, &settings); err != nil {
+		return types.Project{}, result, fmt.Errorf("%w: %v", errInvalidArchive, err)
+	}
+	if settings.Version < 1 || settings.Version > archiveVersion {
+		return types.Project{}, result, fmt.Errorf("%w: unsupported archive version %d", errInvalidArchive, settings.Version)
+	}
+
+	if name == "" {
+		name = strings.ToLower(strings.TrimSpace(settings.Name))
+		if match, _ := regexp.MatchString(`^[a-zA-Z0-9_ ]+$`, name); !match {
+			return types.Project{}, result, fmt.Errorf("%w: project name can only contain letters, numbers, and underscores", errInvalidArchive)
+		}
+	}
+	if _, err := s.db.GetProjectByName(owner.Id, name); err == nil {
+		return types.Project{}, result, errProjectExists
+	}
+	if settings.Units == nil {
+		settings.Units = []types.Unit{}
+	}
+	if _, err := time.LoadLocation(settings.Timezone); err != nil || settings.Timezone == "" || settings.Timezone == "Local" {
+		settings.Timezone = "UTC"
+	}
+	if settings.WeekStart < 0 || settings.WeekStart > 6 {
+		settings.WeekStart = int(time.Monday)
+	}
+	if settings.FiscalYearStartMonth < 1 || settings.FiscalYearStartMonth > 12 {
+		settings.FiscalYearStartMonth = 1
+	}
+
+	plan := s.plans["starter"]
+	if settings.RetentionDays < 0 || settings.RetentionDays > plan.Range {
+		settings.RetentionDays = 0
+	}
+
+	pi, err := s.db.BeginProjectImport()
+	if err != nil {
+		return types.Project{}, result, err
+	}
+
+	result.project, err = pi.CreateProject(types.Project{
+		UserId:               owner.Id,
+		ApiKey:               apiKey,
+		Name:                 name,
+		Units:                settings.Units,
+		CurrentPlan:          "starter",
+		MaxEventPerMonth:     plan.MaxEventPerMonth,
+		RetentionDays:        settings.RetentionDays,
+		Timezone:             settings.Timezone,
+		WeekStart:            settings.WeekStart,
+		FiscalYearStartMonth: settings.FiscalYearStartMonth,
+	})
+	if err != nil {
+		pi.Rollback()
+		return types.Project{}, result, err
+	}
+
+	for {
+		var record archiveRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			pi.Rollback()
+			return types.Project{}, result, fmt.Errorf("%w: %w", errInvalidArchive, err)
+		}
+
+		if err := s.importRecord(pi, &result, record); err != nil {
+			pi.Rollback()
+			return types.Project{}, result, err
+		}
+	}
+
+	if err := pi.CreateEvents(result.events); err != nil {
+		pi.Rollback()
+		return types.Project{}, result, err
+	}
+
+	// Formulas can reference the metrics following them in the archive
+	for _, metric := range result.metrics {
+		if metric.Type != types.FORMULA_METRIC {
+			continue
+		}
+		if _, err := validateFormula(metric.Formula, metric.Name, result.metrics); err != nil {
+			pi.Rollback()
+			return types.Project{}, result, fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+	}
+
+	if err := pi.Commit(); err != nil {
+		return types.Project{}, result, err
+	}
+
+	return result.project, result, nil
+}
+
+// importRecord writes a record of an archive, remapping the ids it references
+func (s *Service) importRecord(pi *db.ProjectImport, result *archiveImport, record archiveRecord) error {
+	switch record.Kind {
+	case archiveMetric:
+		var metric archiveMetricData
+		if err := json.Unmarshal(record.Data, &metric); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+
+		plan := s.plans[result.project.CurrentPlan]
+		if plan.MetricLimit >= 0 && result.Metrics >= plan.MetricLimit {
+			return fmt.Errorf("%w: the archive has more metrics than the %d allowed by the %s plan", errInvalidArchive, plan.MetricLimit, plan.Name)
+		}
+
+		// Metrics are checked as when they are created
+		metric.Name = strings.TrimSpace(metric.Name)
+		if match, _ := regexp.MatchString(`^[a-zA-Z0-9 _\-/\$%#&\*\(\)!~]+$`, metric.Name); !match {
+			return fmt.Errorf("%w: invalid metric name '%s'", errInvalidArchive, metric.Name)
+		}
+		if isReservedMetricName(metric.Name) {
+			return fmt.Errorf("%w: the metric name '%s' is reserved by the API", errInvalidArchive, metric.Name)
+		}
+		if metric.Type < 0 || metric.Type > types.FORMULA_METRIC {
+			return fmt.Errorf("%w: invalid type for the metric '%s'", errInvalidArchive, metric.Name)
+		}
+		if metric.Type == types.FORMULA_METRIC {
+			node, err := parseFormula(metric.Formula)
+			if err != nil {
+				return fmt.Errorf("%w: the formula of '%s' is invalid: %v", errInvalidArchive, metric.Name, err)
+			}
+			metric.Formula = node.String()
+		} else {
+			metric.Formula = ""
+		}
+
+		filters := make(map[uuid.UUID]types.Filter, len(metric.Filters))
+		for id, filter := range metric.Filters {
+			newId := uuid.New()
+			result.filterIds[id] = newId
+			filters[newId] = filter
+		}
+
+		id, err := pi.CreateMetric(types.Metric{
+			ProjectId:          result.project.Id,
+			Name:               metric.Name,
+			Type:               metric.Type,
+			Unit:               metric.Unit,
+			NamePos:            metric.NamePos,
+			NameNeg:            metric.NameNeg,
+			Filters:            filters,
+			Total:              metric.Total,
+			EventCount:         metric.EventCount,
+			Created:            metric.Created,
+			LastEventTimestamp: metric.LastEventTimestamp,
+			Formula:            metric.Formula,
+		})
+		if err != nil {
+			return err
+		}
+
+		result.metricIds[metric.Id] = id
+		result.metrics = append(result.metrics, types.Metric{Name: metric.Name, Type: metric.Type, Formula: metric.Formula})
+		result.Metrics++
+
+	case archiveMember:
+		var member archiveMemberData
+		if err := json.Unmarshal(record.Data, &member); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+
+		if strings.EqualFold(member.Email, result.owner.Email) {
+			return nil
+		}
+		if member.Role <= types.TEAM_OWNER || member.Role > types.TEAM_GUEST {
+			return fmt.Errorf("%w: invalid role for %s", errInvalidArchive, member.Email)
+		}
+
+		user, err := s.db.GetUserByEmail(strings.ToLower(member.Email))
+		if err == sql.ErrNoRows {
+			result.Skipped = append(result.Skipped, member.Email)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		id, err := pi.CreateTeamRelation(types.TeamRelation{UserId: user.Id, ProjectId: result.project.Id, Role: member.Role})
+		if err != nil {
+			return err
+		}
+
+		result.relations[member.Email] = id
+		result.Members++
+
+	case archiveBlocks:
+		var data archiveBlocksData
+		if err := json.Unmarshal(record.Data, &data); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+
+		blocks := types.Blocks{
+			ProjectId: result.project.Id,
+			Layout:    remapBlocks(data.Layout, result.metricIds),
+			Labels:    data.Labels,
+		}
+		if blocks.Layout == nil {
+			blocks.Layout = []types.Block{}
+		}
+		if blocks.Labels == nil {
+			blocks.Labels = []types.Label{}
+		}
+
+		// The layout of the previous owner goes to the user importing the project
+		if data.Owner {
+			blocks.UserId = result.owner.Id
+		} else {
+			relationId, exists := result.relations[data.Email]
+			if !exists {
+				return nil
+			}
+			user, err := s.db.GetUserByEmail(strings.ToLower(data.Email))
+			if err != nil {
+				return err
+			}
+			blocks.UserId = user.Id
+			blocks.TeamRelationId = sql.Null[string]{V: relationId.String(), Valid: true}
+		}
+
+		return pi.CreateBlocks(blocks)
+
+	case archiveEvent:
+		var event archiveEventData
+		if err := json.Unmarshal(record.Data, &event); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidArchive, err)
+		}
+
+		metricId, exists := result.metricIds[event.MetricId]
+		if !exists {
+			return fmt.Errorf("%w: an event references an unknown metric", errInvalidArchive)
+		}
+
+		// The imported events count towards the monthly quota of the new project
+		if result.Events >= int64(result.project.MaxEventPerMonth) {
+			return fmt.Errorf("%w: the archive has more events than the %d allowed per month by the %s plan", errInvalidArchive, result.project.MaxEventPerMonth, s.plans[result.project.CurrentPlan].Name)
+		}
+
+		filters := make([]uuid.UUID, 0, len(event.Filters))
+		for _, id := range event.Filters {
+			if newId, exists := result.filterIds[id]; exists {
+				filters = append(filters, newId)
+			}
+		}
+
+		result.events = append(result.events, types.MetricEvent{
+			MetricId: metricId,
+			ValuePos: event.ValuePos,
+			ValueNeg: event.ValueNeg,
+			Date:     event.Date,
+			Filters:  filters,
+			EntityId: event.EntityId,
+		})
+		result.Events++
+
+		if len(result.events) == archiveEventBatch {
+			if err := pi.CreateEvents(result.events); err != nil {
+				return err
+			}
+			result.events = result.events[:0]
+		}
+
+		if result.Events%archiveCommitEvents == 0 {
+			return pi.Checkpoint()
+		}
+
+	case archiveHeader:
+		return fmt.Errorf("%w: the archive has more than one header", errInvalidArchive)
+	}
+
+	// Records of an unknown kind come from a later minor version and are skipped
+	return nil
+}
+
+// ExportProjectArchive downloads a gzipped archive of a project, which can be imported on any instance
+func (s *Service) ExportProjectArchive(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	if project.UserRole != types.TEAM_OWNER && project.UserRole != types.TEAM_ADMIN {
+		http.Error(w, "You do not have the necessary role to perform this action", http.StatusUnauthorized)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_%s.measurely.gz"`, strings.ReplaceAll(project.Name, " ", "_"), time.Now().UTC().Format("2006-01-02")))
+
+	gz := gzip.NewWriter(w)
+	if err := s.writeArchive(gz, project); err != nil {
+		// The response has already started, the download ends up truncated
+		log.Println("Error exporting project archive:", err)
+		return
+	}
+	if err := gz.Close(); err != nil {
+		log.Println("Error exporting project archive:", err)
+	}
+}
+
+// ImportProjectArchive creates a new project owned by the user from an archive sent as the request body
+func (s *Service) ImportProjectArchive(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("name")))
+	if name != "" {
+		if match, _ := regexp.MatchString(`^[a-zA-Z0-9_ ]+$`, name); !match {
+			http.Error(w, "Project name can only contain letters, numbers, and underscores", http.StatusBadRequest)
+			return
+		}
+	}
+
+	owner, err := s.db.GetUserById(token.Id)
+	if err != nil {
+		log.Println("Error fetching user:", err)
+		http.Error(w, "Failed to retrieve user", http.StatusInternalServerError)
+		return
+	}
+
+	gz, err := gzip.NewReader(http.MaxBytesReader(w, r.Body, maxArchiveSize))
+	if err != nil {
+		http.Error(w, "Invalid archive, it must be gzipped", http.StatusBadRequest)
+		return
+	}
+	defer gz.Close()
+
+	apiKey, err := GenerateRandomKey()
+	if err != nil {
+		http.Error(w, "Unable to generate API key, please try again later", http.StatusInternalServerError)
+		return
+	}
+
+	project, result, err := s.importArchive(&limitedReader{r: gz, remaining: maxArchiveExpandSize}, owner, name, apiKey)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || errors.Is(err, errArchiveTooLarge) {
+		http.Error(w, fmt.Sprintf("The archive cannot exceed %d MB, or %d MB once decompressed", maxArchiveSize>>20, maxArchiveExpandSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	} else if errors.Is(err, errInvalidArchive) || err == errProjectExists {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Println("Error importing project archive:", err)
+		http.Error(w, "Failed to import project", http.StatusInternalServerError)
+		return
+	}
+
+	project.UserRole = types.TEAM_OWNER
+
+	bytes, err := json.Marshal(struct {
+		Project types.Project `json:"project"`
+		Plan    types.Plan    `json:"plan"`
+		archiveImport
+	}{
+		Project:       project,
+		Plan:          s.plans[project.CurrentPlan],
+		archiveImport: result,
+	})
+	if err != nil {
+		http.Error(w, "Failed to marshal project data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes)
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// calendar splits time into buckets following the settings of a project
+type calendar struct {
+	settings types.Calendar
+	loc      *time.Location
+}
+
+// utcCalendar is the calendar of the projects keeping the default settings
+var utcCalendar = calendar{
+	settings: types.Calendar{Timezone: "UTC", WeekStart: int(time.Monday), FiscalYearStartMonth: 1},
+	loc:      time.UTC,
+}
+
+// projectCalendar returns the calendar of a project, falling back to UTC when the zone is unknown
+func projectCalendar(project types.Project) calendar {
+	loc, err := time.LoadLocation(project.Timezone)
+	if err != nil || project.Timezone == "" || project.Timezone == "Local" {
+		loc = time.UTC
+		project.Timezone = "UTC"
+	}
+
+	settings := types.Calendar{
+		Timezone:             project.Timezone,
+		WeekStart:            project.WeekStart,
+		FiscalYearStartMonth: project.FiscalYearStartMonth,
+	}
+	if settings.WeekStart < 0 || settings.WeekStart > 6 {
+		settings.WeekStart = int(time.Monday)
+	}
+	if settings.FiscalYearStartMonth < 1 || settings.FiscalYearStartMonth > 12 {
+		settings.FiscalYearStartMonth = 1
+	}
+
+	return calendar{settings: settings, loc: loc}
+}
+
+// truncate returns the start of the bucket containing t. Buckets of a minute or an hour follow the
+// wall clock, so a repeated hour at the end of daylight saving time forms two buckets. Larger buckets
+// start at local midnight, whatever the length of their days.
+func (c calendar) truncate(t time.Time, granularity string) time.Time {
+	local := t.In(c.loc)
+	switch granularity {
+	case types.GRANULARITY_MINUTE:
+		return local.Add(-time.Duration(local.Second())*time.Second - time.Duration(local.Nanosecond()))
+	case types.GRANULARITY_HOUR:
+		return local.Add(-time.Duration(local.Minute())*time.Minute - time.Duration(local.Second())*time.Second - time.Duration(local.Nanosecond()))
+	case types.GRANULARITY_WEEK:
+		offset := (int(local.Weekday()) - c.settings.WeekStart + 7) % 7
+		return time.Date(local.Year(), local.Month(), local.Day()-offset, 0, 0, 0, 0, c.loc)
+	case types.GRANULARITY_MONTH:
+		return time.Date(local.Year(), local.Month(), 1, 0, 0, 0, 0, c.loc)
+	case types.GRANULARITY_QUARTER:
+		offset := (int(local.Month()) - c.settings.FiscalYearStartMonth + 12) % 3
+		return time.Date(local.Year(), local.Month()-time.Month(offset), 1, 0, 0, 0, 0, c.loc)
+	case types.GRANULARITY_YEAR:
+		offset := (int(local.Month()) - c.settings.FiscalYearStartMonth + 12) % 12
+		return time.Date(local.Year(), local.Month()-time.Month(offset), 1, 0, 0, 0, 0, c.loc)
+	default:
+		return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, c.loc)
+	}
+}
+
+// next returns the start of the bucket following the one starting at t
+func (c calendar) next(t time.Time, granularity string) time.Time {
+	local := t.In(c.loc)
+	switch granularity {
+	case types.GRANULARITY_MINUTE:
+		return c.truncate(local.Add(time.Minute), granularity)
+	case types.GRANULARITY_HOUR:
+		return c.truncate(local.Add(time.Hour), granularity)
+	case types.GRANULARITY_WEEK:
+		return time.Date(local.Year(), local.Month(), local.Day()+7, 0, 0, 0, 0, c.loc)
+	case types.GRANULARITY_MONTH:
+		return time.Date(local.Year(), local.Month()+1, 1, 0, 0, 0, 0, c.loc)
+	case types.GRANULARITY_QUARTER:
+		return time.Date(local.Year(), local.Month()+3, 1, 0, 0, 0, 0, c.loc)
+	case types.GRANULARITY_YEAR:
+		return time.Date(local.Year()+1, local.Month(), 1, 0, 0, 0, 0, c.loc)
+	default:
+		return time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, c.loc)
+	}
+}
+
+// previousPeriod returns the period preceding [start, end). A range made of whole calendar periods is
+// shifted back by as many periods, so that a month is compared with the previous month and a fiscal
+// year with the previous fiscal year. Other ranges are shifted back by their duration.
+func (c calendar) previousPeriod(start time.Time, end time.Time) (time.Time, time.Time) {
+	granularities := []string{types.GRANULARITY_YEAR, types.GRANULARITY_QUARTER, types.GRANULARITY_MONTH, types.GRANULARITY_WEEK, types.GRANULARITY_DAY}
+	for _, granularity := range granularities {
+		if !c.truncate(start, granularity).Equal(start) || !c.truncate(end, granularity).Equal(end) {
+			continue
+		}
+
+		previous := start
+		for bucket := start; bucket.Before(end); bucket = c.next(bucket, granularity) {
+			previous = c.truncate(previous.Add(-time.Nanosecond), granularity)
+		}
+		return previous.UTC(), start
+	}
+
+	return start.Add(-end.Sub(start)), start
+}
+
+// countBuckets returns the number of buckets covering the date range, stopping past the query limit
+func (c calendar) countBuckets(start time.Time, end time.Time, granularity string) int {
+	count := 0
+	for bucket := c.truncate(start, granularity); !bucket.After(end); bucket = c.next(bucket, granularity) {
+		count++
+		if count > maxQueryBuckets {
+			break
+		}
+	}
+	return count
+}
+
+// wholeHourOffsets reports whether the zone stays offset from UTC by whole hours over the range,
+// in which case every UTC hour lies within a single local hour
+func (c calendar) wholeHourOffsets(start time.Time, end time.Time) bool {
+	for t := start; ; t = t.Add(24 * time.Hour) {
+		if t.After(end) {
+			t = end
+		}
+		if _, offset := t.In(c.loc).Zone(); offset%3600 != 0 {
+			return false
+		}
+		if t.Equal(end) {
+			return true
+		}
+	}
+}
+
+// UpdateProjectCalendar updates the timezone, the first day of the week and the first month of the
+// fiscal year used to aggregate the events of a project
+func (s *Service) UpdateProjectCalendar(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId            uuid.UUID `json:"project_id"`
+		Timezone             string    `json:"timezone"`
+		WeekStart            int       `json:"week_start"`
+		FiscalYearStartMonth int       `json:"fiscal_year_start_month"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := time.LoadLocation(request.Timezone); err != nil || request.Timezone == "" || request.Timezone == "Local" {
+		http.Error(w, "Invalid timezone", http.StatusBadRequest)
+		return
+	}
+
+	if request.WeekStart < 0 || request.WeekStart > 6 {
+		http.Error(w, "The week must start on a day between 0 (Sunday) and 6 (Saturday)", http.StatusBadRequest)
+		return
+	}
+
+	if request.FiscalYearStartMonth < 1 || request.FiscalYearStartMonth > 12 {
+		http.Error(w, "The fiscal year must start on a month between 1 and 12", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(request.ProjectId, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	if project.UserRole != types.TEAM_OWNER && project.UserRole != types.TEAM_ADMIN {
+		http.Error(w, "You do not have the necessary role to perform this action", http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.db.UpdateProjectCalendar(project.Id, request.Timezone, request.WeekStart, request.FiscalYearStartMonth); err != nil {
+		log.Println("Error updating project calendar:", err)
+		http.Error(w, "Failed to update project calendar", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
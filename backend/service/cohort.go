@@ -0,0 +1,254 @@
+package service
+
+import (
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Limits applied to the cohort retention queries
+const (
+	defaultCohortPeriods = 8
+	maxCohortPeriods     = 24
+	maxCohorts           = 53
+)
+
+// cohortMetric reads a metric of a cohort query and its optional filter. The metric must belong
+// to the project and hold raw events. The returned error is meant to be shown to the user.
+func (s *Service) cohortMetric(query url.Values, key string, projectid uuid.UUID) (types.Metric, uuid.UUID, error) {
+	metricid, err := uuid.Parse(query.Get(key + "_metric_id"))
+	if err != nil {
+		return types.Metric{}, uuid.Nil, fmt.Errorf("Invalid %s metric ID", key)
+	}
+
+	metric, err := s.db.GetMetricById(metricid)
+	if err != nil || metric.ProjectId != projectid {
+		return types.Metric{}, uuid.Nil, fmt.Errorf("The %s metric was not found", key)
+	}
+	if metric.Type == types.FORMULA_METRIC {
+		return types.Metric{}, uuid.Nil, errors.New("Formula metrics cannot be used for cohorts")
+	}
+
+	filterid := uuid.Nil
+	if value := query.Get(key + "_filter_id"); value != "" {
+		filterid, err = uuid.Parse(value)
+		if err != nil {
+			return types.Metric{}, uuid.Nil, fmt.Errorf("Invalid %s filter ID", key)
+		}
+		if _, exists := metric.Filters[filterid]; !exists {
+			return types.Metric{}, uuid.Nil, fmt.Errorf("The %s filter does not belong to the metric", key)
+		}
+	}
+
+	return metric, filterid, nil
+}
+
+// buildCohorts lays the aggregates over the cohorts of the range. Each cohort lists its periods
+// up to the current one, the periods that have not started yet are left out.
+func buildCohorts(cal calendar, granularity string, cohorts []time.Time, periods int, aggregates []types.CohortAggregate, now time.Time) ([]types.Cohort, []*float64) {
+	sizes := make(map[time.Time]int64)
+	returns := make(map[time.Time]map[time.Time]int64)
+	for _, aggregate := range aggregates {
+		cohort := cal.truncate(aggregate.Cohort, granularity).UTC()
+		if aggregate.Period == nil {
+			sizes[cohort] += aggregate.Entities
+			continue
+		}
+		if returns[cohort] == nil {
+			returns[cohort] = make(map[time.Time]int64)
+		}
+		returns[cohort][cal.truncate(*aggregate.Period, granularity).UTC()] += aggregate.Entities
+	}
+
+	returned := make([]int64, periods+1)
+	total := make([]int64, periods+1)
+	result := make([]types.Cohort, len(cohorts))
+	for i, date := range cohorts {
+		cohort := types.Cohort{
+			Date:    date,
+			Size:    sizes[date],
+			Periods: []types.CohortPeriod{},
+		}
+
+		period := date
+		for index := 0; index <= periods && !period.After(now); index++ {
+			next := cal.next(period, granularity).UTC()
+			current := types.CohortPeriod{
+				Index:    index,
+				Date:     period,
+				Entities: returns[date][period],
+				Complete: !next.After(now),
+			}
+			if cohort.Size > 0 {
+				current.Rate = float64(current.Entities) / float64(cohort.Size)
+			}
+			if current.Complete {
+				returned[index] += current.Entities
+				total[index] += cohort.Size
+			}
+			cohort.Periods = append(cohort.Periods, current)
+			period = next
+		}
+
+		result[i] = cohort
+	}
+
+	average := make([]*float64, periods+1)
+	for index := range average {
+		if total[index] > 0 {
+			rate := float64(returned[index]) / float64(total[index])
+			average[index] = &rate
+		}
+	}
+
+	return result, average
+}
+
+// GetCohortRetention groups the entities by the week or the month of their first event of a start metric,
+// then measures the share of each cohort coming back with events of a return metric in the following
+// periods. The return metric defaults to the start metric.
+func (s *Service) GetCohortRetention(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	projectid, err := uuid.Parse(query.Get("project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	start, err := time.Parse(DateFormat, query.Get("start"))
+	if err != nil {
+		http.Error(w, "Invalid start date", http.StatusBadRequest)
+		return
+	}
+
+	end, err := time.Parse(DateFormat, query.Get("end"))
+	if err != nil {
+		http.Error(w, "Invalid end date", http.StatusBadRequest)
+		return
+	}
+
+	if end.Before(start) {
+		http.Error(w, "The end date must be after the start date", http.StatusBadRequest)
+		return
+	}
+
+	granularity := query.Get("granularity")
+	switch granularity {
+	case types.GRANULARITY_WEEK, types.GRANULARITY_MONTH:
+	case "":
+		granularity = types.GRANULARITY_WEEK
+	default:
+		http.Error(w, "Invalid granularity, it must be week or month", http.StatusBadRequest)
+		return
+	}
+
+	periods := defaultCohortPeriods
+	if value := query.Get("periods"); value != "" {
+		periods, err = strconv.Atoi(value)
+		if err != nil || periods < 1 || periods > maxCohortPeriods {
+			http.Error(w, fmt.Sprintf("The number of periods must be between 1 and %d", maxCohortPeriods), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if query.Get("return_metric_id") == "" {
+		query.Set("return_metric_id", query.Get("start_metric_id"))
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	startMetric, startFilterId, err := s.cohortMetric(query, "start", project.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	returnMetric, returnFilterId, err := s.cohortMetric(query, "return", project.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Cohorts cover whole buckets, so that the first and the last ones are not truncated
+	cal := projectCalendar(project)
+	var cohorts []time.Time
+	for bucket := cal.truncate(start, granularity); !bucket.After(end); bucket = cal.next(bucket, granularity) {
+		cohorts = append(cohorts, bucket.UTC())
+	}
+	if len(cohorts) > maxCohorts {
+		http.Error(w, fmt.Sprintf("The query would return more than %d cohorts, use a larger granularity", maxCohorts), http.StatusBadRequest)
+		return
+	}
+	cohortStart := cohorts[0]
+	cohortEnd := cal.next(cohorts[len(cohorts)-1], granularity).UTC()
+
+	plan, exists := s.plans[project.CurrentPlan]
+	if !exists {
+		http.Error(w, "Invalid subscription plan", http.StatusBadRequest)
+		return
+	}
+
+	if !isRangeAllowed(plan, cohortStart, end) {
+		http.Error(w, fmt.Sprintf("Date range exceeds plan limit of %d days", plan.Range), http.StatusUnauthorized)
+		return
+	}
+
+	// The returns are followed until the last period of the last cohort
+	now := time.Now().UTC()
+	returnEnd := cohorts[len(cohorts)-1]
+	for i := 0; i <= periods; i++ {
+		returnEnd = cal.next(returnEnd, granularity).UTC()
+	}
+	if returnEnd.After(now) {
+		returnEnd = now
+	}
+
+	aggregates, err := s.db.GetCohorts(startMetric.Id, startFilterId, returnMetric.Id, returnFilterId, cohortStart, cohortEnd, returnEnd, granularity, cal.settings)
+	if err != nil {
+		log.Println("Error fetching cohorts:", err)
+		http.Error(w, "Failed to compute cohorts", http.StatusInternalServerError)
+		return
+	}
+
+	result := types.CohortRetention{
+		StartMetricId:  startMetric.Id,
+		ReturnMetricId: returnMetric.Id,
+		Granularity:    granularity,
+		Start:          cohortStart,
+		End:            cohortEnd,
+	}
+	result.Cohorts, result.Average = buildCohorts(cal, granularity, cohorts, periods, aggregates, now)
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Failed to process cohorts", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
@@ -0,0 +1,370 @@
+package service
+
+import (
+	"Measurely/types"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Periods a range can be compared against
+const (
+	comparePrevious = "previous"
+	compareLastYear = "last_year"
+	compareOffset   = "offset"
+)
+
+// rangeAggregates computes the partial aggregates of a metric over [start, end), for every event
+// under the nil filter id and for each filter. The days fully covered by the range are read from
+// the daily rollups.
+func (s *Service) rangeAggregates(metricId uuid.UUID, start time.Time, end time.Time) (map[uuid.UUID]types.BucketAggregate, error) {
+	rollupStart := utcCalendar.truncate(start, types.GRANULARITY_DAY)
+	if rollupStart.Before(start) {
+		rollupStart = utcCalendar.next(rollupStart, types.GRANULARITY_DAY)
+	}
+	rollupEnd := utcCalendar.truncate(end, types.GRANULARITY_DAY)
+
+	var aggregates []types.FilterAggregate
+	if !rollupStart.Before(rollupEnd) {
+		raw, err := s.db.GetFilterAggregates(metricId, start, end)
+		if err != nil {
+			return nil, err
+		}
+		aggregates = raw
+	} else {
+		rollups, err := s.db.GetRollupFilterAggregates(metricId, types.GRANULARITY_DAY, rollupStart, rollupEnd)
+		if err != nil {
+			return nil, err
+		}
+		aggregates = rollups
+
+		if start.Before(rollupStart) {
+			head, err := s.db.GetFilterAggregates(metricId, start, rollupStart)
+			if err != nil {
+				return nil, err
+			}
+			aggregates = append(aggregates, head...)
+		}
+
+		if rollupEnd.Before(end) {
+			tail, err := s.db.GetFilterAggregates(metricId, rollupEnd, end)
+			if err != nil {
+				return nil, err
+			}
+			aggregates = append(aggregates, tail...)
+		}
+	}
+
+	merged := make(map[uuid.UUID]types.BucketAggregate)
+	for _, aggregate := range aggregates {
+		merged[aggregate.FilterId] = mergeAggregate(merged[aggregate.FilterId], aggregate.BucketAggregate)
+	}
+	return merged, nil
+}
+
+// formulaRangeValue evaluates a formula metric over a range [start, end). The operands are aggregated
+// over the whole range before the formula is applied, like a single bucket of a query. The metrics
+// must include the operands of the formula, as resolved for a query. An undefined value is zero.
+func (s *Service) formulaRangeValue(metric types.Metric, metrics map[uuid.UUID]types.Metric, start time.Time, end time.Time, aggregation string) (float64, error) {
+	values := make(map[uuid.UUID]float64)
+	for _, operand := range metrics {
+		if operand.Type == types.FORMULA_METRIC {
+			continue
+		}
+		aggregates, err := s.rangeAggregates(operand.Id, start, end)
+		if err != nil {
+			return 0, err
+		}
+		values[operand.Id] = finalizeBucket(aggregates[uuid.Nil], start, operand.Type, aggregation).Value
+	}
+
+	scale := formulaScale(aggregation)
+	value, ok := formulaEvaluator(metrics)(metric, func(operand types.Metric) float64 {
+		return values[operand.Id] / scale
+	})
+	if !ok {
+		return 0, nil
+	}
+	return value * scale, nil
+}
+
+// defaultComparison returns the aggregation compared for each type of metric
+func defaultComparison(metricType int) string {
+	switch metricType {
+	case types.AVERAGE_METRIC:
+		return types.AGGREGATION_AVG
+	case types.DUAL_METRIC:
+		return types.AGGREGATION_NET
+	default:
+		return types.AGGREGATION_SUM
+	}
+}
+
+// periodChange computes the absolute and relative change between two values. The relative change
+// is left empty when the previous value is zero.
+func periodChange(current float64, previous float64) types.PeriodChange {
+	change := types.PeriodChange{
+		Current:  current,
+		Previous: previous,
+		Change:   current - previous,
+	}
+
+	if previous != 0 {
+		percent := (current - previous) / math.Abs(previous) * 100
+		change.ChangePercent = &percent
+	}
+
+	return change
+}
+
+// CompareMetricPeriods compares the value of a metric over a range with the previous period, the same
+// period of the previous year or the range shifted back by a number of days. The change is reported
+// for the whole metric and for each of its filters.
+func (s *Service) CompareMetricPeriods(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+		return
+	}
+
+	// Parse query params
+	query := r.URL.Query()
+	metricid, err := uuid.Parse(query.Get("metric_id"))
+	if err != nil {
+		http.Error(w, "Invalid metric ID", http.StatusBadRequest)
+		return
+	}
+
+	projectid, err := uuid.Parse(query.Get("project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	start, err := time.Parse(DateFormat, query.Get("start"))
+	if err != nil {
+		http.Error(w, "Invalid start date", http.StatusBadRequest)
+		return
+	}
+
+	end, err := time.Parse(DateFormat, query.Get("end"))
+	if err != nil {
+		http.Error(w, "Invalid end date", http.StatusBadRequest)
+		return
+	}
+
+	if end.Before(start) {
+		http.Error(w, "The end date must be after the start date", http.StatusBadRequest)
+		return
+	}
+
+	compare := query.Get("compare")
+	if compare == "" {
+		compare = comparePrevious
+	}
+
+	offsetDays := 0
+	switch compare {
+	case comparePrevious, compareLastYear:
+	case compareOffset:
+		offsetDays, err = strconv.Atoi(query.Get("offset_days"))
+		if err != nil || offsetDays < 1 {
+			http.Error(w, "Invalid offset, it must be a positive number of days", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Invalid comparison", http.StatusBadRequest)
+		return
+	}
+
+	aggregation := query.Get("aggregation")
+	switch aggregation {
+	case "", types.AGGREGATION_SUM, types.AGGREGATION_COUNT, types.AGGREGATION_AVG, types.AGGREGATION_MIN, types.AGGREGATION_MAX, types.AGGREGATION_NET:
+	default:
+		http.Error(w, "Invalid aggregation", http.StatusBadRequest)
+		return
+	}
+
+	// Validate access
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err != nil {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+
+	metric, err := s.db.GetMetricById(metricid)
+	if err != nil || metric.ProjectId != project.Id {
+		http.Error(w, "Unauthorized access to metric", http.StatusUnauthorized)
+		return
+	}
+
+	if aggregation == "" {
+		aggregation = defaultComparison(metric.Type)
+	}
+	if aggregation == types.AGGREGATION_NET && metric.Type != types.DUAL_METRIC && metric.Type != types.FORMULA_METRIC {
+		http.Error(w, "The net aggregation is only available for dual metrics", http.StatusBadRequest)
+		return
+	}
+
+	// The periods are shifted in the timezone of the project, so that days keep lining up
+	cal := projectCalendar(project)
+	currentStart := start
+	currentEnd := rangeEnd(end)
+
+	var previousStart, previousEnd time.Time
+	switch compare {
+	case comparePrevious:
+		previousStart, previousEnd = cal.previousPeriod(currentStart, currentEnd)
+	case compareLastYear:
+		previousStart = currentStart.In(cal.loc).AddDate(-1, 0, 0).UTC()
+		previousEnd = currentEnd.In(cal.loc).AddDate(-1, 0, 0).UTC()
+	case compareOffset:
+		previousStart = currentStart.In(cal.loc).AddDate(0, 0, -offsetDays).UTC()
+		previousEnd = currentEnd.In(cal.loc).AddDate(0, 0, -offsetDays).UTC()
+	}
+
+	plan, exists := s.plans[project.CurrentPlan]
+	if !exists {
+		http.Error(w, "Invalid subscription plan", http.StatusBadRequest)
+		return
+	}
+
+	// Each period is bound by the range of the plan, the previous one can lie further back
+	if !isRangeAllowed(plan, currentStart, end) || !isRangeAllowed(plan, previousStart, previousEnd.Add(-time.Microsecond)) {
+		http.Error(w, fmt.Sprintf("Date range exceeds plan limit of %d days", plan.Range), http.StatusUnauthorized)
+		return
+	}
+
+	if metric.Type == types.FORMULA_METRIC {
+		s.compareFormulaPeriods(w, project, metric, aggregation, currentStart, end, previousStart, previousEnd)
+		return
+	}
+
+	current, err := s.rangeAggregates(metric.Id, currentStart, currentEnd)
+	if err != nil {
+		log.Printf("Error comparing events: %v", err)
+		http.Error(w, "Failed to compare events", http.StatusInternalServerError)
+		return
+	}
+
+	previous, err := s.rangeAggregates(metric.Id, previousStart, previousEnd)
+	if err != nil {
+		log.Printf("Error comparing events: %v", err)
+		http.Error(w, "Failed to compare events", http.StatusInternalServerError)
+		return
+	}
+
+	value := func(aggregates map[uuid.UUID]types.BucketAggregate, filterid uuid.UUID) float64 {
+		return finalizeBucket(aggregates[filterid], time.Time{}, metric.Type, aggregation).Value
+	}
+
+	comparison := types.MetricComparison{
+		MetricId:      metric.Id,
+		MetricName:    metric.Name,
+		MetricType:    metric.Type,
+		Aggregation:   aggregation,
+		CurrentStart:  currentStart,
+		CurrentEnd:    end,
+		PreviousStart: previousStart,
+		PreviousEnd:   previousEnd.Add(-time.Microsecond),
+		Total:         periodChange(value(current, uuid.Nil), value(previous, uuid.Nil)),
+		Filters:       []types.FilterChange{},
+	}
+
+	if metric.Type == types.DUAL_METRIC {
+		valuePos := periodChange(float64(current[uuid.Nil].SumPos), float64(previous[uuid.Nil].SumPos))
+		valueNeg := periodChange(float64(current[uuid.Nil].SumNeg), float64(previous[uuid.Nil].SumNeg))
+		comparison.ValuePos = &valuePos
+		comparison.ValueNeg = &valueNeg
+	}
+
+	for filterid, filter := range metric.Filters {
+		comparison.Filters = append(comparison.Filters, types.FilterChange{
+			FilterId:     filterid,
+			Name:         filter.Name,
+			Category:     filter.Category,
+			PeriodChange: periodChange(value(current, filterid), value(previous, filterid)),
+		})
+	}
+	sort.Slice(comparison.Filters, func(i, j int) bool {
+		a, b := comparison.Filters[i], comparison.Filters[j]
+		if a.Category != b.Category {
+			return a.Category < b.Category
+		}
+		return a.Name < b.Name
+	})
+
+	bytes, err := json.Marshal(comparison)
+	if err != nil {
+		http.Error(w, "Failed to process comparison", http.StatusInternalServerError)
+		return
+	}
+
+	// Cache results
+	if end.Before(time.Now()) {
+		SetupCacheControl(w, 100000000)
+	} else {
+		SetupCacheControl(w, 5)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// compareFormulaPeriods compares the value of a formula metric over two periods. Formulas have no
+// filters, so only the total of the metric is compared.
+func (s *Service) compareFormulaPeriods(w http.ResponseWriter, project types.Project, metric types.Metric, aggregation string, currentStart time.Time, end time.Time, previousStart time.Time, previousEnd time.Time) {
+	metrics, err := s.resolveQueryMetrics(metricQuery{metricIds: []uuid.UUID{metric.Id}, aggregation: aggregation}, project.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	current, err := s.formulaRangeValue(metric, metrics, currentStart, rangeEnd(end), aggregation)
+	if err != nil {
+		log.Printf("Error comparing events: %v", err)
+		http.Error(w, "Failed to compare events", http.StatusInternalServerError)
+		return
+	}
+
+	previous, err := s.formulaRangeValue(metric, metrics, previousStart, previousEnd, aggregation)
+	if err != nil {
+		log.Printf("Error comparing events: %v", err)
+		http.Error(w, "Failed to compare events", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(types.MetricComparison{
+		MetricId:      metric.Id,
+		MetricName:    metric.Name,
+		MetricType:    metric.Type,
+		Aggregation:   aggregation,
+		CurrentStart:  currentStart,
+		CurrentEnd:    end,
+		PreviousStart: previousStart,
+		PreviousEnd:   previousEnd.Add(-time.Microsecond),
+		Total:         periodChange(current, previous),
+		Filters:       []types.FilterChange{},
+	})
+	if err != nil {
+		http.Error(w, "Failed to process comparison", http.StatusInternalServerError)
+		return
+	}
+
+	// Cache results
+	if end.Before(time.Now()) {
+		SetupCacheControl(w, 100000000)
+	} else {
+		SetupCacheControl(w, 5)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
@@ -0,0 +1,415 @@
+package service
+
+import (
+	"Measurely/db"
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Bounds of the dead-letter store. Each API key stores at most deadLetterRate rejected events per
+// minute and a replay records at most maxReplayEvents events, the rest is left for the next replay.
+const (
+	deadLetterQueueSize = 1000
+	deadLetterRate      = 60
+	maxReplayEvents     = 5000
+)
+
+// deadLetter is a rejected event waiting to be stored
+type deadLetter struct {
+	apikey     string
+	identifier string
+	payload    []byte
+	reason     string
+	message    string
+}
+
+// isDeadLettered reports whether the rejections of a reason are stored. Events rejected because of the
+// API key belong to no project, so they are only answered to the client. The events over the quota are
+// kept to be replayed once the quota allows it, the rate of the store bounding how many are written.
+func isDeadLettered(reason string) bool {
+	switch reason {
+	case types.REJECT_UNAUTHORIZED, types.REJECT_PROJECT_NOT_FOUND:
+		return false
+	}
+	return true
+}
+
+// queueDeadLetter hands a rejected event to the dead-letter writer. The event is dropped when its API
+// key exceeds the rate of the store or when the writer falls behind.
+func (s *Service) queueDeadLetter(apikey string, identifier string, payload []byte, reason string, message string) {
+	if !isDeadLettered(reason) || !s.deadLetterCap.allow(apikey) {
+		return
+	}
+
+	select {
+	case s.deadLetters <- deadLetter{apikey, identifier, payload, reason, message}:
+	default:
+	}
+}
+
+// writeDeadLetters stores the queued rejected events until the queue is closed
+func (s *Service) writeDeadLetters() {
+	defer close(s.deadLetterEnd)
+	for letter := range s.deadLetters {
+		s.deadLetterEvent(letter.apikey, letter.identifier, letter.payload, letter.reason, letter.message)
+	}
+}
+
+// deadLetterEvent stores an event rejected by the ingestion pipeline so it can be inspected and replayed.
+// Events sent with an API key that does not belong to any project are dropped.
+func (s *Service) deadLetterEvent(apikey string, identifier string, payload []byte, reason string, message string) {
+	projectCache, err := s.GetProjectCache(apikey)
+	if err != nil || projectCache.id == uuid.Nil {
+		return
+	}
+
+	if err := s.db.CreateDeadLetter(types.DeadLetter{
+		ProjectId:        projectCache.id,
+		MetricIdentifier: identifier,
+		Payload:          string(payload),
+		Reason:           reason,
+		Message:          message,
+	}); err != nil {
+		log.Printf("Error storing dead letter: %v", err)
+	}
+}
+
+// ListDeadLetters returns the rejected events of a project, most recent first
+func (s *Service) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			log.Println("Error fetching project:", err)
+			http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if project.UserRole == types.TEAM_GUEST {
+		http.Error(w, "You do not have the necessary role to perform this action", http.StatusUnauthorized)
+		return
+	}
+
+	letters, err := s.db.GetDeadLetters(projectid, query.Get("reason"), limit, offset)
+	if err != nil {
+		log.Println("Error fetching dead letters:", err)
+		http.Error(w, "Failed to retrieve rejected events", http.StatusInternalServerError)
+		return
+	}
+	if letters == nil {
+		letters = []types.DeadLetter{}
+	}
+
+	body, err := json.Marshal(letters)
+	if err != nil {
+		http.Error(w, "Failed to process rejected events", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// GetDeadLetter returns a single rejected event with its payload
+func (s *Service) GetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	letterid, err := uuid.Parse(chi.URLParam(r, "dead_letter_id"))
+	if err != nil {
+		http.Error(w, "Invalid rejected event ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			log.Println("Error fetching project:", err)
+			http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if project.UserRole == types.TEAM_GUEST {
+		http.Error(w, "You do not have the necessary role to perform this action", http.StatusUnauthorized)
+		return
+	}
+
+	letter, err := s.db.GetDeadLetter(letterid, projectid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Rejected event not found", http.StatusNotFound)
+		} else {
+			log.Println("Error fetching dead letter:", err)
+			http.Error(w, "Failed to retrieve rejected event", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	body, err := json.Marshal(letter)
+	if err != nil {
+		http.Error(w, "Failed to process rejected event", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// replayEvent records count occurrences of a prepared event in the same batches, and returns the
+// number of occurrences recorded
+func (s *Service) replayEvent(event preparedEvent, count int) (int, error) {
+	events := make([]db.MetricEventData, count)
+	for i := range events {
+		events[i] = db.MetricEventData{
+			MetricID:  event.metric.metric_id,
+			ProjectID: event.project.id,
+			ToAdd:     event.pos,
+			ToRemove:  event.neg,
+			Filters:   event.filters,
+			EntityId:  event.entity,
+		}
+	}
+
+	replayed, monthlyCount := 0, event.project.event_count
+	var err error
+	for _, result := range s.bm.QueueEvents(events) {
+		if result.Error != nil {
+			err = result.Error
+			continue
+		}
+		replayed++
+		monthlyCount = max(monthlyCount, result.MonthlyCount)
+	}
+
+	s.projectsCache.Store(event.project.api_key, ProjectCache{
+		api_key:             event.project.api_key,
+		id:                  event.project.id,
+		event_count:         monthlyCount,
+		monthly_event_limit: event.project.monthly_event_limit,
+	})
+	return replayed, err
+}
+
+// ReplayDeadLetters sends rejected events through the ingestion pipeline again.
+// Replayed events are recorded at the time of the replay and removed from the store,
+// while events that are rejected again are kept with their new reason. A replay records
+// at most maxReplayEvents events, the occurrences left over are kept for the next replay.
+func (s *Service) ReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId uuid.UUID   `json:"project_id"`
+		Ids       []uuid.UUID `json:"ids"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(request.Ids) == 0 || len(request.Ids) > 500 {
+		http.Error(w, "Between 1 and 500 rejected events can be replayed at once", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(request.ProjectId, token.Id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			log.Println("Error fetching project:", err)
+			http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if project.UserRole == types.TEAM_GUEST {
+		http.Error(w, "You do not have the necessary role to perform this action", http.StatusUnauthorized)
+		return
+	}
+
+	letters, err := s.db.GetDeadLettersByIds(request.ProjectId, request.Ids)
+	if err != nil {
+		log.Println("Error fetching dead letters:", err)
+		http.Error(w, "Failed to retrieve rejected events", http.StatusInternalServerError)
+		return
+	}
+
+	type ReplayFailure struct {
+		Id      uuid.UUID `json:"id"`
+		Reason  string    `json:"reason"`
+		Message string    `json:"message"`
+	}
+
+	response := struct {
+		Replayed  int             `json:"replayed"`
+		Remaining int             `json:"remaining"`
+		Failed    []ReplayFailure `json:"failed"`
+	}{
+		Failed: []ReplayFailure{},
+	}
+
+	for _, letter := range letters {
+		reason, message := "", ""
+		remaining := letter.Occurrences
+
+		budget := maxReplayEvents - response.Replayed
+		if budget <= 0 {
+			response.Remaining += remaining
+			continue
+		}
+
+		var payload eventPayload
+		if err := json.Unmarshal([]byte(letter.Payload), &payload); err != nil {
+			reason, message = types.REJECT_INVALID_BODY, "Invalid request body"
+		} else if event, eerr := s.prepareMetricEvent(project.ApiKey, letter.MetricIdentifier, payload); eerr != nil {
+			reason, message = eerr.reason, eerr.message
+		} else {
+			replayed, err := s.replayEvent(event, min(remaining, budget))
+			remaining -= replayed
+			response.Replayed += replayed
+			if err != nil {
+				log.Printf("Error replaying dead letter: %v", err)
+				reason, message = types.REJECT_PROCESSING_FAILED, err.Error()
+			}
+		}
+
+		if reason == "" && remaining > 0 {
+			if err := s.db.UpdateDeadLetterOccurrences(letter.Id, remaining); err != nil {
+				log.Println("Error updating dead letter:", err)
+			}
+			response.Remaining += remaining
+			continue
+		}
+
+		if reason == "" {
+			if err := s.db.DeleteDeadLetter(letter.Id); err != nil {
+				log.Println("Error deleting dead letter:", err)
+			}
+			continue
+		}
+
+		if err := s.db.UpdateDeadLetterFailure(letter.Id, reason, message, remaining); err != nil {
+			log.Println("Error updating dead letter:", err)
+		}
+		response.Failed = append(response.Failed, ReplayFailure{
+			Id:      letter.Id,
+			Reason:  reason,
+			Message: message,
+		})
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Failed to process replay results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// PurgeDeadLetters deletes rejected events of a project, either by id or by reason
+func (s *Service) PurgeDeadLetters(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId uuid.UUID   `json:"project_id"`
+		Ids       []uuid.UUID `json:"ids"`
+		Reason    string      `json:"reason"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(request.ProjectId, token.Id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			log.Println("Error fetching project:", err)
+			http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if project.UserRole != types.TEAM_OWNER && project.UserRole != types.TEAM_ADMIN {
+		http.Error(w, "You do not have the necessary role to perform this action", http.StatusUnauthorized)
+		return
+	}
+
+	deleted, err := s.db.DeleteDeadLetters(request.ProjectId, request.Ids, request.Reason)
+	if err != nil {
+		log.Println("Error purging dead letters:", err)
+		http.Error(w, "Failed to purge rejected events", http.StatusInternalServerError)
+		return
+	}
+
+	body, err := json.Marshal(struct {
+		Deleted int64 `json:"deleted"`
+	}{
+		Deleted: deleted,
+	})
+	if err != nil {
+		http.Error(w, "Failed to process purge results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -0,0 +1,464 @@
+package service
+
+import (
+	"Measurely/db"
+	"Measurely/email"
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Settings of the digest emails. Digests are sent a while after their period ends, so that the late
+// events are counted, and retried later when the email could not be sent.
+const (
+	digestInterval   = 15 * time.Minute
+	digestDelay      = time.Hour
+	digestRetry      = time.Hour
+	maxDigestMetrics = 20
+	digestTopFilters = 3
+)
+
+// digestGranularity returns the bucket covered by a digest of the given frequency
+func digestGranularity(frequency string) string {
+	if frequency == types.DIGEST_MONTHLY {
+		return types.GRANULARITY_MONTH
+	}
+	return types.GRANULARITY_WEEK
+}
+
+// nextDigestSend returns the date the next digest is due, after the end of the current period
+func nextDigestSend(cal calendar, frequency string, now time.Time) time.Time {
+	granularity := digestGranularity(frequency)
+	return cal.next(cal.truncate(now, granularity), granularity).Add(digestDelay).UTC()
+}
+
+// digestPeriod returns the last complete period at the given date, in the calendar of the project
+func digestPeriod(cal calendar, frequency string, now time.Time) (time.Time, time.Time) {
+	granularity := digestGranularity(frequency)
+	end := cal.truncate(now, granularity)
+	return cal.truncate(end.Add(-time.Nanosecond), granularity), end
+}
+
+// SendDigests sends the digests that are due. Only one replica sends them at a time, so that every
+// digest is sent once.
+func (s *Service) SendDigests() {
+	locked, err := s.db.WithAdvisoryLock(db.LOCK_DIGESTS, s.sendDueDigests)
+	if err != nil {
+		log.Println("Failed to acquire the digests lock:", err)
+	} else if !locked {
+		log.Println("Digests already sent on another instance, skipping")
+	}
+}
+
+func (s *Service) sendDueDigests() {
+	now := time.Now().UTC()
+	subscriptions, err := s.db.GetDueDigestSubscriptions(now)
+	if err != nil {
+		log.Println("Failed to fetch due digests:", err)
+		return
+	}
+
+	for _, subscription := range subscriptions {
+		if s.scheduler.Stopping() {
+			return
+		}
+		s.sendDigest(subscription, now)
+	}
+}
+
+// sendDigest sends a digest and schedules the next one. The digests of the users who left the
+// project are removed.
+func (s *Service) sendDigest(subscription types.DigestSubscription, now time.Time) {
+	project, err := s.db.GetProject(subscription.ProjectId, subscription.UserId)
+	if err == sql.ErrNoRows {
+		if err := s.db.DeleteDigestSubscription(subscription.ProjectId, subscription.UserId); err != nil {
+			log.Println("Failed to delete digest subscription:", err)
+		}
+		return
+	} else if err != nil {
+		log.Println("Failed to fetch the project of a digest:", err)
+		return
+	}
+
+	cal := projectCalendar(project)
+	nextSend := nextDigestSend(cal, subscription.Frequency, now)
+
+	fields, err := s.buildDigest(project, subscription, now)
+	if err == nil {
+		var user types.User
+		user, err = s.db.GetUserById(subscription.UserId)
+		if err == nil {
+			fields.To = user.Email
+			err = s.email.SendDigest(fields)
+		}
+	}
+
+	if err != nil {
+		log.Printf("Failed to send digest %s: %v", subscription.Id, err)
+		if err := s.db.UpdateDigestSchedule(subscription.Id, nil, now.Add(digestRetry)); err != nil {
+			log.Println("Failed to update digest schedule:", err)
+		}
+		return
+	}
+
+	if err := s.db.UpdateDigestSchedule(subscription.Id, &now, nextSend); err != nil {
+		log.Println("Failed to update digest schedule:", err)
+	}
+}
+
+// buildDigest computes the values of the metrics of a digest over the last complete period, along with
+// the previous period and the filters with the highest values
+func (s *Service) buildDigest(project types.Project, subscription types.DigestSubscription, now time.Time) (email.DigestFields, error) {
+	cal := projectCalendar(project)
+	granularity := digestGranularity(subscription.Frequency)
+	start, end := digestPeriod(cal, subscription.Frequency, now)
+	previousStart := cal.truncate(start.Add(-time.Nanosecond), granularity)
+
+	fields := email.DigestFields{
+		Subject:     fmt.Sprintf("Your %s digest of %s", subscription.Frequency, project.Name),
+		ProjectName: project.Name,
+		Period:      formatDigestPeriod(subscription.Frequency, start, end),
+		Metrics:     []email.DigestMetric{},
+		Link:        GetOrigin(),
+	}
+
+	metrics, err := s.db.GetMetrics(project.Id)
+	if err != nil {
+		return email.DigestFields{}, err
+	}
+
+	byId := make(map[uuid.UUID]types.Metric, len(metrics))
+	for _, metric := range metrics {
+		byId[metric.Id] = metric
+	}
+
+	// Metrics deleted since the digest was set up are skipped
+	var included []types.Metric
+	if len(subscription.MetricIds) == 0 {
+		included = metrics
+	} else {
+		for _, metricid := range subscription.MetricIds {
+			if metric, exists := byId[metricid]; exists {
+				included = append(included, metric)
+			}
+		}
+	}
+	if len(included) > maxDigestMetrics {
+		included = included[:maxDigestMetrics]
+	}
+
+	for _, metric := range included {
+		aggregation := defaultComparison(metric.Type)
+		series, err := s.runMetricQuery(metricQuery{
+			metricIds:   []uuid.UUID{metric.Id},
+			start:       previousStart,
+			end:         end.Add(-time.Microsecond),
+			granularity: granularity,
+			aggregation: aggregation,
+			calendar:    cal,
+		}, byId)
+		if err != nil {
+			return email.DigestFields{}, err
+		}
+
+		var previous, current float64
+		if len(series) == 1 && len(series[0].Buckets) == 2 {
+			previous = series[0].Buckets[0].Value
+			current = series[0].Buckets[1].Value
+		}
+
+		unit := valueUnit(aggregation)
+		symbol := unitSymbol(project, metric)
+		change := periodChange(current/unit, previous/unit)
+
+		digestMetric := email.DigestMetric{
+			Name:     metric.Name,
+			Value:    formatDigestValue(change.Current, symbol),
+			Previous: formatDigestValue(change.Previous, symbol),
+			Trend:    "flat",
+		}
+		if change.Change > 0 {
+			digestMetric.Trend = "up"
+		} else if change.Change < 0 {
+			digestMetric.Trend = "down"
+		}
+		if change.ChangePercent != nil {
+			digestMetric.Change = fmt.Sprintf("%+.1f%%", *change.ChangePercent)
+		} else if change.Current != 0 {
+			digestMetric.Change = "New"
+		}
+
+		if metric.Type != types.FORMULA_METRIC && len(metric.Filters) > 0 {
+			digestMetric.TopFilters, err = s.digestTopFilters(metric, aggregation, symbol, start, end)
+			if err != nil {
+				return email.DigestFields{}, err
+			}
+		}
+
+		fields.Metrics = append(fields.Metrics, digestMetric)
+	}
+
+	return fields, nil
+}
+
+// digestTopFilters returns the filters of a metric with the highest values over [start, end)
+func (s *Service) digestTopFilters(metric types.Metric, aggregation string, symbol string, start time.Time, end time.Time) ([]email.DigestFilter, error) {
+	aggregates, err := s.rangeAggregates(metric.Id, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	type filterValue struct {
+		label string
+		value float64
+	}
+
+	var values []filterValue
+	for filterid, aggregate := range aggregates {
+		filter, exists := metric.Filters[filterid]
+		if filterid == uuid.Nil || !exists || aggregate.Count == 0 {
+			continue
+		}
+
+		label := filter.Name
+		if filter.Category != "" {
+			label = filter.Category + ": " + filter.Name
+		}
+		bucket := finalizeBucket(aggregate, start, metric.Type, aggregation)
+		values = append(values, filterValue{label: label, value: bucket.Value / valueUnit(aggregation)})
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].value != values[j].value {
+			return values[i].value > values[j].value
+		}
+		return values[i].label < values[j].label
+	})
+	if len(values) > digestTopFilters {
+		values = values[:digestTopFilters]
+	}
+
+	filters := make([]email.DigestFilter, len(values))
+	for i, value := range values {
+		filters[i] = email.DigestFilter{Label: value.label, Value: formatDigestValue(value.value, symbol)}
+	}
+	return filters, nil
+}
+
+// unitSymbol returns the symbol of the unit of a metric. Units missing from the project are shown as is.
+func unitSymbol(project types.Project, metric types.Metric) string {
+	for _, unit := range project.Units {
+		if unit.Name == metric.Unit {
+			return unit.Symbol
+		}
+	}
+	return metric.Unit
+}
+
+// formatDigestValue rounds a value to two decimals and separates its thousands
+func formatDigestValue(value float64, symbol string) string {
+	formatted := strconv.FormatFloat(math.Abs(math.Round(value*100)/100), 'f', -1, 64)
+	integer, decimals, _ := strings.Cut(formatted, ".")
+
+	var builder strings.Builder
+	if value <= -0.005 {
+		builder.WriteByte('-')
+	}
+	for i, digit := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			builder.WriteByte(',')
+		}
+		builder.WriteRune(digit)
+	}
+	if decimals != "" {
+		builder.WriteString("." + decimals)
+	}
+	if symbol != "" {
+		builder.WriteString(" " + symbol)
+	}
+	return builder.String()
+}
+
+// formatDigestPeriod describes the period covered by a digest, end excluded
+func formatDigestPeriod(frequency string, start time.Time, end time.Time) string {
+	if frequency == types.DIGEST_MONTHLY {
+		return start.Format("January 2006")
+	}
+	last := end.Add(-time.Nanosecond)
+	return fmt.Sprintf("Week of %s to %s", start.Format("January 2"), last.Format("January 2, 2006"))
+}
+
+// GetDigestSubscription returns the digest the user receives for a project
+func (s *Service) GetDigestSubscription(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	subscription, err := s.db.GetDigestSubscription(project.Id, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Digest not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching digest subscription:", err)
+		http.Error(w, "Failed to retrieve digest", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(subscription)
+	if err != nil {
+		http.Error(w, "Failed to process digest", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// UpdateDigestSubscription sets up the digest the user receives for a project. Every member of the
+// project can receive a digest, and the next one is scheduled after the end of the current period.
+func (s *Service) UpdateDigestSubscription(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId uuid.UUID   `json:"project_id"`
+		Frequency string      `json:"frequency"`
+		MetricIds []uuid.UUID `json:"metric_ids"`
+		Enabled   *bool       `json:"enabled"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Frequency != types.DIGEST_WEEKLY && request.Frequency != types.DIGEST_MONTHLY {
+		http.Error(w, "Invalid frequency, it must be weekly or monthly", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(request.ProjectId, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	metrics, err := s.db.GetMetrics(project.Id)
+	if err != nil {
+		log.Println("Error fetching metrics:", err)
+		http.Error(w, "Failed to retrieve metrics", http.StatusInternalServerError)
+		return
+	}
+
+	exists := make(map[uuid.UUID]bool, len(metrics))
+	for _, metric := range metrics {
+		exists[metric.Id] = true
+	}
+
+	metricIds := []uuid.UUID{}
+	seen := make(map[uuid.UUID]bool, len(request.MetricIds))
+	for _, metricid := range request.MetricIds {
+		if !exists[metricid] {
+			http.Error(w, "Metric not found", http.StatusNotFound)
+			return
+		}
+		if !seen[metricid] {
+			seen[metricid] = true
+			metricIds = append(metricIds, metricid)
+		}
+	}
+	if len(metricIds) > maxDigestMetrics {
+		http.Error(w, fmt.Sprintf("A digest includes at most %d metrics", maxDigestMetrics), http.StatusBadRequest)
+		return
+	}
+
+	enabled := true
+	if request.Enabled != nil {
+		enabled = *request.Enabled
+	}
+
+	subscription, err := s.db.UpsertDigestSubscription(types.DigestSubscription{
+		ProjectId: project.Id,
+		UserId:    token.Id,
+		Frequency: request.Frequency,
+		MetricIds: metricIds,
+		Enabled:   enabled,
+		NextSend:  nextDigestSend(projectCalendar(project), request.Frequency, time.Now()),
+	})
+	if err != nil {
+		log.Println("Error updating digest subscription:", err)
+		http.Error(w, "Failed to update digest", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(subscription)
+	if err != nil {
+		http.Error(w, "Failed to process digest", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+func (s *Service) DeleteDigestSubscription(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId uuid.UUID `json:"project_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.db.DeleteDigestSubscription(request.ProjectId, token.Id); err != nil {
+		log.Println("Error deleting digest subscription:", err)
+		http.Error(w, "Failed to delete digest", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -1,13 +1,20 @@
 package service
 
 import (
+	"Measurely/db"
 	"Measurely/types"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +25,14 @@ import (
 // Regex for validating filter names/values - allows alphanumeric and selected special chars
 var validFilterRegex = regexp.MustCompile(`^[a-zA-Z0-9 _\-/\$%#&\*\(\)!~]+$`)
 
+// Names taken by the routes of the public API, a metric named after them could not receive events by name
+var reservedMetricNames = []string{"read"}
+
+// isReservedMetricName reports whether a metric name is shadowed by a route of the public API
+func isReservedMetricName(name string) bool {
+	return slices.Contains(reservedMetricNames, name)
+}
+
 // Duration to cache metric data
 const CacheDuration = 15 * time.Minute
 
@@ -98,62 +113,75 @@ func (s *Service) VerifyKeyToMetricName(metricname string, apikey string) bool {
 	return true
 }
 
-// CreateMetricEventV1 creates a new metric event
-func (s *Service) CreateMetricEventV1(w http.ResponseWriter, r *http.Request) {
-	// Extract and validate auth token
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" || len(authHeader) < 8 || authHeader[:7] != "Bearer " {
-		http.Error(w, "Invalid or missing Authorization header", http.StatusUnauthorized)
-		return
-	}
-	apikey := authHeader[7:]
+// Limits of the ingested events. The body limit leaves plenty of room for the filters.
+const (
+	maxEventBodySize  = 64 << 10
+	maxEntityIdLength = 128
+)
 
+// eventPayload is the body accepted by the ingestion endpoints. The entity id identifies the user or
+// account behind the event, so that analyses can follow it across metrics.
+type eventPayload struct {
+	Value    float32           `json:"value"`
+	Filters  map[string]string `json:"filters"`
+	EntityId string            `json:"entity_id"`
+}
+
+// eventError describes why the ingestion pipeline rejected an event
+type eventError struct {
+	status  int
+	reason  string
+	message string
+}
+
+// preparedEvent is an event that passed every ingestion check and is ready to be queued
+type preparedEvent struct {
+	metric  MetricCache
+	project ProjectCache
+	pos     int32
+	neg     int32
+	filters map[string]string
+	entity  string
+}
+
+// prepareMetricEvent runs the ingestion checks on an event without writing anything
+func (s *Service) prepareMetricEvent(apikey string, identifier string, payload eventPayload) (preparedEvent, *eventError) {
 	// Get metric identifier (ID or name)
-	metricid, err := uuid.Parse(chi.URLParam(r, "metric_identifier"))
-	metricname := chi.URLParam(r, "metric_identifier")
+	metricid, err := uuid.Parse(identifier)
+	metricname := identifier
 	useName := metricname != "" && err != nil
 
 	if metricname == "" && err != nil {
-		http.Error(w, "Invalid metric ID", http.StatusBadRequest)
-		return
-	}
-
-	// Parse and validate request
-	var request struct {
-		Value   float32           `json:"value"`
-		Filters map[string]string `json:"filters"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+		return preparedEvent{}, &eventError{http.StatusBadRequest, types.REJECT_INVALID_METRIC, "Invalid metric ID"}
 	}
 
 	// Format and validate filters
-	formattedFilters := make(map[string]string, len(request.Filters))
-	for key, value := range request.Filters {
+	formattedFilters := make(map[string]string, len(payload.Filters))
+	for key, value := range payload.Filters {
 		key = strings.ToLower(strings.TrimSpace(key))
 		value = strings.ToLower(strings.TrimSpace(value))
 
 		if !validFilterRegex.MatchString(key) || !validFilterRegex.MatchString(value) {
-			http.Error(w, "Invalid filter format", http.StatusBadRequest)
-			return
+			return preparedEvent{}, &eventError{http.StatusBadRequest, types.REJECT_INVALID_FILTER, "Invalid filter format"}
 		}
 		formattedFilters[key] = value
 	}
 
+	entity := strings.TrimSpace(payload.EntityId)
+	if len(entity) > maxEntityIdLength {
+		return preparedEvent{}, &eventError{http.StatusBadRequest, types.REJECT_INVALID_ENTITY, fmt.Sprintf("The entity ID must be at most %d characters", maxEntityIdLength)}
+	}
+
 	// Verify access
 	var value any
 	if useName {
 		if !s.VerifyKeyToMetricName(metricname, apikey) {
-			http.Error(w, "Invalid API key or metric name", http.StatusUnauthorized)
-			return
+			return preparedEvent{}, &eventError{http.StatusUnauthorized, types.REJECT_UNAUTHORIZED, "Invalid API key or metric name"}
 		}
 		value, _ = s.metricsCache.Load(apikey + metricname)
 	} else {
 		if !s.VerifyKeyToMetricId(metricid, apikey) {
-			http.Error(w, "Invalid API key or metric ID", http.StatusUnauthorized)
-			return
+			return preparedEvent{}, &eventError{http.StatusUnauthorized, types.REJECT_UNAUTHORIZED, "Invalid API key or metric ID"}
 		}
 		value, _ = s.metricsCache.Load(metricid)
 	}
@@ -162,57 +190,258 @@ func (s *Service) CreateMetricEventV1(w http.ResponseWriter, r *http.Request) {
 	projectCache, err := s.GetProjectCache(metricCache.key)
 	if err != nil {
 		log.Printf("Error getting project cache: %v", err)
-		http.Error(w, "Project not found", http.StatusNotFound)
-		return
+		return preparedEvent{}, &eventError{http.StatusNotFound, types.REJECT_PROJECT_NOT_FOUND, "Project not found"}
 	}
 
 	// Validate limits and rules
 	if projectCache.event_count > projectCache.monthly_event_limit {
-		http.Error(w, fmt.Sprintf("Monthly event limit exceeded: %d", projectCache.monthly_event_limit), http.StatusTooManyRequests)
-		return
+		return preparedEvent{}, &eventError{http.StatusTooManyRequests, types.REJECT_QUOTA_EXCEEDED, fmt.Sprintf("Monthly event limit exceeded: %d", projectCache.monthly_event_limit)}
 	}
 
 	if metricCache.metric_type == types.STRIPE_METRIC {
-		http.Error(w, "Stripe metrics cannot be manually updated", http.StatusForbidden)
-		return
+		return preparedEvent{}, &eventError{http.StatusForbidden, types.REJECT_STRIPE_METRIC, "Stripe metrics cannot be manually updated"}
 	}
 
-	if metricCache.metric_type == types.BASE_METRIC && request.Value < 0 {
-		http.Error(w, "Base metrics cannot be negative", http.StatusBadRequest)
-		return
+	if metricCache.metric_type == types.FORMULA_METRIC {
+		return preparedEvent{}, &eventError{http.StatusForbidden, types.REJECT_FORMULA_METRIC, "Formula metrics are computed from other metrics and cannot receive events"}
 	}
 
-	if request.Value == 0 && metricCache.metric_type != types.AVERAGE_METRIC {
-		http.Error(w, "Value cannot be zero", http.StatusBadRequest)
-		return
+	if metricCache.metric_type == types.BASE_METRIC && payload.Value < 0 {
+		return preparedEvent{}, &eventError{http.StatusBadRequest, types.REJECT_NEGATIVE_VALUE, "Base metrics cannot be negative"}
+	}
+
+	if payload.Value == 0 && metricCache.metric_type != types.AVERAGE_METRIC {
+		return preparedEvent{}, &eventError{http.StatusBadRequest, types.REJECT_ZERO_VALUE, "Value cannot be zero"}
 	}
 
 	// Process value
 	var pos, neg int32 = 0, 0
-	if request.Value > 0 {
-		pos = int32(request.Value * 100)
+	if payload.Value > 0 {
+		pos = int32(payload.Value * 100)
 	} else {
-		neg = -int32(request.Value * 100)
+		neg = -int32(payload.Value * 100)
+	}
+
+	return preparedEvent{
+		metric:  metricCache,
+		project: projectCache,
+		pos:     pos,
+		neg:     neg,
+		filters: formattedFilters,
+		entity:  entity,
+	}, nil
+}
+
+// recordMetricEvent queues a prepared event through the batch manager and refreshes the project cache
+func (s *Service) recordMetricEvent(event preparedEvent) error {
+	count, err := s.db.UpdateMetricAndCreateEvent(event.metric.metric_id, event.project.id, event.pos, event.neg, &event.filters, event.entity, s.bm)
+	if err != nil {
+		return err
+	}
+
+	s.projectsCache.Store(event.project.api_key, ProjectCache{
+		api_key:             event.project.api_key,
+		id:                  event.project.id,
+		event_count:         count,
+		monthly_event_limit: event.project.monthly_event_limit,
+	})
+	return nil
+}
+
+// CreateMetricEventV1 creates a new metric event
+func (s *Service) CreateMetricEventV1(w http.ResponseWriter, r *http.Request) {
+	// Extract and validate auth token
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" || len(authHeader) < 8 || authHeader[:7] != "Bearer " {
+		http.Error(w, "Invalid or missing Authorization header", http.StatusUnauthorized)
+		return
+	}
+	apikey := authHeader[7:]
+	identifier := chi.URLParam(r, "metric_identifier")
+
+	// Parse and validate request
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEventBodySize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var request eventPayload
+	if err := json.Unmarshal(body, &request); err != nil {
+		s.queueDeadLetter(apikey, identifier, body, types.REJECT_INVALID_BODY, "Invalid request body")
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	event, eerr := s.prepareMetricEvent(apikey, identifier, request)
+	if eerr != nil {
+		s.queueDeadLetter(apikey, identifier, body, eerr.reason, eerr.message)
+		http.Error(w, eerr.message, eerr.status)
+		return
 	}
 
 	// Update metric
-	if count, err := s.db.UpdateMetricAndCreateEvent(metricCache.metric_id, projectCache.id, pos, neg, &formattedFilters, s.bm); err != nil {
+	if err := s.recordMetricEvent(event); err != nil {
 		log.Printf("Error updating metric: %v", err)
+		s.queueDeadLetter(apikey, identifier, body, types.REJECT_PROCESSING_FAILED, err.Error())
 		http.Error(w, "Failed to update metric", http.StatusInternalServerError)
 		return
-	} else {
-		s.projectsCache.Store(projectCache.api_key, ProjectCache{
-			api_key:             projectCache.api_key,
-			id:                  projectCache.id,
-			event_count:         count,
-			monthly_event_limit: projectCache.monthly_event_limit,
-		})
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-// GetMetricEvents returns metric events for a time range
+// ValidateMetricEventV1 runs the ingestion pipeline on an event without recording it
+// and reports what would have been written
+func (s *Service) ValidateMetricEventV1(w http.ResponseWriter, r *http.Request) {
+	type ValidatedEvent struct {
+		MetricId          uuid.UUID                  `json:"metric_id"`
+		MetricName        string                     `json:"metric_name"`
+		MetricType        int                        `json:"metric_type"`
+		ProjectId         uuid.UUID                  `json:"project_id"`
+		ValuePos          int32                      `json:"value_pos"`
+		ValueNeg          int32                      `json:"value_neg"`
+		MatchedFilters    map[uuid.UUID]types.Filter `json:"matched_filters"`
+		IgnoredFilters    map[string]string          `json:"ignored_filters"`
+		EntityId          string                     `json:"entity_id"`
+		MonthlyEventCount int                        `json:"monthly_event_count"`
+		MonthlyEventLimit int                        `json:"monthly_event_limit"`
+	}
+
+	type ValidationReport struct {
+		Valid   bool            `json:"valid"`
+		Reason  string          `json:"reason,omitempty"`
+		Message string          `json:"message,omitempty"`
+		Event   *ValidatedEvent `json:"event,omitempty"`
+	}
+
+	writeReport := func(report ValidationReport, status int) {
+		bytes, err := json.Marshal(report)
+		if err != nil {
+			http.Error(w, "Failed to process validation report", http.StatusInternalServerError)
+			return
+		}
+
+		SetupCacheControl(w, 0)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(bytes)
+	}
+
+	// Extract and validate auth token
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" || len(authHeader) < 8 || authHeader[:7] != "Bearer " {
+		writeReport(ValidationReport{Reason: types.REJECT_UNAUTHORIZED, Message: "Invalid or missing Authorization header"}, http.StatusUnauthorized)
+		return
+	}
+	apikey := authHeader[7:]
+	identifier := chi.URLParam(r, "metric_identifier")
+
+	var request eventPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEventBodySize)).Decode(&request); err != nil {
+		writeReport(ValidationReport{Reason: types.REJECT_INVALID_BODY, Message: "Invalid request body"}, http.StatusBadRequest)
+		return
+	}
+
+	event, eerr := s.prepareMetricEvent(apikey, identifier, request)
+	if eerr != nil {
+		writeReport(ValidationReport{Reason: eerr.reason, Message: eerr.message}, eerr.status)
+		return
+	}
+
+	// Resolve the filters the batch manager would attach to the event
+	metric, err := s.db.GetMetricById(event.metric.metric_id)
+	if err != nil {
+		log.Printf("Error getting metric by ID: %v", err)
+		http.Error(w, "Failed to resolve metric", http.StatusInternalServerError)
+		return
+	}
+
+	matched := make(map[uuid.UUID]types.Filter)
+	for _, filterId := range db.MatchFilters(metric.Filters, event.filters) {
+		matched[filterId] = metric.Filters[filterId]
+	}
+
+	ignored := make(map[string]string)
+	for category, name := range event.filters {
+		found := false
+		for _, filter := range matched {
+			if filter.Category == category && filter.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ignored[category] = name
+		}
+	}
+
+	writeReport(ValidationReport{
+		Valid: true,
+		Event: &ValidatedEvent{
+			MetricId:          metric.Id,
+			MetricName:        metric.Name,
+			MetricType:        metric.Type,
+			ProjectId:         event.project.id,
+			ValuePos:          event.pos,
+			ValueNeg:          event.neg,
+			MatchedFilters:    matched,
+			IgnoredFilters:    ignored,
+			EntityId:          event.entity,
+			MonthlyEventCount: event.project.event_count,
+			MonthlyEventLimit: event.project.monthly_event_limit,
+		},
+	}, http.StatusOK)
+}
+
+// Page sizes of the raw event listing
+const (
+	defaultEventsPageSize = 100
+	maxEventsPageSize     = 1000
+)
+
+// encodeEventCursor turns the position of an event into an opaque cursor
+func encodeEventCursor(event types.MetricEvent) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d_%s", event.Date.UnixMicro(), event.Id)))
+}
+
+// decodeEventCursor reads a cursor returned by encodeEventCursor
+func decodeEventCursor(cursor string) (types.EventCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return types.EventCursor{}, err
+	}
+
+	date, id, found := strings.Cut(string(raw), "_")
+	if !found {
+		return types.EventCursor{}, errors.New("malformed cursor")
+	}
+
+	micros, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return types.EventCursor{}, err
+	}
+
+	eventid, err := uuid.Parse(id)
+	if err != nil {
+		return types.EventCursor{}, err
+	}
+
+	return types.EventCursor{Date: time.UnixMicro(micros).UTC(), Id: eventid}, nil
+}
+
+// GetMetricEvents returns the raw events of a metric for a time range.
+// Events are sorted by date, ascending unless order is desc, and can be returned in three ways:
+//   - pages of limit events, continued with the next_cursor of the previous page, when limit or cursor is set
+//   - a newline delimited JSON stream when format is ndjson
+//   - a JSON array of every event otherwise
+//
+// When end is omitted, the range covers the history available with the plan from start.
 func (s *Service) GetMetricEvents(w http.ResponseWriter, r *http.Request) {
 	token, ok := r.Context().Value(types.TOKEN).(types.Token)
 	if !ok {
@@ -240,13 +469,55 @@ func (s *Service) GetMetricEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	end, err := time.Parse(DateFormat, query.Get("end"))
-	if err != nil {
-		http.Error(w, "Invalid end date", http.StatusBadRequest)
+	var end time.Time
+	if query.Get("end") != "" {
+		end, err = time.Parse(DateFormat, query.Get("end"))
+		if err != nil {
+			http.Error(w, "Invalid end date", http.StatusBadRequest)
+			return
+		}
+	}
+
+	desc := false
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		http.Error(w, "Invalid order, it must be asc or desc", http.StatusBadRequest)
 		return
 	}
 
-	usenext := query.Get("use_next") == "1"
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "ndjson" {
+		http.Error(w, "Invalid format, it must be json or ndjson", http.StatusBadRequest)
+		return
+	}
+
+	paginated := query.Has("limit") || query.Has("cursor")
+	if paginated && format == "ndjson" {
+		http.Error(w, "Pagination is not available with the ndjson format", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultEventsPageSize
+	if query.Has("limit") {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > maxEventsPageSize {
+			http.Error(w, fmt.Sprintf("The limit must be between 1 and %d", maxEventsPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var cursor *types.EventCursor
+	if query.Get("cursor") != "" {
+		decoded, err := decodeEventCursor(query.Get("cursor"))
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		cursor = &decoded
+	}
 
 	// Validate access
 	project, err := s.db.GetProject(projectid, token.Id)
@@ -266,22 +537,61 @@ func (s *Service) GetMetricEvents(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if end.IsZero() {
+		end = start.AddDate(0, 0, plan.Range)
+	}
+
 	// Check date range
-	nbrDays := (float64(end.Sub(start).Abs()) / float64(24*time.Hour)) - 2
-	if nbrDays > float64(plan.Range) {
+	if !isRangeAllowed(plan, start, end) {
 		http.Error(w, fmt.Sprintf("Date range exceeds plan limit of %d days", plan.Range), http.StatusUnauthorized)
 		return
 	}
 
-	// Fetch events
-	metrics, err := s.db.GetMetricEvents(metricid, start, end, usenext)
+	// Formula metrics have no events of their own, their buckets are returned instead
+	metric, err := s.db.GetMetricById(metricid)
 	if err != nil {
-		log.Printf("Error fetching events: %v", err)
-		http.Error(w, "Failed to retrieve events", http.StatusInternalServerError)
+		log.Printf("Error fetching metric: %v", err)
+		http.Error(w, "Failed to retrieve metric", http.StatusInternalServerError)
+		return
+	}
+	if metric.Type == types.FORMULA_METRIC {
+		s.formulaEvents(w, project, metric, start, end, query.Get("granularity"), desc, format == "ndjson", paginated, cursor, limit)
 		return
 	}
 
-	bytes, err := json.Marshal(metrics)
+	if paginated {
+		// One more event is read to know whether another page follows
+		events, err := s.db.GetMetricEventsPage(metricid, start, end, cursor, desc, limit+1)
+		if err != nil {
+			log.Printf("Error fetching events: %v", err)
+			http.Error(w, "Failed to retrieve events", http.StatusInternalServerError)
+			return
+		}
+
+		writeEventsPage(w, events, limit, end)
+		return
+	}
+
+	s.streamMetricEvents(w, metricid, start, end, desc, format == "ndjson")
+}
+
+// writeEventsPage writes a page of the raw event listing. The events hold up to one more event than
+// the limit, which tells whether another page follows.
+func writeEventsPage(w http.ResponseWriter, events []types.MetricEvent, limit int, end time.Time) {
+	var nextCursor *string
+	if len(events) > limit {
+		events = events[:limit]
+		next := encodeEventCursor(events[len(events)-1])
+		nextCursor = &next
+	}
+
+	bytes, err := json.Marshal(struct {
+		Events     []types.MetricEvent `json:"events"`
+		NextCursor *string             `json:"next_cursor"`
+	}{
+		Events:     events,
+		NextCursor: nextCursor,
+	})
 	if err != nil {
 		http.Error(w, "Failed to process events", http.StatusInternalServerError)
 		return
@@ -298,76 +608,171 @@ func (s *Service) GetMetricEvents(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
-// GetDailyVariation returns daily metric variations
-func (s *Service) GetDailyVariation(w http.ResponseWriter, r *http.Request) {
-	token, ok := r.Context().Value(types.TOKEN).(types.Token)
-	if !ok {
-		http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
-		return
+// streamMetricEvents writes the events of a range as they are read from the database, either as a
+// JSON array or as newline delimited JSON. An error past the first event can no longer change the
+// status, so it is reported in the X-Stream-Error trailer. The JSON array is then left unterminated
+// and the newline delimited stream ends with an error line. Streams are never cached, as a truncated
+// body would otherwise be served again.
+func (s *Service) streamMetricEvents(w http.ResponseWriter, metricid uuid.UUID, start time.Time, end time.Time, desc bool, ndjson bool) {
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	written := 0
+
+	SetupCacheControl(w, 0)
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
 	}
+	w.Header().Set("Trailer", "X-Stream-Error")
 
-	// Parse query params
-	query := r.URL.Query()
-	metricid, err := uuid.Parse(query.Get("metric_id"))
-	if err != nil {
-		http.Error(w, "Invalid metric ID", http.StatusBadRequest)
-		return
-	}
+	err := s.db.StreamMetricEvents(metricid, start, end, desc, func(event types.MetricEvent) error {
+		if written == 0 && !ndjson {
+			w.Write([]byte("["))
+		} else if !ndjson {
+			w.Write([]byte(","))
+		}
+
+		// The encoder ends each event with a newline
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+
+		written++
+		if flusher != nil && written%1000 == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
 
-	projectid, err := uuid.Parse(query.Get("project_id"))
 	if err != nil {
-		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		log.Printf("Error streaming events: %v", err)
+		if written == 0 {
+			w.Header().Del("Trailer")
+			http.Error(w, "Failed to retrieve events", http.StatusInternalServerError)
+			return
+		}
+
+		if ndjson {
+			encoder.Encode(struct {
+				Error string `json:"error"`
+			}{Error: "Failed to retrieve events"})
+		}
+		w.Header().Set("X-Stream-Error", "Failed to retrieve events")
 		return
 	}
 
-	start, err := time.Parse(DateFormat, query.Get("start"))
-	if err != nil {
-		http.Error(w, "Invalid start date", http.StatusBadRequest)
-		return
+	if !ndjson {
+		if written == 0 {
+			w.Write([]byte("["))
+		}
+		w.Write([]byte("]"))
 	}
+}
 
-	end, err := time.Parse(DateFormat, query.Get("end"))
-	if err != nil {
-		http.Error(w, "Invalid end date", http.StatusBadRequest)
+// formulaEvents lists the buckets of a formula metric as events dated at the start of each bucket,
+// so that the charts built from the events of a metric also work for formulas. The buckets last an
+// hour for ranges of up to two days and a day otherwise, unless a granularity is given. The events
+// are identified by their bucket, so that their ids and the cursors stay stable across requests.
+func (s *Service) formulaEvents(w http.ResponseWriter, project types.Project, metric types.Metric, start time.Time, end time.Time, granularity string, desc bool, ndjson bool, paginated bool, cursor *types.EventCursor, limit int) {
+	switch granularity {
+	case types.GRANULARITY_MINUTE, types.GRANULARITY_HOUR, types.GRANULARITY_DAY, types.GRANULARITY_WEEK,
+		types.GRANULARITY_MONTH, types.GRANULARITY_QUARTER, types.GRANULARITY_YEAR:
+	case "":
+		granularity = types.GRANULARITY_DAY
+		if end.Sub(start) <= 48*time.Hour {
+			granularity = types.GRANULARITY_HOUR
+		}
+	default:
+		http.Error(w, "Invalid granularity", http.StatusBadRequest)
 		return
 	}
 
-	// Validate access
-	app, err := s.db.GetProject(projectid, token.Id)
-	if err != nil {
-		http.Error(w, "Project not found", http.StatusNotFound)
+	q := metricQuery{
+		metricIds:   []uuid.UUID{metric.Id},
+		start:       start,
+		end:         end,
+		granularity: granularity,
+		aggregation: types.AGGREGATION_SUM,
+		calendar:    projectCalendar(project),
+	}
+	if err := q.checkBuckets(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if !s.VerifyKeyToMetricId(metricid, app.ApiKey) {
-		http.Error(w, "Unauthorized access to metric", http.StatusUnauthorized)
+	metrics, err := s.resolveQueryMetrics(q, project.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	events, err := s.db.GetVariationEvents(metricid, start, end)
+	series, err := s.runMetricQuery(q, metrics)
 	if err != nil {
-		http.Error(w, "Failed to retrieve variation data", http.StatusInternalServerError)
+		log.Printf("Error querying events: %v", err)
+		http.Error(w, "Failed to retrieve events", http.StatusInternalServerError)
 		return
 	}
 
-	// Remove duplicates
-	if len(events) > 1 && events[0].Id == events[1].Id {
-		events = events[:1]
+	events := []types.MetricEvent{}
+	for _, bucket := range series[0].Buckets {
+		if bucket.Value == 0 {
+			continue
+		}
+
+		// Each bucket holds a single event, the cursor only needs to compare the dates
+		if cursor != nil && ((!desc && !bucket.Date.After(cursor.Date)) || (desc && !bucket.Date.Before(cursor.Date))) {
+			continue
+		}
+
+		value := int32(math.Max(math.Min(math.Round(bucket.Value), math.MaxInt32), -math.MaxInt32))
+		event := types.MetricEvent{
+			Id:       uuid.NewSHA1(metric.Id, []byte(fmt.Sprintf("%s_%d", granularity, bucket.Date.UnixMicro()))),
+			MetricId: metric.Id,
+			Date:     bucket.Date,
+			Filters:  []uuid.UUID{},
+		}
+		if value > 0 {
+			event.ValuePos = value
+		} else {
+			event.ValueNeg = -value
+		}
+		events = append(events, event)
+	}
+	if desc {
+		slices.Reverse(events)
 	}
 
-	body, err := json.Marshal(events)
-	if err != nil {
-		http.Error(w, "Failed to process events", http.StatusInternalServerError)
+	if paginated {
+		if len(events) > limit+1 {
+			events = events[:limit+1]
+		}
+		writeEventsPage(w, events, limit, end)
 		return
 	}
 
-	// Cache results
+	// The buckets are fully computed before they are written, unlike the streamed events
 	if end.Before(time.Now()) {
 		SetupCacheControl(w, 100000000)
 	} else {
 		SetupCacheControl(w, 5)
 	}
 
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		for _, event := range events {
+			encoder.Encode(event)
+		}
+		return
+	}
+
+	bytes, err := json.Marshal(events)
+	if err != nil {
+		http.Error(w, "Failed to process events", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(body)
+	w.Write(bytes)
 }
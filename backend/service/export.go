@@ -0,0 +1,718 @@
+package service
+
+import (
+	"Measurely/email"
+	"Measurely/types"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Settings of the event exports
+const (
+	maxInlineExportEvents = 100000
+	exportPartSize        = 8 * 1024 * 1024
+	exportRowGroupSize    = 50000
+	exportLinkExpiry      = 7 * 24 * time.Hour
+	exportInterval        = 15 * time.Second
+	exportHeartbeat       = time.Minute
+	exportStaleAfter      = 10 * time.Minute
+	incompleteUploadDays  = 1
+	exportsListed         = 20
+)
+
+// exportRow is a single event as written to the export files. Values are converted back from
+// hundredths and the filters are resolved to their category and name.
+type exportRow struct {
+	Date       time.Time         `parquet:"date,timestamp(microsecond)" json:"date"`
+	EventId    string            `parquet:"event_id" json:"event_id"`
+	MetricId   string            `parquet:"metric_id" json:"metric_id"`
+	MetricName string            `parquet:"metric_name" json:"metric_name"`
+	Value      float64           `parquet:"value" json:"value"`
+	ValuePos   float64           `parquet:"value_pos" json:"value_pos"`
+	ValueNeg   float64           `parquet:"value_neg" json:"value_neg"`
+	EntityId   string            `parquet:"entity_id" json:"entity_id"`
+	Filters    map[string]string `parquet:"filters" json:"filters"`
+}
+
+// exportEncoder writes the rows of an export in one of the supported formats
+type exportEncoder interface {
+	Write(row exportRow) error
+	Close() error
+}
+
+// csvEncoder writes one column per filter category
+type csvEncoder struct {
+	writer     *csv.Writer
+	categories []string
+	header     bool
+}
+
+func (e *csvEncoder) writeHeader() error {
+	header := []string{"date", "event_id", "metric_id", "metric_name", "value", "value_pos", "value_neg", "entity_id"}
+	for _, category := range e.categories {
+		header = append(header, "filter_"+category)
+	}
+	e.header = true
+	return e.writer.Write(header)
+}
+
+func (e *csvEncoder) Write(row exportRow) error {
+	if !e.header {
+		if err := e.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	record := []string{
+		row.Date.Format(DateFormat),
+		row.EventId,
+		row.MetricId,
+		row.MetricName,
+		strconv.FormatFloat(row.Value, 'f', -1, 64),
+		strconv.FormatFloat(row.ValuePos, 'f', -1, 64),
+		strconv.FormatFloat(row.ValueNeg, 'f', -1, 64),
+		row.EntityId,
+	}
+	for _, category := range e.categories {
+		record = append(record, row.Filters[category])
+	}
+	return e.writer.Write(record)
+}
+
+func (e *csvEncoder) Close() error {
+	if !e.header {
+		if err := e.writeHeader(); err != nil {
+			return err
+		}
+	}
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+type ndjsonEncoder struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonEncoder) Write(row exportRow) error {
+	return e.encoder.Encode(row)
+}
+
+func (e *ndjsonEncoder) Close() error {
+	return nil
+}
+
+type parquetEncoder struct {
+	writer *parquet.GenericWriter[exportRow]
+}
+
+func (e *parquetEncoder) Write(row exportRow) error {
+	_, err := e.writer.Write([]exportRow{row})
+	return err
+}
+
+func (e *parquetEncoder) Close() error {
+	return e.writer.Close()
+}
+
+// newExportEncoder returns the encoder of the format, writing to w
+func newExportEncoder(format string, w io.Writer, categories []string) exportEncoder {
+	switch format {
+	case types.EXPORT_NDJSON:
+		return &ndjsonEncoder{encoder: json.NewEncoder(w)}
+	case types.EXPORT_PARQUET:
+		return &parquetEncoder{writer: parquet.NewGenericWriter[exportRow](w, parquet.MaxRowsPerRowGroup(exportRowGroupSize))}
+	default:
+		return &csvEncoder{writer: csv.NewWriter(w), categories: categories}
+	}
+}
+
+// exportContentType returns the content type of the files of the format
+func exportContentType(format string) string {
+	switch format {
+	case types.EXPORT_NDJSON:
+		return "application/x-ndjson"
+	case types.EXPORT_PARQUET:
+		return "application/vnd.apache.parquet"
+	default:
+		return "text/csv"
+	}
+}
+
+// exportFileName returns the name of the file downloaded by the user
+func exportFileName(name string, start time.Time, end time.Time, format string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '"' || r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, name)
+	return fmt.Sprintf("%s_%s_%s.%s", name, start.Format("2006-01-02"), end.Format("2006-01-02"), format)
+}
+
+// writeExport writes the events of the metrics recorded between start and end, one metric after
+// the other, and returns the number of rows written
+func (s *Service) writeExport(w io.Writer, format string, metrics []types.Metric, start time.Time, end time.Time) (int64, error) {
+	var categories []string
+	for _, metric := range metrics {
+		for _, filter := range metric.Filters {
+			if !slices.Contains(categories, filter.Category) {
+				categories = append(categories, filter.Category)
+			}
+		}
+	}
+	sort.Strings(categories)
+
+	encoder := newExportEncoder(format, w, categories)
+
+	var rows int64
+	for _, metric := range metrics {
+		err := s.db.StreamMetricEvents(metric.Id, start, end, false, func(event types.MetricEvent) error {
+			filters := make(map[string]string, len(event.Filters))
+			for _, filterid := range event.Filters {
+				filter, exists := metric.Filters[filterid]
+				if !exists {
+					continue
+				}
+				if name, exists := filters[filter.Category]; exists {
+					filters[filter.Category] = name + "|" + filter.Name
+				} else {
+					filters[filter.Category] = filter.Name
+				}
+			}
+
+			rows++
+			return encoder.Write(exportRow{
+				Date:       event.Date,
+				EventId:    event.Id.String(),
+				MetricId:   metric.Id.String(),
+				MetricName: metric.Name,
+				Value:      float64(int64(event.ValuePos)-int64(event.ValueNeg)) / 100,
+				ValuePos:   float64(event.ValuePos) / 100,
+				ValueNeg:   float64(event.ValueNeg) / 100,
+				EntityId:   event.EntityId,
+				Filters:    filters,
+			})
+		})
+		if err != nil {
+			return rows, err
+		}
+	}
+
+	return rows, encoder.Close()
+}
+
+// exportMetrics returns the metrics covered by an export, every metric of the project when no
+// metric is given
+func (s *Service) exportMetrics(projectId uuid.UUID, metricId uuid.NullUUID) ([]types.Metric, error) {
+	metrics, err := s.db.GetMetrics(projectId)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if !metricId.Valid {
+		return metrics, nil
+	}
+
+	for _, metric := range metrics {
+		if metric.Id == metricId.UUID {
+			return []types.Metric{metric}, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// s3MultipartWriter streams a file to object storage in parts, so that large exports are never
+// held in memory
+type s3MultipartWriter struct {
+	client   *s3.Client
+	bucket   string
+	key      string
+	uploadId *string
+	buffer   bytes.Buffer
+	parts    []s3types.CompletedPart
+	size     int64
+}
+
+func newS3MultipartWriter(client *s3.Client, bucket string, key string, contentType string) (*s3MultipartWriter, error) {
+	upload, err := client.CreateMultipartUpload(context.TODO(), &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3MultipartWriter{client: client, bucket: bucket, key: key, uploadId: upload.UploadId}, nil
+}
+
+func (w *s3MultipartWriter) Write(p []byte) (int, error) {
+	n, _ := w.buffer.Write(p)
+	w.size += int64(n)
+	if w.buffer.Len() >= exportPartSize {
+		if err := w.uploadPart(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (w *s3MultipartWriter) uploadPart() error {
+	number := int32(len(w.parts) + 1)
+	part, err := w.client.UploadPart(context.TODO(), &s3.UploadPartInput{
+		Bucket:     aws.String(w.bucket),
+		Key:        aws.String(w.key),
+		UploadId:   w.uploadId,
+		PartNumber: aws.Int32(number),
+		Body:       bytes.NewReader(w.buffer.Bytes()),
+	})
+	if err != nil {
+		return err
+	}
+
+	w.parts = append(w.parts, s3types.CompletedPart{ETag: part.ETag, PartNumber: aws.Int32(number)})
+	w.buffer.Reset()
+	return nil
+}
+
+// Close uploads the last part and completes the upload
+func (w *s3MultipartWriter) Close() error {
+	if w.buffer.Len() > 0 || len(w.parts) == 0 {
+		if err := w.uploadPart(); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.client.CompleteMultipartUpload(context.TODO(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(w.bucket),
+		Key:             aws.String(w.key),
+		UploadId:        w.uploadId,
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: w.parts},
+	})
+	return err
+}
+
+// Abort discards the parts uploaded so far
+func (w *s3MultipartWriter) Abort() {
+	if _, err := w.client.AbortMultipartUpload(context.TODO(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(w.bucket),
+		Key:      aws.String(w.key),
+		UploadId: w.uploadId,
+	}); err != nil {
+		log.Println("Failed to abort export upload:", err)
+	}
+}
+
+// privateBucket returns the bucket holding the exports and the imported files. Unlike the media
+// bucket, which is served publicly, its files are only reached through presigned links.
+func privateBucket() string {
+	return os.Getenv("S3_PRIVATE_BUCKET_NAME")
+}
+
+// setupPrivateBucket makes the private bucket discard the parts of the uploads left incomplete by
+// an instance that stopped during an export or an import
+func (s *Service) setupPrivateBucket() {
+	if privateBucket() == "" {
+		log.Println("S3_PRIVATE_BUCKET_NAME is not set, background exports and imports are disabled")
+		return
+	}
+
+	if _, err := s.s3Client.PutBucketLifecycleConfiguration(context.TODO(), &s3.PutBucketLifecycleConfigurationInput{
+		Bucket: aws.String(privateBucket()),
+		LifecycleConfiguration: &s3types.BucketLifecycleConfiguration{
+			Rules: []s3types.LifecycleRule{{
+				ID:     aws.String("abort-incomplete-uploads"),
+				Status: s3types.ExpirationStatusEnabled,
+				Filter: &s3types.LifecycleRuleFilter{Prefix: aws.String("")},
+				AbortIncompleteMultipartUpload: &s3types.AbortIncompleteMultipartUpload{
+					DaysAfterInitiation: aws.Int32(incompleteUploadDays),
+				},
+			}},
+		},
+	}); err != nil {
+		log.Println("Failed to set the lifecycle of the private bucket:", err)
+	}
+}
+
+// exportLink returns a temporary download link of a finished export
+func (s *Service) exportLink(export types.MetricExport, fileName string) (string, error) {
+	request, err := s3.NewPresignClient(s.s3Client).PresignGetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket:                     aws.String(privateBucket()),
+		Key:                        aws.String(export.ObjectKey),
+		ResponseContentDisposition: aws.String(fmt.Sprintf(`attachment; filename="%s"`, fileName)),
+	}, s3.WithPresignExpires(exportLinkExpiry))
+	if err != nil {
+		return "", err
+	}
+	return request.URL, nil
+}
+
+// RunExports processes the pending exports. Exports are claimed one at a time, so several
+// instances can share the queue.
+func (s *Service) RunExports() {
+	if privateBucket() == "" {
+		return
+	}
+
+	for !s.scheduler.Stopping() {
+		export, err := s.db.ClaimExport(time.Now().UTC().Add(-exportStaleAfter))
+		if err == sql.ErrNoRows {
+			return
+		} else if err != nil {
+			log.Println("Failed to claim export:", err)
+			return
+		}
+
+		s.runExport(export)
+	}
+
+	s.deleteExpiredExports()
+}
+
+// deleteExpiredExports removes the files of the exports whose download link has expired
+func (s *Service) deleteExpiredExports() {
+	exports, err := s.db.GetExpiredExports(time.Now().UTC().Add(-exportLinkExpiry))
+	if err != nil {
+		log.Println("Failed to fetch expired exports:", err)
+		return
+	}
+
+	for _, export := range exports {
+		if _, err := s.s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+			Bucket: aws.String(privateBucket()),
+			Key:    aws.String(export.ObjectKey),
+		}); err != nil {
+			log.Println("Failed to delete export file:", err)
+			continue
+		}
+
+		if err := s.db.ClearExportObject(export.Id); err != nil {
+			log.Println("Failed to update export:", err)
+		}
+	}
+}
+
+// runExport writes an export to object storage and emails its download link to the user who requested it
+func (s *Service) runExport(export types.MetricExport) {
+	name := "export"
+	fail := func(err error) {
+		log.Printf("Export %s failed: %v", export.Id, err)
+		export.Status = types.EXPORT_FAILED
+		export.Error = err.Error()
+		if err := s.db.CompleteExport(export); err != nil {
+			log.Println("Failed to update export:", err)
+		}
+		s.notifyExport(export, name, "")
+	}
+
+	project, err := s.db.GetProjectById(export.ProjectId)
+	if err != nil {
+		fail(err)
+		return
+	}
+	name = project.Name
+
+	metrics, err := s.exportMetrics(project.Id, export.MetricId)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if export.MetricId.Valid {
+		name = metrics[0].Name
+	}
+
+	// The claim is refreshed while the export runs, an export is only claimed again once its
+	// instance stopped
+	stop := heartbeat(exportHeartbeat, func() error { return s.db.TouchExport(export.Id) })
+	defer stop()
+
+	export.ObjectKey = fmt.Sprintf("exports/%s/%s.%s", project.Id, export.Id, export.Format)
+	writer, err := newS3MultipartWriter(s.s3Client, privateBucket(), export.ObjectKey, exportContentType(export.Format))
+	if err != nil {
+		export.ObjectKey = ""
+		fail(err)
+		return
+	}
+
+	export.RowCount, err = s.writeExport(writer, export.Format, metrics, export.StartDate, export.EndDate)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		writer.Abort()
+		export.ObjectKey = ""
+		fail(err)
+		return
+	}
+
+	export.Status = types.EXPORT_DONE
+	export.Size = writer.size
+	if err := s.db.CompleteExport(export); err != nil {
+		log.Println("Failed to update export:", err)
+		return
+	}
+
+	link, err := s.exportLink(export, exportFileName(name, export.StartDate, export.EndDate, export.Format))
+	if err != nil {
+		log.Println("Failed to create export link:", err)
+		return
+	}
+	s.notifyExport(export, name, link)
+}
+
+// notifyExport emails the outcome of an export to the user who requested it
+func (s *Service) notifyExport(export types.MetricExport, name string, link string) {
+	user, err := s.db.GetUserById(export.UserId)
+	if err != nil {
+		log.Println("Failed to fetch the user of an export:", err)
+		return
+	}
+
+	fields := email.MailFields{
+		To:          user.Email,
+		Subject:     "Your export of " + name + " is ready",
+		Content:     fmt.Sprintf("The export of %s from %s to %s is ready. The download link below expires in 7 days.", name, export.StartDate.Format("2006-01-02"), export.EndDate.Format("2006-01-02")),
+		Link:        link,
+		ButtonTitle: "Download",
+	}
+
+	if export.Status == types.EXPORT_FAILED {
+		fields.Subject = "Your export of " + name + " failed"
+		fields.Content = fmt.Sprintf("The export of %s from %s to %s could not be completed. Please try again or contact support if the problem persists.", name, export.StartDate.Format("2006-01-02"), export.EndDate.Format("2006-01-02"))
+		fields.Link = GetOrigin()
+		fields.ButtonTitle = "Open Measurely"
+	}
+
+	if err := s.email.SendEmail(fields); err != nil {
+		log.Println("Failed to send export email:", err)
+	}
+}
+
+// ExportMetricEvents exports the events of a metric, or of every metric of a project, over a date
+// range. Small exports are downloaded right away, larger ones are queued and their link is emailed.
+func (s *Service) ExportMetricEvents(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	projectid, err := uuid.Parse(query.Get("project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	var metricid uuid.NullUUID
+	if value := query.Get("metric_id"); value != "" {
+		metricid.UUID, err = uuid.Parse(value)
+		if err != nil {
+			http.Error(w, "Invalid metric ID", http.StatusBadRequest)
+			return
+		}
+		metricid.Valid = true
+	}
+
+	format := query.Get("format")
+	switch format {
+	case types.EXPORT_CSV, types.EXPORT_NDJSON, types.EXPORT_PARQUET:
+	case "":
+		format = types.EXPORT_CSV
+	default:
+		http.Error(w, "Invalid format, use csv, ndjson or parquet", http.StatusBadRequest)
+		return
+	}
+
+	start, err := time.Parse(DateFormat, query.Get("start"))
+	if err != nil {
+		http.Error(w, "Invalid start date", http.StatusBadRequest)
+		return
+	}
+
+	end, err := time.Parse(DateFormat, query.Get("end"))
+	if err != nil {
+		http.Error(w, "Invalid end date", http.StatusBadRequest)
+		return
+	}
+
+	if end.Before(start) {
+		http.Error(w, "The end date must be after the start date", http.StatusBadRequest)
+		return
+	}
+
+	// Validate access
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	plan, exists := s.plans[project.CurrentPlan]
+	if !exists {
+		http.Error(w, "Invalid subscription plan", http.StatusBadRequest)
+		return
+	}
+
+	if !isRangeAllowed(plan, start, end) {
+		http.Error(w, fmt.Sprintf("Date range exceeds plan limit of %d days", plan.Range), http.StatusUnauthorized)
+		return
+	}
+
+	metrics, err := s.exportMetrics(project.Id, metricid)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unauthorized access to metric", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		log.Println("Error fetching metrics:", err)
+		http.Error(w, "Failed to retrieve metrics", http.StatusInternalServerError)
+		return
+	}
+
+	metricIds := make([]uuid.UUID, len(metrics))
+	for i, metric := range metrics {
+		metricIds[i] = metric.Id
+	}
+
+	count, err := s.db.CountMetricEvents(metricIds, start, end)
+	if err != nil {
+		log.Println("Error counting events:", err)
+		http.Error(w, "Failed to export events", http.StatusInternalServerError)
+		return
+	}
+
+	// Large exports run in the background
+	if count > maxInlineExportEvents {
+		if privateBucket() == "" {
+			http.Error(w, fmt.Sprintf("Exports of more than %d events are not available on this instance", maxInlineExportEvents), http.StatusServiceUnavailable)
+			return
+		}
+
+		export, err := s.db.CreateExport(types.MetricExport{
+			ProjectId: project.Id,
+			UserId:    token.Id,
+			MetricId:  metricid,
+			Format:    format,
+			StartDate: start,
+			EndDate:   end,
+		})
+		if err != nil {
+			log.Println("Error creating export:", err)
+			http.Error(w, "Failed to create export", http.StatusInternalServerError)
+			return
+		}
+
+		bytes, err := json.Marshal(export)
+		if err != nil {
+			http.Error(w, "Failed to process export", http.StatusInternalServerError)
+			return
+		}
+
+		SetupCacheControl(w, 0)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write(bytes)
+		return
+	}
+
+	name := project.Name
+	if metricid.Valid {
+		name = metrics[0].Name
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", exportContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFileName(name, start, end, format)))
+
+	if _, err := s.writeExport(w, format, metrics, start, end); err != nil {
+		// The response has already started, the download ends up truncated
+		log.Printf("Error exporting events: %v", err)
+	}
+}
+
+// GetExports lists the latest exports of a project, with a download link for the finished ones
+func (s *Service) GetExports(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	exports, err := s.db.GetExports(project.Id, exportsListed)
+	if err != nil {
+		log.Println("Error fetching exports:", err)
+		http.Error(w, "Failed to retrieve exports", http.StatusInternalServerError)
+		return
+	}
+
+	type exportResponse struct {
+		types.MetricExport
+		URL string `json:"url"`
+	}
+
+	response := make([]exportResponse, len(exports))
+	for i, export := range exports {
+		response[i].MetricExport = export
+		if export.Status != types.EXPORT_DONE || export.ObjectKey == "" || !export.Finished.Valid ||
+			time.Since(export.Finished.V) > exportLinkExpiry {
+			continue
+		}
+
+		link, err := s.exportLink(export, exportFileName(project.Name, export.StartDate, export.EndDate, export.Format))
+		if err != nil {
+			log.Println("Failed to create export link:", err)
+			continue
+		}
+		response[i].URL = link
+	}
+
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, "Failed to process exports", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
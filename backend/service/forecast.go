@@ -0,0 +1,523 @@
+package service
+
+import (
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Settings of the forecasting model. The trend is damped so that long horizons do not extrapolate
+// a short burst forever.
+const (
+	forecastDamping      = 0.98
+	forecastMinPoints    = 4
+	forecastQuotaDays    = 60
+	forecastQuotaHistory = 84
+)
+
+// Names of the models used to forecast a series
+const (
+	forecastHoltWinters = "holt_winters"
+	forecastHolt        = "holt"
+)
+
+// forecastSmoothing lists the smoothing parameters tried when fitting a model
+var forecastSmoothing = []float64{0.1, 0.3, 0.5, 0.7, 0.9}
+
+// forecastScores maps the supported confidence levels to the z-score of their interval
+var forecastScores = map[int]float64{80: 1.2816, 90: 1.6449, 95: 1.96, 99: 2.5758}
+
+// forecastGranularity describes how a granularity is forecast: the length of its season, the number
+// of buckets of history fitted, and the default and maximum horizons
+type forecastGranularity struct {
+	season     int
+	history    int
+	horizon    int
+	maxHorizon int
+}
+
+var forecastGranularities = map[string]forecastGranularity{
+	types.GRANULARITY_HOUR:  {season: 24, history: 28 * 24, horizon: 24, maxHorizon: 7 * 24},
+	types.GRANULARITY_DAY:   {season: 7, history: 365, horizon: 30, maxHorizon: 365},
+	types.GRANULARITY_WEEK:  {season: 0, history: 104, horizon: 12, maxHorizon: 104},
+	types.GRANULARITY_MONTH: {season: 12, history: 36, horizon: 6, maxHorizon: 36},
+}
+
+// forecastModel is an additive Holt-Winters model with a damped trend. Without a season, it reduces
+// to the linear model of Holt.
+type forecastModel struct {
+	alpha    float64
+	beta     float64
+	gamma    float64
+	season   int
+	level    float64
+	trend    float64
+	seasonal []float64
+	length   int
+	sse      float64
+	fitted   int
+}
+
+// fitModel runs the model over the series with the given smoothing parameters, keeping the sum of
+// the squared one step errors
+func fitModel(values []float64, season int, alpha float64, beta float64, gamma float64) forecastModel {
+	m := forecastModel{alpha: alpha, beta: beta, gamma: gamma, season: season, length: len(values)}
+
+	start := 1
+	if season > 0 {
+		first, second := 0.0, 0.0
+		for i := 0; i < season; i++ {
+			first += values[i]
+			second += values[season+i]
+		}
+		first /= float64(season)
+		second /= float64(season)
+
+		m.level = first
+		m.trend = (second - first) / float64(season)
+		m.seasonal = make([]float64, season)
+		for i := 0; i < season; i++ {
+			m.seasonal[i] = values[i] - first
+		}
+		start = season
+	} else {
+		m.level = values[0]
+		m.trend = values[1] - values[0]
+	}
+
+	for t := start; t < len(values); t++ {
+		seasonal := 0.0
+		if season > 0 {
+			seasonal = m.seasonal[t%season]
+		}
+
+		err := values[t] - (m.level + forecastDamping*m.trend + seasonal)
+		m.sse += err * err
+		m.fitted++
+
+		level := alpha*(values[t]-seasonal) + (1-alpha)*(m.level+forecastDamping*m.trend)
+		m.trend = beta*(level-m.level) + (1-beta)*forecastDamping*m.trend
+		m.level = level
+		if season > 0 {
+			m.seasonal[t%season] = gamma*(values[t]-level) + (1-gamma)*seasonal
+		}
+	}
+
+	return m
+}
+
+// fitForecast picks the smoothing parameters minimizing the one step errors over the series. A seasonal
+// model needs two full seasons of history, shorter series are fitted without a season.
+func fitForecast(values []float64, season int) (forecastModel, error) {
+	if season > 0 && len(values) < 2*season+forecastMinPoints {
+		season = 0
+	}
+	if len(values) < forecastMinPoints {
+		return forecastModel{}, errors.New("Not enough history to forecast the metric")
+	}
+
+	gammas := forecastSmoothing
+	if season == 0 {
+		gammas = []float64{0}
+	}
+
+	var best forecastModel
+	found := false
+	for _, alpha := range forecastSmoothing {
+		for _, beta := range forecastSmoothing {
+			for _, gamma := range gammas {
+				m := fitModel(values, season, alpha, beta, gamma)
+				if !found || m.sse < best.sse {
+					best = m
+					found = true
+				}
+			}
+		}
+	}
+
+	return best, nil
+}
+
+// name returns the name of the model exposed in the responses
+func (m forecastModel) name() string {
+	if m.season > 0 {
+		return forecastHoltWinters
+	}
+	return forecastHolt
+}
+
+// forecast projects the next buckets of the series. The interval widens with the horizon following
+// the approximate variance of the additive model, z being the score of the confidence level.
+func (m forecastModel) forecast(horizon int, z float64, nonNegative bool) []types.ForecastPoint {
+	variance := 0.0
+	if m.fitted > 0 {
+		variance = m.sse / float64(m.fitted)
+	}
+
+	points := make([]types.ForecastPoint, horizon)
+	damping, spread := 0.0, 1.0
+	for h := 1; h <= horizon; h++ {
+		damping += math.Pow(forecastDamping, float64(h))
+
+		value := m.level + damping*m.trend
+		if m.season > 0 {
+			value += m.seasonal[(m.length+h-1)%m.season]
+		}
+
+		if h > 1 {
+			j := float64(h - 1)
+			coefficient := m.alpha * (1 + j*m.beta)
+			if m.season > 0 && (h-1)%m.season == 0 {
+				coefficient += m.gamma
+			}
+			spread += coefficient * coefficient
+		}
+		margin := z * math.Sqrt(variance*spread)
+
+		point := types.ForecastPoint{Value: value, Lower: value - margin, Upper: value + margin}
+		if nonNegative {
+			point.Value = max(point.Value, 0)
+			point.Lower = max(point.Lower, 0)
+			point.Upper = max(point.Upper, 0)
+		}
+		points[h-1] = point
+	}
+
+	return points
+}
+
+// parseConfidence reads the confidence level of the intervals, 95% by default
+func parseConfidence(value string) (int, float64, error) {
+	if value == "" {
+		return 95, forecastScores[95], nil
+	}
+	confidence, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, 0, errors.New("Invalid confidence level")
+	}
+	z, exists := forecastScores[confidence]
+	if !exists {
+		return 0, 0, errors.New("The confidence level must be 80, 90, 95 or 99")
+	}
+	return confidence, z, nil
+}
+
+// forecastHistoryStart returns the start of the first full bucket of history available with the plan
+func forecastHistoryStart(cal calendar, granularity string, current time.Time, buckets int, plan types.Plan) time.Time {
+	start := current
+	for i := 0; i < buckets; i++ {
+		previous := cal.truncate(start.Add(-time.Nanosecond), granularity)
+		if !isRangeAllowed(plan, previous, current) {
+			break
+		}
+		start = previous
+	}
+	return start
+}
+
+// GetMetricForecast projects the next buckets of a metric with a Holt-Winters model fitted on its
+// history. The bucket in progress is left out of the fit, and the forecast starts with it.
+func (s *Service) GetMetricForecast(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	projectid, err := uuid.Parse(query.Get("project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	if len(query["metric_id"]) != 1 {
+		http.Error(w, "A forecast covers a single metric", http.StatusBadRequest)
+		return
+	}
+
+	// The date range is computed from the granularity, the other parameters follow the aggregation queries
+	params := make(url.Values, len(query))
+	for key, value := range query {
+		params[key] = value
+	}
+	now := time.Now().UTC()
+	params["start"] = []string{now.Format(DateFormat)}
+	params["end"] = []string{now.Format(DateFormat)}
+	delete(params, "group_by")
+	delete(params, "bands")
+
+	q, err := parseMetricQuery(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	settings, exists := forecastGranularities[q.granularity]
+	if !exists {
+		http.Error(w, "Forecasts are only available for the hour, day, week and month granularities", http.StatusBadRequest)
+		return
+	}
+
+	horizon := settings.horizon
+	if value := query.Get("horizon"); value != "" {
+		horizon, err = strconv.Atoi(value)
+		if err != nil || horizon < 1 || horizon > settings.maxHorizon {
+			http.Error(w, fmt.Sprintf("The horizon must be between 1 and %d buckets", settings.maxHorizon), http.StatusBadRequest)
+			return
+		}
+	}
+
+	confidence, z, err := parseConfidence(query.Get("confidence"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	plan, exists := s.plans[project.CurrentPlan]
+	if !exists {
+		http.Error(w, "Invalid subscription plan", http.StatusBadRequest)
+		return
+	}
+
+	q.calendar = projectCalendar(project)
+	current := q.calendar.truncate(now, q.granularity)
+	q.start = forecastHistoryStart(q.calendar, q.granularity, current, settings.history, plan)
+	q.end = current.Add(-time.Microsecond)
+	if !q.start.Before(current) {
+		http.Error(w, "Not enough history to forecast the metric", http.StatusBadRequest)
+		return
+	}
+
+	metrics, err := s.resolveQueryMetrics(q, project.Id)
+	if err == errMetricAccess {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metric := metrics[q.metricIds[0]]
+
+	series, err := s.runMetricQuery(q, metrics)
+	if err != nil {
+		log.Println("Error querying events:", err)
+		http.Error(w, "Failed to query events", http.StatusInternalServerError)
+		return
+	}
+
+	// The buckets before the creation of the metric would read as zeros
+	created := q.calendar.next(q.calendar.truncate(metric.Created, q.granularity), q.granularity)
+	values := []float64{}
+	nonNegative := true
+	for _, bucket := range series[0].Buckets {
+		if bucket.Date.Before(created) {
+			continue
+		}
+		values = append(values, bucket.Value)
+		if bucket.Value < 0 {
+			nonNegative = false
+		}
+	}
+
+	model, err := fitForecast(values, settings.season)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	points := model.forecast(horizon, z, nonNegative)
+	date := current
+	for i := range points {
+		points[i].Date = date
+		date = q.calendar.next(date, q.granularity)
+	}
+
+	bytes, err := json.Marshal(types.MetricForecast{
+		MetricId:    metric.Id,
+		MetricName:  metric.Name,
+		Granularity: q.granularity,
+		Aggregation: q.aggregation,
+		Model:       model.name(),
+		Season:      model.season,
+		Confidence:  confidence,
+		Points:      points,
+	})
+	if err != nil {
+		http.Error(w, "Failed to process forecast", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// GetQuotaForecast projects the monthly event count of a project, day by day, to predict when it
+// reaches the event limit of its plan. The daily counts of every metric are summed then forecast,
+// and the events already received today are deducted from the projection of the day. The count is
+// not reset within the horizon, as it only resets once the invoice of the project is paid.
+func (s *Service) GetQuotaForecast(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(r.URL.Query().Get("project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	confidence, z, err := parseConfidence(r.URL.Query().Get("confidence"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	plan, exists := s.plans[project.CurrentPlan]
+	if !exists {
+		http.Error(w, "Invalid subscription plan", http.StatusBadRequest)
+		return
+	}
+
+	metrics, err := s.db.GetMetrics(project.Id)
+	if err != nil {
+		log.Println("Error fetching metrics:", err)
+		http.Error(w, "Failed to retrieve metrics", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	today := utcCalendar.truncate(now, types.GRANULARITY_DAY)
+	q := metricQuery{
+		start:       forecastHistoryStart(utcCalendar, types.GRANULARITY_DAY, today, forecastQuotaHistory, plan),
+		end:         now,
+		granularity: types.GRANULARITY_DAY,
+		aggregation: types.AGGREGATION_COUNT,
+		calendar:    utcCalendar,
+	}
+	byId := make(map[uuid.UUID]types.Metric, len(metrics))
+	for _, metric := range metrics {
+		if metric.Type == types.FORMULA_METRIC {
+			continue
+		}
+		q.metricIds = append(q.metricIds, metric.Id)
+		byId[metric.Id] = metric
+	}
+
+	series, err := s.runMetricQuery(q, byId)
+	if err != nil {
+		log.Println("Error querying events:", err)
+		http.Error(w, "Failed to query events", http.StatusInternalServerError)
+		return
+	}
+
+	// The imported events are counted by the rollups but not by the quota
+	imported, err := s.db.GetImportedEventCounts(q.metricIds, q.start, rangeEnd(q.end))
+	if err != nil {
+		log.Println("Error counting imported events:", err)
+		http.Error(w, "Failed to query events", http.StatusInternalServerError)
+		return
+	}
+
+	// The last bucket is the day in progress
+	days := utcCalendar.countBuckets(q.start, q.end, q.granularity)
+	totals := make([]float64, days)
+	for _, current := range series {
+		for i, bucket := range current.Buckets {
+			totals[i] += bucket.Value
+		}
+	}
+	for i, day := 0, q.start; i < days; i, day = i+1, utcCalendar.next(day, q.granularity) {
+		totals[i] = max(totals[i]-float64(imported[day.UTC()]), 0)
+	}
+	received := totals[days-1]
+	totals = totals[:days-1]
+
+	forecast := types.QuotaForecast{
+		MonthlyEventCount: project.MonthlyEventCount,
+		MaxEventPerMonth:  project.MaxEventPerMonth,
+		Confidence:        confidence,
+		Points:            []types.ForecastPoint{},
+	}
+
+	model, err := fitForecast(totals, 7)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The bounds of every day are added up, which gives a conservative range for the cumulative count
+	count := float64(project.MonthlyEventCount)
+	cumulative := types.ForecastPoint{Value: count, Lower: count, Upper: count}
+	limit := float64(project.MaxEventPerMonth)
+	date := today
+	for i, point := range model.forecast(forecastQuotaDays, z, true) {
+		if i == 0 {
+			point.Value = max(point.Value-received, 0)
+			point.Lower = max(point.Lower-received, 0)
+			point.Upper = max(point.Upper-received, 0)
+		}
+		cumulative.Date = date
+		cumulative.Value += point.Value
+		cumulative.Lower += point.Lower
+		cumulative.Upper += point.Upper
+		forecast.Points = append(forecast.Points, cumulative)
+
+		if limit > 0 {
+			reached := date
+			if forecast.LimitDate == nil && cumulative.Value >= limit {
+				forecast.LimitDate = &reached
+			}
+			if forecast.EarliestLimitDate == nil && cumulative.Upper >= limit {
+				forecast.EarliestLimitDate = &reached
+			}
+			if forecast.LatestLimitDate == nil && cumulative.Lower >= limit {
+				forecast.LatestLimitDate = &reached
+			}
+		}
+		date = utcCalendar.next(date, types.GRANULARITY_DAY)
+	}
+
+	bytes, err := json.Marshal(forecast)
+	if err != nil {
+		http.Error(w, "Failed to process forecast", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"math"
+	"testing"
+)
+
+// repeatSeason repeats a season of values the given number of times
+func repeatSeason(season []float64, times int) []float64 {
+	var values []float64
+	for i := 0; i < times; i++ {
+		values = append(values, season...)
+	}
+	return values
+}
+
+func TestFitModelConstant(t *testing.T) {
+	values := repeatSeason([]float64{50}, 20)
+
+	m := fitModel(values, 0, 0.5, 0.5, 0)
+	if m.level != 50 || m.trend != 0 || m.sse != 0 || m.fitted != 19 {
+		t.Fatalf("level %v, trend %v, sse %v over %d points, want 50, 0, 0 over 19", m.level, m.trend, m.sse, m.fitted)
+	}
+
+	for i, point := range m.forecast(5, forecastScores[95], false) {
+		if point.Value != 50 || point.Lower != 50 || point.Upper != 50 {
+			t.Errorf("point %d is %v [%v, %v], want 50 without interval", i, point.Value, point.Lower, point.Upper)
+		}
+	}
+}
+
+func TestFitModelSeasonal(t *testing.T) {
+	season := []float64{10, 20, 30, 20}
+	values := repeatSeason(season, 6)
+
+	m := fitModel(values, len(season), 0.3, 0.3, 0.3)
+	if m.sse > 1e-9 {
+		t.Errorf("a repeating season has an error of %v, want 0", m.sse)
+	}
+
+	// The series ends with a full season, the forecast starts over with its first bucket
+	for i, point := range m.forecast(8, forecastScores[95], false) {
+		if math.Abs(point.Value-season[i%len(season)]) > 1e-9 {
+			t.Errorf("point %d is %v, want %v", i, point.Value, season[i%len(season)])
+		}
+	}
+}
+
+func TestFitForecast(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+		season int
+		model  string
+		err    bool
+	}{
+		{"too short", forecastMinPoints - 1, 0, "", true},
+		{"linear", forecastMinPoints, 0, forecastHolt, false},
+		{"season too long", 2*7 + forecastMinPoints - 1, 7, forecastHolt, false},
+		{"seasonal", 2*7 + forecastMinPoints, 7, forecastHoltWinters, false},
+	}
+
+	for _, test := range tests {
+		values := make([]float64, test.length)
+		for i := range values {
+			values[i] = float64(i%7) + float64(i)/10
+		}
+
+		m, err := fitForecast(values, test.season)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: fitted a model, want an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: failed: %v", test.name, err)
+		} else if m.name() != test.model {
+			t.Errorf("%s: fitted a %s model, want %s", test.name, m.name(), test.model)
+		}
+	}
+}
+
+func TestFitForecastPicksBestParameters(t *testing.T) {
+	values := []float64{12, 15, 11, 19, 22, 18, 25, 24, 29, 27, 33, 31, 38, 35, 41, 40}
+
+	best, err := fitForecast(values, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alpha := range forecastSmoothing {
+		for _, beta := range forecastSmoothing {
+			if m := fitModel(values, 0, alpha, beta, 0); m.sse < best.sse {
+				t.Errorf("alpha %v and beta %v have an error of %v, lower than the %v picked", alpha, beta, m.sse, best.sse)
+			}
+		}
+	}
+}
+
+func TestForecastIntervals(t *testing.T) {
+	values := []float64{100, 96, 90, 91, 84, 80, 79, 71, 70, 64, 61, 55}
+	m, err := fitForecast(values, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	points := m.forecast(60, forecastScores[90], false)
+	for i := 1; i < len(points); i++ {
+		if points[i].Upper-points[i].Lower < points[i-1].Upper-points[i-1].Lower {
+			t.Errorf("the interval narrows at point %d", i)
+		}
+		if points[i].Value >= points[i-1].Value {
+			t.Errorf("point %d does not follow the decreasing trend", i)
+		}
+	}
+
+	// The trend is damped, each step moves less than the previous one
+	for i := 2; i < len(points); i++ {
+		if math.Abs(points[i].Value-points[i-1].Value) >= math.Abs(points[i-1].Value-points[i-2].Value) {
+			t.Errorf("the trend is not damped at point %d", i)
+		}
+	}
+
+	for i, point := range m.forecast(60, forecastScores[90], true) {
+		if point.Value < 0 || point.Lower < 0 || point.Upper < 0 {
+			t.Errorf("point %d is %v [%v, %v], want non-negative values", i, point.Value, point.Lower, point.Upper)
+		}
+	}
+}
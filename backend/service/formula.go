@@ -0,0 +1,505 @@
+package service
+
+import (
+	"Measurely/types"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// Limits applied to the formula metrics
+const (
+	maxFormulaLength     = 500
+	maxFormulaReferences = 10
+	maxFormulaDepth      = 5
+)
+
+// Names that can be referenced without braces in a formula. Other names are written as {name}.
+var formulaIdentifierRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// formulaNode is a node of a parsed formula. Leaves are numbers or references to metrics by name,
+// the other nodes apply an operator to their operands.
+type formulaNode struct {
+	op    byte
+	value float64
+	name  string
+	left  *formulaNode
+	right *formulaNode
+}
+
+// Kinds of the formula nodes that are not binary operators
+const (
+	formulaNumber    byte = 'n'
+	formulaReference byte = 'r'
+	formulaNegate    byte = '~'
+)
+
+// formulaParser is a recursive descent parser over the grammar:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = factor { ("*" | "/") factor }
+//	factor = "-" factor | number | name | "{" name "}" | "(" expr ")"
+type formulaParser struct {
+	src        []rune
+	pos        int
+	references int
+}
+
+// parseFormula parses a formula such as "revenue / signups" or "({new users} - churned) * 100".
+// The returned error is meant to be shown to the user.
+func parseFormula(src string) (*formulaNode, error) {
+	if len(src) > maxFormulaLength {
+		return nil, fmt.Errorf("A formula cannot be longer than %d characters", maxFormulaLength)
+	}
+
+	p := &formulaParser{src: []rune(src)}
+	node, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	if p.pos < len(p.src) {
+		return nil, fmt.Errorf("Unexpected '%c' at position %d", p.src[p.pos], p.pos+1)
+	}
+	if p.references == 0 {
+		return nil, errors.New("A formula must reference at least one metric")
+	}
+	if p.references > maxFormulaReferences {
+		return nil, fmt.Errorf("A formula cannot reference more than %d metrics", maxFormulaReferences)
+	}
+
+	return node, nil
+}
+
+func (p *formulaParser) skipSpaces() {
+	for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+// peek returns the next character that is not a space, or 0 at the end of the formula
+func (p *formulaParser) peek() rune {
+	p.skipSpaces()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *formulaParser) expr() (*formulaNode, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+
+	for c := p.peek(); c == '+' || c == '-'; c = p.peek() {
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = &formulaNode{op: byte(c), left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *formulaParser) term() (*formulaNode, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+
+	for c := p.peek(); c == '*' || c == '/'; c = p.peek() {
+		p.pos++
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = &formulaNode{op: byte(c), left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *formulaParser) factor() (*formulaNode, error) {
+	c := p.peek()
+	start := p.pos
+
+	switch {
+	case c == 0:
+		return nil, errors.New("Unexpected end of formula")
+
+	case c == '-':
+		p.pos++
+		operand, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return &formulaNode{op: formulaNegate, left: operand}, nil
+
+	case c == '(':
+		p.pos++
+		node, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("Missing ')' for the '(' at position %d", start+1)
+		}
+		p.pos++
+		return node, nil
+
+	case c == '{':
+		end := p.pos + 1
+		for end < len(p.src) && p.src[end] != '}' {
+			end++
+		}
+		if end == len(p.src) {
+			return nil, fmt.Errorf("Missing '}' for the '{' at position %d", start+1)
+		}
+		name := strings.TrimSpace(string(p.src[p.pos+1 : end]))
+		if name == "" {
+			return nil, fmt.Errorf("Empty metric name at position %d", start+1)
+		}
+		p.pos = end + 1
+		p.references++
+		return &formulaNode{op: formulaReference, name: name}, nil
+
+	case c == '.' || unicode.IsDigit(c):
+		for p.pos < len(p.src) && (p.src[p.pos] == '.' || unicode.IsDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		value, err := strconv.ParseFloat(string(p.src[start:p.pos]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number at position %d", start+1)
+		}
+		return &formulaNode{op: formulaNumber, value: value}, nil
+
+	case c == '_' || unicode.IsLetter(c):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || unicode.IsLetter(p.src[p.pos]) || unicode.IsDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		p.references++
+		return &formulaNode{op: formulaReference, name: string(p.src[start:p.pos])}, nil
+	}
+
+	return nil, fmt.Errorf("Unexpected '%c' at position %d", c, start+1)
+}
+
+// precedence returns the binding strength of the node, leaves bind the strongest
+func (n *formulaNode) precedence() int {
+	switch n.op {
+	case '+', '-':
+		return 1
+	case '*', '/':
+		return 2
+	case formulaNegate:
+		return 3
+	}
+	return 4
+}
+
+// String formats the formula in its canonical form, which is the form stored with the metric
+func (n *formulaNode) String() string {
+	switch n.op {
+	case formulaNumber:
+		return strconv.FormatFloat(n.value, 'f', -1, 64)
+	case formulaReference:
+		if formulaIdentifierRegex.MatchString(n.name) {
+			return n.name
+		}
+		return "{" + n.name + "}"
+	case formulaNegate:
+		if n.left.precedence() < n.precedence() {
+			return "-(" + n.left.String() + ")"
+		}
+		return "-" + n.left.String()
+	}
+
+	left := n.left.String()
+	if n.left.precedence() < n.precedence() {
+		left = "(" + left + ")"
+	}
+	right := n.right.String()
+	if n.right.precedence() <= n.precedence() {
+		right = "(" + right + ")"
+	}
+	return left + " " + string(n.op) + " " + right
+}
+
+// references lists the names of the metrics used by the formula
+func (n *formulaNode) references() []string {
+	switch n.op {
+	case formulaNumber:
+		return nil
+	case formulaReference:
+		return []string{n.name}
+	case formulaNegate:
+		return n.left.references()
+	}
+	return append(n.left.references(), n.right.references()...)
+}
+
+// rename replaces the references to a metric that has been renamed, and reports whether the formula changed
+func (n *formulaNode) rename(from string, to string) bool {
+	switch n.op {
+	case formulaNumber:
+		return false
+	case formulaReference:
+		if n.name == from {
+			n.name = to
+			return true
+		}
+		return false
+	case formulaNegate:
+		return n.left.rename(from, to)
+	}
+	left := n.left.rename(from, to)
+	right := n.right.rename(from, to)
+	return left || right
+}
+
+// eval computes the value of the formula. It reports false when the value is undefined, which
+// happens on a division by zero.
+func (n *formulaNode) eval(value func(name string) (float64, bool)) (float64, bool) {
+	switch n.op {
+	case formulaNumber:
+		return n.value, true
+	case formulaReference:
+		return value(n.name)
+	case formulaNegate:
+		v, ok := n.left.eval(value)
+		return -v, ok
+	}
+
+	left, ok := n.left.eval(value)
+	if !ok {
+		return 0, false
+	}
+	right, ok := n.right.eval(value)
+	if !ok {
+		return 0, false
+	}
+
+	switch n.op {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	default:
+		if right == 0 {
+			return 0, false
+		}
+		return left / right, true
+	}
+}
+
+// validateFormula parses the formula of a metric and checks it against the other metrics of the
+// project: every reference must exist, and formulas referencing other formulas cannot loop back or
+// nest too deeply. It returns the canonical form of the formula.
+func validateFormula(src string, name string, metrics []types.Metric) (string, error) {
+	node, err := parseFormula(src)
+	if err != nil {
+		return "", err
+	}
+
+	byName := make(map[string]types.Metric, len(metrics))
+	for _, metric := range metrics {
+		byName[metric.Name] = metric
+	}
+
+	// The metric being validated replaces its stored version
+	byName[name] = types.Metric{Name: name, Type: types.FORMULA_METRIC, Formula: node.String()}
+
+	var visit func(metric types.Metric, path []string) error
+	visit = func(metric types.Metric, path []string) error {
+		if len(path) > maxFormulaDepth {
+			return fmt.Errorf("Formulas cannot be nested more than %d levels deep", maxFormulaDepth)
+		}
+
+		formula, err := parseFormula(metric.Formula)
+		if err != nil {
+			return fmt.Errorf("The formula of '%s' is invalid: %v", metric.Name, err)
+		}
+
+		for _, reference := range formula.references() {
+			operand, exists := byName[reference]
+			if !exists {
+				return fmt.Errorf("Unknown metric '%s'", reference)
+			}
+			if operand.Type != types.FORMULA_METRIC {
+				continue
+			}
+			for _, seen := range path {
+				if seen == reference {
+					return fmt.Errorf("The formula cannot reference itself, through '%s'", strings.Join(append(path, reference), "' > '"))
+				}
+			}
+			if err := visit(operand, append(path, reference)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := visit(byName[name], []string{name}); err != nil {
+		return "", err
+	}
+
+	return node.String(), nil
+}
+
+// formulaUsers returns the formula metrics of the project referencing the given metric
+func formulaUsers(name string, metrics []types.Metric) []types.Metric {
+	var users []types.Metric
+	for _, metric := range metrics {
+		if metric.Type != types.FORMULA_METRIC {
+			continue
+		}
+		node, err := parseFormula(metric.Formula)
+		if err != nil {
+			continue
+		}
+		for _, reference := range node.references() {
+			if reference == name {
+				users = append(users, metric)
+				break
+			}
+		}
+	}
+	return users
+}
+
+// expandFormulas adds the operands of the formula metrics to the resolved metrics of a query,
+// following nested formulas, and returns the ids of the metrics whose events must be aggregated
+func expandFormulas(metricIds []uuid.UUID, resolved map[uuid.UUID]types.Metric, byName map[string]types.Metric) ([]uuid.UUID, error) {
+	var baseIds []uuid.UUID
+	seen := make(map[uuid.UUID]bool)
+
+	var expand func(metric types.Metric, depth int) error
+	expand = func(metric types.Metric, depth int) error {
+		if seen[metric.Id] {
+			return nil
+		}
+		seen[metric.Id] = true
+		resolved[metric.Id] = metric
+
+		if metric.Type != types.FORMULA_METRIC {
+			baseIds = append(baseIds, metric.Id)
+			return nil
+		}
+		if depth > maxFormulaDepth {
+			return fmt.Errorf("The formula of '%s' is nested too deeply", metric.Name)
+		}
+
+		node, err := parseFormula(metric.Formula)
+		if err != nil {
+			return fmt.Errorf("The formula of '%s' is invalid: %v", metric.Name, err)
+		}
+		for _, reference := range node.references() {
+			operand, exists := byName[reference]
+			if !exists {
+				return fmt.Errorf("The formula of '%s' references the unknown metric '%s'", metric.Name, reference)
+			}
+			if err := expand(operand, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, metricid := range metricIds {
+		if err := expand(resolved[metricid], 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return baseIds, nil
+}
+
+// formulaScale returns the unit of the operands of a formula. Values are expressed in hundredths,
+// except for counts.
+func formulaScale(aggregation string) float64 {
+	if aggregation == types.AGGREGATION_COUNT {
+		return 1
+	}
+	return 100
+}
+
+// formulaEvaluator returns a function evaluating the formula metrics among the given metrics. The
+// values of the base metrics they reference, directly or through other formulas, are read from operand.
+func formulaEvaluator(metrics map[uuid.UUID]types.Metric) func(metric types.Metric, operand func(types.Metric) float64) (float64, bool) {
+	byName := make(map[string]types.Metric, len(metrics))
+	for _, m := range metrics {
+		byName[m.Name] = m
+	}
+
+	nodes := make(map[uuid.UUID]*formulaNode)
+	for _, m := range metrics {
+		if m.Type == types.FORMULA_METRIC {
+			if node, err := parseFormula(m.Formula); err == nil {
+				nodes[m.Id] = node
+			}
+		}
+	}
+
+	var valueOf func(metric types.Metric, operand func(types.Metric) float64, depth int) (float64, bool)
+	valueOf = func(metric types.Metric, operand func(types.Metric) float64, depth int) (float64, bool) {
+		if metric.Type != types.FORMULA_METRIC {
+			return operand(metric), true
+		}
+		node, exists := nodes[metric.Id]
+		if !exists || depth > maxFormulaDepth {
+			return 0, false
+		}
+		return node.eval(func(name string) (float64, bool) {
+			reference, exists := byName[name]
+			if !exists {
+				return 0, false
+			}
+			return valueOf(reference, operand, depth+1)
+		})
+	}
+
+	return func(metric types.Metric, operand func(types.Metric) float64) (float64, bool) {
+		return valueOf(metric, operand, 0)
+	}
+}
+
+// formulaSeries computes the buckets of a formula metric from the series of its operands. The
+// operands are converted from hundredths before the formula is applied, and the result is converted
+// back, so that formula series read like any other series. Undefined buckets have a value of zero.
+func formulaSeries(q metricQuery, metric types.Metric, metrics map[uuid.UUID]types.Metric, series map[uuid.UUID]types.MetricSeries) types.MetricSeries {
+	scale := formulaScale(q.aggregation)
+	evaluate := formulaEvaluator(metrics)
+
+	result := types.MetricSeries{
+		MetricId:    metric.Id,
+		MetricName:  metric.Name,
+		MetricType:  metric.Type,
+		Aggregation: q.aggregation,
+		Buckets:     []types.MetricBucket{},
+	}
+
+	for bucket, i := q.calendar.truncate(q.start, q.granularity), 0; !bucket.After(q.end); bucket, i = q.calendar.next(bucket, q.granularity), i+1 {
+		current := types.MetricBucket{Date: bucket}
+		value, ok := evaluate(metric, func(operand types.Metric) float64 {
+			return series[operand.Id].Buckets[i].Value / scale
+		})
+		if ok {
+			current.Value = value * scale
+		}
+		result.Buckets = append(result.Buckets, current)
+	}
+
+	return result
+}
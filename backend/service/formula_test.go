@@ -0,0 +1,126 @@
+package service
+
+import (
+	"Measurely/types"
+	"strings"
+	"testing"
+)
+
+// evalFormula parses and evaluates a formula whose references resolve to the given values
+func evalFormula(t *testing.T, src string, values map[string]float64) (float64, bool) {
+	t.Helper()
+
+	node, err := parseFormula(src)
+	if err != nil {
+		t.Fatalf("parseFormula(%q) failed: %v", src, err)
+	}
+
+	return node.eval(func(name string) (float64, bool) {
+		value, exists := values[name]
+		return value, exists
+	})
+}
+
+func TestFormulaPrecedence(t *testing.T) {
+	tests := []struct {
+		src       string
+		value     float64
+		canonical string
+	}{
+		{"a + b * c", 14, "a + b * c"},
+		{"(a + b) * c", 18, "(a + b) * c"},
+		{"a + 2 * c", 8, "a + 2 * c"},
+		{"b - a - c", -1, "b - a - c"},
+		{"b - (a - c)", 5, "b - (a - c)"},
+		{"b / a / a", 1, "b / a / a"},
+		{"b / (a / a)", 4, "b / (a / a)"},
+		{"-a * c", -6, "-a * c"},
+		{"-(a + b) * a", -12, "-(a + b) * a"},
+		{"({a} + b) / c", 2, "(a + b) / c"},
+	}
+
+	values := map[string]float64{"a": 2, "b": 4, "c": 3}
+	for _, test := range tests {
+		value, ok := evalFormula(t, test.src, values)
+		if !ok || value != test.value {
+			t.Errorf("%q = %v (%v), want %v", test.src, value, ok, test.value)
+		}
+
+		node, _ := parseFormula(test.src)
+		if node.String() != test.canonical {
+			t.Errorf("%q formats as %q, want %q", test.src, node.String(), test.canonical)
+		}
+	}
+}
+
+func TestFormulaDivisionByZero(t *testing.T) {
+	values := map[string]float64{"revenue": 100, "signups": 0}
+
+	for _, src := range []string{"revenue / signups", "revenue / (signups * 2)", "1 + revenue / 0", "-(revenue / signups)"} {
+		if value, ok := evalFormula(t, src, values); ok {
+			t.Errorf("%q = %v, want an undefined value", src, value)
+		}
+	}
+
+	if value, ok := evalFormula(t, "signups / revenue", values); !ok || value != 0 {
+		t.Errorf("signups / revenue = %v (%v), want 0", value, ok)
+	}
+}
+
+func TestFormulaParseErrors(t *testing.T) {
+	for _, src := range []string{"", "1 + 2", "a +", "(a + b", "{a", "{} + a", "a $ b", "a b", "a / (b))"} {
+		if _, err := parseFormula(src); err == nil {
+			t.Errorf("parseFormula(%q) succeeded, want an error", src)
+		}
+	}
+}
+
+func TestValidateFormulaCycles(t *testing.T) {
+	metrics := []types.Metric{
+		{Name: "revenue", Type: types.BASE_METRIC},
+		{Name: "signups", Type: types.BASE_METRIC},
+		{Name: "arpu", Type: types.FORMULA_METRIC, Formula: "revenue / signups"},
+		{Name: "margin", Type: types.FORMULA_METRIC, Formula: "loop * 2"},
+	}
+
+	tests := []struct {
+		name    string
+		formula string
+		err     string
+	}{
+		{"ratio", "arpu * 100", ""},
+		{"ratio", "ratio + 1", "cannot reference itself"},
+		{"loop", "margin + 1", "cannot reference itself"},
+		{"arpu", "ratio", "Unknown metric 'ratio'"},
+		{"ratio", "missing / 2", "Unknown metric 'missing'"},
+	}
+
+	for _, test := range tests {
+		formula, err := validateFormula(test.formula, test.name, metrics)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("validateFormula(%q, %q) failed: %v", test.formula, test.name, err)
+			} else if formula != test.formula {
+				t.Errorf("validateFormula(%q, %q) = %q", test.formula, test.name, formula)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("validateFormula(%q, %q) = %v, want an error containing %q", test.formula, test.name, err, test.err)
+		}
+	}
+}
+
+func TestValidateFormulaDepth(t *testing.T) {
+	metrics := []types.Metric{{Name: "m0", Type: types.BASE_METRIC}}
+	for i := 1; i <= maxFormulaDepth+1; i++ {
+		metrics = append(metrics, types.Metric{Name: "m" + string(rune('0'+i)), Type: types.FORMULA_METRIC, Formula: "m" + string(rune('0'+i-1)) + " + 1"})
+	}
+
+	if _, err := validateFormula("m1 * 2", "top", metrics); err != nil {
+		t.Errorf("a shallow formula failed: %v", err)
+	}
+	if _, err := validateFormula("m"+string(rune('0'+maxFormulaDepth+1))+" * 2", "top", metrics); err == nil {
+		t.Error("a formula nested too deeply was accepted")
+	}
+}
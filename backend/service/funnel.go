@@ -0,0 +1,519 @@
+package service
+
+import (
+	"Measurely/db"
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Limits applied to the funnels. The window is expressed in minutes.
+const (
+	minFunnelSteps      = 2
+	maxFunnelSteps      = 10
+	maxFunnelName       = 100
+	defaultFunnelWindow = 7 * 24 * 60
+	maxFunnelWindow     = 90 * 24 * 60
+)
+
+// Interval at which the index of the entity funnels is checked
+const entityIndexInterval = time.Hour
+
+// EnsureEntityIndex builds the index the entity funnels rely on. Building it on a large table takes a
+// while, so it is built in the background instead of with the migrations that run at startup. The
+// funnels work without it, only slower. Only one replica builds it at a time.
+func (s *Service) EnsureEntityIndex() {
+	ctx, cancel := s.scheduler.Context()
+	defer cancel()
+
+	locked, err := s.db.WithAdvisoryLock(db.LOCK_ENTITY_INDEX, func() {
+		built, err := s.db.EnsureEntityIndex(ctx)
+		if err != nil {
+			log.Println("Failed to build the entity index:", err)
+		} else if built {
+			log.Println("Built the entity index")
+		}
+	})
+	if err != nil {
+		log.Println("Failed to acquire the entity index lock:", err)
+	} else if !locked {
+		log.Println("Entity index already being built on another instance, skipping")
+	}
+}
+
+type funnelRequest struct {
+	ProjectId     uuid.UUID          `json:"project_id"`
+	FunnelId      uuid.UUID          `json:"funnel_id"`
+	Name          string             `json:"name"`
+	Steps         []types.FunnelStep `json:"steps"`
+	WindowMinutes int                `json:"window_minutes"`
+}
+
+// apply validates the request and copies it to the funnel. The returned error is meant to be shown to the user.
+func (req funnelRequest) apply(funnel *types.Funnel, metrics map[uuid.UUID]types.Metric) error {
+	funnel.Name = strings.TrimSpace(req.Name)
+	if funnel.Name == "" || len(funnel.Name) > maxFunnelName {
+		return fmt.Errorf("The name must be between 1 and %d characters", maxFunnelName)
+	}
+
+	if len(req.Steps) < minFunnelSteps || len(req.Steps) > maxFunnelSteps {
+		return fmt.Errorf("A funnel has between %d and %d steps", minFunnelSteps, maxFunnelSteps)
+	}
+	for _, step := range req.Steps {
+		metric, exists := metrics[step.MetricId]
+		if !exists {
+			return errMetricAccess
+		}
+		if metric.Type == types.FORMULA_METRIC {
+			return errors.New("Formula metrics cannot be used in a funnel")
+		}
+		if step.FilterId.Valid {
+			if _, exists := metric.Filters[step.FilterId.UUID]; !exists {
+				return fmt.Errorf("The filter of the step '%s' does not belong to the metric", metric.Name)
+			}
+		}
+	}
+	funnel.Steps = req.Steps
+
+	funnel.WindowMinutes = req.WindowMinutes
+	if funnel.WindowMinutes == 0 {
+		funnel.WindowMinutes = defaultFunnelWindow
+	}
+	if funnel.WindowMinutes < 1 || funnel.WindowMinutes > maxFunnelWindow {
+		return fmt.Errorf("The window must be between 1 and %d minutes", maxFunnelWindow)
+	}
+
+	return nil
+}
+
+// funnelStepResults computes the conversions of the steps from their counts
+func funnelStepResults(funnel types.Funnel, metrics map[uuid.UUID]types.Metric, counts []int64) []types.FunnelStepResult {
+	results := make([]types.FunnelStepResult, len(funnel.Steps))
+	for i, step := range funnel.Steps {
+		results[i] = types.FunnelStepResult{
+			MetricId:   step.MetricId,
+			MetricName: metrics[step.MetricId].Name,
+			FilterId:   step.FilterId,
+			Count:      counts[i],
+		}
+		if counts[0] > 0 {
+			overall := float64(counts[i]) / float64(counts[0])
+			results[i].Overall = &overall
+		}
+		if i > 0 && counts[i-1] > 0 {
+			conversion := float64(counts[i]) / float64(counts[i-1])
+			results[i].Conversion = &conversion
+		}
+	}
+	return results
+}
+
+// funnelCounts returns the count of each step of the funnel, bucket by bucket. Aggregate funnels
+// count the events of each step, so a step can convert more than the previous one. Entity funnels
+// count the entities entering the funnel in each bucket, along with the ones reaching each step.
+func (s *Service) funnelCounts(funnel types.Funnel, q metricQuery, mode string, metrics map[uuid.UUID]types.Metric) ([]time.Time, [][]int64, error) {
+	var dates []time.Time
+	for bucket := q.calendar.truncate(q.start, q.granularity); !bucket.After(q.end); bucket = q.calendar.next(bucket, q.granularity) {
+		dates = append(dates, bucket.UTC())
+	}
+	counts := make([][]int64, len(dates))
+	for i := range counts {
+		counts[i] = make([]int64, len(funnel.Steps))
+	}
+
+	if mode == types.FUNNEL_ENTITY {
+		aggregates, err := s.db.GetFunnelEntities(funnel, q.start, rangeEnd(q.end), q.granularity, q.calendar.settings)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		indexes := make(map[time.Time]int, len(dates))
+		for i, date := range dates {
+			indexes[date] = i
+		}
+		for _, aggregate := range aggregates {
+			index, exists := indexes[q.calendar.truncate(aggregate.Bucket, q.granularity).UTC()]
+			if !exists {
+				continue
+			}
+			for i, count := range aggregate.Counts {
+				counts[index][i] += count
+			}
+		}
+
+		return dates, counts, nil
+	}
+
+	for i, step := range funnel.Steps {
+		stepQuery := q
+		stepQuery.metricIds = []uuid.UUID{step.MetricId}
+		stepQuery.filterId = step.FilterId.UUID
+		series, err := s.runMetricQuery(stepQuery, metrics)
+		if err != nil {
+			return nil, nil, err
+		}
+		for j, bucket := range series[0].Buckets {
+			if j < len(counts) {
+				counts[j][i] = bucket.Count
+			}
+		}
+	}
+
+	return dates, counts, nil
+}
+
+func (s *Service) GetFunnels(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	funnels, err := s.db.GetFunnels(project.Id)
+	if err != nil {
+		log.Println("Error fetching funnels:", err)
+		http.Error(w, "Failed to retrieve funnels", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(funnels)
+	if err != nil {
+		http.Error(w, "Failed to process funnels", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// QueryFunnel computes the conversions of the steps of a funnel over a range, in total and by bucket.
+// The entity mode follows the entity ids of the events, the aggregate mode compares the event counts.
+func (s *Service) QueryFunnel(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	projectid, err := uuid.Parse(query.Get("project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	funnelid, err := uuid.Parse(query.Get("funnel_id"))
+	if err != nil {
+		http.Error(w, "Invalid funnel ID", http.StatusBadRequest)
+		return
+	}
+
+	start, err := time.Parse(DateFormat, query.Get("start"))
+	if err != nil {
+		http.Error(w, "Invalid start date", http.StatusBadRequest)
+		return
+	}
+
+	end, err := time.Parse(DateFormat, query.Get("end"))
+	if err != nil {
+		http.Error(w, "Invalid end date", http.StatusBadRequest)
+		return
+	}
+
+	if end.Before(start) {
+		http.Error(w, "The end date must be after the start date", http.StatusBadRequest)
+		return
+	}
+
+	granularity := query.Get("granularity")
+	switch granularity {
+	case types.GRANULARITY_HOUR, types.GRANULARITY_DAY, types.GRANULARITY_WEEK, types.GRANULARITY_MONTH:
+	case "":
+		granularity = types.GRANULARITY_DAY
+	default:
+		http.Error(w, "Invalid granularity, it must be hour, day, week or month", http.StatusBadRequest)
+		return
+	}
+
+	mode := query.Get("mode")
+	switch mode {
+	case types.FUNNEL_AGGREGATE, types.FUNNEL_ENTITY:
+	case "":
+		mode = types.FUNNEL_AGGREGATE
+	default:
+		http.Error(w, "Invalid mode, it must be aggregate or entity", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	plan, exists := s.plans[project.CurrentPlan]
+	if !exists {
+		http.Error(w, "Invalid subscription plan", http.StatusBadRequest)
+		return
+	}
+
+	if !isRangeAllowed(plan, start, end) {
+		http.Error(w, fmt.Sprintf("Date range exceeds plan limit of %d days", plan.Range), http.StatusUnauthorized)
+		return
+	}
+
+	q := metricQuery{
+		start:       start,
+		end:         end,
+		granularity: granularity,
+		aggregation: types.AGGREGATION_COUNT,
+		calendar:    projectCalendar(project),
+	}
+	if err := q.checkBuckets(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	funnel, err := s.db.GetFunnel(funnelid, project.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Funnel not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching funnel:", err)
+		http.Error(w, "Failed to retrieve funnel", http.StatusInternalServerError)
+		return
+	}
+
+	metrics, ok := s.funnelMetrics(w, project)
+	if !ok {
+		return
+	}
+
+	// The metrics and the filters of a funnel can be deleted after it was created
+	for i, step := range funnel.Steps {
+		metric, exists := metrics[step.MetricId]
+		if !exists {
+			http.Error(w, fmt.Sprintf("The metric of step %d no longer exists, update the funnel", i+1), http.StatusConflict)
+			return
+		}
+		if _, exists := metric.Filters[step.FilterId.UUID]; step.FilterId.Valid && !exists {
+			http.Error(w, fmt.Sprintf("The filter of step %d no longer exists, update the funnel", i+1), http.StatusConflict)
+			return
+		}
+	}
+
+	dates, counts, err := s.funnelCounts(funnel, q, mode, metrics)
+	if err != nil {
+		log.Println("Error computing funnel:", err)
+		http.Error(w, "Failed to compute the funnel", http.StatusInternalServerError)
+		return
+	}
+
+	result := types.FunnelResult{
+		FunnelId:    funnel.Id,
+		Name:        funnel.Name,
+		Mode:        mode,
+		Granularity: granularity,
+		Start:       start,
+		End:         end,
+		Buckets:     make([]types.FunnelBucket, len(dates)),
+	}
+	totals := make([]int64, len(funnel.Steps))
+	for i, date := range dates {
+		for j, count := range counts[i] {
+			totals[j] += count
+		}
+		result.Buckets[i] = types.FunnelBucket{Date: date, Steps: funnelStepResults(funnel, metrics, counts[i])}
+	}
+	result.Steps = funnelStepResults(funnel, metrics, totals)
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Failed to process funnel", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+func (s *Service) CreateFunnel(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request funnelRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.editorProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	metrics, ok := s.funnelMetrics(w, project)
+	if !ok {
+		return
+	}
+
+	funnel := types.Funnel{
+		ProjectId: project.Id,
+		UserId:    token.Id,
+	}
+	if err := request.apply(&funnel, metrics); err == errMetricAccess {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	funnel, err := s.db.CreateFunnel(funnel)
+	if err != nil {
+		log.Println("Error creating funnel:", err)
+		http.Error(w, "Failed to create funnel", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(funnel)
+	if err != nil {
+		http.Error(w, "Failed to process funnel", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes)
+}
+
+func (s *Service) UpdateFunnel(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request funnelRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.editorProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	funnel, err := s.db.GetFunnel(request.FunnelId, project.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Funnel not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching funnel:", err)
+		http.Error(w, "Failed to retrieve funnel", http.StatusInternalServerError)
+		return
+	}
+
+	metrics, ok := s.funnelMetrics(w, project)
+	if !ok {
+		return
+	}
+
+	if err := request.apply(&funnel, metrics); err == errMetricAccess {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.db.UpdateFunnel(funnel); err != nil {
+		log.Println("Error updating funnel:", err)
+		http.Error(w, "Failed to update funnel", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) DeleteFunnel(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId uuid.UUID `json:"project_id"`
+		FunnelId  uuid.UUID `json:"funnel_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.editorProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeleteFunnel(request.FunnelId, project.Id); err != nil {
+		log.Println("Error deleting funnel:", err)
+		http.Error(w, "Failed to delete funnel", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// funnelMetrics returns the metrics of the project the steps of a funnel are picked from
+func (s *Service) funnelMetrics(w http.ResponseWriter, project types.Project) (map[uuid.UUID]types.Metric, bool) {
+	list, err := s.db.GetMetrics(project.Id)
+	if err != nil {
+		log.Println("Error fetching metrics:", err)
+		http.Error(w, "Failed to retrieve metrics", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	metrics := make(map[uuid.UUID]types.Metric, len(list))
+	for _, metric := range list {
+		metrics[metric.Id] = metric
+	}
+	return metrics, true
+}
@@ -0,0 +1,787 @@
+package service
+
+import (
+	"Measurely/db"
+	"Measurely/email"
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Settings of the metric goals. A goal falls behind once its pace drops under goalBehindPace, after
+// a share of goalMinElapsed of its period, so that the first days of a period are not notified.
+const (
+	goalInterval    = time.Hour
+	goalHistory     = 56
+	goalMinElapsed  = 0.1
+	goalBehindPace  = 0.9
+	maxGoalDays     = 366
+	maxGoalName     = 100
+	goalModelLinear = "linear"
+)
+
+// errGoalBuckets is returned when the period of a bucket goal does not contain a full bucket
+var errGoalBuckets = errors.New("The period of the goal must contain at least one full bucket")
+
+// goalPeriod returns the period of a goal containing the given date. Custom goals keep their dates.
+func goalPeriod(cal calendar, goal types.MetricGoal, now time.Time) (time.Time, time.Time) {
+	switch goal.Period {
+	case types.GOAL_CUSTOM:
+		return goal.PeriodStart.In(cal.loc), goal.PeriodEnd.In(cal.loc)
+	case types.GOAL_QUARTER:
+		start := cal.truncate(now, types.GRANULARITY_QUARTER)
+		return start, cal.next(start, types.GRANULARITY_QUARTER)
+	default:
+		start := cal.truncate(now, types.GRANULARITY_MONTH)
+		return start, cal.next(start, types.GRANULARITY_MONTH)
+	}
+}
+
+// goalBuckets returns the buckets fully contained in the period of a bucket goal
+func goalBuckets(cal calendar, granularity string, start time.Time, end time.Time) []time.Time {
+	first := cal.truncate(start, granularity)
+	if first.Before(start) {
+		first = cal.next(first, granularity)
+	}
+
+	var buckets []time.Time
+	for bucket := first; !cal.next(bucket, granularity).After(end); bucket = cal.next(bucket, granularity) {
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
+
+// goalState tells whether a goal is reached, behind its pace or on track. A goal whose period ended
+// without reaching its target is behind.
+func goalState(progress types.GoalProgress, ended bool) string {
+	switch {
+	case progress.Progress >= 1:
+		return types.GOAL_REACHED
+	case ended:
+		return types.GOAL_BEHIND
+	case progress.ExpectedProgress >= goalMinElapsed && progress.Pace != nil && *progress.Pace < goalBehindPace:
+		return types.GOAL_BEHIND
+	default:
+		return types.GOAL_ON_TRACK
+	}
+}
+
+// goalProgress computes the progress of a goal in the period containing the given date. The metrics
+// must include the metric of the goal, along with its operands for a formula.
+func (s *Service) goalProgress(project types.Project, goal types.MetricGoal, metrics map[uuid.UUID]types.Metric, now time.Time) (types.GoalProgress, error) {
+	cal := projectCalendar(project)
+	start, end := goalPeriod(cal, goal, now)
+
+	progress := types.GoalProgress{
+		GoalId:      goal.Id,
+		PeriodStart: start,
+		PeriodEnd:   end,
+		Target:      goal.Target,
+		Model:       goalModelLinear,
+		Buckets:     []types.GoalBucket{},
+	}
+
+	metric, exists := metrics[goal.MetricId]
+	if !exists {
+		return types.GoalProgress{}, errMetricAccess
+	}
+
+	if now.After(start) {
+		var err error
+		if goal.Mode == types.GOAL_BUCKET {
+			err = s.bucketGoalProgress(cal, goal, metrics, now, &progress)
+		} else {
+			err = s.cumulativeGoalProgress(cal, project, goal, metric, metrics, now, &progress)
+		}
+		if err != nil {
+			return types.GoalProgress{}, err
+		}
+	}
+
+	if progress.ExpectedProgress > 0 {
+		pace := progress.Progress / progress.ExpectedProgress
+		progress.Pace = &pace
+	}
+	progress.State = goalState(progress, !now.Before(end))
+
+	return progress, nil
+}
+
+// cumulativeGoalProgress compares the value of the period with the target, expected to grow linearly
+// over the period. The rest of the period is projected day by day with a model fitted on the daily
+// values, the events already received today being deducted from the projection of the day.
+func (s *Service) cumulativeGoalProgress(cal calendar, project types.Project, goal types.MetricGoal, metric types.Metric, metrics map[uuid.UUID]types.Metric, now time.Time, progress *types.GoalProgress) error {
+	start, end := progress.PeriodStart, progress.PeriodEnd
+	current := now
+	if current.After(end) {
+		current = end
+	}
+	today := cal.truncate(current, types.GRANULARITY_DAY)
+
+	queryStart := forecastHistoryStart(cal, types.GRANULARITY_DAY, today, goalHistory, s.plans[project.CurrentPlan])
+	if start.Before(queryStart) {
+		queryStart = start
+	}
+
+	series, err := s.runMetricQuery(metricQuery{
+		metricIds:   []uuid.UUID{goal.MetricId},
+		start:       queryStart,
+		end:         current.Add(-time.Microsecond),
+		granularity: types.GRANULARITY_DAY,
+		aggregation: goal.Aggregation,
+		calendar:    cal,
+	}, metrics)
+	if err != nil {
+		return err
+	}
+
+	// The days before the creation of the metric would read as zeros
+	unit := valueUnit(goal.Aggregation)
+	created := cal.truncate(metric.Created, types.GRANULARITY_DAY)
+	value, todayValue := 0.0, 0.0
+	history := []float64{}
+	nonNegative := true
+	for _, bucket := range series[0].Buckets {
+		bucketValue := bucket.Value / unit
+		if !bucket.Date.Before(start) {
+			value += bucketValue
+		}
+		if bucket.Date.Equal(today) {
+			todayValue = bucketValue
+		} else if bucket.Date.Before(today) && !bucket.Date.Before(created) {
+			history = append(history, bucketValue)
+			if bucketValue < 0 {
+				nonNegative = false
+			}
+		}
+	}
+
+	elapsed := float64(current.Sub(start)) / float64(end.Sub(start))
+	progress.Value = value
+	progress.Progress = value / goal.Target
+	progress.ExpectedProgress = elapsed
+	progress.Projected = value
+
+	if now.Before(end) {
+		remaining := cal.countBuckets(today, end.Add(-time.Nanosecond), types.GRANULARITY_DAY)
+		if model, err := fitForecast(history, forecastGranularities[types.GRANULARITY_DAY].season); err == nil {
+			progress.Projected = value - todayValue
+			for i, point := range model.forecast(remaining, 0, nonNegative) {
+				if i == 0 {
+					point.Value = max(point.Value, todayValue)
+				}
+				progress.Projected += point.Value
+			}
+			progress.Model = model.name()
+		} else if elapsed > 0 {
+			progress.Projected = value / elapsed
+		}
+	}
+	progress.ProjectedProgress = progress.Projected / goal.Target
+
+	return nil
+}
+
+// bucketGoalProgress counts the buckets of the period reaching the target. A bucket in progress is met
+// as soon as it reaches the target when its value never goes back down, which holds for the count
+// and for the sum of dual metrics, and once complete otherwise. The buckets left are projected with the share of complete buckets met.
+func (s *Service) bucketGoalProgress(cal calendar, goal types.MetricGoal, metrics map[uuid.UUID]types.Metric, now time.Time, progress *types.GoalProgress) error {
+	buckets := goalBuckets(cal, goal.Granularity, progress.PeriodStart, progress.PeriodEnd)
+	if len(buckets) == 0 {
+		return errGoalBuckets
+	}
+	progress.TotalBuckets = len(buckets)
+	if !now.After(buckets[0]) {
+		return nil
+	}
+
+	end := cal.next(buckets[len(buckets)-1], goal.Granularity)
+	if now.Before(end) {
+		end = now
+	}
+
+	series, err := s.runMetricQuery(metricQuery{
+		metricIds:   []uuid.UUID{goal.MetricId},
+		start:       buckets[0],
+		end:         end.Add(-time.Microsecond),
+		granularity: goal.Granularity,
+		aggregation: goal.Aggregation,
+		calendar:    cal,
+	}, metrics)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[int64]float64, len(series[0].Buckets))
+	for _, bucket := range series[0].Buckets {
+		values[bucket.Date.Unix()] = bucket.Value / valueUnit(goal.Aggregation)
+	}
+
+	monotonic := goal.Aggregation == types.AGGREGATION_COUNT ||
+		(goal.Aggregation == types.AGGREGATION_SUM && metrics[goal.MetricId].Type == types.DUAL_METRIC)
+	met, complete, completeMet, decided := 0, 0, 0, 0
+	for _, date := range buckets {
+		if !date.Before(now) {
+			break
+		}
+
+		bucket := types.GoalBucket{
+			Date:     date,
+			Value:    values[date.Unix()],
+			Complete: !cal.next(date, goal.Granularity).After(now),
+		}
+		bucket.Met = bucket.Value >= goal.Target && (bucket.Complete || monotonic)
+
+		if bucket.Complete {
+			complete++
+			decided++
+			if bucket.Met {
+				completeMet++
+			}
+		} else if bucket.Met {
+			decided++
+		}
+		if bucket.Met {
+			met++
+		}
+		progress.Buckets = append(progress.Buckets, bucket)
+	}
+
+	rate := 1.0
+	if complete > 0 {
+		rate = float64(completeMet) / float64(complete)
+	}
+
+	total := float64(len(buckets))
+	progress.Value = float64(met)
+	progress.Progress = float64(met) / total
+	progress.ExpectedProgress = float64(complete) / total
+	progress.Projected = float64(met) + float64(len(buckets)-decided)*rate
+	progress.ProjectedProgress = progress.Projected / total
+
+	return nil
+}
+
+// CheckGoals notifies the goals that were reached or fell behind their pace. Only one replica checks
+// the goals at a time, so that every change is notified once.
+func (s *Service) CheckGoals() {
+	locked, err := s.db.WithAdvisoryLock(db.LOCK_GOALS, s.checkMetricGoals)
+	if err != nil {
+		log.Println("Failed to acquire the goals lock:", err)
+	} else if !locked {
+		log.Println("Goals already checked on another instance, skipping")
+	}
+}
+
+func (s *Service) checkMetricGoals() {
+	now := time.Now().UTC()
+
+	// Custom goals are checked once more after their end, to notify the ones that were missed
+	goals, err := s.db.GetActiveMetricGoals(now.Add(-2 * goalInterval))
+	if err != nil {
+		log.Println("Failed to fetch metric goals:", err)
+		return
+	}
+
+	var project types.Project
+	var metrics map[uuid.UUID]types.Metric
+	var projectErr error
+	for _, goal := range goals {
+		if s.scheduler.Stopping() {
+			return
+		}
+
+		if goal.ProjectId != project.Id {
+			project, projectErr = s.db.GetProjectById(goal.ProjectId)
+			if projectErr == nil {
+				var list []types.Metric
+				list, projectErr = s.db.GetMetrics(goal.ProjectId)
+				metrics = make(map[uuid.UUID]types.Metric, len(list))
+				for _, metric := range list {
+					metrics[metric.Id] = metric
+				}
+			}
+			project.Id = goal.ProjectId
+		}
+		if projectErr != nil {
+			log.Println("Failed to fetch the project of a goal:", projectErr)
+			continue
+		}
+
+		s.checkMetricGoal(project, goal, metrics, now)
+	}
+}
+
+// checkMetricGoal records the state of a goal in its current period, and notifies it when it changes
+// to reached or behind. Each period starts on track.
+func (s *Service) checkMetricGoal(project types.Project, goal types.MetricGoal, metrics map[uuid.UUID]types.Metric, now time.Time) {
+	progress, err := s.goalProgress(project, goal, metrics, now)
+	if err != nil {
+		log.Printf("Failed to compute the progress of goal %s: %v", goal.Id, err)
+		return
+	}
+
+	previous := goal.State
+	if goal.StatePeriod == nil || !goal.StatePeriod.Equal(progress.PeriodStart) {
+		previous = types.GOAL_ON_TRACK
+	}
+	if progress.State == previous && goal.StatePeriod != nil && goal.StatePeriod.Equal(progress.PeriodStart) {
+		return
+	}
+
+	if progress.State != previous && progress.State != types.GOAL_ON_TRACK {
+		s.notifyGoal(project, goal, metrics[goal.MetricId], progress, now)
+	}
+
+	if err := s.db.UpdateMetricGoalState(goal.Id, progress.State, progress.PeriodStart.UTC()); err != nil {
+		log.Println("Failed to update metric goal:", err)
+	}
+}
+
+// describeGoal explains the state of a goal in plain words, for the notifications
+func describeGoal(goal types.MetricGoal, metric types.Metric, progress types.GoalProgress) string {
+	percent := func(value float64) string {
+		return fmt.Sprintf("%d%%", int(math.Round(value*100)))
+	}
+
+	if goal.Mode == types.GOAL_BUCKET {
+		if progress.State == types.GOAL_REACHED {
+			return fmt.Sprintf("The goal %s is reached: every %s of the period reached %s on %s.",
+				goal.Name, goal.Granularity, formatDigestValue(goal.Target, ""), metric.Name)
+		}
+		return fmt.Sprintf("The goal %s is behind: %d of the %ss so far reached %s on %s, out of %d in the period.",
+			goal.Name, int(progress.Value), goal.Granularity, formatDigestValue(goal.Target, ""), metric.Name, progress.TotalBuckets)
+	}
+
+	if progress.State == types.GOAL_REACHED {
+		return fmt.Sprintf("The goal %s is reached: %s reached %s, for a target of %s.",
+			goal.Name, metric.Name, formatDigestValue(progress.Value, ""), formatDigestValue(goal.Target, ""))
+	}
+	return fmt.Sprintf("The goal %s is behind pace: %s is at %s of its target with %s of the period elapsed, and is projected to reach %s.",
+		goal.Name, metric.Name, percent(progress.Progress), percent(progress.ExpectedProgress), percent(progress.ProjectedProgress))
+}
+
+// goalPayload is the body of the goal webhooks
+type goalPayload struct {
+	Goal struct {
+		Id     uuid.UUID `json:"id"`
+		Name   string    `json:"name"`
+		Period string    `json:"period"`
+		Mode   string    `json:"mode"`
+	} `json:"goal"`
+	Metric struct {
+		Id   uuid.UUID `json:"id"`
+		Name string    `json:"name"`
+	} `json:"metric"`
+	Progress types.GoalProgress `json:"progress"`
+	Message  string             `json:"message"`
+}
+
+// notifyGoal sends a goal that was reached or fell behind to the project webhooks, and by email to
+// the user who set it while they are still a member of the project
+func (s *Service) notifyGoal(project types.Project, goal types.MetricGoal, metric types.Metric, progress types.GoalProgress, now time.Time) {
+	message := describeGoal(goal, metric, progress)
+
+	event := types.WEBHOOK_GOAL_BEHIND
+	subject := "Goal behind pace: " + goal.Name
+	if progress.State == types.GOAL_REACHED {
+		event = types.WEBHOOK_GOAL_REACHED
+		subject = "Goal reached: " + goal.Name
+	}
+
+	var payload goalPayload
+	payload.Goal.Id = goal.Id
+	payload.Goal.Name = goal.Name
+	payload.Goal.Period = goal.Period
+	payload.Goal.Mode = goal.Mode
+	payload.Metric.Id = metric.Id
+	payload.Metric.Name = metric.Name
+	payload.Progress = progress
+	payload.Message = message
+	s.emitProjectEvent(project.Id, event, payload)
+
+	if !goal.NotifyEmail {
+		return
+	}
+
+	if _, err := s.db.GetProject(project.Id, goal.UserId); err != nil {
+		return
+	}
+
+	user, err := s.db.GetUserById(goal.UserId)
+	if err != nil {
+		log.Println("Failed to fetch the user of a goal:", err)
+		return
+	}
+
+	if err := s.email.SendEmail(email.MailFields{
+		To:          user.Email,
+		Subject:     subject,
+		Content:     message,
+		Link:        GetOrigin(),
+		ButtonTitle: "Open Measurely",
+	}); err != nil {
+		log.Println("Failed to send goal email:", err)
+	}
+}
+
+// goalRequest holds the settings of a goal sent by the dashboard
+type goalRequest struct {
+	ProjectId   uuid.UUID  `json:"project_id"`
+	GoalId      uuid.UUID  `json:"goal_id"`
+	MetricId    uuid.UUID  `json:"metric_id"`
+	Name        string     `json:"name"`
+	Target      float64    `json:"target"`
+	Period      string     `json:"period"`
+	PeriodStart *time.Time `json:"period_start"`
+	PeriodEnd   *time.Time `json:"period_end"`
+	Mode        string     `json:"mode"`
+	Granularity string     `json:"granularity"`
+	Aggregation string     `json:"aggregation"`
+	NotifyEmail *bool      `json:"notify_email"`
+}
+
+// apply validates the settings of the request and copies them to the goal. The dates of a custom
+// goal are days of the project calendar, the last one included. The returned error is meant to be
+// shown to the user.
+func (req goalRequest) apply(goal *types.MetricGoal, metric types.Metric, cal calendar) error {
+	goal.Name = strings.TrimSpace(req.Name)
+	if goal.Name == "" || len(goal.Name) > maxGoalName {
+		return fmt.Errorf("The name must be between 1 and %d characters", maxGoalName)
+	}
+
+	if req.Target <= 0 {
+		return errors.New("The target must be greater than zero")
+	}
+	goal.Target = req.Target
+
+	goal.Period = req.Period
+	goal.PeriodStart, goal.PeriodEnd = nil, nil
+	switch goal.Period {
+	case types.GOAL_MONTH, types.GOAL_QUARTER:
+	case types.GOAL_CUSTOM:
+		if req.PeriodStart == nil || req.PeriodEnd == nil {
+			return errors.New("A custom goal needs a start and an end date")
+		}
+		start := cal.truncate(*req.PeriodStart, types.GRANULARITY_DAY).UTC()
+		end := cal.next(cal.truncate(*req.PeriodEnd, types.GRANULARITY_DAY), types.GRANULARITY_DAY).UTC()
+		if !start.Before(end) {
+			return errors.New("The end date must be after the start date")
+		}
+		if end.Sub(start) > maxGoalDays*24*time.Hour {
+			return fmt.Errorf("A custom goal covers at most %d days", maxGoalDays)
+		}
+		goal.PeriodStart, goal.PeriodEnd = &start, &end
+	default:
+		return errors.New("Invalid period, it must be month, quarter or custom")
+	}
+
+	goal.Aggregation = req.Aggregation
+	if goal.Aggregation == "" {
+		goal.Aggregation = defaultComparison(metric.Type)
+	}
+	switch goal.Aggregation {
+	case types.AGGREGATION_SUM, types.AGGREGATION_COUNT, types.AGGREGATION_AVG, types.AGGREGATION_MIN, types.AGGREGATION_MAX:
+	case types.AGGREGATION_NET:
+		if metric.Type != types.DUAL_METRIC {
+			return errors.New("The net aggregation is only available for dual metrics")
+		}
+	default:
+		return errors.New("Invalid aggregation")
+	}
+
+	goal.Mode = req.Mode
+	if goal.Mode == "" {
+		goal.Mode = types.GOAL_CUMULATIVE
+	}
+	switch goal.Mode {
+	case types.GOAL_CUMULATIVE:
+		if metric.Type == types.FORMULA_METRIC {
+			return errors.New("The cumulative mode is not available for formula metrics")
+		}
+		if goal.Aggregation != types.AGGREGATION_SUM && goal.Aggregation != types.AGGREGATION_COUNT && goal.Aggregation != types.AGGREGATION_NET {
+			return errors.New("The cumulative mode needs the sum, count or net aggregation")
+		}
+		goal.Granularity = ""
+	case types.GOAL_BUCKET:
+		goal.Granularity = req.Granularity
+		switch goal.Granularity {
+		case types.GRANULARITY_DAY, types.GRANULARITY_WEEK, types.GRANULARITY_MONTH:
+		default:
+			return errors.New("Invalid granularity, it must be day, week or month")
+		}
+		if goal.Period == types.GOAL_MONTH && goal.Granularity == types.GRANULARITY_MONTH {
+			return errors.New("The buckets of a monthly goal must be days or weeks")
+		}
+		if goal.Period == types.GOAL_CUSTOM && len(goalBuckets(cal, goal.Granularity, goal.PeriodStart.In(cal.loc), goal.PeriodEnd.In(cal.loc))) == 0 {
+			return errGoalBuckets
+		}
+	default:
+		return errors.New("Invalid mode, it must be cumulative or bucket")
+	}
+
+	if req.NotifyEmail != nil {
+		goal.NotifyEmail = *req.NotifyEmail
+	}
+
+	return nil
+}
+
+func (s *Service) GetMetricGoals(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	goals, err := s.db.GetMetricGoals(project.Id)
+	if err != nil {
+		log.Println("Error fetching metric goals:", err)
+		http.Error(w, "Failed to retrieve goals", http.StatusInternalServerError)
+		return
+	}
+	if goals == nil {
+		goals = []types.MetricGoal{}
+	}
+
+	bytes, err := json.Marshal(goals)
+	if err != nil {
+		http.Error(w, "Failed to process goals", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// GetGoalProgress returns the progress of a goal in its current period, its pace against a linear
+// expectation and its projected attainment at the end of the period
+func (s *Service) GetGoalProgress(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	projectid, err := uuid.Parse(query.Get("project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	goalid, err := uuid.Parse(query.Get("goal_id"))
+	if err != nil {
+		http.Error(w, "Invalid goal ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	goal, err := s.db.GetMetricGoal(goalid, project.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Goal not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching metric goal:", err)
+		http.Error(w, "Failed to retrieve goal", http.StatusInternalServerError)
+		return
+	}
+
+	list, err := s.db.GetMetrics(project.Id)
+	if err != nil {
+		log.Println("Error fetching metrics:", err)
+		http.Error(w, "Failed to retrieve metrics", http.StatusInternalServerError)
+		return
+	}
+	metrics := make(map[uuid.UUID]types.Metric, len(list))
+	for _, metric := range list {
+		metrics[metric.Id] = metric
+	}
+
+	progress, err := s.goalProgress(project, goal, metrics, time.Now().UTC())
+	if err != nil {
+		log.Println("Error computing goal progress:", err)
+		http.Error(w, "Failed to compute the progress of the goal", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(progress)
+	if err != nil {
+		http.Error(w, "Failed to process goal progress", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+func (s *Service) CreateMetricGoal(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request goalRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	metric, err := s.db.GetMetricById(request.MetricId)
+	if err != nil || metric.ProjectId != project.Id {
+		http.Error(w, "Metric not found", http.StatusNotFound)
+		return
+	}
+
+	goal := types.MetricGoal{
+		ProjectId:   project.Id,
+		MetricId:    metric.Id,
+		UserId:      token.Id,
+		NotifyEmail: true,
+	}
+	if err := request.apply(&goal, metric, projectCalendar(project)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	goal, err = s.db.CreateMetricGoal(goal)
+	if err != nil {
+		log.Println("Error creating metric goal:", err)
+		http.Error(w, "Failed to create goal", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(goal)
+	if err != nil {
+		http.Error(w, "Failed to process goal", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes)
+}
+
+// UpdateMetricGoal updates the settings of a goal. The metric of a goal cannot change.
+func (s *Service) UpdateMetricGoal(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request goalRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	goal, err := s.db.GetMetricGoal(request.GoalId, project.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Goal not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching metric goal:", err)
+		http.Error(w, "Failed to retrieve goal", http.StatusInternalServerError)
+		return
+	}
+
+	metric, err := s.db.GetMetricById(goal.MetricId)
+	if err != nil {
+		log.Println("Error fetching metric:", err)
+		http.Error(w, "Failed to retrieve metric", http.StatusInternalServerError)
+		return
+	}
+
+	if err := request.apply(&goal, metric, projectCalendar(project)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.db.UpdateMetricGoal(goal); err != nil {
+		log.Println("Error updating metric goal:", err)
+		http.Error(w, "Failed to update goal", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) DeleteMetricGoal(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId uuid.UUID `json:"project_id"`
+		GoalId    uuid.UUID `json:"goal_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeleteMetricGoal(request.GoalId, project.Id); err != nil {
+		log.Println("Error deleting metric goal:", err)
+		http.Error(w, "Failed to delete goal", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
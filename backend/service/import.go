@@ -0,0 +1,755 @@
+package service
+
+import (
+	"Measurely/db"
+	"Measurely/email"
+	"Measurely/types"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Settings of the CSV imports
+const (
+	maxImportSize      = 200 * 1024 * 1024
+	importPreviewRows  = 20
+	importMaxErrors    = 100
+	importChunkSize    = 1000
+	importInterval     = 15 * time.Second
+	importHeartbeat    = time.Minute
+	importStaleAfter   = 10 * time.Minute
+	importPreviewTTL   = 24 * time.Hour
+	importsListed      = 20
+	maxImportEventSize = math.MaxInt32 / 100
+)
+
+// Formats accepted for the timestamps of the imported rows
+var importDateFormats = []string{
+	time.RFC3339Nano,
+	DateFormat,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// importColumns maps the columns of an import file. Every column that is not the timestamp, the
+// metric, the value or the entity is a filter category, the filter_ prefix of the exports being optional.
+type importColumns struct {
+	timestamp int
+	metric    int
+	value     int
+	entity    int
+	filters   map[int]string
+}
+
+// Columns of the exports that are ignored when a file is imported back
+var ignoredImportColumns = []string{"event_id", "metric_id", "value_pos", "value_neg"}
+
+func parseImportHeader(header []string) (importColumns, error) {
+	columns := importColumns{timestamp: -1, metric: -1, value: -1, entity: -1, filters: make(map[int]string)}
+
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		switch name {
+		case "timestamp", "date":
+			columns.timestamp = i
+		case "metric", "metric_name":
+			columns.metric = i
+		case "value":
+			columns.value = i
+		case "entity_id", "entity":
+			columns.entity = i
+		default:
+			if name == "" || slices.Contains(ignoredImportColumns, name) {
+				continue
+			}
+			category := strings.TrimPrefix(name, "filter_")
+			if !validFilterRegex.MatchString(category) {
+				return columns, fmt.Errorf("Invalid filter category '%s'", category)
+			}
+			columns.filters[i] = category
+		}
+	}
+
+	if columns.timestamp < 0 || columns.metric < 0 || columns.value < 0 {
+		return columns, errors.New("The file must have a timestamp, a metric and a value column")
+	}
+	return columns, nil
+}
+
+func parseImportTimestamp(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, format := range importDateFormats {
+		if date, err := time.Parse(format, value); err == nil {
+			return date.UTC(), nil
+		}
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("Invalid timestamp '%s'", value)
+}
+
+// importRow is a validated row of an import file
+type importRow struct {
+	Date     time.Time         `json:"date"`
+	Metric   string            `json:"metric"`
+	Value    float64           `json:"value"`
+	Filters  map[string]string `json:"filters"`
+	EntityId string            `json:"entity_id"`
+	metric   types.Metric
+	pos      int32
+	neg      int32
+}
+
+// importScanner validates the rows of an import file against the metrics of the project
+type importScanner struct {
+	columns importColumns
+	metrics map[string]types.Metric
+	cutoff  time.Time
+	now     time.Time
+}
+
+// newImportScanner loads the metrics of the project. Rows older than the retention of the project
+// would be deleted right away, so they are rejected.
+func (s *Service) newImportScanner(project types.Project) (*importScanner, error) {
+	metrics, err := s.db.GetMetrics(project.Id)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	scanner := &importScanner{metrics: make(map[string]types.Metric, len(metrics)), now: time.Now().UTC()}
+	for _, metric := range metrics {
+		scanner.metrics[strings.ToLower(metric.Name)] = metric
+	}
+
+	if retention := s.effectiveRetention(project, scanner.now); retention > 0 {
+		today := time.Date(scanner.now.Year(), scanner.now.Month(), scanner.now.Day(), 0, 0, 0, 0, time.UTC)
+		scanner.cutoff = today.AddDate(0, 0, -retention)
+	}
+
+	return scanner, nil
+}
+
+// validate runs the ingestion checks on a row of the file
+func (sc *importScanner) validate(record []string) (importRow, error) {
+	field := func(i int) string {
+		if i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var row importRow
+	var err error
+
+	row.Date, err = parseImportTimestamp(field(sc.columns.timestamp))
+	if err != nil {
+		return row, err
+	}
+	if row.Date.After(sc.now) {
+		return row, errors.New("The timestamp is in the future")
+	}
+	if row.Date.Before(sc.cutoff) {
+		return row, errors.New("The timestamp is older than the retention of the project")
+	}
+
+	metric, exists := sc.metrics[strings.ToLower(field(sc.columns.metric))]
+	if !exists {
+		return row, fmt.Errorf("Unknown metric '%s'", field(sc.columns.metric))
+	}
+	row.metric = metric
+	row.Metric = metric.Name
+
+	if metric.Type == types.STRIPE_METRIC {
+		return row, errors.New("Stripe metrics cannot be manually updated")
+	}
+	if metric.Type == types.FORMULA_METRIC {
+		return row, errors.New("Formula metrics cannot receive events")
+	}
+
+	row.Value, err = strconv.ParseFloat(field(sc.columns.value), 64)
+	if err != nil || math.IsNaN(row.Value) || math.IsInf(row.Value, 0) {
+		return row, fmt.Errorf("Invalid value '%s'", field(sc.columns.value))
+	}
+	if metric.Type == types.BASE_METRIC && row.Value < 0 {
+		return row, errors.New("Base metrics cannot be negative")
+	}
+	if row.Value == 0 && metric.Type != types.AVERAGE_METRIC {
+		return row, errors.New("Value cannot be zero")
+	}
+	if math.Abs(row.Value) > maxImportEventSize {
+		return row, errors.New("The value is too large")
+	}
+
+	hundredths := int32(math.Round(row.Value * 100))
+	if hundredths > 0 {
+		row.pos = hundredths
+	} else {
+		row.neg = -hundredths
+	}
+
+	if sc.columns.entity >= 0 {
+		row.EntityId = field(sc.columns.entity)
+		if len(row.EntityId) > maxEntityIdLength {
+			return row, fmt.Errorf("The entity ID must be at most %d characters", maxEntityIdLength)
+		}
+	}
+
+	row.Filters = make(map[string]string)
+	for i, category := range sc.columns.filters {
+		name := strings.ToLower(field(i))
+		if name == "" {
+			continue
+		}
+		if !validFilterRegex.MatchString(name) {
+			return row, fmt.Errorf("Invalid filter '%s'", name)
+		}
+		row.Filters[category] = name
+	}
+
+	return row, nil
+}
+
+// importScan holds the outcome of reading an import file
+type importScan struct {
+	total      int64
+	valid      int64
+	firstEvent *time.Time
+	lastEvent  *time.Time
+	metrics    map[string]int64
+	errors     []types.ImportRowError
+	sample     []importRow
+}
+
+func (scan *importScan) addError(row int64, err error) {
+	if len(scan.errors) < importMaxErrors {
+		scan.errors = append(scan.errors, types.ImportRowError{Row: row, Message: err.Error()})
+	}
+}
+
+// scan reads every row of the file, calling fn with the valid ones. Row numbers start at 1 with the header.
+func (sc *importScanner) scan(r io.Reader, fn func(line int64, row importRow) error) (importScan, error) {
+	result := importScan{metrics: make(map[string]int64), errors: []types.ImportRowError{}, sample: []importRow{}}
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return result, errors.New("The file is empty")
+	} else if err != nil {
+		return result, fmt.Errorf("Invalid CSV file: %v", err)
+	}
+
+	sc.columns, err = parseImportHeader(header)
+	if err != nil {
+		return result, err
+	}
+
+	for line := int64(2); ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		result.total++
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return result, err
+			}
+			result.addError(line, err)
+			continue
+		}
+
+		row, err := sc.validate(record)
+		if err != nil {
+			result.addError(line, err)
+			continue
+		}
+
+		result.valid++
+		result.metrics[row.Metric]++
+		if result.firstEvent == nil || row.Date.Before(*result.firstEvent) {
+			date := row.Date
+			result.firstEvent = &date
+		}
+		if result.lastEvent == nil || row.Date.After(*result.lastEvent) {
+			date := row.Date
+			result.lastEvent = &date
+		}
+		if len(result.sample) < importPreviewRows {
+			result.sample = append(result.sample, row)
+		}
+
+		if fn != nil {
+			if err := fn(line, row); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// RunEventImports loads the committed imports through the ingestion pipeline. Imports are claimed
+// one at a time, so several instances can share the queue.
+func (s *Service) RunEventImports() {
+	if privateBucket() == "" {
+		return
+	}
+	defer s.expireEventImports()
+
+	for !s.scheduler.Stopping() {
+		imp, err := s.db.ClaimEventImport(time.Now().UTC().Add(-importStaleAfter))
+		if err == sql.ErrNoRows {
+			return
+		} else if err != nil {
+			log.Println("Failed to claim import:", err)
+			return
+		}
+
+		s.runEventImport(imp)
+	}
+}
+
+// expireEventImports deletes the files of the previews that were never committed
+func (s *Service) expireEventImports() {
+	imports, err := s.db.ExpireEventImports(time.Now().UTC().Add(-importPreviewTTL))
+	if err != nil {
+		log.Println("Failed to expire imports:", err)
+		return
+	}
+
+	for _, imp := range imports {
+		if _, err := s.s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+			Bucket: aws.String(privateBucket()),
+			Key:    aws.String(imp.ObjectKey),
+		}); err != nil {
+			log.Println("Failed to delete import file:", err)
+		}
+	}
+}
+
+// runEventImport reads an import file back from object storage and queues its rows with their
+// original timestamps. Imported events do not count against the monthly quota.
+func (s *Service) runEventImport(imp types.EventImport) {
+	imp.Status = types.IMPORT_FAILED
+	imp.ImportedRows = 0
+
+	// The claim is refreshed while the import runs, an import is only claimed again once its
+	// instance stopped
+	stop := heartbeat(importHeartbeat, func() error { return s.db.TouchEventImport(imp.Id) })
+	defer stop()
+
+	finish := func() {
+		if err := s.db.CompleteEventImport(imp); err != nil {
+			log.Println("Failed to update import:", err)
+		}
+		s.notifyEventImport(imp)
+	}
+
+	project, err := s.db.GetProjectById(imp.ProjectId)
+	if err != nil {
+		log.Println("Failed to fetch the project of an import:", err)
+		imp.Errors = []types.ImportRowError{{Message: "The project could not be loaded"}}
+		finish()
+		return
+	}
+
+	scanner, err := s.newImportScanner(project)
+	if err != nil {
+		log.Println("Failed to prepare import:", err)
+		imp.Errors = []types.ImportRowError{{Message: "The metrics of the project could not be loaded"}}
+		finish()
+		return
+	}
+
+	// An import claimed again after its instance stopped starts over
+	if err := s.db.ClearImportEvents(imp.Id); err != nil {
+		log.Println("Failed to clear the events of an import:", err)
+		imp.Errors = []types.ImportRowError{{Message: "The events of a previous attempt could not be deleted"}}
+		finish()
+		return
+	}
+
+	object, err := s.s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(privateBucket()),
+		Key:    aws.String(imp.ObjectKey),
+	})
+	if err != nil {
+		log.Println("Failed to download import:", err)
+		imp.Errors = []types.ImportRowError{{Message: "The file could not be read"}}
+		finish()
+		return
+	}
+	defer object.Body.Close()
+
+	importId := uuid.NullUUID{UUID: imp.Id, Valid: true}
+	var rowErrors []types.ImportRowError
+	var chunk []db.MetricEventData
+	var lines []int64
+
+	flush := func() error {
+		if s.scheduler.Stopping() {
+			return errors.New("The import was interrupted, it can be undone and imported again")
+		}
+
+		for i, result := range s.bm.QueueEvents(chunk) {
+			if result.Error != nil {
+				if len(rowErrors) < importMaxErrors {
+					rowErrors = append(rowErrors, types.ImportRowError{Row: lines[i], Message: result.Error.Error()})
+				}
+				continue
+			}
+			imp.ImportedRows++
+		}
+		chunk = chunk[:0]
+		lines = lines[:0]
+		return nil
+	}
+
+	scan, err := scanner.scan(object.Body, func(line int64, row importRow) error {
+		chunk = append(chunk, db.MetricEventData{
+			MetricID:  row.metric.Id,
+			ProjectID: project.Id,
+			ToAdd:     row.pos,
+			ToRemove:  row.neg,
+			Filters:   row.Filters,
+			EntityId:  row.EntityId,
+			Date:      row.Date,
+			ImportId:  importId,
+			SkipQuota: true,
+		})
+		lines = append(lines, line)
+
+		if len(chunk) == importChunkSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil && len(chunk) > 0 {
+		err = flush()
+	}
+
+	imp.Errors = append(scan.errors, rowErrors...)
+	if err != nil {
+		log.Printf("Import %s failed: %v", imp.Id, err)
+		imp.Errors = append(imp.Errors, types.ImportRowError{Message: err.Error()})
+	} else {
+		imp.Status = types.IMPORT_DONE
+	}
+	finish()
+
+	if _, err := s.s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: aws.String(privateBucket()),
+		Key:    aws.String(imp.ObjectKey),
+	}); err != nil && imp.Status == types.IMPORT_DONE {
+		log.Println("Failed to delete import file:", err)
+	}
+}
+
+// notifyEventImport emails the outcome of an import to the user who committed it
+func (s *Service) notifyEventImport(imp types.EventImport) {
+	user, err := s.db.GetUserById(imp.UserId)
+	if err != nil {
+		log.Println("Failed to fetch the user of an import:", err)
+		return
+	}
+
+	fields := email.MailFields{
+		To:          user.Email,
+		Subject:     "Your import of " + imp.FileName + " is complete",
+		Content:     fmt.Sprintf("%d of the %d rows of %s have been imported. The import can be undone from the settings of the project.", imp.ImportedRows, imp.TotalRows, imp.FileName),
+		Link:        GetOrigin(),
+		ButtonTitle: "Open Measurely",
+	}
+
+	if imp.Status == types.IMPORT_FAILED {
+		fields.Subject = "Your import of " + imp.FileName + " failed"
+		fields.Content = fmt.Sprintf("The import of %s could not be completed, %d rows were imported before it stopped. It can be undone from the settings of the project and imported again.", imp.FileName, imp.ImportedRows)
+	}
+
+	if err := s.email.SendEmail(fields); err != nil {
+		log.Println("Failed to send import email:", err)
+	}
+}
+
+// importProject loads the project of an import request and checks the role of the user
+func (s *Service) importProject(w http.ResponseWriter, token types.Token, projectid uuid.UUID) (types.Project, bool) {
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return types.Project{}, false
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return types.Project{}, false
+	}
+
+	if project.UserRole != types.TEAM_OWNER && project.UserRole != types.TEAM_ADMIN {
+		http.Error(w, "You do not have the necessary role to perform this action", http.StatusUnauthorized)
+		return types.Project{}, false
+	}
+
+	return project, true
+}
+
+// CreateEventImport uploads a CSV file of historical events, sent as the request body, and
+// validates every row. Nothing is written until the import is committed.
+func (s *Service) CreateEventImport(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	projectid, err := uuid.Parse(query.Get("project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	fileName := strings.TrimSpace(query.Get("file_name"))
+	if fileName == "" {
+		fileName = "import.csv"
+	}
+
+	project, ok := s.importProject(w, token, projectid)
+	if !ok {
+		return
+	}
+
+	if privateBucket() == "" {
+		http.Error(w, "Imports are not available on this instance", http.StatusServiceUnavailable)
+		return
+	}
+
+	scanner, err := s.newImportScanner(project)
+	if err != nil {
+		log.Println("Error fetching metrics:", err)
+		http.Error(w, "Failed to retrieve metrics", http.StatusInternalServerError)
+		return
+	}
+
+	// The file is stored while it is validated, so that the import can run later from another instance
+	objectKey := fmt.Sprintf("imports/%s/%s.csv", project.Id, uuid.New())
+	writer, err := newS3MultipartWriter(s.s3Client, privateBucket(), objectKey, "text/csv")
+	if err != nil {
+		log.Println("Error uploading import:", err)
+		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportSize)
+	scan, err := scanner.scan(io.TeeReader(body, writer), nil)
+	if err == nil {
+		// Store what is left after the last complete row
+		if _, err = io.Copy(writer, body); err == nil {
+			err = writer.Close()
+		}
+	}
+	if err != nil {
+		writer.Abort()
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("The file cannot exceed %d MB", maxImportSize/1024/1024), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	imp, err := s.db.CreateEventImport(types.EventImport{
+		ProjectId:  project.Id,
+		UserId:     token.Id,
+		FileName:   fileName,
+		ObjectKey:  objectKey,
+		TotalRows:  scan.total,
+		ValidRows:  scan.valid,
+		FirstEvent: scan.firstEvent,
+		LastEvent:  scan.lastEvent,
+		Metrics:    scan.metrics,
+		Errors:     scan.errors,
+	})
+	if err != nil {
+		log.Println("Error creating import:", err)
+		http.Error(w, "Failed to create import", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(struct {
+		types.EventImport
+		Preview []importRow `json:"preview"`
+	}{
+		EventImport: imp,
+		Preview:     scan.sample,
+	})
+	if err != nil {
+		http.Error(w, "Failed to process import", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes)
+}
+
+// CommitEventImport queues a previewed import, its rows are then loaded in the background
+func (s *Service) CommitEventImport(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId uuid.UUID `json:"project_id"`
+		ImportId  uuid.UUID `json:"import_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.importProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	imp, err := s.db.GetEventImport(request.ImportId, project.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Import not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching import:", err)
+		http.Error(w, "Failed to retrieve import", http.StatusInternalServerError)
+		return
+	}
+
+	if imp.ValidRows == 0 {
+		http.Error(w, "The import has no valid row", http.StatusBadRequest)
+		return
+	}
+	if imp.Status == types.IMPORT_EXPIRED {
+		http.Error(w, "The preview has expired, please upload the file again", http.StatusGone)
+		return
+	}
+
+	updated, err := s.db.UpdateEventImportStatus(imp.Id, types.IMPORT_PREVIEWED, types.IMPORT_PENDING)
+	if err != nil {
+		log.Println("Error committing import:", err)
+		http.Error(w, "Failed to commit import", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.Error(w, "The import has already been committed", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// UndoEventImport deletes the events of a finished import
+func (s *Service) UndoEventImport(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId uuid.UUID `json:"project_id"`
+		ImportId  uuid.UUID `json:"import_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.importProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	undone, err := s.db.DeleteImportEvents(request.ImportId, project.Id)
+	if err != nil {
+		log.Println("Error undoing import:", err)
+		http.Error(w, "Failed to undo import", http.StatusInternalServerError)
+		return
+	}
+	if !undone {
+		http.Error(w, "Only finished imports can be undone", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetEventImports lists the latest imports of a project
+func (s *Service) GetEventImports(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	imports, err := s.db.GetEventImports(project.Id, importsListed)
+	if err != nil {
+		log.Println("Error fetching imports:", err)
+		http.Error(w, "Failed to retrieve imports", http.StatusInternalServerError)
+		return
+	}
+	if imports == nil {
+		imports = []types.EventImport{}
+	}
+
+	bytes, err := json.Marshal(imports)
+	if err != nil {
+		http.Error(w, "Failed to process imports", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Interval between keep-alive comments sent on idle live streams
+const liveHeartbeatInterval = 15 * time.Second
+
+// EventPubSub carries the events flushed by the batch manager to the live streams of every replica.
+// The open streams watch their project, so that the events of the other projects are not carried.
+type EventPubSub interface {
+	Publish(events []types.LiveEvent) error
+	Subscribe(handler func([]types.LiveEvent))
+	Watch(projectId uuid.UUID) error
+	Close() error
+}
+
+// localPubSub delivers events to the streams of the current process only
+type localPubSub struct {
+	mu       sync.RWMutex
+	handlers []func([]types.LiveEvent)
+}
+
+func (ps *localPubSub) Publish(events []types.LiveEvent) error {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for _, handler := range ps.handlers {
+		handler(events)
+	}
+	return nil
+}
+
+func (ps *localPubSub) Subscribe(handler func([]types.LiveEvent)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.handlers = append(ps.handlers, handler)
+}
+
+// Watch does nothing, the live hub already skips the projects without streams
+func (ps *localPubSub) Watch(projectId uuid.UUID) error {
+	return nil
+}
+
+func (ps *localPubSub) Close() error {
+	return nil
+}
+
+// liveSubscriber is a single open live stream
+type liveSubscriber struct {
+	events     chan types.LiveEvent
+	metricIds  map[uuid.UUID]bool
+	categories map[string]bool
+}
+
+// matches reports whether the event passes the metric and filter category selection of the stream
+func (sub *liveSubscriber) matches(event types.LiveEvent) bool {
+	if len(sub.metricIds) > 0 && !sub.metricIds[event.MetricId] {
+		return false
+	}
+	if len(sub.categories) == 0 {
+		return true
+	}
+	for _, filter := range event.Filters {
+		if sub.categories[filter.Category] {
+			return true
+		}
+	}
+	return false
+}
+
+// liveHub dispatches events to the open live streams of each project
+type liveHub struct {
+	mu          sync.RWMutex
+	subscribers map[uuid.UUID]map[*liveSubscriber]struct{}
+	closed      chan struct{}
+	closeOnce   sync.Once
+}
+
+func newLiveHub() *liveHub {
+	return &liveHub{
+		subscribers: make(map[uuid.UUID]map[*liveSubscriber]struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+func (h *liveHub) subscribe(projectId uuid.UUID, sub *liveSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[projectId] == nil {
+		h.subscribers[projectId] = make(map[*liveSubscriber]struct{})
+	}
+	h.subscribers[projectId][sub] = struct{}{}
+}
+
+func (h *liveHub) unsubscribe(projectId uuid.UUID, sub *liveSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers[projectId], sub)
+	if len(h.subscribers[projectId]) == 0 {
+		delete(h.subscribers, projectId)
+	}
+}
+
+// broadcast hands the events to the matching streams. Events are dropped for streams that fall behind.
+func (h *liveHub) broadcast(events []types.LiveEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.subscribers) == 0 {
+		return
+	}
+
+	for _, event := range events {
+		for sub := range h.subscribers[event.ProjectId] {
+			if !sub.matches(event) {
+				continue
+			}
+			select {
+			case sub.events <- event:
+			default:
+			}
+		}
+	}
+}
+
+// close ends every open live stream
+func (h *liveHub) close() {
+	h.closeOnce.Do(func() {
+		close(h.closed)
+	})
+}
+
+// watchLiveProject keeps the events of a project flowing to the streams of this replica
+func (s *Service) watchLiveProject(projectId uuid.UUID) {
+	if err := s.pubsub.Watch(projectId); err != nil {
+		log.Printf("Error watching live events: %v", err)
+	}
+}
+
+// CloseLiveStreams ends the open live streams so the server can shut down
+func (s *Service) CloseLiveStreams() {
+	s.live.close()
+}
+
+// LiveEvents streams the events of a project as Server-Sent Events as soon as they are recorded.
+// The stream can be narrowed down with the metric_id and category query parameters, both repeatable.
+func (s *Service) LiveEvents(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	sub := &liveSubscriber{
+		events:     make(chan types.LiveEvent, 256),
+		metricIds:  make(map[uuid.UUID]bool),
+		categories: make(map[string]bool),
+	}
+
+	query := r.URL.Query()
+	for _, value := range query["metric_id"] {
+		metricid, err := uuid.Parse(value)
+		if err != nil {
+			http.Error(w, "Invalid metric ID", http.StatusBadRequest)
+			return
+		}
+		sub.metricIds[metricid] = true
+	}
+	for _, category := range query["category"] {
+		sub.categories[category] = true
+	}
+
+	_, err = s.db.GetProject(projectid, token.Id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Project not found", http.StatusNotFound)
+		} else {
+			log.Println("Error fetching project:", err)
+			http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	s.live.subscribe(projectid, sub)
+	defer s.live.unsubscribe(projectid, sub)
+	s.watchLiveProject(projectid)
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(liveHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.live.closed:
+			return
+		case <-heartbeat.C:
+			s.watchLiveProject(projectid)
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case event := <-sub.events:
+			bytes, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: metric_event\ndata: %s\n\n", bytes)
+			flusher.Flush()
+		}
+	}
+}
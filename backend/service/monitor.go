@@ -0,0 +1,431 @@
+package service
+
+import (
+	"Measurely/db"
+	"Measurely/email"
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Settings of the metric monitors. The interval goes up to a month, for the jobs running monthly.
+const (
+	monitorInterval        = time.Minute
+	minMonitorInterval     = 1
+	maxMonitorInterval     = 31 * 24 * 60
+	defaultMonitorInterval = 60
+)
+
+// CheckMonitors looks for the monitored metrics that went silent or received events again. Only one
+// replica checks the monitors at a time, so that every transition is notified once.
+func (s *Service) CheckMonitors() {
+	locked, err := s.db.WithAdvisoryLock(db.LOCK_MONITORS, s.checkMetricMonitors)
+	if err != nil {
+		log.Println("Failed to acquire the monitors lock:", err)
+	} else if !locked {
+		log.Println("Monitors already checked on another instance, skipping")
+	}
+}
+
+func (s *Service) checkMetricMonitors() {
+	now := time.Now().UTC().Truncate(time.Second)
+	monitors, err := s.db.GetEnabledMetricMonitors()
+	if err != nil {
+		log.Println("Failed to fetch metric monitors:", err)
+		return
+	}
+
+	for _, monitor := range monitors {
+		if s.scheduler.Stopping() {
+			return
+		}
+		s.checkMetricMonitor(monitor, now)
+	}
+}
+
+// monitorDeadline returns the date past which the metric of a monitor is silent. The interval is
+// counted from the last event, or from the moment the monitor was enabled if it came later.
+func monitorDeadline(monitor types.MetricMonitor) time.Time {
+	reference := monitor.LastEventTimestamp
+	if monitor.ActiveSince.After(reference) {
+		reference = monitor.ActiveSince
+	}
+	return reference.Add(time.Duration(monitor.IntervalMinutes) * time.Minute)
+}
+
+// checkMetricMonitor moves a monitor between the ok and silent states. Each transition is notified once.
+func (s *Service) checkMetricMonitor(monitor types.MetricMonitor, now time.Time) {
+	deadline := monitorDeadline(monitor)
+	silent := now.After(deadline)
+
+	state := monitor.State
+	silentSince := monitor.SilentSince
+	switch {
+	case silent && monitor.State != types.MONITOR_SILENT:
+		state = types.MONITOR_SILENT
+		silentSince = &deadline
+	case !silent && monitor.State == types.MONITOR_SILENT:
+		state = types.MONITOR_OK
+		silentSince = nil
+	}
+
+	if state != monitor.State {
+		metric, err := s.db.GetMetricById(monitor.MetricId)
+		if err != nil {
+			log.Println("Failed to fetch the metric of a monitor:", err)
+			return
+		}
+		s.notifyMonitor(monitor, metric, state, now)
+	}
+
+	if err := s.db.UpdateMetricMonitorState(monitor.Id, state, silentSince, now); err != nil {
+		log.Println("Failed to update metric monitor:", err)
+	}
+}
+
+// describeMonitor explains the state of a monitor in plain words, for the notifications
+func describeMonitor(monitor types.MetricMonitor, metric types.Metric, state string, now time.Time) string {
+	interval := formatAlertWindow(monitor.IntervalMinutes)
+	if state == types.MONITOR_SILENT {
+		return fmt.Sprintf("%s has not received any event for %s. Its monitor expects at least one event every %s.",
+			capitalize(metric.Name), interval, interval)
+	}
+
+	message := fmt.Sprintf("%s is receiving events again.", capitalize(metric.Name))
+	if monitor.SilentSince != nil {
+		silence := int(now.Sub(*monitor.SilentSince).Minutes()) + monitor.IntervalMinutes
+		message = fmt.Sprintf("%s is receiving events again, after %s without any event.", capitalize(metric.Name), formatAlertWindow(silence))
+	}
+	return message
+}
+
+// monitorPayload is the body of the monitor webhooks
+type monitorPayload struct {
+	Type      string    `json:"type"`
+	Date      time.Time `json:"date"`
+	ProjectId uuid.UUID `json:"project_id"`
+	Monitor   struct {
+		Id              uuid.UUID `json:"id"`
+		IntervalMinutes int       `json:"interval_minutes"`
+	} `json:"monitor"`
+	Metric struct {
+		Id   uuid.UUID `json:"id"`
+		Name string    `json:"name"`
+	} `json:"metric"`
+	LastEventTimestamp time.Time `json:"last_event_timestamp"`
+	Message            string    `json:"message"`
+}
+
+// notifyMonitor notifies a transition of a monitor through its webhook and the project webhooks, and
+// by email to the owners and admins of the project
+func (s *Service) notifyMonitor(monitor types.MetricMonitor, metric types.Metric, state string, now time.Time) {
+	message := describeMonitor(monitor, metric, state, now)
+	transition := "recovered"
+	if state == types.MONITOR_SILENT {
+		transition = "silent"
+	}
+
+	payload := monitorPayload{
+		Type:               "monitor." + transition,
+		Date:               now,
+		ProjectId:          monitor.ProjectId,
+		LastEventTimestamp: monitor.LastEventTimestamp,
+		Message:            message,
+	}
+	payload.Monitor.Id = monitor.Id
+	payload.Monitor.IntervalMinutes = monitor.IntervalMinutes
+	payload.Metric.Id = metric.Id
+	payload.Metric.Name = metric.Name
+	s.emitProjectEvent(monitor.ProjectId, payload.Type, payload)
+
+	if monitor.WebhookUrl != "" {
+		s.queueSourceWebhook(monitor.ProjectId, types.DELIVERY_SOURCE_MONITOR, monitor.Id, uuid.New(), payload.Type, payload)
+	}
+
+	if !monitor.NotifyEmail {
+		return
+	}
+
+	project, err := s.db.GetProjectById(monitor.ProjectId)
+	if err != nil {
+		log.Println("Failed to fetch the project of a monitor:", err)
+		return
+	}
+
+	relations, err := s.db.GetTeamRelations(monitor.ProjectId)
+	if err != nil {
+		log.Println("Failed to fetch the team of a monitor:", err)
+		return
+	}
+
+	// The owner of the project has no team relation
+	recipients := []uuid.UUID{project.UserId}
+	for _, relation := range relations {
+		if relation.Role == types.TEAM_OWNER || relation.Role == types.TEAM_ADMIN {
+			recipients = append(recipients, relation.UserId)
+		}
+	}
+
+	subject := "Metric silent: " + metric.Name
+	if state == types.MONITOR_OK {
+		subject = "Metric recovered: " + metric.Name
+	}
+
+	for _, userId := range recipients {
+		user, err := s.db.GetUserById(userId)
+		if err != nil {
+			log.Println("Failed to fetch the user of a monitor:", err)
+			continue
+		}
+
+		if err := s.email.SendEmail(email.MailFields{
+			To:          user.Email,
+			Subject:     subject,
+			Content:     message,
+			Link:        GetOrigin(),
+			ButtonTitle: "Open Measurely",
+		}); err != nil {
+			log.Println("Failed to send monitor email:", err)
+		}
+	}
+}
+
+// monitorRequest holds the settings of a monitor sent by the dashboard
+type monitorRequest struct {
+	ProjectId       uuid.UUID `json:"project_id"`
+	MonitorId       uuid.UUID `json:"monitor_id"`
+	MetricId        uuid.UUID `json:"metric_id"`
+	IntervalMinutes int       `json:"interval_minutes"`
+	NotifyEmail     *bool     `json:"notify_email"`
+	WebhookUrl      string    `json:"webhook_url"`
+	Enabled         *bool     `json:"enabled"`
+}
+
+// apply validates the settings of the request and copies them to the monitor. The returned error is
+// meant to be shown to the user.
+func (req monitorRequest) apply(monitor *types.MetricMonitor) error {
+	monitor.IntervalMinutes = req.IntervalMinutes
+	if monitor.IntervalMinutes == 0 {
+		monitor.IntervalMinutes = defaultMonitorInterval
+	}
+	if monitor.IntervalMinutes < minMonitorInterval || monitor.IntervalMinutes > maxMonitorInterval {
+		return fmt.Errorf("The interval must be between %d and %d minutes", minMonitorInterval, maxMonitorInterval)
+	}
+
+	if req.NotifyEmail != nil {
+		monitor.NotifyEmail = *req.NotifyEmail
+	}
+	if req.Enabled != nil {
+		monitor.Enabled = *req.Enabled
+	}
+
+	monitor.WebhookUrl = strings.TrimSpace(req.WebhookUrl)
+	if monitor.WebhookUrl != "" {
+		if err := validateWebhookUrl(monitor.WebhookUrl); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) GetMetricMonitors(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, projectid)
+	if !ok {
+		return
+	}
+
+	monitors, err := s.db.GetMetricMonitors(project.Id)
+	if err != nil {
+		log.Println("Error fetching metric monitors:", err)
+		http.Error(w, "Failed to retrieve monitors", http.StatusInternalServerError)
+		return
+	}
+	if monitors == nil {
+		monitors = []types.MetricMonitor{}
+	}
+
+	bytes, err := json.Marshal(monitors)
+	if err != nil {
+		http.Error(w, "Failed to process monitors", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// CreateMetricMonitor creates the monitor of a metric. A metric has at most one monitor, and the
+// secret used to sign the webhooks of the monitor is generated along with it.
+func (s *Service) CreateMetricMonitor(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request monitorRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	metric, err := s.db.GetMetricById(request.MetricId)
+	if err != nil || metric.ProjectId != project.Id {
+		http.Error(w, "Metric not found", http.StatusNotFound)
+		return
+	}
+	if metric.Type == types.FORMULA_METRIC {
+		http.Error(w, "Monitors are not available for formula metrics", http.StatusBadRequest)
+		return
+	}
+
+	monitors, err := s.db.GetMetricMonitors(project.Id)
+	if err != nil {
+		log.Println("Error fetching metric monitors:", err)
+		http.Error(w, "Failed to retrieve monitors", http.StatusInternalServerError)
+		return
+	}
+	for _, monitor := range monitors {
+		if monitor.MetricId == metric.Id {
+			http.Error(w, "The metric already has a monitor", http.StatusConflict)
+			return
+		}
+	}
+
+	monitor := types.MetricMonitor{
+		ProjectId:   project.Id,
+		MetricId:    metric.Id,
+		UserId:      token.Id,
+		NotifyEmail: true,
+		Enabled:     true,
+	}
+	if err := request.apply(&monitor); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	monitor.WebhookSecret, err = generateWebhookSecret()
+	if err != nil {
+		log.Println("Error generating webhook secret:", err)
+		http.Error(w, "Failed to create monitor", http.StatusInternalServerError)
+		return
+	}
+
+	monitor, err = s.db.CreateMetricMonitor(monitor)
+	if err != nil {
+		log.Println("Error creating metric monitor:", err)
+		http.Error(w, "Failed to create monitor", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(monitor)
+	if err != nil {
+		http.Error(w, "Failed to process monitor", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes)
+}
+
+// UpdateMetricMonitor updates the settings of a monitor. The metric of a monitor cannot change.
+func (s *Service) UpdateMetricMonitor(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request monitorRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	monitor, err := s.db.GetMetricMonitor(request.MonitorId, project.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Monitor not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching metric monitor:", err)
+		http.Error(w, "Failed to retrieve monitor", http.StatusInternalServerError)
+		return
+	}
+
+	if err := request.apply(&monitor); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.db.UpdateMetricMonitor(monitor); err != nil {
+		log.Println("Error updating metric monitor:", err)
+		http.Error(w, "Failed to update monitor", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) DeleteMetricMonitor(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId uuid.UUID `json:"project_id"`
+		MonitorId uuid.UUID `json:"monitor_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeleteMetricMonitor(request.MonitorId, project.Id); err != nil {
+		log.Println("Error deleting metric monitor:", err)
+		http.Error(w, "Failed to delete monitor", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
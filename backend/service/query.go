@@ -0,0 +1,625 @@
+package service
+
+import (
+	"Measurely/types"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Limits applied to the aggregation queries
+const (
+	maxQueryMetrics = 20
+	maxQueryBuckets = 10000
+	maxGroupBy      = 3
+	maxGroupTop     = 50
+	defaultGroupTop = 10
+)
+
+// metricQuery describes a bucketed aggregation over one or more metrics
+type metricQuery struct {
+	metricIds   []uuid.UUID
+	start       time.Time
+	end         time.Time
+	granularity string
+	aggregation string
+	filterId    uuid.UUID
+	groupBy     []string
+	top         int
+	bands       bool
+	calendar    calendar
+}
+
+// errMetricAccess is returned when a queried metric does not belong to the project
+var errMetricAccess = errors.New("Unauthorized access to metric")
+
+// parseMetricQuery reads an aggregation query from the url parameters. The returned error is meant to be shown to the user.
+func parseMetricQuery(query url.Values) (metricQuery, error) {
+	q := metricQuery{
+		granularity: query.Get("granularity"),
+		aggregation: query.Get("aggregation"),
+	}
+
+	for _, value := range query["metric_id"] {
+		metricid, err := uuid.Parse(value)
+		if err != nil {
+			return q, errors.New("Invalid metric ID")
+		}
+		q.metricIds = append(q.metricIds, metricid)
+	}
+	if len(q.metricIds) == 0 {
+		return q, errors.New("At least one metric ID is required")
+	}
+	if len(q.metricIds) > maxQueryMetrics {
+		return q, fmt.Errorf("A query cannot include more than %d metrics", maxQueryMetrics)
+	}
+
+	var err error
+	q.start, err = time.Parse(DateFormat, query.Get("start"))
+	if err != nil {
+		return q, errors.New("Invalid start date")
+	}
+
+	q.end, err = time.Parse(DateFormat, query.Get("end"))
+	if err != nil {
+		return q, errors.New("Invalid end date")
+	}
+
+	if q.end.Before(q.start) {
+		return q, errors.New("The end date must be after the start date")
+	}
+
+	switch q.granularity {
+	case types.GRANULARITY_MINUTE, types.GRANULARITY_HOUR, types.GRANULARITY_DAY, types.GRANULARITY_WEEK,
+		types.GRANULARITY_MONTH, types.GRANULARITY_QUARTER, types.GRANULARITY_YEAR:
+	case "":
+		q.granularity = types.GRANULARITY_DAY
+	default:
+		return q, errors.New("Invalid granularity")
+	}
+
+	switch q.aggregation {
+	case types.AGGREGATION_SUM, types.AGGREGATION_COUNT, types.AGGREGATION_AVG, types.AGGREGATION_MIN, types.AGGREGATION_MAX, types.AGGREGATION_NET:
+	case "":
+		q.aggregation = types.AGGREGATION_SUM
+	default:
+		return q, errors.New("Invalid aggregation")
+	}
+
+	if value := query.Get("filter_id"); value != "" {
+		q.filterId, err = uuid.Parse(value)
+		if err != nil {
+			return q, errors.New("Invalid filter ID")
+		}
+		if len(q.metricIds) > 1 {
+			return q, errors.New("A filter can only be applied to a single metric")
+		}
+	}
+
+	if groupBy := query["group_by"]; len(groupBy) > 0 {
+		if len(q.metricIds) > 1 {
+			return q, errors.New("Grouping is only available for a single metric")
+		}
+		if len(groupBy) > maxGroupBy {
+			return q, fmt.Errorf("A query cannot be grouped by more than %d categories", maxGroupBy)
+		}
+		for i, category := range groupBy {
+			if category == "" || slices.Contains(groupBy[:i], category) {
+				return q, errors.New("Invalid group by category")
+			}
+		}
+		q.groupBy = groupBy
+
+		q.top = defaultGroupTop
+		if value := query.Get("top"); value != "" {
+			q.top, err = strconv.Atoi(value)
+			if err != nil || q.top < 1 || q.top > maxGroupTop {
+				return q, fmt.Errorf("The top parameter must be between 1 and %d", maxGroupTop)
+			}
+		}
+	}
+
+	if query.Get("bands") == "true" {
+		if q.granularity != types.GRANULARITY_HOUR && q.granularity != types.GRANULARITY_DAY {
+			return q, errors.New("Bands are only available for the hour and day granularities")
+		}
+		if len(q.groupBy) > 0 {
+			return q, errors.New("Bands are not available for grouped queries")
+		}
+		q.bands = true
+	}
+
+	return q, nil
+}
+
+// checkBuckets makes sure the query does not return too many buckets once split with its calendar
+func (q metricQuery) checkBuckets() error {
+	if q.calendar.countBuckets(q.start, q.end, q.granularity) > maxQueryBuckets {
+		return fmt.Errorf("The query would return more than %d buckets, use a larger granularity", maxQueryBuckets)
+	}
+	return nil
+}
+
+// isRangeAllowed checks the date range against the history available with the plan
+func isRangeAllowed(plan types.Plan, start time.Time, end time.Time) bool {
+	nbrDays := (float64(end.Sub(start).Abs()) / float64(24*time.Hour)) - 2
+	return nbrDays <= float64(plan.Range)
+}
+
+// mergeAggregate combines two partial aggregates of the same bucket
+func mergeAggregate(a types.BucketAggregate, b types.BucketAggregate) types.BucketAggregate {
+	if a.Count == 0 {
+		return b
+	}
+	if b.Count == 0 {
+		return a
+	}
+
+	a.Count += b.Count
+	a.SumPos += b.SumPos
+	a.SumNeg += b.SumNeg
+	a.MinValue = min(a.MinValue, b.MinValue)
+	a.MaxValue = max(a.MaxValue, b.MaxValue)
+	return a
+}
+
+// finalizeBucket turns the partial aggregate of a bucket into its value. Values are expressed in
+// hundredths, like the raw events. The sum of a dual metric adds both sides, while net subtracts them.
+func finalizeBucket(aggregate types.BucketAggregate, date time.Time, metricType int, aggregation string) types.MetricBucket {
+	bucket := types.MetricBucket{
+		Date:     date,
+		ValuePos: aggregate.SumPos,
+		ValueNeg: aggregate.SumNeg,
+		Count:    aggregate.Count,
+	}
+
+	if aggregate.Count == 0 {
+		return bucket
+	}
+
+	switch aggregation {
+	case types.AGGREGATION_COUNT:
+		bucket.Value = float64(aggregate.Count)
+	case types.AGGREGATION_AVG:
+		bucket.Value = float64(aggregate.SumPos-aggregate.SumNeg) / float64(aggregate.Count)
+	case types.AGGREGATION_MIN:
+		bucket.Value = float64(aggregate.MinValue)
+	case types.AGGREGATION_MAX:
+		bucket.Value = float64(aggregate.MaxValue)
+	case types.AGGREGATION_NET:
+		bucket.Value = float64(aggregate.SumPos - aggregate.SumNeg)
+	default:
+		if metricType == types.DUAL_METRIC {
+			bucket.Value = float64(aggregate.SumPos + aggregate.SumNeg)
+		} else {
+			bucket.Value = float64(aggregate.SumPos - aggregate.SumNeg)
+		}
+	}
+
+	return bucket
+}
+
+// buildSeries lays the partial aggregates of each metric over the full list of buckets of the query.
+// Partials of smaller buckets are merged into the bucket of the query containing them.
+func buildSeries(q metricQuery, metrics map[uuid.UUID]types.Metric, aggregates []types.BucketAggregate) []types.MetricSeries {
+	perMetric := make(map[uuid.UUID]map[time.Time]types.BucketAggregate, len(q.metricIds))
+	for _, aggregate := range aggregates {
+		if perMetric[aggregate.MetricId] == nil {
+			perMetric[aggregate.MetricId] = make(map[time.Time]types.BucketAggregate)
+		}
+		bucket := q.calendar.truncate(aggregate.Bucket, q.granularity).UTC()
+		perMetric[aggregate.MetricId][bucket] = mergeAggregate(perMetric[aggregate.MetricId][bucket], aggregate)
+	}
+
+	series := make([]types.MetricSeries, 0, len(q.metricIds))
+	for _, metricid := range q.metricIds {
+		metric := metrics[metricid]
+		current := types.MetricSeries{
+			MetricId:    metric.Id,
+			MetricName:  metric.Name,
+			MetricType:  metric.Type,
+			Aggregation: q.aggregation,
+			Buckets:     []types.MetricBucket{},
+		}
+
+		for bucket := q.calendar.truncate(q.start, q.granularity); !bucket.After(q.end); bucket = q.calendar.next(bucket, q.granularity) {
+			current.Buckets = append(current.Buckets, finalizeBucket(perMetric[metricid][bucket.UTC()], bucket, metric.Type, q.aggregation))
+		}
+
+		series = append(series, current)
+	}
+
+	return series
+}
+
+// rangeEnd turns the inclusive end of a query into an exclusive bound. Postgres stores timestamps
+// with a microsecond precision.
+func rangeEnd(end time.Time) time.Time {
+	return end.Add(time.Microsecond)
+}
+
+// rollupGranularity returns the rollup granularity able to serve the query, if any. Rollups are
+// bucketed on UTC hours and days, which only line up with the local buckets of some zones.
+func (q metricQuery) rollupGranularity() (string, bool) {
+	switch q.granularity {
+	case types.GRANULARITY_MINUTE:
+		return "", false
+	case types.GRANULARITY_HOUR:
+		return types.GRANULARITY_HOUR, q.calendar.wholeHourOffsets(q.start, q.end)
+	default:
+		if q.calendar.loc == time.UTC {
+			return types.GRANULARITY_DAY, true
+		}
+		return types.GRANULARITY_HOUR, q.calendar.wholeHourOffsets(q.start, q.end)
+	}
+}
+
+// runMetricQuery executes the aggregation query. The metrics must belong to the project the query is run for,
+// along with the operands of the formula metrics. The operands are aggregated once, then the formulas are
+// evaluated bucket by bucket.
+func (s *Service) runMetricQuery(q metricQuery, metrics map[uuid.UUID]types.Metric) ([]types.MetricSeries, error) {
+	byName := make(map[string]types.Metric, len(metrics))
+	for _, metric := range metrics {
+		byName[metric.Name] = metric
+	}
+
+	baseIds, err := expandFormulas(q.metricIds, metrics, byName)
+	if err != nil {
+		return nil, err
+	}
+
+	base := q
+	base.metricIds = baseIds
+	baseSeries, err := s.aggregateMetricQuery(base, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	byId := make(map[uuid.UUID]types.MetricSeries, len(baseSeries))
+	for _, current := range baseSeries {
+		byId[current.MetricId] = current
+	}
+
+	series := make([]types.MetricSeries, 0, len(q.metricIds))
+	for _, metricid := range q.metricIds {
+		if metrics[metricid].Type == types.FORMULA_METRIC {
+			series = append(series, formulaSeries(q, metrics[metricid], metrics, byId))
+		} else {
+			series = append(series, byId[metricid])
+		}
+	}
+
+	if q.bands {
+		if err := s.addSeasonalBands(q, metrics, series); err != nil {
+			return nil, err
+		}
+	}
+
+	return series, nil
+}
+
+// aggregateMetricQuery aggregates the events of the metrics of the query. The rollup buckets fully
+// covered by the range are read from the rollups, only the edges of the range are aggregated from the raw events.
+func (s *Service) aggregateMetricQuery(q metricQuery, metrics map[uuid.UUID]types.Metric) ([]types.MetricSeries, error) {
+	if len(q.metricIds) == 0 {
+		return nil, nil
+	}
+
+	end := rangeEnd(q.end)
+
+	// Rollups fully covered by the range
+	granularity, ok := q.rollupGranularity()
+	var rollupStart, rollupEnd time.Time
+	if ok {
+		rollupStart = utcCalendar.truncate(q.start, granularity)
+		if rollupStart.Before(q.start) {
+			rollupStart = utcCalendar.next(rollupStart, granularity)
+		}
+		rollupEnd = utcCalendar.truncate(end, granularity)
+	}
+
+	if !ok || !rollupStart.Before(rollupEnd) {
+		aggregates, err := s.db.GetBucketAggregates(q.metricIds, q.start, end, q.granularity, q.calendar.settings, q.filterId)
+		if err != nil {
+			return nil, err
+		}
+		return buildSeries(q, metrics, aggregates), nil
+	}
+
+	aggregates, err := s.db.GetRollupAggregates(q.metricIds, granularity, rollupStart, rollupEnd, q.filterId)
+	if err != nil {
+		return nil, err
+	}
+
+	if q.start.Before(rollupStart) {
+		head, err := s.db.GetBucketAggregates(q.metricIds, q.start, rollupStart, q.granularity, q.calendar.settings, q.filterId)
+		if err != nil {
+			return nil, err
+		}
+		aggregates = append(aggregates, head...)
+	}
+
+	if rollupEnd.Before(end) {
+		tail, err := s.db.GetBucketAggregates(q.metricIds, rollupEnd, end, q.granularity, q.calendar.settings, q.filterId)
+		if err != nil {
+			return nil, err
+		}
+		aggregates = append(aggregates, tail...)
+	}
+
+	return buildSeries(q, metrics, aggregates), nil
+}
+
+// categoryFilters returns the ids of the filters of a metric belonging to a category
+func categoryFilters(metric types.Metric, category string) []string {
+	var filterIds []string
+	for filterid, filter := range metric.Filters {
+		if filter.Category == category {
+			filterIds = append(filterIds, filterid.String())
+		}
+	}
+	return filterIds
+}
+
+// metricGroup accumulates the buckets of a group while building a grouped series
+type metricGroup struct {
+	key     string
+	filters map[string]*string
+	buckets map[time.Time]types.BucketAggregate
+	overall types.BucketAggregate
+	total   float64
+}
+
+// buildGroupedSeries resolves the group keys into filter names, keeps the top N groups ranked by the
+// magnitude of their overall value and folds the remaining groups into a single "other" group. The
+// events without a filter in a category have a null value for it, as does the "other" group for
+// every category, so that they never collide with the name of a real filter.
+func buildGroupedSeries(q metricQuery, metric types.Metric, aggregates []types.GroupedBucketAggregate) types.GroupedMetricSeries {
+	groups := make(map[string]*metricGroup)
+	for _, aggregate := range aggregates {
+		filterIds := strings.Split(aggregate.GroupKey, ",")
+		filters := make(map[string]*string, len(q.groupBy))
+		names := make([]string, len(q.groupBy))
+		for i, category := range q.groupBy {
+			filters[category] = nil
+			names[i] = "-"
+			if i < len(filterIds) {
+				if filterid, err := uuid.Parse(filterIds[i]); err == nil {
+					if filter, exists := metric.Filters[filterid]; exists {
+						filters[category] = &filter.Name
+						names[i] = "=" + filter.Name
+					}
+				}
+			}
+		}
+
+		// Several filters of a category can share a name, groups are keyed on the names
+		key := strings.Join(names, "\x00")
+		group, exists := groups[key]
+		if !exists {
+			group = &metricGroup{key: key, filters: filters, buckets: make(map[time.Time]types.BucketAggregate)}
+			groups[key] = group
+		}
+
+		bucket := q.calendar.truncate(aggregate.Bucket, q.granularity).UTC()
+		group.buckets[bucket] = mergeAggregate(group.buckets[bucket], aggregate.BucketAggregate)
+		group.overall = mergeAggregate(group.overall, aggregate.BucketAggregate)
+	}
+
+	ranked := make([]*metricGroup, 0, len(groups))
+	for _, group := range groups {
+		group.total = finalizeBucket(group.overall, q.start, metric.Type, q.aggregation).Value
+		ranked = append(ranked, group)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if math.Abs(ranked[i].total) != math.Abs(ranked[j].total) {
+			return math.Abs(ranked[i].total) > math.Abs(ranked[j].total)
+		}
+		return ranked[i].key < ranked[j].key
+	})
+
+	if len(ranked) > q.top {
+		other := &metricGroup{filters: make(map[string]*string, len(q.groupBy)), buckets: make(map[time.Time]types.BucketAggregate)}
+		for _, category := range q.groupBy {
+			other.filters[category] = nil
+		}
+		for _, group := range ranked[q.top:] {
+			for bucket, aggregate := range group.buckets {
+				other.buckets[bucket] = mergeAggregate(other.buckets[bucket], aggregate)
+			}
+			other.overall = mergeAggregate(other.overall, group.overall)
+		}
+		other.total = finalizeBucket(other.overall, q.start, metric.Type, q.aggregation).Value
+		ranked = append(ranked[:q.top], other)
+	}
+
+	series := types.GroupedMetricSeries{
+		MetricId:    metric.Id,
+		MetricName:  metric.Name,
+		MetricType:  metric.Type,
+		Aggregation: q.aggregation,
+		GroupBy:     q.groupBy,
+		Groups:      make([]types.MetricGroup, 0, len(ranked)),
+	}
+
+	for i, group := range ranked {
+		current := types.MetricGroup{
+			Filters: group.filters,
+			Other:   i == q.top,
+			Total:   group.total,
+			Buckets: []types.MetricBucket{},
+		}
+		for bucket := q.calendar.truncate(q.start, q.granularity); !bucket.After(q.end); bucket = q.calendar.next(bucket, q.granularity) {
+			current.Buckets = append(current.Buckets, finalizeBucket(group.buckets[bucket.UTC()], bucket, metric.Type, q.aggregation))
+		}
+		series.Groups = append(series.Groups, current)
+	}
+
+	return series
+}
+
+// runGroupedMetricQuery executes an aggregation query grouped by filter categories
+func (s *Service) runGroupedMetricQuery(q metricQuery, metric types.Metric) (types.GroupedMetricSeries, error) {
+	categories := make([][]string, len(q.groupBy))
+	for i, category := range q.groupBy {
+		categories[i] = categoryFilters(metric, category)
+	}
+
+	aggregates, err := s.db.GetGroupedBucketAggregates(metric.Id, q.start, rangeEnd(q.end), q.granularity, q.calendar.settings, q.filterId, categories)
+	if err != nil {
+		return types.GroupedMetricSeries{}, err
+	}
+
+	return buildGroupedSeries(q, metric, aggregates), nil
+}
+
+// resolveQueryMetrics loads the metrics of the query and makes sure they belong to the project
+func (s *Service) resolveQueryMetrics(q metricQuery, projectId uuid.UUID) (map[uuid.UUID]types.Metric, error) {
+	metrics, err := s.db.GetMetrics(projectId)
+	if err != nil {
+		log.Printf("Error fetching metrics: %v", err)
+		return nil, errMetricAccess
+	}
+
+	byId := make(map[uuid.UUID]types.Metric, len(metrics))
+	for _, metric := range metrics {
+		byId[metric.Id] = metric
+	}
+
+	resolved := make(map[uuid.UUID]types.Metric, len(q.metricIds))
+	for _, metricid := range q.metricIds {
+		metric, exists := byId[metricid]
+		if !exists {
+			return nil, errMetricAccess
+		}
+		if q.aggregation == types.AGGREGATION_NET && metric.Type != types.DUAL_METRIC && metric.Type != types.FORMULA_METRIC {
+			return nil, errors.New("The net aggregation is only available for dual metrics")
+		}
+		if q.filterId != uuid.Nil {
+			if _, exists := metric.Filters[q.filterId]; !exists {
+				return nil, errors.New("The filter does not belong to the metric")
+			}
+		}
+		for _, category := range q.groupBy {
+			if len(categoryFilters(metric, category)) == 0 {
+				return nil, fmt.Errorf("The metric has no filter in the category '%s'", category)
+			}
+		}
+		resolved[metricid] = metric
+	}
+
+	// The operands of the formulas are resolved along with the queried metrics
+	byName := make(map[string]types.Metric, len(metrics))
+	for _, metric := range metrics {
+		byName[metric.Name] = metric
+	}
+	if _, err := expandFormulas(q.metricIds, resolved, byName); err != nil {
+		return nil, err
+	}
+
+	if q.aggregation == types.AGGREGATION_NET {
+		for _, metric := range resolved {
+			if metric.Type != types.DUAL_METRIC && metric.Type != types.FORMULA_METRIC {
+				return nil, fmt.Errorf("The net aggregation is only available for dual metrics, '%s' is used by a formula", metric.Name)
+			}
+		}
+	}
+
+	return resolved, nil
+}
+
+// QueryMetricEvents returns the events of one or more metrics aggregated into time buckets.
+// With group_by, the values of a single metric are broken down by the given filter categories.
+func (s *Service) QueryMetricEvents(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	projectid, err := uuid.Parse(query.Get("project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	q, err := parseMetricQuery(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Validate access
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err != nil {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+
+	q.calendar = projectCalendar(project)
+	if err := q.checkBuckets(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metrics, err := s.resolveQueryMetrics(q, project.Id)
+	if err == errMetricAccess {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	plan, exists := s.plans[project.CurrentPlan]
+	if !exists {
+		http.Error(w, "Invalid subscription plan", http.StatusBadRequest)
+		return
+	}
+
+	// Check date range
+	if !isRangeAllowed(plan, q.start, q.end) {
+		http.Error(w, fmt.Sprintf("Date range exceeds plan limit of %d days", plan.Range), http.StatusUnauthorized)
+		return
+	}
+
+	var result any
+	if len(q.groupBy) > 0 {
+		result, err = s.runGroupedMetricQuery(q, metrics[q.metricIds[0]])
+	} else {
+		result, err = s.runMetricQuery(q, metrics)
+	}
+	if err != nil {
+		log.Printf("Error querying events: %v", err)
+		http.Error(w, "Failed to query events", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, "Failed to process events", http.StatusInternalServerError)
+		return
+	}
+
+	// Cache results
+	if q.end.Before(time.Now()) {
+		SetupCacheControl(w, 100000000)
+	} else {
+		SetupCacheControl(w, 5)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
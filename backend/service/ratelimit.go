@@ -0,0 +1,42 @@
+package service
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter allows a number of actions per key within fixed windows. The counts are forgotten
+// at the end of each window, so the memory used is bounded by the keys seen in a single window.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	start  time.Time
+	counts map[string]int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		counts: make(map[string]int),
+	}
+}
+
+// allow records an action for the key and reports whether it stays within the limit of the current window
+func (l *rateLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.start) >= l.window {
+		l.start = now
+		l.counts = make(map[string]int)
+	}
+
+	if l.counts[key] >= l.limit {
+		return false
+	}
+	l.counts[key]++
+	return true
+}
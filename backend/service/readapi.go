@@ -0,0 +1,578 @@
+package service
+
+import (
+	"Measurely/types"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Prefix of the read keys, it sets them apart from the ingestion keys of the projects
+const readKeyPrefix = "mly_read_"
+
+// Number of characters of a read key shown in the dashboard
+const readKeyDisplayLength = len(readKeyPrefix) + 6
+
+// Duration a read key stays cached, it bounds the time a revoked key keeps working on other instances
+const readKeyCacheDuration = time.Minute
+
+// Cache durations of the read API responses
+const (
+	readCacheOpen   = 10
+	readCacheClosed = 3600
+)
+
+type ApiKeyCache struct {
+	key    types.ApiKey
+	expiry time.Time
+}
+
+// hashApiKey returns the hash under which an API key is stored
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetupReadCacheControl lets the clients of the read API cache a response without sharing it
+// between keys
+func SetupReadCacheControl(w http.ResponseWriter, maxAge int) {
+	w.Header().Set("Vary", "Authorization")
+	if maxAge <= 0 {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	}
+}
+
+// ReadApiKeyMiddleware authenticates the requests of the read API with a read-scoped key sent
+// as a bearer token
+func (s *Service) ReadApiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || !strings.HasPrefix(raw, readKeyPrefix) {
+			http.Error(w, "Unauthorized: Missing read API key", http.StatusUnauthorized)
+			return
+		}
+
+		hash := hashApiKey(raw)
+		var key types.ApiKey
+		if value, ok := s.apiKeysCache.Load(hash); ok && time.Now().Before(value.(ApiKeyCache).expiry) {
+			key = value.(ApiKeyCache).key
+		} else {
+			var err error
+			key, err = s.db.GetApiKeyByHash(hash)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Unauthorized: Invalid read API key", http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				log.Println("Error fetching API key:", err)
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+
+			s.apiKeysCache.Store(hash, ApiKeyCache{key: key, expiry: time.Now().Add(readKeyCacheDuration)})
+
+			// The last use is only refreshed when the cache expires
+			go func(id uuid.UUID) {
+				if err := s.db.UpdateApiKeyLastUsed(id, time.Now().UTC()); err != nil {
+					log.Println("Error updating API key last use:", err)
+				}
+			}(key.Id)
+		}
+
+		if key.Scope != types.SCOPE_READ {
+			http.Error(w, "Unauthorized: The key does not grant read access", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), types.API_KEY, key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// readProject returns the project of the read key of the request
+func (s *Service) readProject(w http.ResponseWriter, r *http.Request) (types.Project, bool) {
+	key, ok := r.Context().Value(types.API_KEY).(types.ApiKey)
+	if !ok {
+		http.Error(w, "Unauthorized: Invalid read API key", http.StatusUnauthorized)
+		return types.Project{}, false
+	}
+
+	project, err := s.db.GetProjectById(key.ProjectId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return types.Project{}, false
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return types.Project{}, false
+	}
+
+	return project, true
+}
+
+// readMetric returns the metric of the request, identified by its ID or its name
+func (s *Service) readMetric(w http.ResponseWriter, r *http.Request, project types.Project) (types.Metric, bool) {
+	identifier := chi.URLParam(r, "metric")
+
+	var metric types.Metric
+	var err error
+	if metricid, perr := uuid.Parse(identifier); perr == nil {
+		metric, err = s.db.GetMetricById(metricid)
+		if err == nil && metric.ProjectId != project.Id {
+			err = sql.ErrNoRows
+		}
+	} else {
+		metric, err = s.db.GetMetricByName(identifier, project.Id)
+	}
+
+	if err == sql.ErrNoRows {
+		http.Error(w, "Metric not found", http.StatusNotFound)
+		return types.Metric{}, false
+	} else if err != nil {
+		log.Println("Error fetching metric:", err)
+		http.Error(w, "Failed to retrieve metric", http.StatusInternalServerError)
+		return types.Metric{}, false
+	}
+
+	return metric, true
+}
+
+// writeReadResponse encodes the response of a read endpoint
+func writeReadResponse(w http.ResponseWriter, value any, maxAge int) {
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, "Failed to process response", http.StatusInternalServerError)
+		return
+	}
+
+	SetupReadCacheControl(w, maxAge)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// ReadMetricsV1 lists the metrics of the project of the read key
+func (s *Service) ReadMetricsV1(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.readProject(w, r)
+	if !ok {
+		return
+	}
+
+	metrics, err := s.db.GetMetrics(project.Id)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Error fetching metrics:", err)
+		http.Error(w, "Failed to retrieve metrics", http.StatusInternalServerError)
+		return
+	}
+	if metrics == nil {
+		metrics = []types.Metric{}
+	}
+
+	writeReadResponse(w, metrics, readCacheOpen)
+}
+
+// ReadMetricV1 returns a metric along with its lifetime total
+func (s *Service) ReadMetricV1(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.readProject(w, r)
+	if !ok {
+		return
+	}
+
+	metric, ok := s.readMetric(w, r, project)
+	if !ok {
+		return
+	}
+
+	writeReadResponse(w, metric, readCacheOpen)
+}
+
+// ReadMetricTotalV1 returns the value of a metric over a date range. Without a range, the lifetime
+// total of the metric is returned. Values are expressed in hundredths, like the raw events.
+func (s *Service) ReadMetricTotalV1(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.readProject(w, r)
+	if !ok {
+		return
+	}
+
+	metric, ok := s.readMetric(w, r, project)
+	if !ok {
+		return
+	}
+
+	// The operands of a formula are resolved along with it
+	var metrics map[uuid.UUID]types.Metric
+	if metric.Type == types.FORMULA_METRIC {
+		var err error
+		metrics, err = s.resolveQueryMetrics(metricQuery{metricIds: []uuid.UUID{metric.Id}}, project.Id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	query := r.URL.Query()
+	if query.Get("start") == "" && query.Get("end") == "" {
+		// The lifetime total of a formula is evaluated from the lifetime totals of its operands
+		if metric.Type == types.FORMULA_METRIC {
+			scale := formulaScale(types.AGGREGATION_SUM)
+			total, ok := formulaEvaluator(metrics)(metric, func(operand types.Metric) float64 {
+				return float64(operand.Total) / scale
+			})
+			if ok {
+				metric.Total = int64(math.Round(total * scale))
+			}
+		}
+
+		writeReadResponse(w, struct {
+			MetricId uuid.UUID `json:"metric_id"`
+			Value    int64     `json:"value"`
+			Count    int64     `json:"count"`
+		}{
+			MetricId: metric.Id,
+			Value:    metric.Total,
+			Count:    metric.EventCount,
+		}, readCacheOpen)
+		return
+	}
+
+	start, err := time.Parse(DateFormat, query.Get("start"))
+	if err != nil {
+		http.Error(w, "Invalid start date", http.StatusBadRequest)
+		return
+	}
+
+	end, err := time.Parse(DateFormat, query.Get("end"))
+	if err != nil {
+		http.Error(w, "Invalid end date", http.StatusBadRequest)
+		return
+	}
+
+	if end.Before(start) {
+		http.Error(w, "The end date must be after the start date", http.StatusBadRequest)
+		return
+	}
+
+	aggregation := query.Get("aggregation")
+	switch aggregation {
+	case "":
+		aggregation = defaultComparison(metric.Type)
+	case types.AGGREGATION_SUM, types.AGGREGATION_COUNT, types.AGGREGATION_AVG, types.AGGREGATION_MIN, types.AGGREGATION_MAX:
+	case types.AGGREGATION_NET:
+		if metric.Type != types.DUAL_METRIC && metric.Type != types.FORMULA_METRIC {
+			http.Error(w, "The net aggregation is only available for dual metrics", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Invalid aggregation", http.StatusBadRequest)
+		return
+	}
+
+	plan, exists := s.plans[project.CurrentPlan]
+	if !exists {
+		http.Error(w, "Invalid subscription plan", http.StatusBadRequest)
+		return
+	}
+
+	if !isRangeAllowed(plan, start, end) {
+		http.Error(w, fmt.Sprintf("Date range exceeds plan limit of %d days", plan.Range), http.StatusUnauthorized)
+		return
+	}
+
+	var bucket types.MetricBucket
+	if metric.Type == types.FORMULA_METRIC {
+		bucket.Value, err = s.formulaRangeValue(metric, metrics, start, rangeEnd(end), aggregation)
+	} else {
+		var aggregates map[uuid.UUID]types.BucketAggregate
+		aggregates, err = s.rangeAggregates(metric.Id, start, rangeEnd(end))
+		bucket = finalizeBucket(aggregates[uuid.Nil], start, metric.Type, aggregation)
+	}
+	if err != nil {
+		log.Printf("Error aggregating events: %v", err)
+		http.Error(w, "Failed to aggregate events", http.StatusInternalServerError)
+		return
+	}
+
+	maxAge := readCacheOpen
+	if end.Before(time.Now()) {
+		maxAge = readCacheClosed
+	}
+
+	writeReadResponse(w, struct {
+		MetricId    uuid.UUID `json:"metric_id"`
+		Aggregation string    `json:"aggregation"`
+		Start       time.Time `json:"start"`
+		End         time.Time `json:"end"`
+		Value       float64   `json:"value"`
+		ValuePos    int64     `json:"value_pos"`
+		ValueNeg    int64     `json:"value_neg"`
+		Count       int64     `json:"count"`
+	}{
+		MetricId:    metric.Id,
+		Aggregation: aggregation,
+		Start:       start,
+		End:         end,
+		Value:       bucket.Value,
+		ValuePos:    bucket.ValuePos,
+		ValueNeg:    bucket.ValueNeg,
+		Count:       bucket.Count,
+	}, maxAge)
+}
+
+// ReadMetricSeriesV1 returns the events of a metric aggregated into time buckets. It accepts the
+// parameters of the dashboard queries, including group_by.
+func (s *Service) ReadMetricSeriesV1(w http.ResponseWriter, r *http.Request) {
+	project, ok := s.readProject(w, r)
+	if !ok {
+		return
+	}
+
+	metric, ok := s.readMetric(w, r, project)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	query.Set("metric_id", metric.Id.String())
+	q, err := parseMetricQuery(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q.calendar = projectCalendar(project)
+	if err := q.checkBuckets(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metrics, err := s.resolveQueryMetrics(q, project.Id)
+	if err == errMetricAccess {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	plan, exists := s.plans[project.CurrentPlan]
+	if !exists {
+		http.Error(w, "Invalid subscription plan", http.StatusBadRequest)
+		return
+	}
+
+	if !isRangeAllowed(plan, q.start, q.end) {
+		http.Error(w, fmt.Sprintf("Date range exceeds plan limit of %d days", plan.Range), http.StatusUnauthorized)
+		return
+	}
+
+	var result any
+	if len(q.groupBy) > 0 {
+		result, err = s.runGroupedMetricQuery(q, metrics[metric.Id])
+	} else {
+		var series []types.MetricSeries
+		series, err = s.runMetricQuery(q, metrics)
+		if err == nil && len(series) > 0 {
+			result = series[0]
+		}
+	}
+	if err != nil {
+		log.Printf("Error querying events: %v", err)
+		http.Error(w, "Failed to query events", http.StatusInternalServerError)
+		return
+	}
+
+	maxAge := readCacheOpen
+	if q.end.Before(time.Now()) {
+		maxAge = readCacheClosed
+	}
+
+	writeReadResponse(w, result, maxAge)
+}
+
+// GetReadKeys lists the read keys of a project
+func (s *Service) GetReadKeys(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	keys, err := s.db.GetApiKeys(project.Id)
+	if err != nil {
+		log.Println("Error fetching read keys:", err)
+		http.Error(w, "Failed to retrieve read keys", http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []types.ApiKey{}
+	}
+
+	bytes, err := json.Marshal(keys)
+	if err != nil {
+		http.Error(w, "Failed to process read keys", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// CreateReadKey creates a read key for a project. The key is only returned once, only its hash is stored.
+func (s *Service) CreateReadKey(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId uuid.UUID `json:"project_id"`
+		Name      string    `json:"name"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Name) > 100 {
+		http.Error(w, "The name of the key must be between 1 and 100 characters", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(request.ProjectId, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	if project.UserRole != types.TEAM_OWNER && project.UserRole != types.TEAM_ADMIN {
+		http.Error(w, "You do not have the necessary role to perform this action", http.StatusUnauthorized)
+		return
+	}
+
+	random, err := GenerateRandomKey()
+	if err != nil {
+		log.Println("Error generating read key:", err)
+		http.Error(w, "Failed to generate read key", http.StatusInternalServerError)
+		return
+	}
+	raw := readKeyPrefix + random
+
+	key, err := s.db.CreateApiKey(types.ApiKey{
+		ProjectId: project.Id,
+		Name:      request.Name,
+		Prefix:    raw[:readKeyDisplayLength],
+		KeyHash:   hashApiKey(raw),
+		Scope:     types.SCOPE_READ,
+	})
+	if err != nil {
+		log.Println("Error creating read key:", err)
+		http.Error(w, "Failed to create read key", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(struct {
+		types.ApiKey
+		Key string `json:"key"`
+	}{
+		ApiKey: key,
+		Key:    raw,
+	})
+	if err != nil {
+		http.Error(w, "Failed to process read key", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes)
+}
+
+// DeleteReadKey revokes a read key of a project
+func (s *Service) DeleteReadKey(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId uuid.UUID `json:"project_id"`
+		KeyId     uuid.UUID `json:"key_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(request.ProjectId, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	if project.UserRole != types.TEAM_OWNER && project.UserRole != types.TEAM_ADMIN {
+		http.Error(w, "You do not have the necessary role to perform this action", http.StatusUnauthorized)
+		return
+	}
+
+	key, err := s.db.GetApiKey(request.KeyId, project.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Read key not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching read key:", err)
+		http.Error(w, "Failed to retrieve read key", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.db.DeleteApiKey(key.Id, project.Id); err != nil {
+		log.Println("Error deleting read key:", err)
+		http.Error(w, "Failed to delete read key", http.StatusInternalServerError)
+		return
+	}
+
+	s.apiKeysCache.Delete(key.KeyHash)
+
+	w.WriteHeader(http.StatusOK)
+}
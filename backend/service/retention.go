@@ -0,0 +1,274 @@
+package service
+
+import (
+	"Measurely/db"
+	"Measurely/types"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Retention settings of the pruner
+const (
+	retentionInterval    = time.Hour
+	retentionBatchSize   = 5000
+	retentionMaxBatches  = 200
+	retentionBatchPause  = 100 * time.Millisecond
+	retentionGracePeriod = 30 * 24 * time.Hour
+	retentionRunsHistory = 90 * 24 * time.Hour
+	retentionRunsListed  = 30
+)
+
+// effectiveRetention returns the number of days of events kept for the project. A custom retention
+// can only shorten the range of the plan, and the retention of the previous plan applies during the
+// grace period following a downgrade.
+func (s *Service) effectiveRetention(project types.Project, now time.Time) int {
+	plan, exists := s.plans[project.CurrentPlan]
+	if !exists {
+		return 0
+	}
+
+	retention := plan.Range
+	if project.RetentionDays > 0 && project.RetentionDays < retention {
+		retention = project.RetentionDays
+	}
+
+	if project.GraceUntil.Valid && now.Before(project.GraceUntil.V) && project.GraceRetentionDays > retention {
+		retention = project.GraceRetentionDays
+	}
+
+	return retention
+}
+
+// startRetentionGrace keeps the retention of the current plan for a grace period when the project
+// moves to a plan with a shorter range
+func (s *Service) startRetentionGrace(project types.Project, newPlan string) {
+	current, exists := s.plans[project.CurrentPlan]
+	if !exists {
+		return
+	}
+	next, exists := s.plans[newPlan]
+	if !exists || next.Range >= current.Range {
+		return
+	}
+
+	retention := s.effectiveRetention(project, time.Now().UTC())
+	if err := s.db.UpdateProjectRetentionGrace(project.Id, retention, time.Now().UTC().Add(retentionGracePeriod)); err != nil {
+		log.Println("Failed to start the retention grace period:", err)
+	}
+}
+
+// PruneExpiredEvents deletes the events past the retention of every project. Only one replica prunes at a time.
+func (s *Service) PruneExpiredEvents() {
+	locked, err := s.db.WithAdvisoryLock(db.LOCK_RETENTION, s.pruneProjects)
+	if err != nil {
+		log.Println("Failed to acquire the retention lock:", err)
+	} else if !locked {
+		log.Println("Retention already running on another instance, skipping")
+	}
+}
+
+func (s *Service) pruneProjects() {
+	projects, err := s.db.GetRetentionProjects()
+	if err != nil {
+		log.Println("Failed to fetch projects for retention:", err)
+		return
+	}
+
+	for _, project := range projects {
+		if s.scheduler.Stopping() {
+			return
+		}
+
+		run := s.pruneProject(project)
+		if run.EventsDeleted == 0 && run.RollupsDeleted == 0 && run.Error == "" {
+			continue
+		}
+
+		if err := s.db.CreateRetentionRun(run); err != nil {
+			log.Println("Failed to record retention run:", err)
+		}
+	}
+
+	if err := s.db.DeleteRetentionRunsBefore(time.Now().UTC().Add(-retentionRunsHistory)); err != nil {
+		log.Println("Failed to delete old retention runs:", err)
+	}
+	if err := s.db.DeleteWebhookDeliveriesBefore(time.Now().UTC().Add(-webhookDeliveriesHistory)); err != nil {
+		log.Println("Failed to delete old webhook deliveries:", err)
+	}
+}
+
+// pruneProject deletes the expired events of a project in bounded batches. The daily rollups are kept
+// as a compacted history while the hourly rollups expire with the events.
+func (s *Service) pruneProject(project types.Project) types.RetentionRun {
+	now := time.Now().UTC()
+	run := types.RetentionRun{
+		ProjectId:     project.Id,
+		RetentionDays: s.effectiveRetention(project, now),
+		Started:       now,
+	}
+
+	if run.RetentionDays <= 0 {
+		return run
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	run.Cutoff = today.AddDate(0, 0, -run.RetentionDays)
+
+	run.Complete = true
+	for batch := 0; ; batch++ {
+		if batch == retentionMaxBatches || s.scheduler.Stopping() {
+			run.Complete = false
+			break
+		}
+
+		deleted, err := s.db.DeleteExpiredEvents(project.Id, run.Cutoff, retentionBatchSize)
+		if err != nil {
+			log.Println("Failed to delete expired events:", err)
+			run.Error = err.Error()
+			run.Complete = false
+			break
+		}
+
+		run.EventsDeleted += deleted
+		if deleted < retentionBatchSize {
+			break
+		}
+		time.Sleep(retentionBatchPause)
+	}
+
+	if run.Error == "" {
+		deleted, err := s.db.DeleteExpiredRollups(project.Id, types.GRANULARITY_HOUR, run.Cutoff)
+		if err != nil {
+			log.Println("Failed to delete expired rollups:", err)
+			run.Error = err.Error()
+			run.Complete = false
+		}
+		run.RollupsDeleted = deleted
+	}
+
+	run.Finished = time.Now().UTC()
+	return run
+}
+
+// GetRetention returns the retention policy of a project along with the latest pruning runs
+func (s *Service) GetRetention(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(projectid, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	runs, err := s.db.GetRetentionRuns(project.Id, retentionRunsListed)
+	if err != nil {
+		log.Println("Error fetching retention runs:", err)
+		http.Error(w, "Failed to retrieve retention runs", http.StatusInternalServerError)
+		return
+	}
+	if runs == nil {
+		runs = []types.RetentionRun{}
+	}
+
+	var graceUntil *time.Time
+	if project.GraceUntil.Valid && time.Now().UTC().Before(project.GraceUntil.V) {
+		graceUntil = &project.GraceUntil.V
+	}
+
+	bytes, err := json.Marshal(struct {
+		PlanRange              int                  `json:"plan_range"`
+		RetentionDays          int                  `json:"retention_days"`
+		EffectiveRetentionDays int                  `json:"effective_retention_days"`
+		GraceRetentionDays     int                  `json:"grace_retention_days"`
+		GraceUntil             *time.Time           `json:"grace_until"`
+		Runs                   []types.RetentionRun `json:"runs"`
+	}{
+		PlanRange:              s.plans[project.CurrentPlan].Range,
+		RetentionDays:          project.RetentionDays,
+		EffectiveRetentionDays: s.effectiveRetention(project, time.Now().UTC()),
+		GraceRetentionDays:     project.GraceRetentionDays,
+		GraceUntil:             graceUntil,
+		Runs:                   runs,
+	})
+	if err != nil {
+		http.Error(w, "Failed to process retention", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// UpdateRetention sets a custom retention for a project. A retention of 0 follows the range of the plan.
+func (s *Service) UpdateRetention(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId     uuid.UUID `json:"project_id"`
+		RetentionDays int       `json:"retention_days"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, err := s.db.GetProject(request.ProjectId, token.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching project:", err)
+		http.Error(w, "Failed to retrieve project", http.StatusInternalServerError)
+		return
+	}
+
+	if project.UserRole != types.TEAM_OWNER && project.UserRole != types.TEAM_ADMIN {
+		http.Error(w, "You do not have the necessary role to perform this action", http.StatusUnauthorized)
+		return
+	}
+
+	plan, exists := s.plans[project.CurrentPlan]
+	if !exists {
+		http.Error(w, "Invalid subscription plan", http.StatusBadRequest)
+		return
+	}
+
+	if request.RetentionDays < 0 || request.RetentionDays > plan.Range {
+		http.Error(w, "The retention must be between 0 and the range of your plan", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.db.UpdateProjectRetention(project.Id, request.RetentionDays); err != nil {
+		log.Println("Error updating retention:", err)
+		http.Error(w, "Failed to update retention", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Scheduler runs the background jobs of the service at a fixed interval
+type Scheduler struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{stop: make(chan struct{})}
+}
+
+// Every runs the job at each interval until the scheduler shuts down. The first run happens after
+// the initial delay, and the interval is counted from the end of the previous run.
+func (sc *Scheduler) Every(name string, initialDelay time.Duration, interval time.Duration, job func()) {
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+
+		timer := time.NewTimer(initialDelay)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-sc.stop:
+				return
+			case <-timer.C:
+				start := time.Now()
+				sc.run(name, job)
+				log.Printf("Job %s finished in %v", name, time.Since(start).Round(time.Millisecond))
+				timer.Reset(interval)
+			}
+		}
+	}()
+}
+
+// run executes a job, recovering from any panic so that the job keeps being scheduled
+func (sc *Scheduler) run(name string, job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Job %s panicked: %v", name, r)
+		}
+	}()
+	job()
+}
+
+// Stopping reports whether the scheduler is shutting down, long jobs should return early when it is
+func (sc *Scheduler) Stopping() bool {
+	select {
+	case <-sc.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Context returns a context canceled when the scheduler shuts down, so that the queries of long jobs
+// are interrupted. The returned function releases the context once the job is done.
+func (sc *Scheduler) Context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-sc.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Shutdown stops scheduling jobs and waits for the running ones to finish
+func (sc *Scheduler) Shutdown() {
+	sc.stopOnce.Do(func() {
+		close(sc.stop)
+	})
+	sc.wg.Wait()
+}
+
+// heartbeat calls beat at each interval until the returned function is called. Long jobs use it to
+// show that they are still running, so that their claim is not taken over by another instance.
+func heartbeat(interval time.Duration, beat func() error) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := beat(); err != nil {
+					log.Println("Failed to record heartbeat:", err)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -57,7 +57,15 @@ type Service struct {
 	providers     map[string]Provider
 	metricsCache  sync.Map
 	projectsCache sync.Map
+	apiKeysCache  sync.Map
 	plans         map[string]types.Plan
+	pubsub        EventPubSub
+	live          *liveHub
+	scheduler     *Scheduler
+	deadLetters   chan deadLetter
+	deadLetterEnd chan struct{}
+	deadLetterCap *rateLimiter
+	annotationCap *rateLimiter
 }
 
 func New() Service {
@@ -154,6 +162,20 @@ func New() Service {
 
 	batchManager := db.NewBatchManager(dbConn, 1000, time.Millisecond*500)
 
+	// Share flushed events with the live streams, across replicas when configured
+	var pubsub EventPubSub = &localPubSub{}
+	if os.Getenv("LIVE_PUBSUB") == "postgres" {
+		pubsub = db.NewNotifyPubSub(dbConn, os.Getenv("DATABASE_URL"))
+	}
+
+	live := newLiveHub()
+	pubsub.Subscribe(live.broadcast)
+	batchManager.OnFlush(func(events []types.LiveEvent) {
+		if err := pubsub.Publish(events); err != nil {
+			log.Printf("Error publishing live events: %v", err)
+		}
+	})
+
 	// Return the new service with all components initialized
 	return Service{
 		db:            dbConn,
@@ -163,10 +185,38 @@ func New() Service {
 		s3Client:      client,
 		metricsCache:  sync.Map{},
 		projectsCache: sync.Map{},
+		apiKeysCache:  sync.Map{},
 		plans:         plans,
+		pubsub:        pubsub,
+		live:          live,
+		scheduler:     NewScheduler(),
+		deadLetters:   make(chan deadLetter, deadLetterQueueSize),
+		deadLetterEnd: make(chan struct{}),
+		deadLetterCap: newRateLimiter(deadLetterRate, time.Minute),
+		annotationCap: newRateLimiter(annotationRate, time.Minute),
 	}
 }
 
+// StartJobs schedules the background jobs of the service, starts following the monthly event
+// counts of the committed batches, starts the writer of the dead-letter store and sets up the
+// private bucket
+func (s *Service) StartJobs() {
+	s.bm.OnCount(s.notifyQuotaThresholds)
+	go s.writeDeadLetters()
+	go s.setupPrivateBucket()
+
+	s.scheduler.Every("retention", time.Minute, retentionInterval, s.PruneExpiredEvents)
+	s.scheduler.Every("exports", exportInterval, exportInterval, s.RunExports)
+	s.scheduler.Every("imports", importInterval, importInterval, s.RunEventImports)
+	s.scheduler.Every("alerts", alertInterval, alertInterval, s.EvaluateAlerts)
+	s.scheduler.Every("anomalies", anomalyInterval, anomalyInterval, s.DetectAnomalies)
+	s.scheduler.Every("monitors", monitorInterval, monitorInterval, s.CheckMonitors)
+	s.scheduler.Every("webhooks", webhookInterval, webhookInterval, s.RunWebhookDeliveries)
+	s.scheduler.Every("digests", digestInterval, digestInterval, s.SendDigests)
+	s.scheduler.Every("goals", goalInterval, goalInterval, s.CheckGoals)
+	s.scheduler.Every("entity_index", time.Minute, entityIndexInterval, s.EnsureEntityIndex)
+}
+
 func (s *Service) AuthenticatedMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Get the session cookie
@@ -211,8 +261,12 @@ func (s *Service) AuthenticatedMiddleware(next http.Handler) http.Handler {
 }
 
 func (s *Service) CleanUp() {
-	s.db.Close()
+	s.scheduler.Shutdown()
+	close(s.deadLetters)
+	<-s.deadLetterEnd
 	s.bm.Shutdown()
+	s.pubsub.Close()
+	s.db.Close()
 }
 
 func (s *Service) EmailValid(w http.ResponseWriter, r *http.Request) {
@@ -1617,6 +1671,7 @@ func (s *Service) CreateMetric(w http.ResponseWriter, r *http.Request) {
 		NameNeg      string    `json:"name_neg"`
 		Unit         string    `json:"unit"`
 		StripeApiKey string    `json:"stripeapikey"`
+		Formula      string    `json:"formula"`
 	}
 
 	// Try to unmarshal the request body
@@ -1638,8 +1693,12 @@ func (s *Service) CreateMetric(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Metric name can only contain letters, numbers, spaces, and these special characters ($, _ , - , / , & , *, ! , ~)", http.StatusBadRequest)
 		return
 	}
+	if isReservedMetricName(request.Name) {
+		http.Error(w, fmt.Sprintf("The name '%s' is reserved by the API", request.Name), http.StatusBadRequest)
+		return
+	}
 
-	if request.Type < 0 || request.Type > 3 {
+	if request.Type < 0 || request.Type > types.FORMULA_METRIC {
 		http.Error(w, "Invalid metric type", http.StatusBadRequest)
 		return
 	}
@@ -1678,6 +1737,22 @@ func (s *Service) CreateMetric(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	formula := ""
+	if request.Type == types.FORMULA_METRIC {
+		metrics, err := s.db.GetMetrics(request.ProjectId)
+		if err != nil && err != sql.ErrNoRows {
+			log.Println("Error fetching metrics:", err)
+			http.Error(w, "Failed to retrieve metrics", http.StatusInternalServerError)
+			return
+		}
+
+		formula, err = validateFormula(request.Formula, request.Name, metrics)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	var stripeApiKey sql.Null[string]
 	if request.Type == types.STRIPE_METRIC {
 		if request.StripeApiKey != "" {
@@ -1697,6 +1772,7 @@ func (s *Service) CreateMetric(w http.ResponseWriter, r *http.Request) {
 		NameNeg:      request.NameNeg,
 		Unit:         request.Unit,
 		StripeApiKey: stripeApiKey,
+		Formula:      formula,
 	})
 	if err != nil {
 		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
@@ -1708,7 +1784,7 @@ func (s *Service) CreateMetric(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if request.BaseValue != 0 {
+	if request.BaseValue != 0 && request.Type != types.FORMULA_METRIC {
 		app, err := s.db.GetProject(request.ProjectId, token.Id)
 		if err == nil {
 			data := map[string]interface{}{
@@ -1739,6 +1815,7 @@ func (s *Service) CreateMetric(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 
 	go measurely.Capture(metricIds["metrics"], measurely.CapturePayload{Value: 1})
+	go s.emitProjectEvent(metric.ProjectId, types.WEBHOOK_METRIC_CREATED, metric)
 }
 
 func (s *Service) DeleteMetric(w http.ResponseWriter, r *http.Request) {
@@ -1778,6 +1855,18 @@ func (s *Service) DeleteMetric(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Formulas would be left with a dangling reference
+	metrics, err := s.db.GetMetrics(request.ProjectId)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Error fetching metrics:", err)
+		http.Error(w, "Failed to retrieve metrics", http.StatusInternalServerError)
+		return
+	}
+	if users := formulaUsers(metric.Name, metrics); len(users) > 0 {
+		http.Error(w, fmt.Sprintf("The metric is used by the formula of '%s'", users[0].Name), http.StatusConflict)
+		return
+	}
+
 	// Delete the metric
 	if err := s.db.DeleteMetric(request.MetricId, request.ProjectId); err != nil {
 		log.Println("Error deleting metric:", err)
@@ -1791,6 +1880,7 @@ func (s *Service) DeleteMetric(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 	go measurely.Capture(metricIds["metrics"], measurely.CapturePayload{Value: -1})
+	go s.emitProjectEvent(project.Id, types.WEBHOOK_METRIC_DELETED, metric)
 }
 
 func (s *Service) GetMetrics(w http.ResponseWriter, r *http.Request) {
@@ -1854,6 +1944,7 @@ func (s *Service) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 		Name      string    `json:"name"`
 		NamePos   string    `json:"name_pos"`
 		NameNeg   string    `json:"name_neg"`
+		Formula   *string   `json:"formula"`
 	}
 
 	// Try to unmarshal the request body
@@ -1866,6 +1957,11 @@ func (s *Service) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 	request.NamePos = strings.TrimSpace(request.NamePos)
 	request.NameNeg = strings.TrimSpace(request.NameNeg)
 
+	if isReservedMetricName(request.Name) {
+		http.Error(w, fmt.Sprintf("The name '%s' is reserved by the API", request.Name), http.StatusBadRequest)
+		return
+	}
+
 	// Get the project
 	project, err := s.db.GetProject(request.ProjectId, token.Id)
 	if err == sql.ErrNoRows {
@@ -1888,6 +1984,34 @@ func (s *Service) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	metrics, err := s.db.GetMetrics(request.ProjectId)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Error fetching metrics:", err)
+		http.Error(w, "Failed to retrieve metrics", http.StatusInternalServerError)
+		return
+	}
+
+	formula := metric.Formula
+	if request.Formula != nil {
+		if metric.Type != types.FORMULA_METRIC {
+			http.Error(w, "Only formula metrics have a formula", http.StatusBadRequest)
+			return
+		}
+
+		others := make([]types.Metric, 0, len(metrics))
+		for _, other := range metrics {
+			if other.Id != metric.Id {
+				others = append(others, other)
+			}
+		}
+
+		formula, err = validateFormula(*request.Formula, request.Name, others)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Update the metric
 	if err := s.db.UpdateMetric(request.MetricId, request.ProjectId, request.Name, request.NamePos, request.NameNeg); err != nil {
 		log.Println("Error updating metric:", err)
@@ -1895,6 +2019,30 @@ func (s *Service) UpdateMetric(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if formula != metric.Formula {
+		if err := s.db.UpdateMetricFormula(request.MetricId, request.ProjectId, formula); err != nil {
+			log.Println("Error updating metric formula:", err)
+			http.Error(w, "Failed to update metric formula", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Formulas reference metrics by name, so they follow the renames
+	if request.Name != metric.Name {
+		for _, user := range formulaUsers(metric.Name, metrics) {
+			if user.Id == metric.Id {
+				continue
+			}
+			node, err := parseFormula(user.Formula)
+			if err != nil || !node.rename(metric.Name, request.Name) {
+				continue
+			}
+			if err := s.db.UpdateMetricFormula(user.Id, request.ProjectId, node.String()); err != nil {
+				log.Println("Error updating metric formula:", err)
+			}
+		}
+	}
+
 	s.metricsCache.Delete(project.ApiKey + metric.Name)
 	w.WriteHeader(http.StatusOK)
 }
@@ -2294,6 +2442,12 @@ func (s *Service) AddTeamMember(w http.ResponseWriter, r *http.Request) {
 		w.Write(body)
 	}
 
+	go s.emitProjectEvent(project.Id, types.WEBHOOK_MEMBER_ADDED, teamMemberEvent{
+		UserId: member.Id,
+		Email:  member.Email,
+		Role:   request.Role,
+	})
+
 	go s.email.SendEmail(email.MailFields{
 		To:          member.Email,
 		Subject:     fmt.Sprintf("You have been added to %s as a team member", project.Name),
@@ -2354,6 +2508,11 @@ func (s *Service) RemoveTeamMember(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 
+	go s.emitProjectEvent(project.Id, types.WEBHOOK_MEMBER_REMOVED, teamMemberEvent{
+		UserId: request.MemberId,
+		Role:   team_relation.Role,
+	})
+
 	user, _ := s.db.GetUserById(team_relation.Id)
 
 	go s.email.SendEmail(email.MailFields{
@@ -2434,6 +2593,13 @@ func (s *Service) UpdateMemberRole(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 
+	previousRole := team_relation.Role
+	go s.emitProjectEvent(project.Id, types.WEBHOOK_MEMBER_ROLE_CHANGED, teamMemberEvent{
+		UserId:       request.MemberId,
+		Role:         request.NewRole,
+		PreviousRole: &previousRole,
+	})
+
 	user, _ := s.db.GetUserById(team_relation.Id)
 
 	go s.email.SendEmail(email.MailFields{
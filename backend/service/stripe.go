@@ -155,11 +155,17 @@ func (s *Service) Subscribe(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Update project plan and metrics
+		s.startRetentionGrace(project, "starter")
 		s.db.UpdateProjectPlan(project.Id, "starter", "", s.plans["starter"].MaxEventPerMonth)
 		s.projectsCache.Delete(project.ApiKey)
 
 		go measurely.Capture(metricIds["projects"], measurely.CapturePayload{Value: 1, Filters: map[string]string{"plan": "starter"}})
 		go measurely.Capture(metricIds["projects"], measurely.CapturePayload{Value: -1, Filters: map[string]string{"plan": project.CurrentPlan}})
+		go s.emitProjectEvent(project.Id, types.WEBHOOK_PLAN_CHANGED, planChangedEvent{
+			Plan:             "starter",
+			PreviousPlan:     project.CurrentPlan,
+			MaxEventPerMonth: s.plans["starter"].MaxEventPerMonth,
+		})
 
 		// Notify user via email
 		go s.email.SendEmail(email.MailFields{
@@ -313,12 +319,18 @@ func (s *Service) Webhook(w http.ResponseWriter, req *http.Request) {
 		}
 
 		// Update project plan and metrics
+		s.startRetentionGrace(project, session.Metadata["plan"])
 		s.db.UpdateProjectPlan(project.Id, session.Metadata["plan"], session.Subscription.ID, max_events)
 		s.db.UpdateUserInvoiceStatus(user.Id, types.INVOICE_ACTIVE)
 		s.projectsCache.Delete(project.ApiKey)
 
 		go measurely.Capture(metricIds["projects"], measurely.CapturePayload{Value: 1, Filters: map[string]string{"plan": session.Metadata["plan"]}})
 		go measurely.Capture(metricIds["projects"], measurely.CapturePayload{Value: -1, Filters: map[string]string{"plan": project.CurrentPlan}})
+		go s.emitProjectEvent(project.Id, types.WEBHOOK_PLAN_CHANGED, planChangedEvent{
+			Plan:             session.Metadata["plan"],
+			PreviousPlan:     project.CurrentPlan,
+			MaxEventPerMonth: max_events,
+		})
 
 		// Notify user via email
 		go s.email.SendEmail(email.MailFields{
@@ -0,0 +1,724 @@
+package service
+
+import (
+	"Measurely/db"
+	"Measurely/types"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Settings of the outbound webhooks
+const (
+	webhookTimeout         = 10 * time.Second
+	webhookSecretPrefix    = "whsec_"
+	webhookSignatureHeader = "X-Measurely-Signature"
+	webhookTimestampHeader = "X-Measurely-Timestamp"
+	webhookEventHeader     = "X-Measurely-Event"
+)
+
+// webhookClient delivers every outbound webhook. Its dialer refuses the addresses of internal
+// networks once the host is resolved, so that a DNS answer cannot point a webhook back at the
+// infrastructure after its url was validated, and redirects are never followed.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: webhookDialControl,
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// errWebhookAddress is returned when a webhook would connect to an internal address
+var errWebhookAddress = errors.New("the webhook URL resolves to an internal address")
+
+// cgnatPrefix is the shared address space of carrier-grade NAT, not covered by netip.Addr.IsPrivate
+var cgnatPrefix = netip.MustParsePrefix("100.64.0.0/10")
+
+// isInternalAddr reports whether the address belongs to the loopback, private, link-local, shared
+// or unspecified ranges
+func isInternalAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() || cgnatPrefix.Contains(addr)
+}
+
+// webhookDialControl runs on the resolved address of each connection of the webhook client
+func webhookDialControl(network string, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil || isInternalAddr(addrPort.Addr()) {
+		return errWebhookAddress
+	}
+	return nil
+}
+
+// generateWebhookSecret creates the secret used to sign the payloads sent to an endpoint
+func generateWebhookSecret() (string, error) {
+	key, err := GenerateRandomKey()
+	if err != nil {
+		return "", err
+	}
+	return webhookSecretPrefix + key, nil
+}
+
+// validateWebhookUrl checks that a webhook can be delivered to the url. Outside of development the
+// url must use https. Internal hosts given as an address or as localhost are refused right away, the
+// other hosts are checked once resolved by the webhook client. The returned error is meant to be shown to the user.
+func validateWebhookUrl(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Hostname() == "" || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+		return errors.New("The webhook URL must be an absolute http or https URL")
+	}
+	if os.Getenv("ENV") == "production" && parsed.Scheme != "https" {
+		return errors.New("The webhook URL must use https")
+	}
+
+	host := strings.ToLower(parsed.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errors.New("The webhook URL cannot point to an internal address")
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && isInternalAddr(addr) {
+		return errors.New("The webhook URL cannot point to an internal address")
+	}
+	return nil
+}
+
+// signWebhook signs a payload with the secret of its endpoint. The signature is the hex encoded
+// HMAC-SHA256 of the timestamp and the body joined by a dot, so that receivers can reject replays.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook posts a signed JSON payload to an endpoint and returns the status of the response.
+// Any status outside of the 2xx range is reported as an error.
+func sendWebhook(endpoint string, secret string, event string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Measurely-Webhooks/1.0")
+	req.Header.Set(webhookEventHeader, event)
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("the endpoint responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Settings of the project webhooks. A delivery is attempted up to webhookMaxAttempts times, waiting
+// twice as long after each failure, which spreads the attempts over about four hours.
+const (
+	webhookInterval          = 15 * time.Second
+	webhookBatchSize         = 50
+	webhookLease             = 2 * time.Minute
+	webhookMaxAttempts       = 10
+	webhookRetryBase         = 30 * time.Second
+	webhookRetryMax          = 2 * time.Hour
+	maxWebhookEndpoints      = 10
+	webhookDeliveriesListed  = 100
+	webhookDeliveriesHistory = 30 * 24 * time.Hour
+)
+
+// Failure classes recorded on the deliveries. The error and the response of the receiver are not kept,
+// as they would reveal which hosts and ports answer behind the url.
+const (
+	webhookErrorUnreachable = "The endpoint could not be reached"
+	webhookErrorRejected    = "The endpoint did not accept the delivery"
+	webhookErrorDisabled    = "The endpoint is disabled"
+	webhookErrorRemoved     = "The webhook no longer exists"
+)
+
+// webhookEvents lists the events the endpoints can subscribe to
+var webhookEvents = []string{
+	types.WEBHOOK_METRIC_CREATED,
+	types.WEBHOOK_METRIC_DELETED,
+	types.WEBHOOK_MEMBER_ADDED,
+	types.WEBHOOK_MEMBER_REMOVED,
+	types.WEBHOOK_MEMBER_ROLE_CHANGED,
+	types.WEBHOOK_PLAN_CHANGED,
+	types.WEBHOOK_QUOTA_THRESHOLD,
+	types.WEBHOOK_ALERT_TRIGGERED,
+	types.WEBHOOK_ALERT_RESOLVED,
+	types.WEBHOOK_ANOMALY_DETECTED,
+	types.WEBHOOK_MONITOR_SILENT,
+	types.WEBHOOK_MONITOR_RECOVERED,
+	types.WEBHOOK_GOAL_REACHED,
+	types.WEBHOOK_GOAL_BEHIND,
+}
+
+// webhookEvent is the body of the project webhooks. The id is shared by the deliveries of the event,
+// so that receivers can ignore the ones they already processed.
+type webhookEvent struct {
+	Id        uuid.UUID `json:"id"`
+	Type      string    `json:"type"`
+	Date      time.Time `json:"date"`
+	ProjectId uuid.UUID `json:"project_id"`
+	Data      any       `json:"data"`
+}
+
+// teamMemberEvent is the data of the team events. The previous role is only set when a role changes.
+type teamMemberEvent struct {
+	UserId       uuid.UUID `json:"user_id"`
+	Email        string    `json:"email,omitempty"`
+	Role         int       `json:"role"`
+	PreviousRole *int      `json:"previous_role,omitempty"`
+}
+
+// planChangedEvent is the data of the plan events
+type planChangedEvent struct {
+	Plan             string `json:"plan"`
+	PreviousPlan     string `json:"previous_plan"`
+	MaxEventPerMonth int    `json:"max_event_per_month"`
+}
+
+// quotaThresholdEvent is the data of the quota events, sent when the monthly event count of a project
+// reaches one of the quotaThresholds percentages of its limit
+type quotaThresholdEvent struct {
+	Threshold         int `json:"threshold"`
+	MonthlyEventCount int `json:"monthly_event_count"`
+	MaxEventPerMonth  int `json:"max_event_per_month"`
+}
+
+// quotaThresholds are the percentages of the event limit notified to the endpoints
+var quotaThresholds = []int{50, 80, 100}
+
+// reachedQuotaThreshold returns the highest threshold crossed when the count of a project went from
+// previous to count, if any
+func reachedQuotaThreshold(previous int, count int, limit int) (int, bool) {
+	if limit <= 0 {
+		return 0, false
+	}
+	for i := len(quotaThresholds) - 1; i >= 0; i-- {
+		mark := (limit*quotaThresholds[i] + 99) / 100
+		if previous < mark && count >= mark {
+			return quotaThresholds[i], true
+		}
+	}
+	return 0, false
+}
+
+// emitProjectEvent queues an event for the endpoints of the project subscribed to it. The deliveries
+// are sent by the webhooks job, so the event is only lost if it cannot be stored.
+func (s *Service) emitProjectEvent(projectId uuid.UUID, event string, data any) {
+	payload := webhookEvent{
+		Id:        uuid.New(),
+		Type:      event,
+		Date:      time.Now().UTC(),
+		ProjectId: projectId,
+		Data:      data,
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", event, err)
+		return
+	}
+
+	if _, err := s.db.CreateWebhookDeliveries(projectId, payload.Id, event, body); err != nil {
+		log.Printf("Failed to queue %s event of %s: %v", event, projectId, err)
+	}
+}
+
+// queueSourceWebhook queues a payload for the webhook of an alert rule, an anomaly subscription or a
+// monitor. The delivery is retried and logged like the deliveries of the project endpoints.
+func (s *Service) queueSourceWebhook(projectId uuid.UUID, source string, sourceId uuid.UUID, eventId uuid.UUID, event string, data any) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Failed to encode %s webhook: %v", event, err)
+		return
+	}
+
+	if err := s.db.CreateSourceWebhookDelivery(projectId, source, sourceId, eventId, event, body); err != nil {
+		log.Printf("Failed to queue %s webhook of %s: %v", event, sourceId, err)
+	}
+}
+
+// notifyQuotaThresholds emits a quota event for the projects whose batch crossed one of the quota thresholds
+func (s *Service) notifyQuotaThresholds(counts []db.ProjectCount) {
+	for _, count := range counts {
+		threshold, reached := reachedQuotaThreshold(count.Previous, count.Count, count.Limit)
+		if !reached {
+			continue
+		}
+
+		s.emitProjectEvent(count.ProjectId, types.WEBHOOK_QUOTA_THRESHOLD, quotaThresholdEvent{
+			Threshold:         threshold,
+			MonthlyEventCount: count.Count,
+			MaxEventPerMonth:  count.Limit,
+		})
+	}
+}
+
+// webhookBackoff returns the delay before the next attempt of a delivery that failed the given number of times
+func webhookBackoff(attempts int) time.Duration {
+	delay := webhookRetryBase
+	for i := 1; i < attempts && delay < webhookRetryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, webhookRetryMax)
+}
+
+// RunWebhookDeliveries sends the deliveries that are due. The deliveries are claimed in batches, so
+// that several replicas can share them, and the deliveries of a batch are sent concurrently.
+func (s *Service) RunWebhookDeliveries() {
+	endpoints := make(map[uuid.UUID]types.WebhookEndpoint)
+	for !s.scheduler.Stopping() {
+		deliveries, err := s.db.ClaimWebhookDeliveries(webhookBatchSize, time.Now().UTC().Add(webhookLease))
+		if err != nil {
+			log.Println("Failed to claim webhook deliveries:", err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, delivery := range deliveries {
+			target, err := s.webhookTarget(delivery, endpoints)
+			if err != nil {
+				log.Println("Failed to fetch the webhook of a delivery:", err)
+				continue
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.attemptWebhookDelivery(delivery, target)
+			}()
+		}
+		wg.Wait()
+
+		if len(deliveries) < webhookBatchSize {
+			return
+		}
+	}
+}
+
+// webhookTarget is the receiver of a delivery. The failure is set when the delivery cannot be sent anymore.
+type webhookTarget struct {
+	url     string
+	secret  string
+	failure string
+}
+
+// webhookTarget resolves the receiver of a delivery. The endpoints are cached for the duration of a run,
+// while the webhooks of the alert rules, anomaly subscriptions and monitors are read at each attempt.
+func (s *Service) webhookTarget(delivery types.WebhookDelivery, endpoints map[uuid.UUID]types.WebhookEndpoint) (webhookTarget, error) {
+	if delivery.Source != types.DELIVERY_SOURCE_ENDPOINT {
+		url, secret, err := s.db.GetSourceWebhook(delivery.Source, delivery.SourceId.UUID)
+		if err == sql.ErrNoRows || (err == nil && url == "") {
+			return webhookTarget{failure: webhookErrorRemoved}, nil
+		} else if err != nil {
+			return webhookTarget{}, err
+		}
+		return webhookTarget{url: url, secret: secret}, nil
+	}
+
+	endpoint, exists := endpoints[delivery.EndpointId.UUID]
+	if !exists {
+		var err error
+		endpoint, err = s.db.GetWebhookEndpointById(delivery.EndpointId.UUID)
+		if err == sql.ErrNoRows {
+			return webhookTarget{failure: webhookErrorRemoved}, nil
+		} else if err != nil {
+			return webhookTarget{}, err
+		}
+		endpoints[endpoint.Id] = endpoint
+	}
+
+	if !endpoint.Enabled {
+		return webhookTarget{failure: webhookErrorDisabled}, nil
+	}
+	return webhookTarget{url: endpoint.Url, secret: endpoint.Secret}, nil
+}
+
+// attemptWebhookDelivery sends a delivery to its receiver and schedules the next attempt when it fails.
+// Only the class of a failure is recorded, so that the log cannot be used to probe hosts.
+func (s *Service) attemptWebhookDelivery(delivery types.WebhookDelivery, target webhookTarget) {
+	var status int
+	failure := target.failure
+	if failure == "" {
+		var err error
+		status, err = sendWebhook(target.url, target.secret, delivery.Event, delivery.Payload)
+		if err != nil && status != 0 {
+			failure = webhookErrorRejected
+		} else if err != nil {
+			failure = webhookErrorUnreachable
+		}
+	}
+
+	now := time.Now().UTC()
+	delivery.ResponseStatus = 0
+	delivery.NextAttempt = nil
+	if failure == "" {
+		delivery.Status = types.DELIVERY_DELIVERED
+		delivery.ResponseStatus = status
+		delivery.Error = ""
+		delivery.Delivered = &now
+	} else {
+		delivery.Error = failure
+		if target.failure != "" || delivery.Attempts >= webhookMaxAttempts {
+			delivery.Status = types.DELIVERY_FAILED
+		} else {
+			next := now.Add(webhookBackoff(delivery.Attempts))
+			delivery.NextAttempt = &next
+		}
+	}
+
+	if err := s.db.UpdateWebhookDelivery(delivery); err != nil {
+		log.Println("Failed to update webhook delivery:", err)
+	}
+
+	// The alert events keep the outcome of their webhook, the event of the delivery being the alert event
+	if delivery.Source == types.DELIVERY_SOURCE_ALERT && delivery.NextAttempt == nil {
+		if err := s.db.UpdateAlertEventWebhookStatus(delivery.EventId, delivery.ResponseStatus); err != nil {
+			log.Println("Failed to update alert event:", err)
+		}
+	}
+}
+
+// webhookEndpointRequest holds the settings of an endpoint sent by the dashboard
+type webhookEndpointRequest struct {
+	ProjectId  uuid.UUID `json:"project_id"`
+	EndpointId uuid.UUID `json:"endpoint_id"`
+	Url        string    `json:"url"`
+	Events     []string  `json:"events"`
+	Enabled    *bool     `json:"enabled"`
+}
+
+// apply validates the settings of the request and copies them to the endpoint. The returned error is
+// meant to be shown to the user.
+func (req webhookEndpointRequest) apply(endpoint *types.WebhookEndpoint) error {
+	endpoint.Url = strings.TrimSpace(req.Url)
+	if err := validateWebhookUrl(endpoint.Url); err != nil {
+		return err
+	}
+
+	if len(req.Events) == 0 {
+		return errors.New("The endpoint must be subscribed to at least one event")
+	}
+	endpoint.Events = []string{}
+	for _, event := range req.Events {
+		if !slices.Contains(webhookEvents, event) {
+			return fmt.Errorf("Unknown event '%s'", event)
+		}
+		if !slices.Contains(endpoint.Events, event) {
+			endpoint.Events = append(endpoint.Events, event)
+		}
+	}
+
+	if req.Enabled != nil {
+		endpoint.Enabled = *req.Enabled
+	}
+
+	return nil
+}
+
+func (s *Service) GetWebhookEndpoints(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, projectid)
+	if !ok {
+		return
+	}
+
+	endpoints, err := s.db.GetWebhookEndpoints(project.Id)
+	if err != nil {
+		log.Println("Error fetching webhook endpoints:", err)
+		http.Error(w, "Failed to retrieve webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(endpoints)
+	if err != nil {
+		http.Error(w, "Failed to process webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// CreateWebhookEndpoint subscribes an endpoint to events of a project. The secret used to sign the
+// deliveries of the endpoint is generated along with it.
+func (s *Service) CreateWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request webhookEndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	endpoints, err := s.db.GetWebhookEndpoints(project.Id)
+	if err != nil {
+		log.Println("Error fetching webhook endpoints:", err)
+		http.Error(w, "Failed to retrieve webhooks", http.StatusInternalServerError)
+		return
+	}
+	if len(endpoints) >= maxWebhookEndpoints {
+		http.Error(w, fmt.Sprintf("A project cannot have more than %d webhooks", maxWebhookEndpoints), http.StatusForbidden)
+		return
+	}
+
+	endpoint := types.WebhookEndpoint{
+		ProjectId: project.Id,
+		UserId:    token.Id,
+		Enabled:   true,
+	}
+	if err := request.apply(&endpoint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	endpoint.Secret, err = generateWebhookSecret()
+	if err != nil {
+		log.Println("Error generating webhook secret:", err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	endpoint, err = s.db.CreateWebhookEndpoint(endpoint)
+	if err != nil {
+		log.Println("Error creating webhook endpoint:", err)
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(endpoint)
+	if err != nil {
+		http.Error(w, "Failed to process webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes)
+}
+
+// UpdateWebhookEndpoint updates the url, the events and the state of an endpoint. Pending deliveries
+// are sent to the new url.
+func (s *Service) UpdateWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request webhookEndpointRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	endpoint, err := s.db.GetWebhookEndpoint(request.EndpointId, project.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error fetching webhook endpoint:", err)
+		http.Error(w, "Failed to retrieve webhook", http.StatusInternalServerError)
+		return
+	}
+
+	if err := request.apply(&endpoint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.db.UpdateWebhookEndpoint(endpoint); err != nil {
+		log.Println("Error updating webhook endpoint:", err)
+		http.Error(w, "Failed to update webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeleteWebhookEndpoint deletes an endpoint along with its deliveries
+func (s *Service) DeleteWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId  uuid.UUID `json:"project_id"`
+		EndpointId uuid.UUID `json:"endpoint_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	if err := s.db.DeleteWebhookEndpoint(request.EndpointId, project.Id); err != nil {
+		log.Println("Error deleting webhook endpoint:", err)
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetWebhookDeliveries returns the delivery log of a project, or of a single endpoint with endpoint_id
+func (s *Service) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	projectid, err := uuid.Parse(chi.URLParam(r, "project_id"))
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+
+	endpointid := uuid.Nil
+	if value := r.URL.Query().Get("endpoint_id"); value != "" {
+		endpointid, err = uuid.Parse(value)
+		if err != nil {
+			http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	project, ok := s.alertProject(w, token, projectid)
+	if !ok {
+		return
+	}
+
+	deliveries, err := s.db.GetWebhookDeliveries(project.Id, endpointid, webhookDeliveriesListed)
+	if err != nil {
+		log.Println("Error fetching webhook deliveries:", err)
+		http.Error(w, "Failed to retrieve webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(deliveries)
+	if err != nil {
+		http.Error(w, "Failed to process webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	SetupCacheControl(w, 0)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bytes)
+}
+
+// RedeliverWebhook sends a delivery again as a new delivery, with the payload of the original
+func (s *Service) RedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	token, ok := r.Context().Value(types.TOKEN).(types.Token)
+	if !ok {
+		http.Error(w, "Authentication error: Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		ProjectId  uuid.UUID `json:"project_id"`
+		DeliveryId uuid.UUID `json:"delivery_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	project, ok := s.alertProject(w, token, request.ProjectId)
+	if !ok {
+		return
+	}
+
+	delivery, err := s.db.RedeliverWebhook(request.DeliveryId, project.Id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Println("Error redelivering webhook:", err)
+		http.Error(w, "Failed to redeliver webhook", http.StatusInternalServerError)
+		return
+	}
+
+	bytes, err := json.Marshal(delivery)
+	if err != nil {
+		http.Error(w, "Failed to process webhook delivery", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes)
+}
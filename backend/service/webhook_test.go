@@ -0,0 +1,83 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReachedQuotaThreshold(t *testing.T) {
+	tests := []struct {
+		previous  int
+		count     int
+		limit     int
+		threshold int
+		reached   bool
+	}{
+		{0, 10, 100, 0, false},
+		{49, 50, 100, 50, true},
+		{50, 60, 100, 0, false},
+		{79, 80, 100, 80, true},
+		{40, 85, 100, 80, true},
+		{10, 150, 100, 100, true},
+		{100, 120, 100, 0, false},
+		{0, 2, 3, 50, true},
+		{2, 3, 3, 100, true},
+		{0, 1000, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		threshold, reached := reachedQuotaThreshold(test.previous, test.count, test.limit)
+		if threshold != test.threshold || reached != test.reached {
+			t.Errorf("reachedQuotaThreshold(%d, %d, %d) = %d, %v, want %d, %v", test.previous, test.count, test.limit, threshold, reached, test.threshold, test.reached)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{8, 64 * time.Minute},
+		{9, webhookRetryMax},
+		{webhookMaxAttempts, webhookRetryMax},
+		{100, webhookRetryMax},
+	}
+
+	for _, test := range tests {
+		if delay := webhookBackoff(test.attempts); delay != test.delay {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", test.attempts, delay, test.delay)
+		}
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"type":"metric.created"}`)
+
+	tests := []struct {
+		secret    string
+		timestamp int64
+		body      []byte
+		signature string
+	}{
+		{"whsec_test", 1700000000, body, "sha256=75870c363e16620b71a06b12fd3eee82f25dfd1567718dc91aa1c6d451911a5f"},
+		{"whsec_test", 1700000001, body, "sha256=ac6048edd6bec647da33255920148fb0eadf71f85d115e09ce56cd91b66b340a"},
+	}
+
+	for _, test := range tests {
+		if signature := signWebhook(test.secret, test.timestamp, test.body); signature != test.signature {
+			t.Errorf("signWebhook(%q, %d) = %s, want %s", test.secret, test.timestamp, signature, test.signature)
+		}
+	}
+
+	if signWebhook("whsec_other", 1700000000, body) == tests[0].signature {
+		t.Error("the signature does not depend on the secret")
+	}
+	if signWebhook("whsec_test", 1700000000, []byte(`{"type":"metric.deleted"}`)) == tests[0].signature {
+		t.Error("the signature does not depend on the body")
+	}
+}
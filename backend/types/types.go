@@ -2,6 +2,7 @@ package types
 
 import (
 	"database/sql"
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -17,6 +18,7 @@ const (
 	DUAL_METRIC
 	AVERAGE_METRIC
 	STRIPE_METRIC
+	FORMULA_METRIC
 )
 
 const (
@@ -36,9 +38,191 @@ const (
 	INVOICE_FAILED
 )
 
+// Reason codes reported when the ingestion pipeline rejects an event
+const (
+	REJECT_UNAUTHORIZED      = "unauthorized"
+	REJECT_INVALID_METRIC    = "invalid_metric"
+	REJECT_INVALID_BODY      = "invalid_body"
+	REJECT_INVALID_FILTER    = "invalid_filter"
+	REJECT_INVALID_ENTITY    = "invalid_entity"
+	REJECT_PROJECT_NOT_FOUND = "project_not_found"
+	REJECT_QUOTA_EXCEEDED    = "quota_exceeded"
+	REJECT_STRIPE_METRIC     = "stripe_metric"
+	REJECT_FORMULA_METRIC    = "formula_metric"
+	REJECT_NEGATIVE_VALUE    = "negative_value"
+	REJECT_ZERO_VALUE        = "zero_value"
+	REJECT_PROCESSING_FAILED = "processing_failed"
+)
+
+// Bucket sizes supported by the aggregation queries
+const (
+	GRANULARITY_MINUTE  = "minute"
+	GRANULARITY_HOUR    = "hour"
+	GRANULARITY_DAY     = "day"
+	GRANULARITY_WEEK    = "week"
+	GRANULARITY_MONTH   = "month"
+	GRANULARITY_QUARTER = "quarter"
+	GRANULARITY_YEAR    = "year"
+)
+
+// Aggregations applied to the events of a bucket
+const (
+	AGGREGATION_SUM   = "sum"
+	AGGREGATION_COUNT = "count"
+	AGGREGATION_AVG   = "avg"
+	AGGREGATION_MIN   = "min"
+	AGGREGATION_MAX   = "max"
+	AGGREGATION_NET   = "net"
+)
+
+// Formats of the event exports
+const (
+	EXPORT_CSV     = "csv"
+	EXPORT_NDJSON  = "ndjson"
+	EXPORT_PARQUET = "parquet"
+)
+
+// States of the background exports
+const (
+	EXPORT_PENDING = "pending"
+	EXPORT_RUNNING = "running"
+	EXPORT_DONE    = "done"
+	EXPORT_FAILED  = "failed"
+)
+
+// States of the event imports
+const (
+	IMPORT_PREVIEWED = "previewed"
+	IMPORT_PENDING   = "pending"
+	IMPORT_RUNNING   = "running"
+	IMPORT_DONE      = "done"
+	IMPORT_FAILED    = "failed"
+	IMPORT_UNDONE    = "undone"
+	IMPORT_EXPIRED   = "expired"
+)
+
+// Kinds of the alert rules. Threshold rules compare the value of a window with a fixed value,
+// change rules compare it with the previous window.
+const (
+	ALERT_THRESHOLD = "threshold"
+	ALERT_CHANGE    = "change"
+)
+
+// Conditions of the alert rules. For the change rules, above is an increase and below a decrease.
+const (
+	ALERT_ABOVE = "above"
+	ALERT_BELOW = "below"
+)
+
+// States of the alert rules
+const (
+	ALERT_OK     = "ok"
+	ALERT_FIRING = "firing"
+)
+
+// Transitions recorded in the history of the alerts
+const (
+	ALERT_TRIGGERED = "triggered"
+	ALERT_RESOLVED  = "resolved"
+)
+
+// Directions of the metric anomalies
+const (
+	ANOMALY_SPIKE = "spike"
+	ANOMALY_DROP  = "drop"
+)
+
+// States of the metric monitors. A silent metric has not received any event within the interval of its monitor.
+const (
+	MONITOR_OK     = "ok"
+	MONITOR_SILENT = "silent"
+)
+
+// Types of the project events sent to the webhook endpoints
+const (
+	WEBHOOK_METRIC_CREATED      = "metric.created"
+	WEBHOOK_METRIC_DELETED      = "metric.deleted"
+	WEBHOOK_MEMBER_ADDED        = "team.member_added"
+	WEBHOOK_MEMBER_REMOVED      = "team.member_removed"
+	WEBHOOK_MEMBER_ROLE_CHANGED = "team.member_role_changed"
+	WEBHOOK_PLAN_CHANGED        = "project.plan_changed"
+	WEBHOOK_QUOTA_THRESHOLD     = "project.quota_threshold"
+	WEBHOOK_ALERT_TRIGGERED     = "alert.triggered"
+	WEBHOOK_ALERT_RESOLVED      = "alert.resolved"
+	WEBHOOK_ANOMALY_DETECTED    = "anomaly.detected"
+	WEBHOOK_MONITOR_SILENT      = "monitor.silent"
+	WEBHOOK_MONITOR_RECOVERED   = "monitor.recovered"
+	WEBHOOK_GOAL_REACHED        = "goal.reached"
+	WEBHOOK_GOAL_BEHIND         = "goal.behind"
+)
+
+// Statuses of the webhook deliveries. A delivery fails once all its attempts are exhausted.
+const (
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_FAILED    = "failed"
+)
+
+// Sources of the webhook deliveries. Besides the project endpoints, the alert rules, the anomaly
+// subscriptions and the monitors have a webhook of their own.
+const (
+	DELIVERY_SOURCE_ENDPOINT = "endpoint"
+	DELIVERY_SOURCE_ALERT    = "alert_rule"
+	DELIVERY_SOURCE_ANOMALY  = "anomaly_subscription"
+	DELIVERY_SOURCE_MONITOR  = "monitor"
+)
+
+// Periods of the metric goals
+const (
+	GOAL_MONTH   = "month"
+	GOAL_QUARTER = "quarter"
+	GOAL_CUSTOM  = "custom"
+)
+
+// Modes of the metric goals. A cumulative goal compares the value of the whole period with the
+// target, a bucket goal expects every bucket of the period to reach it.
+const (
+	GOAL_CUMULATIVE = "cumulative"
+	GOAL_BUCKET     = "bucket"
+)
+
+// States of the metric goals
+const (
+	GOAL_ON_TRACK = "on_track"
+	GOAL_BEHIND   = "behind"
+	GOAL_REACHED  = "reached"
+)
+
+// Sources of the annotations
+const (
+	ANNOTATION_DASHBOARD = "dashboard"
+	ANNOTATION_API       = "api"
+)
+
+// Modes of the funnel queries. Aggregate funnels compare the number of events of each step, while
+// entity funnels follow the entities of the events from one step to the next.
+const (
+	FUNNEL_AGGREGATE = "aggregate"
+	FUNNEL_ENTITY    = "entity"
+)
+
+// Frequencies of the digest emails
+const (
+	DIGEST_WEEKLY  = "weekly"
+	DIGEST_MONTHLY = "monthly"
+)
+
+// Scopes of the project API keys
+const (
+	SCOPE_READ = "read"
+)
+
 type key int
 
-const TOKEN key = iota
+const (
+	TOKEN key = iota
+	API_KEY
+)
 
 type Token struct {
 	Id    uuid.UUID `db:"id" json:"id"`
@@ -65,18 +249,31 @@ type UserProvider struct {
 }
 
 type Project struct {
-	Id                   uuid.UUID `db:"id" json:"id"`
-	ApiKey               string    `db:"api_key" json:"api_key"`
-	Units                []Unit    `json:"units" db:"units"`
-	UserId               uuid.UUID `db:"user_id" json:"user_id"`
-	UserRole             int       `json:"user_role" db:"user_role"`
-	Name                 string    `db:"name" json:"name"`
-	Image                string    `db:"image" json:"image"`
-	CurrentPlan          string    `db:"current_plan" json:"current_plan"`
-	SubscriptionType     int       `db:"subscription_type" json:"subscription_type"`
-	StripeSubscriptionId string    `db:"stripe_subscription_id" json:"-"`
-	MaxEventPerMonth     int       `db:"max_event_per_month" json:"max_event_per_month"`
-	MonthlyEventCount    int       `db:"monthly_event_count" json:"monthly_event_count"`
+	Id                   uuid.UUID           `db:"id" json:"id"`
+	ApiKey               string              `db:"api_key" json:"api_key"`
+	Units                []Unit              `json:"units" db:"units"`
+	UserId               uuid.UUID           `db:"user_id" json:"user_id"`
+	UserRole             int                 `json:"user_role" db:"user_role"`
+	Name                 string              `db:"name" json:"name"`
+	Image                string              `db:"image" json:"image"`
+	CurrentPlan          string              `db:"current_plan" json:"current_plan"`
+	SubscriptionType     int                 `db:"subscription_type" json:"subscription_type"`
+	StripeSubscriptionId string              `db:"stripe_subscription_id" json:"-"`
+	MaxEventPerMonth     int                 `db:"max_event_per_month" json:"max_event_per_month"`
+	MonthlyEventCount    int                 `db:"monthly_event_count" json:"monthly_event_count"`
+	RetentionDays        int                 `db:"retention_days" json:"retention_days"`
+	GraceRetentionDays   int                 `db:"grace_retention_days" json:"grace_retention_days"`
+	GraceUntil           sql.Null[time.Time] `db:"grace_until" json:"-"`
+	Timezone             string              `db:"timezone" json:"timezone"`
+	WeekStart            int                 `db:"week_start" json:"week_start"`
+	FiscalYearStartMonth int                 `db:"fiscal_year_start_month" json:"fiscal_year_start_month"`
+}
+
+// Calendar holds the settings used to split time into days, weeks, quarters and years
+type Calendar struct {
+	Timezone             string
+	WeekStart            int
+	FiscalYearStartMonth int
 }
 
 type Metric struct {
@@ -93,6 +290,7 @@ type Metric struct {
 	Created            time.Time            `db:"created" json:"created"`
 	LastEventTimestamp time.Time            `db:"last_event_timestamp" json:"last_event_timestamp"`
 	StripeApiKey       sql.Null[string]     `db:"stripe_api_key" json:"-"`
+	Formula            string               `db:"formula" json:"formula"`
 }
 
 type MetricEvent struct {
@@ -102,6 +300,234 @@ type MetricEvent struct {
 	ValueNeg int32       `db:"value_neg" json:"value_neg"`
 	Date     time.Time   `db:"date" json:"date"`
 	Filters  []uuid.UUID `db:"filters" json:"filters"`
+	EntityId string      `db:"entity_id" json:"entity_id"`
+}
+
+// BucketAggregate holds the partial aggregates of the events of a bucket. Partials can be merged
+// together before being turned into the final value of the bucket.
+type BucketAggregate struct {
+	MetricId uuid.UUID `db:"metric_id"`
+	Bucket   time.Time `db:"bucket"`
+	Count    int64     `db:"count"`
+	SumPos   int64     `db:"sum_pos"`
+	SumNeg   int64     `db:"sum_neg"`
+	MinValue int64     `db:"min_value"`
+	MaxValue int64     `db:"max_value"`
+}
+
+// GroupedBucketAggregate holds the partial aggregates of a bucket for one combination of filters.
+// The group key lists the filter id matched for each category, separated by commas.
+type GroupedBucketAggregate struct {
+	BucketAggregate
+	GroupKey string `db:"group_key"`
+}
+
+// FilterAggregate holds the partial aggregates of the events of a filter. The nil filter id
+// aggregates every event.
+type FilterAggregate struct {
+	BucketAggregate
+	FilterId uuid.UUID `db:"filter_id"`
+}
+
+type MetricBucket struct {
+	Date     time.Time `json:"date"`
+	Value    float64   `json:"value"`
+	ValuePos int64     `json:"value_pos"`
+	ValueNeg int64     `json:"value_neg"`
+	Count    int64     `json:"count"`
+}
+
+// MetricBand is the range of values expected for a bucket, learned from the same hour of the day
+// and day of the week in the history of the metric
+type MetricBand struct {
+	Date     time.Time `json:"date"`
+	Expected float64   `json:"expected"`
+	Lower    float64   `json:"lower"`
+	Upper    float64   `json:"upper"`
+	Anomaly  bool      `json:"anomaly"`
+}
+
+type MetricSeries struct {
+	MetricId    uuid.UUID      `json:"metric_id"`
+	MetricName  string         `json:"metric_name"`
+	MetricType  int            `json:"metric_type"`
+	Aggregation string         `json:"aggregation"`
+	Buckets     []MetricBucket `json:"buckets"`
+	Bands       []MetricBand   `json:"bands,omitempty"`
+}
+
+// ForecastPoint is a projected bucket, with the bounds of its confidence interval
+type ForecastPoint struct {
+	Date  time.Time `json:"date"`
+	Value float64   `json:"value"`
+	Lower float64   `json:"lower"`
+	Upper float64   `json:"upper"`
+}
+
+type MetricForecast struct {
+	MetricId    uuid.UUID       `json:"metric_id"`
+	MetricName  string          `json:"metric_name"`
+	Granularity string          `json:"granularity"`
+	Aggregation string          `json:"aggregation"`
+	Model       string          `json:"model"`
+	Season      int             `json:"season"`
+	Confidence  int             `json:"confidence"`
+	Points      []ForecastPoint `json:"points"`
+}
+
+// QuotaForecast projects the monthly event count of a project. The points hold the cumulative count
+// at the end of each day, and the limit dates are left empty when the limit is not reached within the horizon.
+type QuotaForecast struct {
+	MonthlyEventCount int             `json:"monthly_event_count"`
+	MaxEventPerMonth  int             `json:"max_event_per_month"`
+	Confidence        int             `json:"confidence"`
+	LimitDate         *time.Time      `json:"limit_date"`
+	EarliestLimitDate *time.Time      `json:"earliest_limit_date"`
+	LatestLimitDate   *time.Time      `json:"latest_limit_date"`
+	Points            []ForecastPoint `json:"points"`
+}
+
+type MetricGroup struct {
+	Filters map[string]*string `json:"filters"`
+	Other   bool               `json:"other"`
+	Total   float64            `json:"total"`
+	Buckets []MetricBucket     `json:"buckets"`
+}
+
+type GroupedMetricSeries struct {
+	MetricId    uuid.UUID     `json:"metric_id"`
+	MetricName  string        `json:"metric_name"`
+	MetricType  int           `json:"metric_type"`
+	Aggregation string        `json:"aggregation"`
+	GroupBy     []string      `json:"group_by"`
+	Groups      []MetricGroup `json:"groups"`
+}
+
+type PeriodChange struct {
+	Current       float64  `json:"current"`
+	Previous      float64  `json:"previous"`
+	Change        float64  `json:"change"`
+	ChangePercent *float64 `json:"change_percent"`
+}
+
+type FilterChange struct {
+	FilterId uuid.UUID `json:"filter_id"`
+	Name     string    `json:"name"`
+	Category string    `json:"category"`
+	PeriodChange
+}
+
+type MetricComparison struct {
+	MetricId      uuid.UUID      `json:"metric_id"`
+	MetricName    string         `json:"metric_name"`
+	MetricType    int            `json:"metric_type"`
+	Aggregation   string         `json:"aggregation"`
+	CurrentStart  time.Time      `json:"current_start"`
+	CurrentEnd    time.Time      `json:"current_end"`
+	PreviousStart time.Time      `json:"previous_start"`
+	PreviousEnd   time.Time      `json:"previous_end"`
+	Total         PeriodChange   `json:"total"`
+	ValuePos      *PeriodChange  `json:"value_pos,omitempty"`
+	ValueNeg      *PeriodChange  `json:"value_neg,omitempty"`
+	Filters       []FilterChange `json:"filters"`
+}
+
+// EventCursor is the position of an event in the (date, id) order of the raw event listing
+type EventCursor struct {
+	Date time.Time
+	Id   uuid.UUID
+}
+
+type LiveEvent struct {
+	ProjectId  uuid.UUID            `json:"project_id"`
+	MetricId   uuid.UUID            `json:"metric_id"`
+	MetricName string               `json:"metric_name"`
+	MetricType int                  `json:"metric_type"`
+	Value      float64              `json:"value"`
+	ValuePos   int32                `json:"value_pos"`
+	ValueNeg   int32                `json:"value_neg"`
+	Date       time.Time            `json:"date"`
+	Filters    map[uuid.UUID]Filter `json:"filters"`
+}
+
+type ApiKey struct {
+	Id        uuid.UUID  `db:"id" json:"id"`
+	ProjectId uuid.UUID  `db:"project_id" json:"project_id"`
+	Name      string     `db:"name" json:"name"`
+	Prefix    string     `db:"prefix" json:"prefix"`
+	KeyHash   string     `db:"key_hash" json:"-"`
+	Scope     string     `db:"scope" json:"scope"`
+	Created   time.Time  `db:"created" json:"created"`
+	LastUsed  *time.Time `db:"last_used" json:"last_used"`
+}
+
+type DeadLetter struct {
+	Id               uuid.UUID `db:"id" json:"id"`
+	ProjectId        uuid.UUID `db:"project_id" json:"project_id"`
+	MetricIdentifier string    `db:"metric_identifier" json:"metric_identifier"`
+	Payload          string    `db:"payload" json:"payload"`
+	PayloadHash      string    `db:"payload_hash" json:"-"`
+	Reason           string    `db:"reason" json:"reason"`
+	Message          string    `db:"message" json:"message"`
+	Occurrences      int       `db:"occurrences" json:"occurrences"`
+	Created          time.Time `db:"created" json:"created"`
+	LastSeen         time.Time `db:"last_seen" json:"last_seen"`
+}
+
+type RetentionRun struct {
+	Id             uuid.UUID `db:"id" json:"id"`
+	ProjectId      uuid.UUID `db:"project_id" json:"project_id"`
+	RetentionDays  int       `db:"retention_days" json:"retention_days"`
+	Cutoff         time.Time `db:"cutoff" json:"cutoff"`
+	EventsDeleted  int64     `db:"events_deleted" json:"events_deleted"`
+	RollupsDeleted int64     `db:"rollups_deleted" json:"rollups_deleted"`
+	Complete       bool      `db:"complete" json:"complete"`
+	Error          string    `db:"error" json:"error"`
+	Started        time.Time `db:"started" json:"started"`
+	Finished       time.Time `db:"finished" json:"finished"`
+}
+
+type MetricExport struct {
+	Id        uuid.UUID           `db:"id" json:"id"`
+	ProjectId uuid.UUID           `db:"project_id" json:"project_id"`
+	UserId    uuid.UUID           `db:"user_id" json:"user_id"`
+	MetricId  uuid.NullUUID       `db:"metric_id" json:"metric_id"`
+	Format    string              `db:"format" json:"format"`
+	StartDate time.Time           `db:"start_date" json:"start_date"`
+	EndDate   time.Time           `db:"end_date" json:"end_date"`
+	Status    string              `db:"status" json:"status"`
+	ObjectKey string              `db:"object_key" json:"-"`
+	RowCount  int64               `db:"row_count" json:"row_count"`
+	Size      int64               `db:"size" json:"size"`
+	Error     string              `db:"error" json:"error"`
+	Created   time.Time           `db:"created" json:"created"`
+	Started   sql.Null[time.Time] `db:"started" json:"-"`
+	Finished  sql.Null[time.Time] `db:"finished" json:"-"`
+}
+
+type EventImport struct {
+	Id           uuid.UUID        `db:"id" json:"id"`
+	ProjectId    uuid.UUID        `db:"project_id" json:"project_id"`
+	UserId       uuid.UUID        `db:"user_id" json:"user_id"`
+	FileName     string           `db:"file_name" json:"file_name"`
+	ObjectKey    string           `db:"object_key" json:"-"`
+	Status       string           `db:"status" json:"status"`
+	TotalRows    int64            `db:"total_rows" json:"total_rows"`
+	ValidRows    int64            `db:"valid_rows" json:"valid_rows"`
+	ImportedRows int64            `db:"imported_rows" json:"imported_rows"`
+	FirstEvent   *time.Time       `db:"first_event" json:"first_event"`
+	LastEvent    *time.Time       `db:"last_event" json:"last_event"`
+	Metrics      map[string]int64 `db:"metrics" json:"metrics"`
+	Errors       []ImportRowError `db:"errors" json:"errors"`
+	Created      time.Time        `db:"created" json:"created"`
+	Started      *time.Time       `db:"started" json:"started"`
+	Finished     *time.Time       `db:"finished" json:"finished"`
+}
+
+// ImportRowError describes why a row of an import was rejected
+type ImportRowError struct {
+	Row     int64  `json:"row"`
+	Message string `json:"message"`
 }
 
 type AccountRecovery struct {
@@ -184,3 +610,280 @@ type TeamInvite struct {
 	Id     uuid.UUID `json:"id" db:"id"`
 	UserId uuid.UUID `json:"user_id" db:"user_id"`
 }
+
+type AlertRule struct {
+	Id              uuid.UUID     `db:"id" json:"id"`
+	ProjectId       uuid.UUID     `db:"project_id" json:"project_id"`
+	MetricId        uuid.UUID     `db:"metric_id" json:"metric_id"`
+	UserId          uuid.UUID     `db:"user_id" json:"user_id"`
+	Name            string        `db:"name" json:"name"`
+	Kind            string        `db:"kind" json:"kind"`
+	Aggregation     string        `db:"aggregation" json:"aggregation"`
+	FilterId        uuid.NullUUID `db:"filter_id" json:"filter_id"`
+	Condition       string        `db:"condition" json:"condition"`
+	Threshold       float64       `db:"threshold" json:"threshold"`
+	WindowMinutes   int           `db:"window_minutes" json:"window_minutes"`
+	CooldownMinutes int           `db:"cooldown_minutes" json:"cooldown_minutes"`
+	NotifyEmail     bool          `db:"notify_email" json:"notify_email"`
+	WebhookUrl      string        `db:"webhook_url" json:"webhook_url"`
+	WebhookSecret   string        `db:"webhook_secret" json:"webhook_secret"`
+	Enabled         bool          `db:"enabled" json:"enabled"`
+	State           string        `db:"state" json:"state"`
+	LastValue       *float64      `db:"last_value" json:"last_value"`
+	LastEvaluated   *time.Time    `db:"last_evaluated" json:"last_evaluated"`
+	LastTriggered   *time.Time    `db:"last_triggered" json:"last_triggered"`
+	Created         time.Time     `db:"created" json:"created"`
+}
+
+type AlertEvent struct {
+	Id            uuid.UUID `db:"id" json:"id"`
+	RuleId        uuid.UUID `db:"rule_id" json:"rule_id"`
+	ProjectId     uuid.UUID `db:"project_id" json:"project_id"`
+	State         string    `db:"state" json:"state"`
+	Value         float64   `db:"value" json:"value"`
+	Reference     *float64  `db:"reference" json:"reference"`
+	Threshold     float64   `db:"threshold" json:"threshold"`
+	WebhookStatus int       `db:"webhook_status" json:"webhook_status"`
+	Created       time.Time `db:"created" json:"created"`
+}
+
+type MetricAnomaly struct {
+	Id          uuid.UUID `db:"id" json:"id"`
+	ProjectId   uuid.UUID `db:"project_id" json:"project_id"`
+	MetricId    uuid.UUID `db:"metric_id" json:"metric_id"`
+	Granularity string    `db:"granularity" json:"granularity"`
+	Bucket      time.Time `db:"bucket" json:"bucket"`
+	Direction   string    `db:"direction" json:"direction"`
+	Value       float64   `db:"value" json:"value"`
+	Expected    float64   `db:"expected" json:"expected"`
+	Lower       float64   `db:"lower" json:"lower"`
+	Upper       float64   `db:"upper" json:"upper"`
+	Score       float64   `db:"score" json:"score"`
+	Created     time.Time `db:"created" json:"created"`
+}
+
+type WebhookEndpoint struct {
+	Id        uuid.UUID `db:"id" json:"id"`
+	ProjectId uuid.UUID `db:"project_id" json:"project_id"`
+	UserId    uuid.UUID `db:"user_id" json:"user_id"`
+	Url       string    `db:"url" json:"url"`
+	Secret    string    `db:"secret" json:"secret"`
+	Events    []string  `db:"events" json:"events"`
+	Enabled   bool      `db:"enabled" json:"enabled"`
+	Created   time.Time `db:"created" json:"created"`
+}
+
+type WebhookDelivery struct {
+	Id             uuid.UUID       `db:"id" json:"id"`
+	EndpointId     uuid.NullUUID   `db:"endpoint_id" json:"endpoint_id"`
+	Source         string          `db:"source" json:"source"`
+	SourceId       uuid.NullUUID   `db:"source_id" json:"source_id"`
+	ProjectId      uuid.UUID       `db:"project_id" json:"project_id"`
+	EventId        uuid.UUID       `db:"event_id" json:"event_id"`
+	Event          string          `db:"event" json:"event"`
+	Payload        json.RawMessage `db:"payload" json:"payload"`
+	Status         string          `db:"status" json:"status"`
+	Attempts       int             `db:"attempts" json:"attempts"`
+	ResponseStatus int             `db:"response_status" json:"response_status"`
+	Error          string          `db:"error" json:"error"`
+	NextAttempt    *time.Time      `db:"next_attempt" json:"next_attempt"`
+	Created        time.Time       `db:"created" json:"created"`
+	Delivered      *time.Time      `db:"delivered" json:"delivered"`
+}
+
+// MetricMonitor expects a metric to receive at least one event every interval
+type MetricMonitor struct {
+	Id                 uuid.UUID  `db:"id" json:"id"`
+	ProjectId          uuid.UUID  `db:"project_id" json:"project_id"`
+	MetricId           uuid.UUID  `db:"metric_id" json:"metric_id"`
+	UserId             uuid.UUID  `db:"user_id" json:"user_id"`
+	IntervalMinutes    int        `db:"interval_minutes" json:"interval_minutes"`
+	NotifyEmail        bool       `db:"notify_email" json:"notify_email"`
+	WebhookUrl         string     `db:"webhook_url" json:"webhook_url"`
+	WebhookSecret      string     `db:"webhook_secret" json:"webhook_secret"`
+	Enabled            bool       `db:"enabled" json:"enabled"`
+	State              string     `db:"state" json:"state"`
+	ActiveSince        time.Time  `db:"active_since" json:"active_since"`
+	SilentSince        *time.Time `db:"silent_since" json:"silent_since"`
+	LastChecked        *time.Time `db:"last_checked" json:"last_checked"`
+	Created            time.Time  `db:"created" json:"created"`
+	LastEventTimestamp time.Time  `db:"last_event_timestamp" json:"last_event_timestamp"`
+}
+
+type AnomalySubscription struct {
+	Id            uuid.UUID     `db:"id" json:"id"`
+	ProjectId     uuid.UUID     `db:"project_id" json:"project_id"`
+	UserId        uuid.UUID     `db:"user_id" json:"user_id"`
+	MetricId      uuid.NullUUID `db:"metric_id" json:"metric_id"`
+	NotifyEmail   bool          `db:"notify_email" json:"notify_email"`
+	WebhookUrl    string        `db:"webhook_url" json:"webhook_url"`
+	WebhookSecret string        `db:"webhook_secret" json:"webhook_secret"`
+	Created       time.Time     `db:"created" json:"created"`
+}
+
+// DigestSubscription schedules the digest emails of a project sent to a user. An empty list of metrics includes every metric.
+type DigestSubscription struct {
+	Id        uuid.UUID   `db:"id" json:"id"`
+	ProjectId uuid.UUID   `db:"project_id" json:"project_id"`
+	UserId    uuid.UUID   `db:"user_id" json:"user_id"`
+	Frequency string      `db:"frequency" json:"frequency"`
+	MetricIds []uuid.UUID `db:"metric_ids" json:"metric_ids"`
+	Enabled   bool        `db:"enabled" json:"enabled"`
+	NextSend  time.Time   `db:"next_send" json:"next_send"`
+	LastSent  *time.Time  `db:"last_sent" json:"last_sent"`
+	Created   time.Time   `db:"created" json:"created"`
+}
+
+// MetricGoal sets a target to the value of a metric over a period
+type MetricGoal struct {
+	Id          uuid.UUID  `db:"id" json:"id"`
+	ProjectId   uuid.UUID  `db:"project_id" json:"project_id"`
+	MetricId    uuid.UUID  `db:"metric_id" json:"metric_id"`
+	UserId      uuid.UUID  `db:"user_id" json:"user_id"`
+	Name        string     `db:"name" json:"name"`
+	Target      float64    `db:"target" json:"target"`
+	Period      string     `db:"period" json:"period"`
+	PeriodStart *time.Time `db:"period_start" json:"period_start"`
+	PeriodEnd   *time.Time `db:"period_end" json:"period_end"`
+	Mode        string     `db:"mode" json:"mode"`
+	Granularity string     `db:"granularity" json:"granularity"`
+	Aggregation string     `db:"aggregation" json:"aggregation"`
+	NotifyEmail bool       `db:"notify_email" json:"notify_email"`
+	State       string     `db:"state" json:"state"`
+	StatePeriod *time.Time `db:"state_period" json:"state_period"`
+	Created     time.Time  `db:"created" json:"created"`
+}
+
+// GoalProgress reports where a goal stands in its current period. The progress, the expected
+// progress and the projection are fractions of the target, or of the buckets of the period for
+// the bucket goals. The pace compares the progress with the expected one. The buckets of a bucket
+// goal are listed up to the current one.
+type GoalProgress struct {
+	GoalId            uuid.UUID    `json:"goal_id"`
+	PeriodStart       time.Time    `json:"period_start"`
+	PeriodEnd         time.Time    `json:"period_end"`
+	Target            float64      `json:"target"`
+	Value             float64      `json:"value"`
+	Progress          float64      `json:"progress"`
+	ExpectedProgress  float64      `json:"expected_progress"`
+	Pace              *float64     `json:"pace"`
+	Projected         float64      `json:"projected"`
+	ProjectedProgress float64      `json:"projected_progress"`
+	Model             string       `json:"model"`
+	State             string       `json:"state"`
+	TotalBuckets      int          `json:"total_buckets"`
+	Buckets           []GoalBucket `json:"buckets"`
+}
+
+type GoalBucket struct {
+	Date     time.Time `json:"date"`
+	Value    float64   `json:"value"`
+	Met      bool      `json:"met"`
+	Complete bool      `json:"complete"`
+}
+
+// Annotation marks a moment or a range on the timeline of a project, such as a deploy or a campaign.
+// An empty list of metrics shows the annotation on every metric.
+type Annotation struct {
+	Id          uuid.UUID     `db:"id" json:"id"`
+	ProjectId   uuid.UUID     `db:"project_id" json:"project_id"`
+	UserId      uuid.NullUUID `db:"user_id" json:"user_id"`
+	Source      string        `db:"source" json:"source"`
+	Title       string        `db:"title" json:"title"`
+	Description string        `db:"description" json:"description"`
+	Tags        []string      `db:"tags" json:"tags"`
+	MetricIds   []uuid.UUID   `db:"metric_ids" json:"metric_ids"`
+	Start       time.Time     `db:"start_date" json:"start"`
+	End         *time.Time    `db:"end_date" json:"end"`
+	Created     time.Time     `db:"created" json:"created"`
+}
+
+// FunnelStep is a step of a funnel, optionally restricted to the events of a filter
+type FunnelStep struct {
+	MetricId uuid.UUID     `json:"metric_id"`
+	FilterId uuid.NullUUID `json:"filter_id"`
+}
+
+// Funnel is an ordered list of steps. The window bounds the time an entity has to reach each step
+// after entering the funnel.
+type Funnel struct {
+	Id            uuid.UUID    `db:"id" json:"id"`
+	ProjectId     uuid.UUID    `db:"project_id" json:"project_id"`
+	UserId        uuid.UUID    `db:"user_id" json:"user_id"`
+	Name          string       `db:"name" json:"name"`
+	Steps         []FunnelStep `db:"steps" json:"steps"`
+	WindowMinutes int          `db:"window_minutes" json:"window_minutes"`
+	Created       time.Time    `db:"created" json:"created"`
+}
+
+// FunnelAggregate holds the number of entities reaching each step of a funnel, for the entities
+// entering the funnel in a bucket
+type FunnelAggregate struct {
+	Bucket time.Time
+	Counts []int64
+}
+
+// FunnelStepResult is the count of a step and its conversion from the previous step and from the
+// first one. Conversions are null when the step they are computed from is empty.
+type FunnelStepResult struct {
+	MetricId   uuid.UUID     `json:"metric_id"`
+	MetricName string        `json:"metric_name"`
+	FilterId   uuid.NullUUID `json:"filter_id"`
+	Count      int64         `json:"count"`
+	Conversion *float64      `json:"conversion"`
+	Overall    *float64      `json:"overall"`
+}
+
+type FunnelBucket struct {
+	Date  time.Time          `json:"date"`
+	Steps []FunnelStepResult `json:"steps"`
+}
+
+// FunnelResult holds the steps of a funnel over a range, along with their split by bucket
+type FunnelResult struct {
+	FunnelId    uuid.UUID          `json:"funnel_id"`
+	Name        string             `json:"name"`
+	Mode        string             `json:"mode"`
+	Granularity string             `json:"granularity"`
+	Start       time.Time          `json:"start"`
+	End         time.Time          `json:"end"`
+	Steps       []FunnelStepResult `json:"steps"`
+	Buckets     []FunnelBucket     `json:"buckets"`
+}
+
+// CohortAggregate holds the number of entities of a cohort. Period is null for the size of the
+// cohort, otherwise it is the bucket in which the entities returned.
+type CohortAggregate struct {
+	Cohort   time.Time  `db:"cohort"`
+	Period   *time.Time `db:"period"`
+	Entities int64      `db:"entities"`
+}
+
+// CohortPeriod is the share of the entities of a cohort returning in a period following its start.
+// A period is incomplete while it is still in progress.
+type CohortPeriod struct {
+	Index    int       `json:"index"`
+	Date     time.Time `json:"date"`
+	Entities int64     `json:"entities"`
+	Rate     float64   `json:"rate"`
+	Complete bool      `json:"complete"`
+}
+
+// Cohort groups the entities whose first occurrence in the start metric falls in the same bucket
+type Cohort struct {
+	Date    time.Time      `json:"date"`
+	Size    int64          `json:"size"`
+	Periods []CohortPeriod `json:"periods"`
+}
+
+// CohortRetention holds the cohorts of a range, along with the retention of each period averaged
+// over the cohorts having completed it, weighted by their size
+type CohortRetention struct {
+	StartMetricId  uuid.UUID  `json:"start_metric_id"`
+	ReturnMetricId uuid.UUID  `json:"return_metric_id"`
+	Granularity    string     `json:"granularity"`
+	Start          time.Time  `json:"start"`
+	End            time.Time  `json:"end"`
+	Cohorts        []Cohort   `json:"cohorts"`
+	Average        []*float64 `json:"average"`
+}